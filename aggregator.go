@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MinuteKey identifies a per-minute aggregation bucket
+type MinuteKey struct {
+	Minute      time.Time
+	Env         string
+	Server      string
+	Program     string
+	APIPath     string
+	StatusClass string
+	// Country and ASN are empty and 0 unless GeoIP enrichment is enabled
+	Country string
+	ASN     uint32
+	// Protocol and TLSVersion are empty unless the program's format logs them
+	Protocol   string
+	TLSVersion string
+}
+
+// MinuteStats holds the aggregated values of one bucket, durations are in milliseconds
+type MinuteStats struct {
+	Count       int64
+	ErrorCount  int64
+	SlowCount   int64
+	SumDuration float64
+	MaxDuration float64
+	Latency     LatencySketch
+}
+
+// Aggregator folds matched entries into per-minute buckets and writes closed buckets to oula_logs_minute.
+// Buckets are keyed by the path template of the request, see ExtractPathTemplate.
+// A bucket stays open until its minute has ended and the grace window has passed, so late entries
+// still land in the right bucket. Entries arriving after that are written as a delta that is added
+// to the stored row.
+// The exact status codes of each program are counted per minute alongside, into oula_logs_status_minute,
+// whose rows are kept for statusRetention regardless of the retention of raw rows.
+type Aggregator struct {
+	db              *sql.DB
+	grace           time.Duration
+	statusRetention time.Duration
+	mu              sync.Mutex
+	buckets         map[MinuteKey]*MinuteStats
+	codes           map[StatusCodeKey]int64
+}
+
+// NewAggregator creates an aggregator writing to db, a statusRetention of 0 keeps status code counts forever
+func NewAggregator(db *sql.DB, grace, statusRetention time.Duration) *Aggregator {
+	return &Aggregator{
+		db:              db,
+		grace:           grace,
+		statusRetention: statusRetention,
+		buckets:         make(map[MinuteKey]*MinuteStats),
+		codes:           make(map[StatusCodeKey]int64),
+	}
+}
+
+// EnsureMinuteTable creates the oula_logs_minute table if it does not exist
+func EnsureMinuteTable(db *sql.DB) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS oula_logs_minute (
+			minute DATETIME NOT NULL,
+			server VARCHAR(64) NOT NULL,
+			program VARCHAR(128) NOT NULL,
+			api_path VARCHAR(255) NOT NULL,
+			status_class VARCHAR(5) NOT NULL,
+			count BIGINT NOT NULL DEFAULT 0,
+			error_count BIGINT NOT NULL DEFAULT 0,
+			sum_duration_ms DOUBLE NOT NULL DEFAULT 0,
+			max_duration_ms DOUBLE NOT NULL DEFAULT 0,
+			p50_ms DOUBLE NOT NULL DEFAULT 0,
+			p95_ms DOUBLE NOT NULL DEFAULT 0,
+			p99_ms DOUBLE NOT NULL DEFAULT 0,
+			sketch VARBINARY(2048) NULL,
+			PRIMARY KEY (minute, server, program, api_path, status_class)
+		)
+	`
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	return EnsureColumns(db, "oula_logs_minute", []Column{
+		{"p50_ms", "DOUBLE NOT NULL DEFAULT 0"},
+		{"p95_ms", "DOUBLE NOT NULL DEFAULT 0"},
+		{"p99_ms", "DOUBLE NOT NULL DEFAULT 0"},
+		{"sketch", "VARBINARY(2048) NULL"},
+	})
+}
+
+// Add folds an entry into its bucket, a nil aggregator is a no-op
+func (a *Aggregator) Add(entry *LogEntry) {
+	if a == nil {
+		return
+	}
+	ts, err := time.ParseInLocation("2006/01/02 15:04:05", entry.Date+" "+entry.Time, time.Local)
+	if err != nil {
+		log.Printf("Error parsing entry time %s %s: %v", entry.Date, entry.Time, err)
+		return
+	}
+
+	key := MinuteKey{
+		Minute:      ts.Truncate(time.Minute),
+		Env:         entry.Env,
+		Server:      entry.Server,
+		Program:     entry.Program,
+		APIPath:     ExtractPathTemplate(entry.RawPath),
+		StatusClass: StatusClass(entry.StatusCode),
+		Country:     entry.Country,
+		ASN:         entry.ASN,
+		Protocol:    entry.Protocol,
+		TLSVersion:  entry.TLSVersion,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats, ok := a.buckets[key]
+	if !ok {
+		stats = &MinuteStats{}
+		a.buckets[key] = stats
+	}
+	stats.Count++
+	if key.StatusClass == "5xx" {
+		stats.ErrorCount++
+	}
+	if entry.IsSlow {
+		stats.SlowCount++
+	}
+	ms := float64(entry.Duration) / float64(time.Millisecond)
+	stats.SumDuration += ms
+	if ms > stats.MaxDuration {
+		stats.MaxDuration = ms
+	}
+	stats.Latency.Add(ms)
+	a.codes[StatusCodeKey{key.Minute, key.Env, key.Server, key.Program, statusCode(entry.StatusCode)}]++
+}
+
+// Run flushes closed buckets every interval and prunes old status code counts every hour until ctx
+// is done, then flushes everything left
+func (a *Aggregator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			a.Flush(time.Time{})
+			return
+		case now := <-ticker.C:
+			a.Flush(now)
+			if a.statusRetention > 0 && now.Sub(lastPrune) >= time.Hour {
+				if err := PruneStatusMinutes(ctx, a.db, now, a.statusRetention); err != nil {
+					log.Printf("Error pruning status code counts: %v", err)
+				}
+				lastPrune = now
+			}
+		}
+	}
+}
+
+// Flush writes the buckets closed at now, a zero now flushes all buckets
+func (a *Aggregator) Flush(now time.Time) {
+	a.mu.Lock()
+	closed := make(map[MinuteKey]*MinuteStats)
+	for key, stats := range a.buckets {
+		if now.IsZero() || !now.Before(key.Minute.Add(time.Minute+a.grace)) {
+			closed[key] = stats
+			delete(a.buckets, key)
+		}
+	}
+	closedCodes := make(map[StatusCodeKey]int64)
+	for key, n := range a.codes {
+		if now.IsZero() || !now.Before(key.Minute.Add(time.Minute+a.grace)) {
+			closedCodes[key] = n
+			delete(a.codes, key)
+		}
+	}
+	a.mu.Unlock()
+
+	if len(closed) == 0 && len(closedCodes) == 0 {
+		return
+	}
+	log.Printf("Flushing %d minute buckets", len(closed))
+	if err := a.write(closed, closedCodes); err != nil {
+		log.Printf("Error writing minute buckets: %v", err)
+		// 写入失败时放回内存，下次重试
+		a.mu.Lock()
+		for key, stats := range closed {
+			a.merge(key, stats)
+		}
+		for key, n := range closedCodes {
+			a.codes[key] += n
+		}
+		a.mu.Unlock()
+	}
+}
+
+// merge adds stats into the bucket for key, the caller must hold a.mu
+func (a *Aggregator) merge(key MinuteKey, stats *MinuteStats) {
+	existing, ok := a.buckets[key]
+	if !ok {
+		a.buckets[key] = stats
+		return
+	}
+	existing.Count += stats.Count
+	existing.ErrorCount += stats.ErrorCount
+	existing.SlowCount += stats.SlowCount
+	existing.SumDuration += stats.SumDuration
+	if stats.MaxDuration > existing.MaxDuration {
+		existing.MaxDuration = stats.MaxDuration
+	}
+	existing.Latency.Merge(&stats.Latency)
+}
+
+// write upserts the buckets and status code counts in a single transaction.
+// The stored sketch of a bucket that was already written is merged in first, so percentiles stay correct for late entries.
+func (a *Aggregator) write(buckets map[MinuteKey]*MinuteStats, codes map[StatusCodeKey]int64) error {
+	selectQuery := `
+		SELECT sketch FROM oula_logs_minute
+		WHERE minute = ? AND env = ? AND server = ? AND program = ? AND api_path = ? AND status_class = ? AND country = ? AND asn = ? AND protocol = ? AND tls_version = ?
+		FOR UPDATE
+	`
+	query := `
+		INSERT INTO oula_logs_minute (minute, env, server, program, api_path, status_class, country, asn, protocol, tls_version, count, error_count, slow_count, sum_duration_ms, max_duration_ms, p50_ms, p95_ms, p99_ms, sketch)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			count = count + VALUES(count),
+			error_count = error_count + VALUES(error_count),
+			slow_count = slow_count + VALUES(slow_count),
+			sum_duration_ms = sum_duration_ms + VALUES(sum_duration_ms),
+			max_duration_ms = GREATEST(max_duration_ms, VALUES(max_duration_ms)),
+			p50_ms = VALUES(p50_ms),
+			p95_ms = VALUES(p95_ms),
+			p99_ms = VALUES(p99_ms),
+			sketch = VALUES(sketch)
+	`
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	for key, stats := range buckets {
+		minute := key.Minute.Format("2006-01-02 15:04:05")
+
+		latency := stats.Latency
+		var stored []byte
+		err := tx.QueryRow(selectQuery, minute, key.Env, key.Server, key.Program, key.APIPath, key.StatusClass, key.Country, key.ASN, key.Protocol, key.TLSVersion).Scan(&stored)
+		if err != nil && err != sql.ErrNoRows {
+			tx.Rollback()
+			return err
+		}
+		if len(stored) > 0 {
+			var previous LatencySketch
+			if err := previous.UnmarshalBinary(stored); err != nil {
+				log.Printf("Ignoring stored sketch for %s %s: %v", minute, key.APIPath, err)
+			} else {
+				latency.Merge(&previous)
+			}
+		}
+		sketch, _ := latency.MarshalBinary()
+
+		_, err = tx.Exec(query, minute, key.Env, key.Server, key.Program, key.APIPath, key.StatusClass, key.Country, key.ASN, key.Protocol, key.TLSVersion,
+			stats.Count, stats.ErrorCount, stats.SlowCount, stats.SumDuration, stats.MaxDuration,
+			latency.Quantile(0.50), latency.Quantile(0.95), latency.Quantile(0.99), sketch)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := writeStatusCodes(tx, codes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// StatusClass returns the class of an HTTP status code, e.g. "2xx", or "other" if it is not a valid code
+func StatusClass(statusCode string) string {
+	code, err := strconv.Atoi(statusCode)
+	if err != nil || code < 100 || code > 599 {
+		return "other"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
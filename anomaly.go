@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// endpointRate holds the per-minute request counts of an endpoint and its alert state
+type endpointRate struct {
+	Current  int64
+	History  []float64
+	Next     int
+	Breaches int
+	Firing   bool
+}
+
+// RateAnomalyDetector alerts when the requests per minute of an endpoint deviate from its recent baseline,
+// e.g. a traffic drop after a bad deploy or a scraping spike. The baseline is the median of the last
+// History minutes and the spread is the median absolute deviation scaled to a standard deviation, with the
+// square root of the median as a floor so steady endpoints do not alert on ordinary noise. A minute deviates
+// when it is more than Factor spreads away from the median, and an alert is sent after Minutes consecutive
+// deviating minutes. Endpoints whose baseline is below MinBaseline are exempt.
+type RateAnomalyDetector struct {
+	Server      string
+	Factor      float64
+	Minutes     int
+	History     int
+	MinBaseline float64
+	Alerter     *Dispatcher
+
+	mu        sync.Mutex
+	endpoints map[endpointKey]*endpointRate
+}
+
+// NewRateAnomalyDetector creates a detector alerting through alerter
+func NewRateAnomalyDetector(server string, factor float64, minutes, history int, minBaseline float64, alerter *Dispatcher) *RateAnomalyDetector {
+	if minutes < 1 {
+		minutes = 1
+	}
+	if history < 3 {
+		history = 3
+	}
+	return &RateAnomalyDetector{
+		Server:      server,
+		Factor:      factor,
+		Minutes:     minutes,
+		History:     history,
+		MinBaseline: minBaseline,
+		Alerter:     alerter,
+		endpoints:   make(map[endpointKey]*endpointRate),
+	}
+}
+
+// Add counts an entry in the current minute, a nil detector is a no-op
+func (d *RateAnomalyDetector) Add(entry *LogEntry) {
+	if d == nil {
+		return
+	}
+	key := endpointKey{Program: entry.Program, APIPath: entry.APIPath}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.endpoints[key]
+	if !ok {
+		r = &endpointRate{}
+		d.endpoints[key] = r
+	}
+	r.Current++
+}
+
+// Run closes a minute every minute until ctx is done
+func (d *RateAnomalyDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, alert := range d.evaluate(now) {
+				d.Alerter.Notify(alert)
+			}
+		}
+	}
+}
+
+// evaluate compares the closing minute of every endpoint with its baseline, adds it to the history and returns the alerts to send
+func (d *RateAnomalyDetector) evaluate(now time.Time) []*Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var alerts []*Alert
+	for key, r := range d.endpoints {
+		count := float64(r.Current)
+
+		// 历史数据不足一半时只积累基线
+		deviating := false
+		var baseline, low, high float64
+		if len(r.History) >= d.History/2 {
+			baseline = median(r.History)
+			deviations := make([]float64, len(r.History))
+			for i, v := range r.History {
+				deviations[i] = math.Abs(v - baseline)
+			}
+			spread := math.Max(1.4826*median(deviations), math.Sqrt(baseline))
+			low, high = baseline-d.Factor*spread, baseline+d.Factor*spread
+			deviating = baseline >= d.MinBaseline && (count < low || count > high)
+		}
+		if deviating {
+			r.Breaches++
+		} else {
+			r.Breaches = 0
+		}
+
+		alert := &Alert{
+			Server:    d.Server,
+			Program:   key.Program,
+			Endpoint:  key.APIPath,
+			Value:     count,
+			Threshold: baseline,
+			Window:    time.Minute.String(),
+			Time:      now,
+		}
+		switch {
+		case r.Breaches >= d.Minutes && !r.Firing:
+			alert.Type = "request_rate_anomaly"
+			alert.Message = fmt.Sprintf("%s received %.0f requests in the last minute, expected %.0f (%.0f to %.0f) for %d minutes", key.APIPath, count, baseline, math.Max(low, 0), high, r.Breaches)
+			alerts = append(alerts, alert)
+			r.Firing = true
+		case r.Firing && r.Breaches == 0:
+			alert.Type = "request_rate_recovered"
+			alert.Message = fmt.Sprintf("%s received %.0f requests in the last minute, back within %.0f to %.0f", key.APIPath, count, math.Max(low, 0), high)
+			alerts = append(alerts, alert)
+			r.Firing = false
+		}
+
+		if len(r.History) < d.History {
+			r.History = append(r.History, count)
+		} else {
+			r.History[r.Next] = count
+			r.Next = (r.Next + 1) % d.History
+		}
+		r.Current = 0
+
+		// 没有流量也不在告警中的接口直接删除
+		if !r.Firing && median(r.History) == 0 {
+			delete(d.endpoints, key)
+		}
+	}
+	return alerts
+}
+
+// median returns the median of values without modifying them, 0 for no values
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
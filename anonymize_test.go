@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		name, ip, want string
+	}{
+		{"IPv4", "192.168.1.42", "192.168.1.0"},
+		{"IPv4 network address", "10.0.0.0", "10.0.0.0"},
+		{"IPv4 loopback", "127.0.0.1", "127.0.0.0"},
+		{"IPv4-mapped IPv6", "::ffff:203.0.113.7", "203.0.113.0"},
+		// IPv6 地址保留 /48 前缀，清零后 80 位
+		{"IPv6", "2001:db8:85a3:1234:5678:8a2e:370:7334", "2001:db8:85a3::"},
+		{"IPv6 zone", "fe80::1%eth0", "fe80::"},
+		{"IPv6 loopback", "::1", "::"},
+		{"empty", "", ""},
+		{"invalid", "not-an-ip", "not-an-ip"},
+		{"IPv4 with port", "192.168.1.42:8080", "192.168.1.42:8080"},
+		{"out of range octet", "192.168.1.256", "192.168.1.256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AnonymizeIP(tt.ip); got != tt.want {
+				t.Errorf("AnonymizeIP(%q) = %q, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnonymizerApply(t *testing.T) {
+	truncate, err := NewAnonymizer(AnonymizePolicy{Mode: "truncate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyed, err := NewAnonymizer(AnonymizePolicy{Mode: "hmac", Key: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"192.168.1.42", "2001:db8:85a3:1234:5678:8a2e:370:7334"} {
+		for name, a := range map[string]*Anonymizer{"truncate": truncate, "hmac": keyed} {
+			entry := &LogEntry{IP: ip, Line: "[GIN] 2024/01/01 - 00:00:00 | 200 | 1ms | " + ip + " | GET \"/api\""}
+			a.Apply(entry)
+			if entry.IP == ip || entry.IP != a.IP(ip) {
+				t.Errorf("%s: IP %s anonymized as %s, want %s", name, ip, entry.IP, a.IP(ip))
+			}
+			if strings.Contains(entry.Line, ip) || !strings.Contains(entry.Line, entry.IP) {
+				t.Errorf("%s: line of %s not scrubbed: %s", name, ip, entry.Line)
+			}
+		}
+	}
+
+	// 同一客户端的不同写法得到相同的哈希
+	if a, b := keyed.IP("::ffff:192.168.1.42"), keyed.IP("192.168.1.42"); a != b {
+		t.Errorf("hmac of the IPv4-mapped address %s differs from %s", a, b)
+	}
+	if _, err := NewAnonymizer(AnonymizePolicy{Mode: "hmac"}); err == nil {
+		t.Error("hmac mode without a key did not fail")
+	}
+}
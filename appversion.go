@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// appVersionInfo is 1 for the current version of each program, for joining version labels onto series
+var appVersionInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "logmonitor_app_version_info",
+	Help: "Deployed version of each program, always 1.",
+}, []string{"program", "version"})
+
+// appVersionChanged is the time a program's version was last seen changing, for deploy markers
+var appVersionChanged = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "logmonitor_app_version_changed_timestamp_seconds",
+	Help: "Unix time at which a new version of each program was detected.",
+}, []string{"program"})
+
+func init() {
+	prometheus.MustRegister(appVersionInfo, appVersionChanged)
+}
+
+// maxAppVersionLength is the size of the app_version column
+const maxAppVersionLength = 64
+
+// VersionSource tells where the deployed version of a program is read, exactly one field is set
+type VersionSource struct {
+	// File is read and its first line is the version, e.g. a VERSION file written by the deploy
+	File string `json:"file,omitempty"`
+	// Env is a variable of log-monitor's own environment
+	Env string `json:"env,omitempty"`
+	// ProcessEnv is a variable of the program's environment, read from /proc/<pid>/environ with the
+	// pid given by supervisorctl, so it follows the environment= of the program's supervisord section
+	ProcessEnv string `json:"process_env,omitempty"`
+}
+
+// Validate checks that exactly one source is set
+func (s VersionSource) Validate() error {
+	n := 0
+	for _, v := range []string{s.File, s.Env, s.ProcessEnv} {
+		if v != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("version needs exactly one of file, env or process_env")
+	}
+	return nil
+}
+
+// Read returns the version of program, truncated to the app_version column
+func (s VersionSource) Read(program string) (string, error) {
+	var version string
+	switch {
+	case s.File != "":
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+		version, _, _ = strings.Cut(string(data), "\n")
+	case s.Env != "":
+		version = os.Getenv(s.Env)
+	case s.ProcessEnv != "":
+		var err error
+		if version, err = processEnv(program, s.ProcessEnv); err != nil {
+			return "", err
+		}
+	}
+	version = strings.TrimSpace(version)
+	if len(version) > maxAppVersionLength {
+		version = version[:maxAppVersionLength]
+	}
+	return version, nil
+}
+
+// processEnv returns a variable of the environment of a running supervisord program
+func processEnv(program, name string) (string, error) {
+	out, err := exec.Command("supervisorctl", "pid", program).Output()
+	if err != nil {
+		return "", fmt.Errorf("running supervisorctl pid: %w", err)
+	}
+	pid := strings.TrimSpace(string(out))
+	if pid == "" || pid == "0" || strings.ContainsAny(pid, " /") {
+		return "", fmt.Errorf("program %s is not running", program)
+	}
+	environ, err := os.ReadFile("/proc/" + pid + "/environ")
+	if err != nil {
+		return "", err
+	}
+	for _, variable := range strings.Split(string(environ), "\x00") {
+		if value, ok := strings.CutPrefix(variable, name+"="); ok {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+// refreshAppVersion re-reads the version of the program, logging and publishing a change. The previous
+// version is kept when it cannot be read.
+func (m *Monitor) refreshAppVersion() {
+	if m.Version == nil {
+		return
+	}
+	version, err := m.Version.Read(m.Program)
+	if err != nil {
+		log.Printf("Error reading the version of %s, keeping %q: %v", m.Program, m.AppVersion, err)
+		return
+	}
+	if version == "" {
+		log.Printf("No version found for %s, keeping %q", m.Program, m.AppVersion)
+		return
+	}
+	if version == m.AppVersion {
+		return
+	}
+	if m.AppVersion != "" {
+		log.Printf("Version of %s changed from %s to %s", m.Program, m.AppVersion, version)
+		appVersionInfo.DeleteLabelValues(m.Program, m.AppVersion)
+		appVersionChanged.WithLabelValues(m.Program).Set(float64(time.Now().Unix()))
+	} else {
+		log.Printf("Version of %s is %s", m.Program, version)
+	}
+	appVersionInfo.WithLabelValues(m.Program, version).Set(1)
+	m.AppVersion = version
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// EnsureAvailabilityTable creates the oula_api_availability table if it does not exist
+func EnsureAvailabilityTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS oula_api_availability (
+			day DATE NOT NULL,
+			program VARCHAR(128) NOT NULL,
+			api_path VARCHAR(255) NOT NULL,
+			total BIGINT NOT NULL,
+			success BIGINT NOT NULL,
+			success_ratio DOUBLE NOT NULL,
+			PRIMARY KEY (day, program, api_path)
+		)
+	`)
+	return err
+}
+
+// rollupAvailability replaces the rows of day in oula_api_availability within tx. Availability is computed
+// from the raw rows, whose api_path is the API list entry the request matched, so there is one row per
+// configured endpoint and environment that received requests. Sampled rows count for the requests they stand for.
+func rollupAvailability(ctx context.Context, tx *sql.Tx, day string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM oula_api_availability WHERE day = ?`, day); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO oula_api_availability (day, env, program, api_path, total, success, success_ratio)
+		SELECT date, env, program, api_path, total, success, success / total
+		FROM (
+			SELECT date, env, program, api_path,
+				ROUND(SUM(sampled_weight)) AS total,
+				ROUND(SUM(IF(status_code < 500, sampled_weight, 0))) AS success
+			FROM oula_logs_record
+			WHERE date = ?
+			GROUP BY date, env, program, api_path
+		) AS daily
+		WHERE total > 0
+	`, day)
+	return err
+}
+
+// EndpointAvailability is the availability of an endpoint over a range of days
+type EndpointAvailability struct {
+	Program string
+	APIPath string
+	Days    int
+	Total   int64
+	Success int64
+}
+
+// Availability returns the ratio of non-5xx requests, 1 without requests
+func (a *EndpointAvailability) Availability() float64 {
+	if a.Total == 0 {
+		return 1
+	}
+	return float64(a.Success) / float64(a.Total)
+}
+
+// LoadAvailability sums the availability rows of env, all environments if it is empty, of the days in
+// [from, to], sorted by program and path
+func LoadAvailability(ctx context.Context, db *sql.DB, env string, from, to time.Time) ([]*EndpointAvailability, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT program, api_path, COUNT(DISTINCT day), SUM(total), SUM(success)
+		FROM oula_api_availability
+		WHERE day >= ? AND day <= ? AND (? = '' OR env = ?)
+		GROUP BY program, api_path
+		ORDER BY program, api_path
+	`, from.Format("2006-01-02"), to.Format("2006-01-02"), env, env)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*EndpointAvailability
+	for rows.Next() {
+		a := &EndpointAvailability{}
+		if err := rows.Scan(&a.Program, &a.APIPath, &a.Days, &a.Total, &a.Success); err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+// writeAvailabilityReport prints the availability of each endpoint with its SLO target and status when the
+// API list sets one, "-" otherwise
+func writeAvailabilityReport(out io.Writer, availability []*EndpointAvailability, apiList map[string]APIEntry, program string) error {
+	sort.SliceStable(availability, func(i, j int) bool {
+		if availability[i].Program != availability[j].Program {
+			return availability[i].Program < availability[j].Program
+		}
+		return availability[i].APIPath < availability[j].APIPath
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROGRAM\tAPI_PATH\tDAYS\tREQUESTS\tAVAILABILITY\tSLO\tSTATUS")
+	for _, a := range availability {
+		if program != "" && a.Program != program {
+			continue
+		}
+		target, status := "-", "-"
+		if slo := apiList[a.APIPath].SLO; slo > 0 {
+			target, status = fmt.Sprintf("%.3f%%", slo*100), "OK"
+			if a.Availability() < slo {
+				status = "VIOLATED"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.3f%%\t%s\t%s\n", a.Program, a.APIPath, a.Days, a.Total, a.Availability()*100, target, status)
+	}
+	return w.Flush()
+}
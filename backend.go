@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:generate mockgen -source=backend.go -destination=mock_backend_test.go -package=main
+
+// Backend stores batches of matched log entries.
+// Entries are reused once Insert returns, so a backend must copy anything it keeps.
+type Backend interface {
+	Insert(entries []*LogEntry) error
+	CleanOld() error
+	// IsHealthy reports whether the backend is reachable
+	IsHealthy(ctx context.Context) bool
+}
+
+// MySQLBackend stores entries in the oula_logs_record table
+type MySQLBackend struct {
+	DB            *sql.DB
+	RetentionDays int
+	// Env is the environment RetentionDays applies to, EnvRetentionDays sets the retention of other
+	// environments, or overrides that of Env. Rows of environments in neither are never deleted.
+	Env              string
+	EnvRetentionDays map[string]int
+	// MaxPacketBytes limits the size of a multi-value INSERT, 0 uses MySQL's default max_allowed_packet
+	MaxPacketBytes int
+	// InsertType is the statement of the inserts, see insertVerbs
+	InsertType string
+	// InsertTimeout fails a batch whose insert takes longer, 0 waits for the database
+	InsertTimeout time.Duration
+	// Daily holds back the deletion of days that are not rolled up yet, unless Force is set. Without a
+	// daily rollup, nothing is summarized from the raw rows and they are deleted past retention.
+	Daily *DailyRollup
+	Force bool
+	// ColumnLimits cuts the values longer than their column before the insert, nil leaves them to
+	// MySQL, which fails the batch in strict mode. Truncated keeps the entries with their original
+	// values, nil discards them.
+	ColumnLimits ColumnLimits
+	Truncated    *TimestampedDeadLetter
+	// MaxBytes deletes the oldest days past MinRetentionDays after the time-based cleanup until the
+	// table fits in this size, 0 only applies the time-based retention
+	MaxBytes         int64
+	MinRetentionDays int
+}
+
+// Insert inserts the entries into oula_logs_record within InsertTimeout
+func (b *MySQLBackend) Insert(entries []*LogEntry) error {
+	ctx := context.Background()
+	if b.InsertTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.InsertTimeout)
+		defer cancel()
+	}
+	if b.ColumnLimits != nil {
+		if originals := TruncateEntries(entries, b.ColumnLimits); len(originals) > 0 && b.Truncated != nil {
+			if path, err := b.Truncated.Write(originals[0].Program, originals); err != nil {
+				log.Printf("Error keeping the original values of %d truncated entries: %v", len(originals), err)
+			} else {
+				log.Printf("Kept the original values of %d truncated entries in %s", len(originals), path)
+			}
+		}
+	}
+	err := InsertLogEntry(ctx, b.DB, entries, b.MaxPacketBytes, b.InsertType)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("inserting %d entries timed out after %s: %w", len(entries), b.InsertTimeout, err)
+	}
+	return err
+}
+
+// CleanOld deletes the entries of each environment past its retention, then the oldest days over MaxBytes
+func (b *MySQLBackend) CleanOld() error {
+	retention := retentionByEnv(b.Env, b.RetentionDays, b.EnvRetentionDays)
+	now := time.Now()
+	if b.Daily != nil && !b.Force {
+		if err := b.Daily.CleanOldLogs(context.Background(), now, retention); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range retention {
+			if err := CleanOldLogs(b.DB, r.Env, now, r.Days); err != nil {
+				return err
+			}
+		}
+	}
+	if b.MaxBytes <= 0 {
+		return nil
+	}
+	held, err := b.cleanToBudget(context.Background(), now, retention)
+	if len(held) > 0 {
+		cleanupHeldBackDays.Add(float64(len(held)))
+		log.Printf("Warning: raw rows of %d days over the size budget were held back until they are rolled up: %s (use -force to delete them anyway)", len(held), strings.Join(held, ", "))
+	}
+	return err
+}
+
+// IsHealthy pings the database
+func (b *MySQLBackend) IsHealthy(ctx context.Context) bool {
+	return b.DB.PingContext(ctx) == nil
+}
+
+// MemoryBackend keeps every inserted batch in memory, for tests and dry runs
+type MemoryBackend struct {
+	mu      sync.Mutex
+	batches [][]*LogEntry
+}
+
+// Insert records a copy of the batch, the entries themselves are copied because they go back to the pool
+func (b *MemoryBackend) Insert(entries []*LogEntry) error {
+	batch := make([]*LogEntry, len(entries))
+	for i, entry := range entries {
+		copied := *entry
+		batch[i] = &copied
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batches = append(b.batches, batch)
+	return nil
+}
+
+// CleanOld is a no-op
+func (b *MemoryBackend) CleanOld() error {
+	return nil
+}
+
+// IsHealthy always returns true
+func (b *MemoryBackend) IsHealthy(ctx context.Context) bool {
+	return true
+}
+
+// Batches returns the batches inserted so far
+func (b *MemoryBackend) Batches() [][]*LogEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]*LogEntry(nil), b.batches...)
+}
+
+// Entries returns all inserted entries in insertion order
+func (b *MemoryBackend) Entries() []*LogEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var entries []*LogEntry
+	for _, batch := range b.batches {
+		entries = append(entries, batch...)
+	}
+	return entries
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// BatchConfig sets when a BatchWriter flushes on its own
+type BatchConfig struct {
+	// Size flushes once the batch holds this many entries, 100 if unset
+	Size int
+	// MaxAge flushes on Add once the oldest entry of the batch waited this long, 0 disables
+	MaxAge time.Duration
+}
+
+// BatchWriter accumulates entries and writes them to a backend in batches. Entries are returned to the
+// pool once their batch is written, whether or not the backend succeeded. It is not safe for concurrent use.
+type BatchWriter struct {
+	Backend Backend
+	Config  BatchConfig
+	// Redactor replaces sensitive field values of entries as they are added, nil keeps them
+	Redactor *Redactor
+
+	entries []*LogEntry
+	oldest  time.Time
+}
+
+// NewBatchWriter creates a writer to backend
+func NewBatchWriter(backend Backend, config BatchConfig) *BatchWriter {
+	if config.Size <= 0 {
+		config.Size = 100
+	}
+	return &BatchWriter{Backend: backend, Config: config}
+}
+
+// Add redacts an entry, adds it to the batch and flushes it if it is full or old enough
+func (w *BatchWriter) Add(entry *LogEntry) error {
+	w.Redactor.Apply(entry)
+	if len(w.entries) == 0 {
+		w.oldest = time.Now()
+	}
+	w.entries = append(w.entries, entry)
+	if len(w.entries) >= w.Config.Size || w.Config.MaxAge > 0 && time.Since(w.oldest) >= w.Config.MaxAge {
+		return w.Flush(context.Background())
+	}
+	return nil
+}
+
+// Len returns the number of entries waiting to be written
+func (w *BatchWriter) Len() int {
+	return len(w.entries)
+}
+
+// Flush writes the pending entries, if any. The batch is kept when ctx is already done.
+func (w *BatchWriter) Flush(ctx context.Context) error {
+	if len(w.entries) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries := w.entries
+	w.entries = nil
+	err := w.Backend.Insert(entries)
+	releaseLogEntries(entries)
+	return err
+}
+
+// trackedBackend wraps the backend of a program to record insert failures for alerting and keep
+// failed batches as dead letters
+type trackedBackend struct {
+	Backend
+	Program    string
+	DeadLetter *TimestampedDeadLetter
+	Failures   *InsertFailureTracker
+	Counters   *ProgramCounters
+}
+
+// Insert writes the batch to the wrapped backend
+func (b *trackedBackend) Insert(entries []*LogEntry) error {
+	err := b.Backend.Insert(entries)
+	b.Failures.Record(len(entries), err)
+	if err != nil {
+		b.Counters.Error()
+	} else {
+		b.Counters.BatchFlushed()
+	}
+	if err != nil && b.DeadLetter != nil {
+		if path, dlErr := b.DeadLetter.Write(b.Program, entries); dlErr != nil {
+			log.Printf("Error writing dead letter for %s: %v", b.Program, dlErr)
+		} else {
+			log.Printf("Wrote %d entries that failed to insert to %s", len(entries), path)
+		}
+	}
+	return err
+}
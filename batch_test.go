@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/mock/gomock"
+)
+
+// testEntries returns n pooled entries of paths /api/v1/users/<first> to /api/v1/users/<first+n-1>
+func testEntries(first, n int) []*LogEntry {
+	entries := make([]*LogEntry, n)
+	for i := range entries {
+		entries[i] = newLogEntry()
+		entries[i].Method = "GET"
+		entries[i].RawPath = fmt.Sprintf("/api/v1/users/%d", first+i)
+	}
+	return entries
+}
+
+// recordPaths returns an Insert action appending the raw paths of each batch to batches, since the
+// entries are returned to the pool once Insert returns
+func recordPaths(batches *[][]string, err error) func([]*LogEntry) error {
+	return func(entries []*LogEntry) error {
+		paths := make([]string, len(entries))
+		for i, entry := range entries {
+			paths[i] = entry.RawPath
+		}
+		*batches = append(*batches, paths)
+		return err
+	}
+}
+
+func TestBatchWriterFlushesFullBatches(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	backend := NewMockBackend(ctrl)
+	var batches [][]string
+	gomock.InOrder(
+		backend.EXPECT().Insert(gomock.Len(3)).DoAndReturn(recordPaths(&batches, nil)).Times(2),
+		backend.EXPECT().Insert(gomock.Len(1)).DoAndReturn(recordPaths(&batches, nil)),
+	)
+
+	w := NewBatchWriter(backend, BatchConfig{Size: 3})
+	for _, entry := range testEntries(0, 7) {
+		if err := w.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Len() != 1 {
+		t.Fatalf("%d entries pending, want 1", w.Len())
+	}
+	if err := w.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 没有待写入的条目时不调用 Insert
+	if err := w.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "[[/api/v1/users/0 /api/v1/users/1 /api/v1/users/2] [/api/v1/users/3 /api/v1/users/4 /api/v1/users/5] [/api/v1/users/6]]"
+	if got := fmt.Sprint(batches); got != want {
+		t.Errorf("batches = %s, want %s", got, want)
+	}
+}
+
+func TestBatchWriterDefaultSize(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	backend := NewMockBackend(ctrl)
+	backend.EXPECT().Insert(gomock.Len(100)).Return(nil)
+
+	w := NewBatchWriter(backend, BatchConfig{})
+	for _, entry := range testEntries(0, 150) {
+		w.Add(entry)
+	}
+	if w.Len() != 50 {
+		t.Errorf("%d entries pending, want 50", w.Len())
+	}
+}
+
+func TestBatchWriterMaxAge(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	backend := NewMockBackend(ctrl)
+	backend.EXPECT().Insert(gomock.Len(2)).Return(nil)
+
+	w := NewBatchWriter(backend, BatchConfig{Size: 100, MaxAge: 20 * time.Millisecond})
+	entries := testEntries(0, 2)
+	if err := w.Add(entries[0]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(25 * time.Millisecond)
+	// 最早的条目超过 MaxAge，添加时写入整个批次
+	if err := w.Add(entries[1]); err != nil {
+		t.Fatal(err)
+	}
+	if w.Len() != 0 {
+		t.Errorf("%d entries pending after MaxAge, want 0", w.Len())
+	}
+}
+
+func TestBatchWriterInsertError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	backend := NewMockBackend(ctrl)
+	insertErr := errors.New("connection refused")
+	backend.EXPECT().Insert(gomock.Len(2)).Return(insertErr)
+
+	w := NewBatchWriter(backend, BatchConfig{Size: 2})
+	entries := testEntries(0, 2)
+	w.Add(entries[0])
+	if err := w.Add(entries[1]); !errors.Is(err, insertErr) {
+		t.Errorf("Add = %v, want %v", err, insertErr)
+	}
+	// 写入失败的批次交给 backend 处理，不再重试
+	if w.Len() != 0 {
+		t.Errorf("%d entries pending after a failed insert, want 0", w.Len())
+	}
+}
+
+func TestBatchWriterFlushCanceled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	// 没有 EXPECT，调用 Insert 会使测试失败
+	backend := NewMockBackend(ctrl)
+
+	w := NewBatchWriter(backend, BatchConfig{Size: 10})
+	for _, entry := range testEntries(0, 3) {
+		w.Add(entry)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.Flush(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Flush = %v, want %v", err, context.Canceled)
+	}
+	if w.Len() != 3 {
+		t.Errorf("%d entries pending after a canceled flush, want 3", w.Len())
+	}
+}
+
+func TestTrackedBackend(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	backend := NewMockBackend(ctrl)
+	gomock.InOrder(
+		backend.EXPECT().Insert(gomock.Any()).Return(nil),
+		backend.EXPECT().Insert(gomock.Any()).Return(errors.New("deadlock")),
+	)
+	counters := NewPerProgramMetrics().Program("api")
+	tracked := &trackedBackend{Backend: backend, Program: "api", Counters: counters}
+
+	if err := tracked.Insert(testEntries(0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracked.Insert(testEntries(2, 2)); err == nil {
+		t.Fatal("the error of the backend was not returned")
+	}
+	if s := counters.Status(); s.BatchesFlushed != 1 || s.Errors != 1 {
+		t.Errorf("counted %d batches and %d errors, want 1 and 1", s.BatchesFlushed, s.Errors)
+	}
+}
+
+// TestMonitorLogsMockBackend checks that processLogs keeps reading after a failed insert and writes the
+// rest of the lines
+func TestMonitorLogsMockBackend(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	backend := NewMockBackend(ctrl)
+	var batches [][]string
+	gomock.InOrder(
+		backend.EXPECT().Insert(gomock.Len(2)).DoAndReturn(recordPaths(&batches, errors.New("connection refused"))),
+		backend.EXPECT().Insert(gomock.Len(2)).DoAndReturn(recordPaths(&batches, nil)),
+		backend.EXPECT().Insert(gomock.Len(1)).DoAndReturn(recordPaths(&batches, nil)),
+	)
+
+	if err := processLogs(testMonitor(backend, 2), strings.NewReader(ginLines(5))); err != nil {
+		t.Fatal(err)
+	}
+	want := "[[/api/v1/users/0 /api/v1/users/1] [/api/v1/users/2 /api/v1/users/3] [/api/v1/users/4]]"
+	if got := fmt.Sprint(batches); got != want {
+		t.Errorf("batches = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// botRequestsTotal counts the requests classified as bots, by program and matched signature.
+// The signatures come from the built-in list and the signature file, so the label stays bounded.
+var botRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_bot_requests_total",
+	Help: "Requests whose user agent matched a bot signature, by program and signature.",
+}, []string{"program", "signature"})
+
+func init() {
+	prometheus.MustRegister(botRequestsTotal)
+}
+
+// builtinBotSignatures are user agent substrings of crawlers, uptime checkers and HTTP libraries,
+// matched case-insensitively. The generic words come last so the specific names are reported.
+var builtinBotSignatures = []string{
+	"googlebot", "bingbot", "baiduspider", "yandexbot", "duckduckbot", "sogou", "360spider", "bytespider",
+	"petalbot", "applebot", "slurp", "semrushbot", "ahrefsbot", "mj12bot", "dotbot", "facebookexternalhit",
+	"twitterbot", "gptbot", "claudebot", "ccbot", "uptimerobot", "pingdom", "statuscake", "site24x7",
+	"datadogsynthetics", "newrelicpinger", "kube-probe", "elb-healthchecker", "googlehc", "prometheus",
+	"blackbox", "curl/", "wget/", "python-requests", "python-urllib", "go-http-client", "okhttp", "java/",
+	"apache-httpclient", "headlesschrome", "phantomjs", "crawler", "spider", "bot",
+}
+
+// compileBotSignatures builds a single case-insensitive alternation of the signatures, so a user agent
+// is classified in one pass and the regexp engine rejects non-matching ones without backtracking
+func compileBotSignatures(signatures []string) *regexp.Regexp {
+	quoted := make([]string, len(signatures))
+	for i, s := range signatures {
+		quoted[i] = regexp.QuoteMeta(strings.ToLower(s))
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+}
+
+// loadBotSignatures reads a signature file: one user agent substring per line, # starts a comment
+func loadBotSignatures(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var signatures []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			signatures = append(signatures, line)
+		}
+	}
+	return signatures, scanner.Err()
+}
+
+// BotClassifier flags requests from crawlers and uptime checkers by their user agent, using the
+// built-in signatures plus those of an optional signature file, which can be reloaded while running
+type BotClassifier struct {
+	Path string
+
+	matcher atomic.Pointer[regexp.Regexp]
+}
+
+// NewBotClassifier creates a classifier, adding the signatures of path if it is not empty
+func NewBotClassifier(path string) (*BotClassifier, error) {
+	c := &BotClassifier{Path: path}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load compiles the built-in and file signatures
+func (c *BotClassifier) load() error {
+	signatures := builtinBotSignatures
+	if c.Path != "" {
+		extra, err := loadBotSignatures(c.Path)
+		if err != nil {
+			return err
+		}
+		// 自定义特征放在通用词之前，报告更具体的名字
+		signatures = append(append([]string(nil), extra...), builtinBotSignatures...)
+	}
+	c.matcher.Store(compileBotSignatures(signatures))
+	return nil
+}
+
+// Watch reloads the signature file whenever it changes until ctx is done, keeping the previous
+// signatures if the file fails to load
+func (c *BotClassifier) Watch(ctx context.Context, interval time.Duration) {
+	if c.Path == "" {
+		return
+	}
+	go watchFile(ctx, "bot signatures", c.Path, interval, c.Reload)
+}
+
+// Reload reads the signature file again, keeping the previous signatures if it fails to load. A nil
+// classifier or one without a file is a no-op.
+func (c *BotClassifier) Reload() {
+	if c == nil || c.Path == "" {
+		return
+	}
+	if err := c.load(); err != nil {
+		log.Printf("Error reloading bot signatures %s, keeping the previous ones: %v", c.Path, err)
+		return
+	}
+	log.Printf("Reloaded bot signatures %s", c.Path)
+}
+
+// Classify sets IsBot on an entry whose user agent matches a signature and counts it, a nil classifier
+// leaves entries unflagged
+func (c *BotClassifier) Classify(entry *LogEntry) {
+	if c == nil || entry.UserAgent == "" {
+		return
+	}
+	signature := c.matcher.Load().FindString(entry.UserAgent)
+	if signature == "" {
+		return
+	}
+	entry.IsBot = true
+	botRequestsTotal.WithLabelValues(entry.Program, strings.ToLower(signature)).Inc()
+}
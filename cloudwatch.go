@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// cloudWatchBatchSize is the number of metric data points sent per PutMetricData call
+const cloudWatchBatchSize = 20
+
+// CloudWatchBackend is a metrics sink that periodically publishes the process's counters and gauges as
+// CloudWatch custom metrics. Prometheus labels become dimensions. Counters are sent as the increase
+// since the previous flush, gauges as their current value.
+type CloudWatchBackend struct {
+	Namespace string
+	Client    *cloudwatch.Client
+	Gatherer  prometheus.Gatherer
+
+	previous map[string]float64
+}
+
+// NewCloudWatchBackend creates a sink for namespace using the default AWS credential chain
+func NewCloudWatchBackend(ctx context.Context, namespace, region string) (*CloudWatchBackend, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &CloudWatchBackend{
+		Namespace: namespace,
+		Client:    cloudwatch.NewFromConfig(cfg),
+		Gatherer:  prometheus.DefaultGatherer,
+		previous:  make(map[string]float64),
+	}, nil
+}
+
+// Run flushes every interval until ctx is done
+func (c *CloudWatchBackend) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil {
+				log.Printf("Error publishing CloudWatch metrics: %v", err)
+			}
+		}
+	}
+}
+
+// Flush publishes the current metrics in batches of cloudWatchBatchSize
+func (c *CloudWatchBackend) Flush(ctx context.Context) error {
+	families, err := c.Gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var data []types.MetricDatum
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var value float64
+			unit := types.StandardUnitNone
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				key := family.GetName() + labelKey(metric.GetLabel())
+				total := metric.GetCounter().GetValue()
+				value = total - c.previous[key]
+				if value < 0 {
+					value = total
+				}
+				c.previous[key] = total
+				unit = types.StandardUnitCount
+			case dto.MetricType_GAUGE:
+				value = metric.GetGauge().GetValue()
+			default:
+				continue
+			}
+
+			var dimensions []types.Dimension
+			for _, label := range metric.GetLabel() {
+				if label.GetValue() == "" {
+					continue
+				}
+				dimensions = append(dimensions, types.Dimension{Name: aws.String(label.GetName()), Value: aws.String(label.GetValue())})
+			}
+			data = append(data, types.MetricDatum{
+				MetricName: aws.String(family.GetName()),
+				Dimensions: dimensions,
+				Timestamp:  aws.Time(now),
+				Unit:       unit,
+				Value:      aws.Float64(value),
+			})
+		}
+	}
+
+	for start := 0; start < len(data); start += cloudWatchBatchSize {
+		end := start + cloudWatchBatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err := c.Client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(c.Namespace),
+			MetricData: data[start:end],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelKey returns a stable key for a label set
+func labelKey(labels []*dto.LabelPair) string {
+	key := ""
+	for _, label := range labels {
+		key += "\x00" + label.GetName() + "=" + label.GetValue()
+	}
+	return key
+}
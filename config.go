@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Config is the optional JSON configuration file for settings that flags cannot express per program
+type Config struct {
+	Programs  map[string]ProgramConfig `json:"programs,omitempty"`
+	Notifiers []NotifierConfig         `json:"notifiers,omitempty"`
+	// GeoIP enables country and ASN enrichment of client IPs
+	GeoIP *GeoIPConfig `json:"geoip,omitempty"`
+	// Scrub enables scrubbing of sensitive values from paths with additional patterns
+	Scrub *ScrubConfig `json:"scrub,omitempty"`
+	// Redact replaces sensitive field values of the endpoints matching each rule before storage
+	Redact []RedactRule `json:"redact,omitempty"`
+	// IgnoreIPs are the IPs and CIDRs whose requests are dropped, in addition to -ignore-ips
+	IgnoreIPs []string `json:"ignore_ips,omitempty"`
+	// Labels are static labels such as env and region, stored with every entry and added to every metric
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// NotifierConfig configures an alert channel
+type NotifierConfig struct {
+	// Type is the channel kind: "webhook", "slack", "dingtalk", "feishu", "email", "pagerduty" or "telegram"
+	Type    string            `json:"type"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Method, Template or TemplateFile, and ExpectStatus customize the "webhook" request: the body is
+	// the text/template rendered over the alert, see examples/webhook-templates
+	Method       string `json:"method,omitempty"`
+	Template     string `json:"template,omitempty"`
+	TemplateFile string `json:"template_file,omitempty"`
+	ExpectStatus []int  `json:"expect_status,omitempty"`
+	// Secret signs DingTalk and Feishu requests
+	Secret string `json:"secret,omitempty"`
+	// Email configures the "email" notifier
+	Email *EmailConfig `json:"email,omitempty"`
+	// PagerDuty configures the "pagerduty" notifier
+	PagerDuty *PagerDutyConfig `json:"pagerduty,omitempty"`
+	// Telegram configures the "telegram" notifier
+	Telegram *TelegramConfig `json:"telegram,omitempty"`
+	// Events limits the alert types sent to this channel, empty sends all. A pagerduty notifier also
+	// receives the recovery types of the listed types, so its incidents resolve.
+	Events []string `json:"events,omitempty"`
+}
+
+// ProgramConfig holds the settings of one monitored program
+type ProgramConfig struct {
+	Sampling *SamplingPolicy `json:"sampling,omitempty"`
+	// ParseErrors overrides the -parse-error-* flags for this program
+	ParseErrors *ParseErrorPolicy `json:"parse_errors,omitempty"`
+	// Silence overrides -silence-after and sets the quiet hours of this program
+	Silence *SilencePolicy `json:"silence,omitempty"`
+	// Bots is "keep" (default) to store bot requests flagged is_bot, "exclude" to also leave them out of
+	// metrics and aggregations, or "drop" to discard them
+	Bots string `json:"bots,omitempty"`
+	// Anonymize overrides -anonymize-ip for this program
+	Anonymize *AnonymizePolicy `json:"anonymize,omitempty"`
+	// Version stores the deployed version of the program in app_version, read when it is tailed
+	Version *VersionSource `json:"version,omitempty"`
+	// Fields are the positions of the optional fields the program's format logs
+	Fields *OptionalFields `json:"fields,omitempty"`
+}
+
+// Duration is a time.Duration written as a string such as "2s" in the config file
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads the config file, an empty path returns an empty config
+func LoadConfig(filePath string) (*Config, error) {
+	config := &Config{}
+	if filePath == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filePath, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", filePath, err)
+	}
+	return config, nil
+}
+
+// Validate checks the values of the config, including that notifier templates parse
+func (c *Config) Validate() error {
+	if err := c.AddNotifiers(&Dispatcher{}); err != nil {
+		return err
+	}
+	if err := ValidateLabels(c.Labels); err != nil {
+		return err
+	}
+	if c.Scrub != nil {
+		if _, err := NewScrubber(*c.Scrub); err != nil {
+			return err
+		}
+	}
+	if _, err := NewRedactor(c.Redact); err != nil {
+		return err
+	}
+	for name, program := range c.Programs {
+		if p := program.Sampling; p != nil {
+			if p.SuccessRate < 0 || p.SuccessRate > 1 {
+				return fmt.Errorf("program %s: sampling success_rate must be in (0,1]", name)
+			}
+			if p.SampleRate < 0 || p.SampleRate > 1 {
+				return fmt.Errorf("program %s: sampling sample_rate must be in (0,1]", name)
+			}
+		}
+		if p := program.ParseErrors; p != nil {
+			if p.Threshold < 0 || p.Threshold > 1 {
+				return fmt.Errorf("program %s: parse_errors threshold must be in [0,1]", name)
+			}
+			if p.Window < 0 || p.For < 0 || p.MinLines < 0 {
+				return fmt.Errorf("program %s: parse_errors window, for and min_lines must not be negative", name)
+			}
+		}
+		switch program.Bots {
+		case "", "keep", "exclude", "drop":
+		default:
+			return fmt.Errorf("program %s: unknown bots policy %q, expected keep, exclude or drop", name, program.Bots)
+		}
+		if p := program.Anonymize; p != nil {
+			if _, err := NewAnonymizer(*p); err != nil {
+				return fmt.Errorf("program %s: %w", name, err)
+			}
+		}
+		if p := program.Version; p != nil {
+			if err := p.Validate(); err != nil {
+				return fmt.Errorf("program %s: %w", name, err)
+			}
+		}
+		if p := program.Fields; p != nil && (p.Protocol < 0 || p.TLSVersion < 0) {
+			return fmt.Errorf("program %s: fields positions must not be negative", name)
+		}
+		if p := program.Silence; p != nil {
+			if p.After < 0 {
+				return fmt.Errorf("program %s: silence after must not be negative", name)
+			}
+			if _, err := parseQuietHours(p.QuietHours); err != nil {
+				return fmt.Errorf("program %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// AddNotifiers registers the configured notifiers in d
+func (c *Config) AddNotifiers(d *Dispatcher) error {
+	for i, n := range c.Notifiers {
+		name := fmt.Sprintf("%s#%d", n.Type, i)
+		switch n.Type {
+		case "webhook":
+			headers := make(http.Header)
+			for k, v := range n.Headers {
+				if !ValidHeaderName(k) {
+					return fmt.Errorf("%s: invalid header name %q", name, k)
+				}
+				headers.Set(k, v)
+			}
+			webhook := NewWebhookAlerter(n.URL, headers)
+			webhook.Method = n.Method
+			webhook.ExpectStatus = n.ExpectStatus
+			source := n.Template
+			if n.TemplateFile != "" {
+				if source != "" {
+					return fmt.Errorf("%s: template and template_file are exclusive", name)
+				}
+				data, err := os.ReadFile(n.TemplateFile)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				source = string(data)
+			}
+			if source != "" {
+				if err := webhook.SetTemplate(source); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+			d.Add(name, webhook, n.Events)
+		case "slack":
+			d.Add(name, NewSlackNotifier(n.URL), n.Events)
+		case "dingtalk":
+			d.Add(name, NewDingTalkNotifier(n.URL, n.Secret), n.Events)
+		case "feishu":
+			d.Add(name, NewFeishuNotifier(n.URL, n.Secret), n.Events)
+		case "email":
+			if n.Email == nil {
+				return fmt.Errorf("%s: missing email settings", name)
+			}
+			notifier, err := NewEmailNotifier(*n.Email)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			d.Add(name, notifier, n.Events)
+		case "pagerduty":
+			if n.PagerDuty == nil {
+				return fmt.Errorf("%s: missing pagerduty settings", name)
+			}
+			notifier, err := NewPagerDutyNotifier(*n.PagerDuty)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			d.Add(name, notifier, pagerDutyEvents(n.Events))
+		case "telegram":
+			if n.Telegram == nil {
+				return fmt.Errorf("%s: missing telegram settings", name)
+			}
+			notifier, err := NewTelegramNotifier(name, *n.Telegram)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			d.Add(name, notifier, n.Events)
+		default:
+			return fmt.Errorf("%s: unknown notifier type %q", name, n.Type)
+		}
+	}
+	return nil
+}
+
+// Program returns the settings of a program, the zero value if it is not configured
+func (c *Config) Program(name string) ProgramConfig {
+	return c.Programs[name]
+}
+
+// PrintConfig writes the effective flag values and config file as JSON to w, with the passwords, tokens,
+// header values and webhook URL paths and queries masked
+func PrintConfig(w io.Writer, config *Config) error {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	if cfg, err := mysql.ParseDSN(flags["dsn"]); err == nil && cfg.Passwd != "" {
+		cfg.Passwd = "xxxxx"
+		flags["dsn"] = cfg.FormatDSN()
+	}
+	if u, err := url.Parse(flags["redis-lock-url"]); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+			flags["redis-lock-url"] = u.String()
+		}
+	}
+	if flags["ingest-token"] != "" {
+		flags["ingest-token"] = "xxxxx"
+	}
+	flags["webhook-url"] = maskURL(flags["webhook-url"])
+	flags["webhook-headers"] = maskHeaders(flags["webhook-headers"])
+
+	masked := *config
+	masked.Notifiers = make([]NotifierConfig, len(config.Notifiers))
+	for i, n := range config.Notifiers {
+		n.URL = maskURL(n.URL)
+		if n.Headers != nil {
+			headers := make(map[string]string, len(n.Headers))
+			for name := range n.Headers {
+				headers[name] = "xxxxx"
+			}
+			n.Headers = headers
+		}
+		if n.Secret != "" {
+			n.Secret = "xxxxx"
+		}
+		if n.Email != nil && n.Email.Password != "" {
+			email := *n.Email
+			email.Password = "xxxxx"
+			n.Email = &email
+		}
+		if n.PagerDuty != nil && n.PagerDuty.RoutingKey != "" {
+			pagerDuty := *n.PagerDuty
+			pagerDuty.RoutingKey = "xxxxx"
+			n.PagerDuty = &pagerDuty
+		}
+		if n.Telegram != nil && n.Telegram.BotToken != "" {
+			telegram := *n.Telegram
+			telegram.BotToken = "xxxxx"
+			n.Telegram = &telegram
+		}
+		masked.Notifiers[i] = n
+	}
+
+	masked.Programs = make(map[string]ProgramConfig, len(config.Programs))
+	for name, program := range config.Programs {
+		if program.Anonymize != nil && program.Anonymize.Key != "" {
+			anonymize := *program.Anonymize
+			anonymize.Key = "xxxxx"
+			program.Anonymize = &anonymize
+		}
+		masked.Programs[name] = program
+	}
+
+	out := struct {
+		Flags map[string]string `json:"flags"`
+		*Config
+	}{flags, &masked}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// maskURL returns the scheme and host of a webhook URL with the password, the path and the query values
+// masked, since services such as Slack, Feishu and DingTalk put the token in the path or the query
+func maskURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		if raw == "" {
+			return ""
+		}
+		return "xxxxx"
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+	}
+	if u.Path != "" && u.Path != "/" {
+		u.Path, u.RawPath = "/xxxxx", ""
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name := range query {
+			query[name] = []string{"xxxxx"}
+		}
+		u.RawQuery = query.Encode()
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
+
+// maskHeaders returns the comma-separated Key:Value headers of -webhook-headers with the values masked
+func maskHeaders(s string) string {
+	var masked []string
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(pair, ":")
+		masked = append(masked, strings.TrimSpace(name)+":xxxxx")
+	}
+	return strings.Join(masked, ",")
+}
+
+// CompressDSN returns dsn with MySQL's compressed protocol enabled, as compress=true does, so that the
+// packets between the driver and the server are zlib-compressed
+func CompressDSN(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	if err := cfg.Apply(mysql.EnableCompression(true)); err != nil {
+		return "", err
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// ValidateDSN parses dsn for driver, only "mysql" is supported, and reports a missing host, port or
+// database name, which sql.Open accepts and which would otherwise fail on first use or silently
+// connect to 127.0.0.1:3306
+func ValidateDSN(dsn, driver string) error {
+	if driver != "mysql" {
+		return fmt.Errorf("unsupported database driver %q", driver)
+	}
+	// ParseDSN 的错误已经以 "invalid DSN" 开头
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return err
+	}
+	if cfg.DBName == "" {
+		return errors.New("DSN has no database name, expected user:password@tcp(host:port)/dbname")
+	}
+
+	// ParseDSN fills in a default address, so the address is read from the DSN itself:
+	// [user[:password]@][net[(addr)]]/dbname[?params]
+	netAddr := dsn[:strings.LastIndexByte(dsn, '/')]
+	if i := strings.LastIndexByte(netAddr, '@'); i >= 0 {
+		netAddr = netAddr[i+1:]
+	}
+	addr := ""
+	if i := strings.IndexByte(netAddr, '('); i >= 0 && strings.HasSuffix(netAddr, ")") {
+		addr = netAddr[i+1 : len(netAddr)-1]
+	}
+	if cfg.Net == "unix" {
+		if addr == "" {
+			return errors.New("DSN has no socket path, expected unix(/path/to/mysqld.sock)")
+		}
+		return nil
+	}
+	if addr == "" {
+		return fmt.Errorf("DSN has no host and port, expected %s(host:port)", cfg.Net)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("DSN address %q has no port, expected host:port", addr)
+	}
+	if host == "" {
+		return fmt.Errorf("DSN address %q has no host", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("DSN address %q has an invalid port", addr)
+	}
+	return nil
+}
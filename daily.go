@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dailyRollupLastSuccess is the completion time of the latest successful daily rollup, for alerting on missed days
+var dailyRollupLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "logmonitor_daily_rollup_last_success_timestamp_seconds",
+	Help: "Unix time of the last successful daily rollup.",
+})
+
+// cleanupHeldBackDays is the number of days whose raw rows were kept past retention by the latest cleanup
+var cleanupHeldBackDays = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "logmonitor_cleanup_held_back_days",
+	Help: "Days past retention whose raw rows were not deleted because their daily rollup has not completed.",
+})
+
+func init() {
+	prometheus.MustRegister(dailyRollupLastSuccess, cleanupHeldBackDays)
+}
+
+// EnsureDailyTables creates oula_logs_daily and the oula_logs_daily_runs completion log if they do not exist.
+// A completion record covers the rollups of all environments of its day.
+// GIN does not log response sizes, so bytes stays NULL until a format provides it.
+func EnsureDailyTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS oula_logs_daily (
+			day DATE NOT NULL,
+			program VARCHAR(128) NOT NULL,
+			api_path VARCHAR(255) NOT NULL,
+			count BIGINT NOT NULL,
+			error_count BIGINT NOT NULL,
+			avg_ms DOUBLE NOT NULL,
+			p95_ms DOUBLE NOT NULL,
+			max_ms DOUBLE NOT NULL,
+			bytes BIGINT NULL,
+			PRIMARY KEY (day, program, api_path)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS oula_logs_daily_runs (
+			day DATE NOT NULL,
+			endpoints INT NOT NULL,
+			completed_at DATETIME NOT NULL,
+			PRIMARY KEY (day)
+		)
+	`)
+	return err
+}
+
+// DailyRollupStatus is the outcome of the latest daily rollup, shown on /-/status
+type DailyRollupStatus struct {
+	Day         string    `json:"day,omitempty"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// DailyRollup aggregates whole days into oula_logs_daily, and the availability of each configured endpoint
+// into oula_api_availability, before retention deletes the raw rows
+type DailyRollup struct {
+	DB *sql.DB
+	// Lookback is how many past days are checked for a missing rollup on each run
+	Lookback int
+
+	mu     sync.Mutex
+	status DailyRollupStatus
+}
+
+// Status returns the outcome of the latest rollup
+func (d *DailyRollup) Status() DailyRollupStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// RunPending rolls up every finished day within the lookback that has no completion record, oldest first
+func (d *DailyRollup) RunPending(ctx context.Context) error {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	for i := d.Lookback; i >= 1; i-- {
+		day := today.AddDate(0, 0, -i)
+		done, err := d.completed(ctx, day)
+		if err != nil {
+			return err
+		}
+		if done {
+			continue
+		}
+		if err := d.Rollup(ctx, day); err != nil {
+			d.setStatus(DailyRollupStatus{Day: day.Format("2006-01-02"), Error: err.Error()})
+			return err
+		}
+	}
+	return nil
+}
+
+// completed reports whether day has a completion record
+func (d *DailyRollup) completed(ctx context.Context, day time.Time) (bool, error) {
+	var n int
+	err := d.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM oula_logs_daily_runs WHERE day = ?`, day.Format("2006-01-02")).Scan(&n)
+	return n > 0, err
+}
+
+// Rollup aggregates each environment of day into oula_logs_daily and oula_api_availability, replacing any
+// rows of an earlier run, and records its completion
+func (d *DailyRollup) Rollup(ctx context.Context, day time.Time) error {
+	from, to := day, day.AddDate(0, 0, 1)
+	envs, err := LoadEnvs(ctx, d.DB, from, to)
+	if err != nil {
+		return err
+	}
+	byEnv := make(map[string]map[endpointKey]*EndpointStats, len(envs))
+	endpoints := 0
+	for _, env := range envs {
+		stats, err := LoadStats(ctx, d.DB, env, from, to)
+		if err != nil {
+			return err
+		}
+		byEnv[env] = stats
+		endpoints += len(stats)
+	}
+
+	dayStr := day.Format("2006-01-02")
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM oula_logs_daily WHERE day = ?`, dayStr); err != nil {
+		tx.Rollback()
+		return err
+	}
+	query := `
+		INSERT INTO oula_logs_daily (day, env, program, api_path, count, error_count, avg_ms, p95_ms, max_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	for env, stats := range byEnv {
+		for _, s := range stats {
+			var avg float64
+			if s.Latency.Total > 0 {
+				avg = s.SumDuration / float64(s.Latency.Total)
+			}
+			_, err := tx.ExecContext(ctx, query, dayStr, env, s.Program, s.APIPath, s.Count, s.ErrorCount, avg, s.Latency.Quantile(0.95), s.MaxDuration)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	if err := rollupAvailability(ctx, tx, dayStr); err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO oula_logs_daily_runs (day, endpoints, completed_at) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE endpoints = VALUES(endpoints), completed_at = VALUES(completed_at)
+	`, dayStr, endpoints, now.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Daily rollup for %s completed: %d endpoints in %d environments", dayStr, endpoints, len(envs))
+	d.setStatus(DailyRollupStatus{Day: dayStr, CompletedAt: now})
+	dailyRollupLastSuccess.Set(float64(now.Unix()))
+	return nil
+}
+
+// CleanOldLogs deletes the raw rows of each environment of retention on the days more than its retention
+// before now, like CleanOldLogs, but only once the day is summarized: a day without a completed rollup is
+// rolled up first, whatever the lookback, and its rows are held back with a warning if that fails, as they
+// could not be summarized once deleted.
+func (d *DailyRollup) CleanOldLogs(ctx context.Context, now time.Time, retention []envRetention) error {
+	var held []string
+	for _, r := range retention {
+		envHeld, err := d.cleanOldLogs(ctx, r.Env, now, r.Days)
+		if err != nil {
+			return err
+		}
+		held = append(held, envHeld...)
+	}
+	cleanupHeldBackDays.Set(float64(len(held)))
+	if len(held) > 0 {
+		log.Printf("Warning: raw rows of %d days were held back until they are rolled up: %s (use -force to delete them anyway)", len(held), strings.Join(held, ", "))
+	}
+	return nil
+}
+
+// cleanOldLogs deletes the raw rows of env past retentionDays and returns the days held back, as "<day> (<env>)"
+func (d *DailyRollup) cleanOldLogs(ctx context.Context, env string, now time.Time, retentionDays int) ([]string, error) {
+	cutoff := RetentionCutoff(now, retentionDays)
+	rows, err := d.DB.QueryContext(ctx, `SELECT DISTINCT DATE_FORMAT(date, '%Y-%m-%d') FROM oula_logs_record WHERE env = ? AND date < ? ORDER BY 1`, env, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Cleaning old logs of %s older than %d days", env, retentionDays)
+	var held []string
+	for _, dayStr := range days {
+		ready, err := d.readyToDelete(ctx, dayStr)
+		if err != nil {
+			return nil, err
+		}
+		if !ready {
+			held = append(held, dayStr+" ("+env+")")
+			continue
+		}
+		if _, err := d.DB.ExecContext(ctx, `DELETE FROM oula_logs_record WHERE env = ? AND date = ?`, env, dayStr); err != nil {
+			return nil, err
+		}
+	}
+	return held, nil
+}
+
+// readyToDelete reports whether the raw rows of a YYYY-MM-DD day may be deleted, running its rollup
+// first if it is missing. It returns false if the rollup fails, so the day is held back.
+func (d *DailyRollup) readyToDelete(ctx context.Context, dayStr string) (bool, error) {
+	day, err := time.ParseInLocation("2006-01-02", dayStr, time.Local)
+	if err != nil {
+		return false, err
+	}
+	done, err := d.completed(ctx, day)
+	if err != nil || done {
+		return done, err
+	}
+	log.Printf("Daily rollup of %s is missing, running it before deleting its raw rows", dayStr)
+	if err := d.Rollup(ctx, day); err != nil {
+		log.Printf("Warning: keeping the raw rows of %s, its daily rollup failed: %v", dayStr, err)
+		d.setStatus(DailyRollupStatus{Day: dayStr, Error: err.Error()})
+		return false, nil
+	}
+	return true, nil
+}
+
+func (d *DailyRollup) setStatus(status DailyRollupStatus) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = status
+}
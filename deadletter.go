@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// entryRecord is the JSON form of an entry, as printed by -dry-run and stored in dead-letter files
+type entryRecord struct {
+	Env           string  `json:"env,omitempty"`
+	Server        string  `json:"server"`
+	Program       string  `json:"program"`
+	Date          string  `json:"date"`
+	Time          string  `json:"time"`
+	StatusCode    string  `json:"status_code"`
+	DurationMS    int64   `json:"duration_ms"`
+	IP            string  `json:"ip"`
+	Method        string  `json:"method"`
+	APIPath       string  `json:"api_path"`
+	IsSlow        bool    `json:"is_slow"`
+	SampledWeight float64 `json:"sampled_weight"`
+	SampleRate    float64 `json:"sample_rate,omitempty"`
+	Country       string  `json:"country"`
+	ASN           uint32  `json:"asn"`
+	IsBot         bool    `json:"is_bot"`
+	QueryParams   string  `json:"query_params,omitempty"`
+	AppVersion    string  `json:"app_version,omitempty"`
+	Protocol      string  `json:"protocol,omitempty"`
+	TLSVersion    string  `json:"tls_version,omitempty"`
+	RawPath       string  `json:"raw_path,omitempty"`
+	// Labels is the JSON object of the static labels
+	Labels json.RawMessage `json:"labels,omitempty"`
+}
+
+// newEntryRecord returns the record of an entry
+func newEntryRecord(entry *LogEntry) entryRecord {
+	return entryRecord{
+		Env: entry.Env, Server: entry.Server, Program: entry.Program, Date: entry.Date, Time: entry.Time,
+		StatusCode: entry.StatusCode, DurationMS: entry.Duration.Milliseconds(), IP: entry.IP,
+		Method: entry.Method, APIPath: entry.APIPath, IsSlow: entry.IsSlow,
+		SampledWeight: entry.SampledWeight, SampleRate: entry.SampleRate, Country: entry.Country, ASN: entry.ASN, IsBot: entry.IsBot,
+		QueryParams: entry.QueryParams, AppVersion: entry.AppVersion, Labels: json.RawMessage(entry.Labels),
+		Protocol: entry.Protocol, TLSVersion: entry.TLSVersion, RawPath: StoredRawPath(entry),
+	}
+}
+
+// LogEntry returns the entry of a record, in DefaultEnv if the record was written before -env, and with
+// its API path as raw path if it was written before raw_path
+func (r entryRecord) LogEntry() *LogEntry {
+	env := r.Env
+	if env == "" {
+		env = DefaultEnv
+	}
+	rawPath := r.RawPath
+	if rawPath == "" {
+		rawPath = r.APIPath
+	}
+	return &LogEntry{
+		Env: env, Server: r.Server, Program: r.Program, Date: r.Date, Time: r.Time,
+		StatusCode: r.StatusCode, Duration: time.Duration(r.DurationMS) * time.Millisecond, IP: r.IP,
+		Method: r.Method, APIPath: r.APIPath, RawPath: rawPath, IsSlow: r.IsSlow,
+		SampledWeight: r.SampledWeight, SampleRate: r.SampleRate, Country: r.Country, ASN: r.ASN, IsBot: r.IsBot,
+		QueryParams: r.QueryParams, AppVersion: r.AppVersion, Labels: string(r.Labels),
+		Protocol: r.Protocol, TLSVersion: r.TLSVersion,
+	}
+}
+
+// TimestampedDeadLetter keeps batches that could not be inserted as <dir>/<program>-<epoch_ns>.ndjson files,
+// one entry per line, for the replay subcommand. Each batch is written to a temporary file in the same
+// directory and renamed into place, so a process killed mid-write never leaves a partial dead-letter file.
+type TimestampedDeadLetter struct {
+	Dir string
+}
+
+// Write stores a batch and returns the path of its file
+func (d *TimestampedDeadLetter) Write(program string, entries []*LogEntry) (string, error) {
+	// 程序名中的路径分隔符会改变文件位置
+	name := strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(program)
+	path := filepath.Join(d.Dir, fmt.Sprintf("%s-%d.ndjson", name, time.Now().UnixNano()))
+	err := writeFileAtomic(path, "."+name+"-*.tmp", func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := enc.Encode(newEntryRecord(entry)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// writeFileAtomic writes a file at path through a temporary file of the same directory, named after
+// pattern, that is synced and renamed into place, so a process killed mid-write never leaves a partial file
+func writeFileAtomic(path, pattern string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// ListDeadLetters returns the dead-letter files in dir, oldest first for each program
+func ListDeadLetters(dir string) ([]string, error) {
+	return filepath.Glob(filepath.Join(dir, "*-*.ndjson"))
+}
+
+// ReadDeadLetter reads the entries of a dead-letter file
+func ReadDeadLetter(path string) ([]*LogEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*LogEntry
+	err = ScanRecords(file, func(entry *LogEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// ScanRecords calls fn with the entry of each record of r, in the NDJSON form of dead-letter files, the
+// file backend and -dry-run json output, until fn returns an error
+func ScanRecords(r io.Reader, fn func(*LogEntry) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var record entryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(record.LogEntry()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// runReplay implements the replay subcommand, which inserts the dead-letter files of a directory and
+// deletes each file once its entries are stored:
+//
+//	log-monitor replay -dsn ... -dir /var/lib/log-monitor/dead-letter [-insert-type insert-ignore]
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	dsn := fs.String("dsn", "", "Data Source Name for MySQL")
+	dir := fs.String("dir", "", "Dead-letter directory")
+	maxPacket := fs.Int("db-max-packet", defaultMaxPacketBytes, "Maximum size in bytes of a multi-value INSERT")
+	insertType := fs.String("insert-type", "insert", "Statement used to store the entries: insert, insert-ignore or replace, see log-monitor -help")
+	fs.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	if err := ValidateInsertType(*insertType); err != nil {
+		return err
+	}
+
+	files, err := ListDeadLetters(*dir)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("mysql", *dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// 截断超长的值，否则整批再次失败
+	limits, err := LoadColumnLimits(context.Background(), db)
+	if err != nil {
+		log.Printf("Error reading the column sizes of oula_logs_record, using the default sizes: %v", err)
+	}
+	for _, path := range files {
+		entries, err := ReadDeadLetter(path)
+		if err != nil {
+			return err
+		}
+		if originals := TruncateEntries(entries, limits); len(originals) > 0 {
+			log.Printf("Truncated values of %d entries from %s", len(originals), path)
+		}
+		if err := InsertLogEntry(context.Background(), db, entries, *maxPacket, *insertType); err != nil {
+			return fmt.Errorf("replaying %s: %w", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		log.Printf("Replayed %d entries from %s", len(entries), path)
+	}
+	log.Printf("Replayed %d dead-letter files", len(files))
+	return nil
+}
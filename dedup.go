@@ -0,0 +1,179 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ingestDuplicateBatches counts the forwarded batches a collector skipped because it already had them
+var ingestDuplicateBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_ingest_duplicate_batches_total",
+	Help: "Forwarded batches acknowledged without being stored again, per agent.",
+}, []string{"agent"})
+
+// ingestLateBatches counts the batches older than the deduplication window, whose duplicates can no longer be recognized
+var ingestLateBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_ingest_late_batches_total",
+	Help: "Forwarded batches created longer ago than -dedup-window, per agent.",
+}, []string{"agent"})
+
+func init() {
+	prometheus.MustRegister(ingestDuplicateBatches, ingestLateBatches)
+}
+
+// EnsureIngestBatchesTable creates the oula_ingest_batches table if it does not exist
+func EnsureIngestBatchesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS oula_ingest_batches (
+			server VARCHAR(64) NOT NULL,
+			batch_id VARCHAR(64) NOT NULL,
+			received_at DATETIME NOT NULL,
+			PRIMARY KEY (server, batch_id),
+			KEY idx_received_at (received_at)
+		)
+	`)
+	return err
+}
+
+// batchKey identifies a batch of an agent
+type batchKey struct {
+	Env    string
+	Server string
+	ID     string
+}
+
+// seenBatch is an element of the deduplication LRU
+type seenBatch struct {
+	Key  batchKey
+	Seen time.Time
+}
+
+// BatchDeduplicator remembers the batches a collector received over Window, so that a batch an agent
+// sends again, because a response was lost or its spool is draining, is acknowledged without being
+// stored twice. IDs are kept in an LRU bounded by MaxBatches. With a DB, they are also recorded in
+// oula_ingest_batches, so duplicates are recognized after a restart of the collector or by another
+// collector sharing the database.
+type BatchDeduplicator struct {
+	Window     time.Duration
+	MaxBatches int
+	DB         *sql.DB
+
+	mu      sync.Mutex
+	batches map[batchKey]*list.Element
+	lru     *list.List
+}
+
+// NewBatchDeduplicator creates a deduplicator, db may be nil to keep the IDs in memory only
+func NewBatchDeduplicator(window time.Duration, maxBatches int, db *sql.DB) *BatchDeduplicator {
+	return &BatchDeduplicator{Window: window, MaxBatches: maxBatches, DB: db, batches: make(map[batchKey]*list.Element), lru: list.New()}
+}
+
+// Claim records a batch before it is stored and reports false if it was already received. Batches
+// without an ID are always stored. A nil deduplicator claims every batch.
+func (d *BatchDeduplicator) Claim(ctx context.Context, env, server, id string, created time.Time) (bool, error) {
+	if d == nil || id == "" {
+		return true, nil
+	}
+	now := time.Now()
+	if !created.IsZero() && now.Sub(created) > d.Window {
+		// 超出窗口的批次可能已被遗忘，无法保证不重复写入
+		log.Printf("Warning: batch %s from %s was created %s ago, longer than -dedup-window %s", id, server, now.Sub(created).Truncate(time.Second), d.Window)
+		ingestLateBatches.WithLabelValues(server).Inc()
+	}
+	key := batchKey{Env: env, Server: server, ID: id}
+
+	d.mu.Lock()
+	d.expire(now)
+	if e, ok := d.batches[key]; ok {
+		e.Value.(*seenBatch).Seen = now
+		d.lru.MoveToFront(e)
+		d.mu.Unlock()
+		ingestDuplicateBatches.WithLabelValues(server).Inc()
+		return false, nil
+	}
+	d.batches[key] = d.lru.PushFront(&seenBatch{Key: key, Seen: now})
+	for d.MaxBatches > 0 && d.lru.Len() > d.MaxBatches {
+		d.evict(d.lru.Back())
+	}
+	d.mu.Unlock()
+
+	if d.DB == nil {
+		return true, nil
+	}
+	result, err := d.DB.ExecContext(ctx, `INSERT IGNORE INTO oula_ingest_batches (env, server, batch_id, received_at) VALUES (?, ?, ?, ?)`,
+		env, server, id, now.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		d.forget(key)
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// 重启前或其他 collector 已经收到
+		ingestDuplicateBatches.WithLabelValues(server).Inc()
+		return false, nil
+	}
+	return true, nil
+}
+
+// Release forgets a claimed batch that failed to be stored, so that its retry is stored
+func (d *BatchDeduplicator) Release(ctx context.Context, env, server, id string) {
+	if d == nil || id == "" {
+		return
+	}
+	d.forget(batchKey{Env: env, Server: server, ID: id})
+	if d.DB != nil {
+		if _, err := d.DB.ExecContext(ctx, `DELETE FROM oula_ingest_batches WHERE env = ? AND server = ? AND batch_id = ?`, env, server, id); err != nil {
+			log.Printf("Error releasing batch %s from %s: %v", id, server, err)
+		}
+	}
+}
+
+// forget removes a batch from the LRU
+func (d *BatchDeduplicator) forget(key batchKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.batches[key]; ok {
+		d.evict(e)
+	}
+}
+
+// expire evicts the batches last seen before the window, d.mu must be held
+func (d *BatchDeduplicator) expire(now time.Time) {
+	for e := d.lru.Back(); e != nil && now.Sub(e.Value.(*seenBatch).Seen) > d.Window; e = d.lru.Back() {
+		d.evict(e)
+	}
+}
+
+// evict removes an element of the LRU, d.mu must be held
+func (d *BatchDeduplicator) evict(e *list.Element) {
+	delete(d.batches, e.Value.(*seenBatch).Key)
+	d.lru.Remove(e)
+}
+
+// Run deletes the recorded batches older than the window every interval until ctx is done
+func (d *BatchDeduplicator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.mu.Lock()
+			d.expire(now)
+			d.mu.Unlock()
+			if d.DB == nil {
+				continue
+			}
+			cutoff := now.Add(-d.Window).Format("2006-01-02 15:04:05")
+			if _, err := d.DB.ExecContext(ctx, `DELETE FROM oula_ingest_batches WHERE received_at < ?`, cutoff); err != nil {
+				log.Printf("Error pruning received batch IDs: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+#!/bin/bash
+# 启动 log-monitor 前等待 MySQL 可以连接
+#
+# MySQL 的地址取自 MYSQL_ADDR（host:port），未设置时取自 -dsn 参数中的 tcp(host:port)。
+# WAIT_TIMEOUT 为最长等待秒数，默认 60，设为 0 不等待。
+set -euo pipefail
+
+addr="${MYSQL_ADDR:-}"
+if [ -z "$addr" ]; then
+	prev=""
+	for arg in "$@"; do
+		case "$arg" in
+		-dsn=* | --dsn=*) dsn="${arg#*=}" ;;
+		*) if [ "$prev" = "-dsn" ] || [ "$prev" = "--dsn" ]; then dsn="$arg"; fi ;;
+		esac
+		prev="$arg"
+	done
+	if [[ "${dsn:-}" =~ @tcp\(([^\)]+)\) ]]; then
+		addr="${BASH_REMATCH[1]}"
+	fi
+fi
+
+timeout="${WAIT_TIMEOUT:-60}"
+if [ -n "$addr" ] && [ "$timeout" -gt 0 ]; then
+	host="${addr%:*}"
+	port="${addr##*:}"
+	if [ "$host" = "$addr" ]; then
+		port=3306
+	fi
+	echo "Waiting up to ${timeout}s for MySQL at ${host}:${port}"
+	deadline=$((SECONDS + timeout))
+	until (exec 3<>"/dev/tcp/${host}/${port}") 2>/dev/null; do
+		if [ "$SECONDS" -ge "$deadline" ]; then
+			echo "MySQL at ${host}:${port} is not reachable after ${timeout}s" >&2
+			exit 1
+		fi
+		sleep 1
+	done
+	echo "MySQL at ${host}:${port} is reachable"
+fi
+
+exec log-monitor "$@"
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// dryRunColumns are the fields printed for each entry in table and csv format, matching the oula_logs_record columns
+var dryRunColumns = []string{"env", "server", "program", "date", "time", "status_code", "duration_ms", "ip", "method", "api_path", "is_slow", "sampled_weight", "country", "asn", "is_bot", "query_params", "app_version", "labels", "protocol", "tls_version", "raw_path", "sample_rate"}
+
+// DryRunBackend prints entries instead of storing them in json, table or csv format. json and table
+// print exactly one line per entry so the output can be counted with wc -l, csv starts with a header
+// row. The summary goes to a separate writer.
+type DryRunBackend struct {
+	Format  string
+	Out     io.Writer
+	Summary io.Writer
+
+	mu     sync.Mutex
+	csv    *csv.Writer
+	header bool
+	count  int64
+}
+
+// NewDryRunBackend creates a backend printing to out in format, which must be "json", "table" or "csv"
+func NewDryRunBackend(format string, out, summary io.Writer) (*DryRunBackend, error) {
+	switch format {
+	case "json", "table", "csv":
+	default:
+		return nil, fmt.Errorf("unknown dry-run format %q, expected json, table or csv", format)
+	}
+	return &DryRunBackend{Format: format, Out: out, Summary: summary, csv: csv.NewWriter(out)}, nil
+}
+
+// dryRunValues returns the values of dryRunColumns for an entry, for the table and csv formats
+func dryRunValues(entry *LogEntry) []string {
+	return []string{
+		entry.Env, entry.Server, entry.Program, entry.Date, entry.Time, entry.StatusCode,
+		strconv.FormatInt(entry.Duration.Milliseconds(), 10), entry.IP, entry.Method, entry.APIPath,
+		strconv.FormatBool(entry.IsSlow), strconv.FormatFloat(entry.SampledWeight, 'g', -1, 64),
+		entry.Country, strconv.FormatUint(uint64(entry.ASN), 10), strconv.FormatBool(entry.IsBot),
+		entry.QueryParams, entry.AppVersion, entry.Labels, entry.Protocol, entry.TLSVersion, StoredRawPath(entry),
+		strconv.FormatFloat(storedSampleRate(entry), 'g', -1, 64),
+	}
+}
+
+// Insert prints the entries, table columns are aligned within a batch
+func (b *DryRunBackend) Insert(entries []*LogEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.Format {
+	case "json":
+		enc := json.NewEncoder(b.Out)
+		for _, entry := range entries {
+			if err := enc.Encode(newEntryRecord(entry)); err != nil {
+				return err
+			}
+		}
+	case "table":
+		w := tabwriter.NewWriter(b.Out, 0, 0, 2, ' ', 0)
+		for _, entry := range entries {
+			values := dryRunValues(entry)
+			// 空值显示为 -，保持列对齐可读
+			for i, v := range values {
+				if v == "" {
+					values[i] = "-"
+				}
+			}
+			fmt.Fprintln(w, strings.Join(values, "\t"))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	case "csv":
+		if !b.header {
+			if err := b.csv.Write(dryRunColumns); err != nil {
+				return err
+			}
+			b.header = true
+		}
+		for _, entry := range entries {
+			if err := b.csv.Write(dryRunValues(entry)); err != nil {
+				return err
+			}
+		}
+		b.csv.Flush()
+		if err := b.csv.Error(); err != nil {
+			return err
+		}
+	}
+	b.count += int64(len(entries))
+	return nil
+}
+
+// CleanOld is a no-op
+func (b *DryRunBackend) CleanOld() error {
+	return nil
+}
+
+// IsHealthy always returns true
+func (b *DryRunBackend) IsHealthy(ctx context.Context) bool {
+	return true
+}
+
+// PrintSummary writes the number of printed entries to the summary writer
+func (b *DryRunBackend) PrintSummary() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(b.Summary, "dry run: %d entries printed\n", b.count)
+}
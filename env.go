@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultEnv is the environment of the entries stored before -env existed, and of instances that do not set it
+const DefaultEnv = "default"
+
+// envPattern matches valid environment names, which fit the VARCHAR(32) env columns
+var envPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// ValidateEnv returns an error if env is not a valid environment name
+func ValidateEnv(env string) error {
+	if !envPattern.MatchString(env) {
+		return fmt.Errorf("invalid environment %q, expected 1 to 32 letters, digits, '_', '.' or '-'", env)
+	}
+	return nil
+}
+
+// ParseEnvRetention parses the env=days list of -env-retention-days, e.g. "staging=3,production=30"
+func ParseEnvRetention(s string) (map[string]int, error) {
+	retention := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		env, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention %q, expected env=days", item)
+		}
+		env = strings.TrimSpace(env)
+		if err := ValidateEnv(env); err != nil {
+			return nil, err
+		}
+		days, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid retention of %s %q, expected a positive number of days", env, value)
+		}
+		retention[env] = days
+	}
+	return retention, nil
+}
+
+// envRetention is the retention of one environment
+type envRetention struct {
+	Env  string
+	Days int
+}
+
+// retentionByEnv returns the retention of env, retentionDays unless overrides sets it, and of every
+// environment of overrides, sorted by environment
+func retentionByEnv(env string, retentionDays int, overrides map[string]int) []envRetention {
+	days := map[string]int{env: retentionDays}
+	for e, d := range overrides {
+		days[e] = d
+	}
+	result := make([]envRetention, 0, len(days))
+	for e, d := range days {
+		result = append(result, envRetention{Env: e, Days: d})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Env < result[j].Env })
+	return result
+}
+
+// LoadEnvs returns the environments with minute rollups or raw rows in [from, to), sorted
+func LoadEnvs(ctx context.Context, db *sql.DB, from, to time.Time) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT env FROM oula_logs_minute WHERE minute >= ? AND minute < ?
+		UNION
+		SELECT env FROM oula_logs_record
+		WHERE date >= ? AND date <= ? AND TIMESTAMP(date, time) >= ? AND TIMESTAMP(date, time) < ?
+		ORDER BY 1
+	`, from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"),
+		from.Format("2006-01-02"), to.Format("2006-01-02"), from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var envs []string
+	for rows.Next() {
+		var env string
+		if err := rows.Scan(&env); err != nil {
+			return nil, err
+		}
+		envs = append(envs, env)
+	}
+	return envs, rows.Err()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// endpointKey identifies an endpoint of a program
+type endpointKey struct {
+	Program string
+	APIPath string
+}
+
+// endpointWindow holds the counts of an endpoint in the current window and its alert state
+type endpointWindow struct {
+	Total    int64
+	Errors   int64
+	Sample   string
+	Breaches int
+	Firing   bool
+	LastSent time.Time
+}
+
+// ErrorRateTracker computes the 5xx ratio of each endpoint per window and alerts when it stays
+// at or above the threshold for a number of consecutive windows. While an alert is firing it is
+// repeated at most once per cooldown, and a recovery alert is sent when the ratio drops back.
+type ErrorRateTracker struct {
+	Server      string
+	Threshold   float64
+	Intervals   int
+	MinRequests int64
+	Cooldown    time.Duration
+	Alerter     *Dispatcher
+
+	mu        sync.Mutex
+	endpoints map[endpointKey]*endpointWindow
+}
+
+// NewErrorRateTracker creates a tracker alerting through alerter
+func NewErrorRateTracker(server string, threshold float64, intervals int, minRequests int64, cooldown time.Duration, alerter *Dispatcher) *ErrorRateTracker {
+	if intervals < 1 {
+		intervals = 1
+	}
+	return &ErrorRateTracker{
+		Server:      server,
+		Threshold:   threshold,
+		Intervals:   intervals,
+		MinRequests: minRequests,
+		Cooldown:    cooldown,
+		Alerter:     alerter,
+		endpoints:   make(map[endpointKey]*endpointWindow),
+	}
+}
+
+// Add counts an entry in the current window, a nil tracker is a no-op
+func (t *ErrorRateTracker) Add(entry *LogEntry) {
+	if t == nil {
+		return
+	}
+	key := endpointKey{Program: entry.Program, APIPath: entry.APIPath}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.endpoints[key]
+	if !ok {
+		w = &endpointWindow{}
+		t.endpoints[key] = w
+	}
+	w.Total++
+	if StatusClass(entry.StatusCode) == "5xx" {
+		w.Errors++
+		w.Sample = entry.Line
+	}
+}
+
+// Run closes a window every interval until ctx is done
+func (t *ErrorRateTracker) Run(ctx context.Context, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, alert := range t.evaluate(now, window) {
+				t.Alerter.Notify(alert)
+			}
+		}
+	}
+}
+
+// evaluate closes the current window and returns the alerts to send
+func (t *ErrorRateTracker) evaluate(now time.Time, window time.Duration) []*Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var alerts []*Alert
+	for key, w := range t.endpoints {
+		var rate float64
+		if w.Total > 0 {
+			rate = float64(w.Errors) / float64(w.Total)
+		}
+
+		if w.Total >= t.MinRequests && rate >= t.Threshold {
+			w.Breaches++
+		} else {
+			w.Breaches = 0
+		}
+
+		alert := &Alert{
+			Server:    t.Server,
+			Program:   key.Program,
+			Endpoint:  key.APIPath,
+			Value:     rate,
+			Threshold: t.Threshold,
+			Window:    window.String(),
+			Time:      now,
+		}
+		switch {
+		case w.Breaches >= t.Intervals && (!w.Firing || now.Sub(w.LastSent) >= t.Cooldown):
+			alert.Type = "error_rate_high"
+			alert.Message = fmt.Sprintf("5xx rate of %s is %.1f%% (%d/%d) over %s", key.APIPath, rate*100, w.Errors, w.Total, window)
+			alert.Sample = w.Sample
+			alerts = append(alerts, alert)
+			w.Firing = true
+			w.LastSent = now
+		case w.Firing && w.Breaches == 0:
+			alert.Type = "error_rate_recovered"
+			alert.Message = fmt.Sprintf("5xx rate of %s recovered to %.1f%% (%d/%d) over %s", key.APIPath, rate*100, w.Errors, w.Total, window)
+			alerts = append(alerts, alert)
+			w.Firing = false
+		}
+
+		// 开始新的窗口，空闲且未告警的接口直接删除
+		if w.Total == 0 && !w.Firing {
+			delete(t.endpoints, key)
+			continue
+		}
+		w.Total, w.Errors, w.Sample = 0, 0, ""
+	}
+	return alerts
+}
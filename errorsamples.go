@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnsureErrorSamplesTable creates the oula_error_samples table if it does not exist
+func EnsureErrorSamplesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS oula_error_samples (
+			id BIGINT NOT NULL AUTO_INCREMENT,
+			burst_start DATETIME NOT NULL,
+			server VARCHAR(64) NOT NULL,
+			program VARCHAR(128) NOT NULL,
+			api_path VARCHAR(255) NOT NULL,
+			status_code INT NOT NULL,
+			logged_at DATETIME NOT NULL,
+			line TEXT NOT NULL,
+			PRIMARY KEY (id),
+			KEY idx_burst (program, api_path, burst_start),
+			KEY idx_logged_at (logged_at)
+		)
+	`)
+	return err
+}
+
+// errorSample is a raw line captured during a burst
+type errorSample struct {
+	BurstStart time.Time
+	Env        string
+	Program    string
+	APIPath    string
+	StatusCode string
+	LoggedAt   time.Time
+	Line       string
+}
+
+// endpointBurst holds the 5xx count of an endpoint in the current minute and its burst state
+type endpointBurst struct {
+	Minute   time.Time
+	Errors   int
+	Start    time.Time
+	EndsAt   time.Time
+	Captured int
+	Dropped  int
+}
+
+// active reports whether the endpoint is in a burst at now
+func (b *endpointBurst) active(now time.Time) bool {
+	return !b.Start.IsZero() && now.Before(b.EndsAt)
+}
+
+// BurstSampler detects 5xx bursts, more than Threshold 5xx responses of an endpoint within a minute, and
+// stores every raw line of that endpoint into oula_error_samples while the burst lasts and for Tail after
+// the last minute above the threshold, at most MaxSamples lines per burst. It works on all matched lines,
+// whether or not they are sampled for storage. Burst start and end are logged and sent as alerts.
+type BurstSampler struct {
+	DB         *sql.DB
+	Server     string
+	Threshold  int
+	Tail       time.Duration
+	MaxSamples int
+	Retention  time.Duration
+	Alerter    *Dispatcher
+
+	mu        sync.Mutex
+	endpoints map[endpointKey]*endpointBurst
+	pending   []errorSample
+}
+
+// NewBurstSampler creates a sampler writing to db
+func NewBurstSampler(db *sql.DB, server string, threshold int, tail time.Duration, maxSamples int, retention time.Duration, alerter *Dispatcher) *BurstSampler {
+	return &BurstSampler{
+		DB:         db,
+		Server:     server,
+		Threshold:  threshold,
+		Tail:       tail,
+		MaxSamples: maxSamples,
+		Retention:  retention,
+		Alerter:    alerter,
+		endpoints:  make(map[endpointKey]*endpointBurst),
+	}
+}
+
+// Add counts an entry and captures its line if its endpoint is in a burst, a nil sampler is a no-op
+func (s *BurstSampler) Add(entry *LogEntry) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	key := endpointKey{Program: entry.Program, APIPath: entry.APIPath}
+	isError := StatusClass(entry.StatusCode) == "5xx"
+
+	s.mu.Lock()
+	b, ok := s.endpoints[key]
+	if !ok {
+		if !isError {
+			s.mu.Unlock()
+			return
+		}
+		b = &endpointBurst{}
+		s.endpoints[key] = b
+	}
+
+	var started *Alert
+	if isError {
+		minute := now.Truncate(time.Minute)
+		if !b.Minute.Equal(minute) {
+			b.Minute, b.Errors = minute, 0
+		}
+		b.Errors++
+		if b.Errors > s.Threshold {
+			if !b.active(now) {
+				*b = endpointBurst{Minute: b.Minute, Errors: b.Errors, Start: now}
+				log.Printf("5xx burst started on %s %s: %d errors this minute", key.Program, key.APIPath, b.Errors)
+				started = &Alert{
+					Type:      "error_burst",
+					Server:    s.Server,
+					Program:   key.Program,
+					Endpoint:  key.APIPath,
+					Value:     float64(b.Errors),
+					Threshold: float64(s.Threshold),
+					Window:    time.Minute.String(),
+					Sample:    entry.Line,
+					Message:   fmt.Sprintf("%s returned more than %d 5xx responses within a minute, capturing raw lines", key.APIPath, s.Threshold),
+					Time:      now,
+				}
+			}
+			b.EndsAt = b.Minute.Add(time.Minute + s.Tail)
+		}
+	}
+
+	if b.active(now) {
+		if b.Captured < s.MaxSamples {
+			// 条目会被放回对象池，复制需要的字段
+			s.pending = append(s.pending, errorSample{
+				BurstStart: b.Start,
+				Env:        strings.Clone(entry.Env),
+				Program:    strings.Clone(entry.Program),
+				APIPath:    strings.Clone(entry.APIPath),
+				StatusCode: strings.Clone(entry.StatusCode),
+				LoggedAt:   now,
+				Line:       strings.Clone(entry.Line),
+			})
+			b.Captured++
+		} else {
+			b.Dropped++
+		}
+	}
+	s.mu.Unlock()
+
+	if started != nil {
+		s.Alerter.Notify(started)
+	}
+}
+
+// Run writes the captured lines and ends finished bursts every interval, and prunes old samples
+// every hour, until ctx is done. The remaining lines are written on exit.
+func (s *BurstSampler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			s.flush(time.Now())
+			return
+		case now := <-ticker.C:
+			s.flush(now)
+			if now.Sub(lastPrune) >= time.Hour {
+				if err := s.Prune(now); err != nil {
+					log.Printf("Error pruning error samples: %v", err)
+				}
+				lastPrune = now
+			}
+		}
+	}
+}
+
+// flush writes the captured lines and sends the end alerts of finished bursts
+func (s *BurstSampler) flush(now time.Time) {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	var ended []*Alert
+	for key, b := range s.endpoints {
+		if b.active(now) {
+			continue
+		}
+		if !b.Start.IsZero() {
+			log.Printf("5xx burst ended on %s %s: captured %d lines, dropped %d", key.Program, key.APIPath, b.Captured, b.Dropped)
+			ended = append(ended, &Alert{
+				Type:     "error_burst_recovered",
+				Server:   s.Server,
+				Program:  key.Program,
+				Endpoint: key.APIPath,
+				Value:    float64(b.Captured),
+				Message:  fmt.Sprintf("5xx burst on %s ended after %s, %d raw lines captured in oula_error_samples", key.APIPath, now.Sub(b.Start).Truncate(time.Second), b.Captured),
+				Time:     now,
+			})
+		}
+		// 不在突发中的接口只保留当前分钟的计数
+		if !b.Minute.Equal(now.Truncate(time.Minute)) {
+			delete(s.endpoints, key)
+		} else {
+			*b = endpointBurst{Minute: b.Minute, Errors: b.Errors}
+		}
+	}
+	s.mu.Unlock()
+
+	if len(pending) > 0 {
+		if err := s.write(pending); err != nil {
+			log.Printf("Error writing %d error samples: %v", len(pending), err)
+		}
+	}
+	for _, alert := range ended {
+		s.Alerter.Notify(alert)
+	}
+}
+
+// write inserts the samples with one multi-value INSERT per chunk
+func (s *BurstSampler) write(samples []errorSample) error {
+	const chunk = 500
+	for start := 0; start < len(samples); start += chunk {
+		end := start + chunk
+		if end > len(samples) {
+			end = len(samples)
+		}
+		query := `INSERT INTO oula_error_samples (burst_start, env, server, program, api_path, status_code, logged_at, line) VALUES ` +
+			strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?, ?, ?, ?), ", end-start), ", ")
+		args := make([]interface{}, 0, (end-start)*8)
+		for _, sample := range samples[start:end] {
+			args = append(args, sample.BurstStart.Format("2006-01-02 15:04:05"), sample.Env, s.Server, sample.Program, sample.APIPath,
+				sample.StatusCode, sample.LoggedAt.Format("2006-01-02 15:04:05"), sample.Line)
+		}
+		if _, err := s.DB.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune deletes samples older than the retention
+func (s *BurstSampler) Prune(now time.Time) error {
+	cutoff := now.Add(-s.Retention).Format("2006-01-02 15:04:05")
+	_, err := s.DB.Exec(`DELETE FROM oula_error_samples WHERE logged_at < ?`, cutoff)
+	return err
+}
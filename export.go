@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// exportFile is an open Parquet file of a day and program
+type exportFile struct {
+	Path   string
+	tmp    *os.File
+	buf    *bufio.Writer
+	writer *ParquetWriter
+}
+
+// Exporter writes entries to Parquet files partitioned by day and program, as
+// <dir>/<YYYY-MM-DD>/<program>.parquet. Each file is written to a temporary file and renamed into place
+// when the exporter is closed, so that readers never see a partial file.
+type Exporter struct {
+	Dir          string
+	Codec        int32
+	RowGroupSize int
+	// Overwrite replaces existing files instead of failing
+	Overwrite bool
+
+	files map[string]*exportFile
+	// Skipped counts the entries without a valid date and time
+	Skipped int64
+}
+
+// Write adds an entry to the file of its day and program
+func (x *Exporter) Write(entry *LogEntry) error {
+	t, err := entryTimestamp(entry)
+	if err != nil {
+		x.Skipped++
+		return nil
+	}
+	path := filepath.Join(x.Dir, t.Format("2006-01-02"), fileBackendProgram(entry.Program)+".parquet")
+	file, ok := x.files[path]
+	if !ok {
+		if file, err = x.create(path); err != nil {
+			return err
+		}
+		if x.files == nil {
+			x.files = make(map[string]*exportFile)
+		}
+		x.files[path] = file
+	}
+	return file.writer.Write(entry)
+}
+
+// create starts the file at path
+func (x *Exporter) create(path string) (*exportFile, error) {
+	if _, err := os.Stat(path); err == nil && !x.Overwrite {
+		return nil, fmt.Errorf("%s already exists, see -overwrite", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(tmp)
+	writer, err := NewParquetWriter(buf, x.Codec, x.RowGroupSize)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &exportFile{Path: path, tmp: tmp, buf: buf, writer: writer}, nil
+}
+
+// Close finishes the files and renames them into place, and returns their paths and number of rows
+func (x *Exporter) Close() (map[string]int64, error) {
+	rows := make(map[string]int64, len(x.files))
+	var errs []error
+	for path, file := range x.files {
+		err := file.writer.Close()
+		if err == nil {
+			err = file.buf.Flush()
+		}
+		if err == nil {
+			err = file.tmp.Sync()
+		}
+		if closeErr := file.tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(file.tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(file.tmp.Name())
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		rows[path] = file.writer.NumRows()
+	}
+	x.files = nil
+	return rows, errors.Join(errs...)
+}
+
+// abort removes the files without renaming them into place
+func (x *Exporter) abort() {
+	for _, file := range x.files {
+		file.tmp.Close()
+		os.Remove(file.tmp.Name())
+	}
+	x.files = nil
+}
+
+// exportInputs returns the NDJSON files of the export arguments, the *.ndjson files of directories
+func exportInputs(args []string) ([]string, error) {
+	var inputs []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			inputs = append(inputs, arg)
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(arg, "*.ndjson"))
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, files...)
+	}
+	return inputs, nil
+}
+
+// runExport implements the export subcommand, which converts the NDJSON entries of file backend
+// directories, dead-letter files or -dry-run json output to Parquet files for offline analysis, without
+// querying MySQL:
+//
+//	log-monitor export -format parquet -out /data/export [-row-group-size 100000] [-compression gzip] /var/lib/log-monitor/files
+//
+// The files are partitioned by day and program and read as one table with e.g. DuckDB's
+// read_parquet('/data/export/*/*.parquet', union_by_name = true).
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "parquet", "Output format, only parquet is supported")
+	out := fs.String("out", "", "Directory of the exported files, written as <day>/<program>.parquet")
+	rowGroupSize := fs.Int("row-group-size", 100000, "Maximum number of rows of a row group")
+	compression := fs.String("compression", "gzip", "Compression of the pages: none or gzip")
+	overwrite := fs.Bool("overwrite", false, "Replace existing files instead of failing")
+	verify := fs.Bool("verify", false, "Read each file back after writing it and check its number of rows")
+	fs.Parse(args)
+	if *format != "parquet" {
+		return fmt.Errorf("unknown -format %q, only parquet is supported", *format)
+	}
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+	if *rowGroupSize <= 0 {
+		return fmt.Errorf("-row-group-size must be positive")
+	}
+	codec, err := ParquetCodec(*compression)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no input, expected NDJSON files or directories")
+	}
+	inputs, err := exportInputs(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	exporter := &Exporter{Dir: *out, Codec: codec, RowGroupSize: *rowGroupSize, Overwrite: *overwrite}
+	for _, input := range inputs {
+		file, err := os.Open(input)
+		if err != nil {
+			exporter.abort()
+			return err
+		}
+		err = ScanRecords(file, exporter.Write)
+		file.Close()
+		if err != nil {
+			exporter.abort()
+			return fmt.Errorf("%s: %w", input, err)
+		}
+	}
+	if exporter.Skipped > 0 {
+		log.Printf("Skipped %d entries without a valid date and time", exporter.Skipped)
+	}
+	rows, err := exporter.Close()
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(rows))
+	for path := range rows {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var total int64
+	for _, path := range paths {
+		if *verify {
+			entries, err := ReadParquet(path)
+			if err != nil {
+				return fmt.Errorf("verifying %s: %w", path, err)
+			}
+			if int64(len(entries)) != rows[path] {
+				return fmt.Errorf("verifying %s: read %d rows, wrote %d", path, len(entries), rows[path])
+			}
+		}
+		log.Printf("Exported %d entries to %s", rows[path], path)
+		total += rows[path]
+	}
+	log.Printf("Exported %d entries from %d files to %d Parquet files", total, len(inputs), len(paths))
+	return nil
+}
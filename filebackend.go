@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileBackendName matches the files of RotatingFileBackend and captures their day
+var fileBackendName = regexp.MustCompile(`^(.+)-(\d{4}-\d{2}-\d{2})\.ndjson$`)
+
+// RotatingFileBackend appends entries as NDJSON to <dir>/<program>-<YYYY-MM-DD>.ndjson, one file per
+// program and day, for environments without a database. The lines have the same form as -dry-run json
+// output and dead-letter files. When a new day's file is started, only the MaxFiles most recent files
+// of the program are kept.
+type RotatingFileBackend struct {
+	Dir           string
+	MaxFiles      int
+	RetentionDays int
+
+	mu sync.Mutex
+}
+
+// fileBackendProgram returns the program part of a file name, without path separators
+func fileBackendProgram(program string) string {
+	return strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(program)
+}
+
+// Insert appends the entries to the current file of their program
+func (b *RotatingFileBackend) Insert(entries []*LogEntry) error {
+	byProgram := make(map[string][]*LogEntry)
+	for _, entry := range entries {
+		byProgram[entry.Program] = append(byProgram[entry.Program], entry)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	day := time.Now().Format("2006-01-02")
+	for program, entries := range byProgram {
+		name := fileBackendProgram(program)
+		path := filepath.Join(b.Dir, name+"-"+day+".ndjson")
+		_, statErr := os.Stat(path)
+		if err := appendRecords(path, entries); err != nil {
+			return err
+		}
+		if os.IsNotExist(statErr) && b.MaxFiles > 0 {
+			if err := b.prune(name); err != nil {
+				log.Printf("Error removing old files of %s: %v", program, err)
+			}
+		}
+	}
+	return nil
+}
+
+// appendRecords appends the entries to the file at path, creating it if needed
+func appendRecords(path string, entries []*LogEntry) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := enc.Encode(newEntryRecord(entry)); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// files returns the files of the backend by program name, oldest first
+func (b *RotatingFileBackend) files() (map[string][]string, error) {
+	dirEntries, err := os.ReadDir(b.Dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]string)
+	for _, e := range dirEntries {
+		if m := fileBackendName.FindStringSubmatch(e.Name()); m != nil && !e.IsDir() {
+			files[m[1]] = append(files[m[1]], e.Name())
+		}
+	}
+	for _, names := range files {
+		sort.Strings(names)
+	}
+	return files, nil
+}
+
+// prune deletes the files of a program beyond the MaxFiles most recent ones
+func (b *RotatingFileBackend) prune(name string) error {
+	files, err := b.files()
+	if err != nil {
+		return err
+	}
+	names := files[name]
+	for len(names) > b.MaxFiles {
+		if err := os.Remove(filepath.Join(b.Dir, names[0])); err != nil {
+			return err
+		}
+		log.Printf("Removed old file %s", names[0])
+		names = names[1:]
+	}
+	return nil
+}
+
+// CleanOld deletes the files of days more than RetentionDays before today
+func (b *RotatingFileBackend) CleanOld() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	files, err := b.files()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().AddDate(0, 0, -b.RetentionDays).Format("2006-01-02")
+	for _, names := range files {
+		for _, name := range names {
+			if fileBackendName.FindStringSubmatch(name)[2] >= cutoff {
+				continue
+			}
+			if err := os.Remove(filepath.Join(b.Dir, name)); err != nil {
+				return err
+			}
+			log.Printf("Removed file %s past retention", name)
+		}
+	}
+	return nil
+}
+
+// IsHealthy reports whether the directory exists
+func (b *RotatingFileBackend) IsHealthy(ctx context.Context) bool {
+	info, err := os.Stat(b.Dir)
+	return err == nil && info.IsDir()
+}
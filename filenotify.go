@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// notifyRecheckInterval is how often a file followed with inotify is checked without an event, in case
+// an event was lost
+const notifyRecheckInterval = time.Minute
+
+// FileNotifier wakes the followers of -log-files files when inotify reports a change of their path. It
+// watches the directories of the files, so that the file created by a rotation is seen too, with a
+// single inotify instance shared by all followers.
+type FileNotifier struct {
+	watcher *fsnotify.Watcher
+	mu      sync.Mutex
+	// dirs counts the paths watched in each directory, wakes holds the channels of each path
+	dirs  map[string]int
+	wakes map[string]map[chan struct{}]struct{}
+}
+
+// NewFileNotifier returns a FileNotifier, or an error if inotify cannot be set up, e.g. when the
+// inotify instance limit is reached
+func NewFileNotifier() (*FileNotifier, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	n := &FileNotifier{watcher: watcher, dirs: make(map[string]int), wakes: make(map[string]map[chan struct{}]struct{})}
+	go n.run()
+	return n, nil
+}
+
+// run wakes the followers of the paths of the events until the watcher is closed. A queue overflow
+// loses events, so every follower is woken to check its file.
+func (n *FileNotifier) run() {
+	for {
+		select {
+		case event, ok := <-n.watcher.Events:
+			if !ok {
+				return
+			}
+			n.wake(filepath.Clean(event.Name))
+		case err, ok := <-n.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching -log-files, checking all files: %v", err)
+			n.mu.Lock()
+			paths := make([]string, 0, len(n.wakes))
+			for path := range n.wakes {
+				paths = append(paths, path)
+			}
+			n.mu.Unlock()
+			for _, path := range paths {
+				n.wake(path)
+			}
+		}
+	}
+}
+
+// wake wakes the followers of path, without blocking on a follower that is not waiting
+func (n *FileNotifier) wake(path string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for wake := range n.wakes[path] {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Watch returns a channel receiving a value when path changes, and a function to stop watching it. It
+// returns an error when the changes of path cannot be seen with inotify: on a network file system,
+// where inotify misses the writes of other hosts, or when the inotify watch limit is reached.
+func (n *FileNotifier) Watch(path string) (<-chan struct{}, func(), error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir := filepath.Dir(path)
+	if fs, ok := networkFileSystem(dir); ok {
+		return nil, nil, fmt.Errorf("%s is on %s, where inotify misses the writes of other hosts", dir, fs)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.dirs[dir] == 0 {
+		if err := n.watcher.Add(dir); err != nil {
+			if errors.Is(err, syscall.ENOSPC) {
+				return nil, nil, fmt.Errorf("inotify watch limit reached, see fs.inotify.max_user_watches: %w", err)
+			}
+			return nil, nil, err
+		}
+	}
+	n.dirs[dir]++
+	wake := make(chan struct{}, 1)
+	if n.wakes[path] == nil {
+		n.wakes[path] = make(map[chan struct{}]struct{})
+	}
+	n.wakes[path][wake] = struct{}{}
+
+	stop := func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.wakes[path], wake)
+		if len(n.wakes[path]) == 0 {
+			delete(n.wakes, path)
+		}
+		if n.dirs[dir]--; n.dirs[dir] == 0 {
+			delete(n.dirs, dir)
+			n.watcher.Remove(dir)
+		}
+	}
+	return wake, stop, nil
+}
+
+// Close stops watching all files
+func (n *FileNotifier) Close() error {
+	return n.watcher.Close()
+}
@@ -0,0 +1,21 @@
+package main
+
+import "syscall"
+
+// networkFileSystems are the statfs magic numbers of the network file systems, see statfs(2)
+var networkFileSystems = map[int64]string{
+	0x6969:     "NFS",
+	0x517b:     "SMB",
+	0xff534d42: "CIFS",
+	0xfe534d42: "SMB2",
+}
+
+// networkFileSystem returns the name of the network file system dir is on, if it is on one
+func networkFileSystem(dir string) (string, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return "", false
+	}
+	fs, ok := networkFileSystems[int64(st.Type)]
+	return fs, ok
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// cpuTime returns the user and system CPU time used by the process so far
+func cpuTime(t *testing.T) time.Duration {
+	t.Helper()
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		t.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// followFiles follows each of paths from its end, with notifier if not nil and by polling every
+// interval otherwise, and returns a channel receiving the path of every line read
+func followFiles(ctx context.Context, t *testing.T, paths []string, notifier *FileNotifier, interval time.Duration) (<-chan string, *sync.WaitGroup) {
+	t.Helper()
+	read := make(chan string, len(paths))
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		follower := &fileFollower{ctx: ctx, path: path, file: file, interval: interval}
+		if notifier != nil {
+			wake, stop, err := notifier.Watch(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(stop)
+			follower.wake = wake
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer follower.Close()
+			scanner := bufio.NewScanner(follower)
+			for scanner.Scan() {
+				read <- path
+			}
+		}()
+	}
+	return read, &wg
+}
+
+// TestFileFollowerIdleStress follows many idle files with inotify and by polling, comparing the checks
+// of the files and the CPU time used while they are idle, then checks that a line appended to every
+// file is read in both modes
+func TestFileFollowerIdleStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	const files, idle, interval = 300, 500 * time.Millisecond, 5 * time.Millisecond
+	dir := t.TempDir()
+	paths := make([]string, files)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("worker-%03d.log", i))
+		appendFile(t, paths[i], "")
+	}
+
+	checks := make(map[string]float64)
+	cpu := make(map[string]time.Duration)
+	for _, wakeup := range []string{"poll", "inotify"} {
+		t.Run(wakeup, func(t *testing.T) {
+			var notifier *FileNotifier
+			if wakeup == "inotify" {
+				var err error
+				if notifier, err = NewFileNotifier(); err != nil {
+					t.Skipf("inotify unavailable: %v", err)
+				}
+				defer notifier.Close()
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			read, wg := followFiles(ctx, t, paths, notifier, interval)
+
+			before, beforeCPU := testutil.ToFloat64(logFileChecks.WithLabelValues(wakeup)), cpuTime(t)
+			time.Sleep(idle)
+			checks[wakeup] = testutil.ToFloat64(logFileChecks.WithLabelValues(wakeup)) - before
+			cpu[wakeup] = cpuTime(t) - beforeCPU
+			t.Logf("%d idle files followed for %s: %.0f checks, %s of CPU", files, idle, checks[wakeup], cpu[wakeup])
+
+			start := time.Now()
+			for _, path := range paths {
+				appendFile(t, path, "line\n")
+			}
+			seen := make(map[string]bool)
+			timeout := time.After(10 * time.Second)
+			for len(seen) < files {
+				select {
+				case path := <-read:
+					seen[path] = true
+				case <-timeout:
+					t.Fatalf("read the line of %d of %d files", len(seen), files)
+				}
+			}
+			t.Logf("read a line appended to each of %d files in %s", files, time.Since(start))
+			cancel()
+			wg.Wait()
+		})
+	}
+	if _, ok := checks["inotify"]; !ok {
+		return
+	}
+	if checks["inotify"] > checks["poll"]/100 {
+		t.Errorf("%.0f checks of idle files with inotify, want at most 1%% of the %.0f checks by polling", checks["inotify"], checks["poll"])
+	}
+}
+
+// TestFileNotifierRotation checks that a follower woken by inotify handles a rotation and a truncation
+// like a polling one, with an interval long enough that only inotify can wake it in time
+func TestFileNotifierRotation(t *testing.T) {
+	notifier, err := NewFileNotifier()
+	if err != nil {
+		t.Skipf("inotify unavailable: %v", err)
+	}
+	defer notifier.Close()
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "history\n")
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, _ := file.Seek(0, io.SeekEnd)
+	wake, stop, err := notifier.Watch(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	follower := &fileFollower{ctx: ctx, path: path, file: file, offset: offset, interval: time.Hour, wake: wake}
+	lines := make(chan string, 10)
+	go func() {
+		defer follower.Close()
+		scanner := bufio.NewScanner(follower)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	appendFile(t, path, "one\n")
+	expectLines(t, lines, "one")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "two\n")
+	expectLines(t, lines, "two")
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "3\n")
+	expectLines(t, lines, "3")
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// networkFileSystem reports no network file system, the file system types are only known on Linux
+func networkFileSystem(dir string) (string, bool) {
+	return "", false
+}
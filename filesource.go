@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// logFileChecks counts the checks of -log-files files for more data by what woke the follower, to compare
+// the wakeups of the files followed with inotify and by polling
+var logFileChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_log_file_checks_total",
+	Help: "Checks of -log-files files for more data, by what woke the follower: \"inotify\" or \"poll\".",
+}, []string{"wakeup"})
+
+func init() {
+	prometheus.MustRegister(logFileChecks)
+}
+
+// defaultLogFilePoll is how often a -log-files file is checked for more data without -log-file-poll-interval
+const defaultLogFilePoll = time.Second
+
+// seekChunkSize is how many bytes SeekToLastNLines reads at a time from the end of the file
+var seekChunkSize int64 = 64 << 10
+
+// ParseLogFiles parses the program=path list of -log-files, e.g. "api=/var/log/api.log,worker=/var/log/worker.log"
+func ParseLogFiles(s string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		program, path, ok := strings.Cut(item, "=")
+		program, path = strings.TrimSpace(program), strings.TrimSpace(path)
+		if !ok || program == "" || path == "" {
+			return nil, fmt.Errorf("invalid log file %q, expected program=path", item)
+		}
+		files[program] = path
+	}
+	return files, nil
+}
+
+// SeekToLastNLines positions f at the start of its last n lines, or at its start if it has fewer. It
+// reads backwards from the end in chunks of seekChunkSize, so only the lines kept are read. A newline
+// ending the file does not start another line, and n <= 0 positions f at its end.
+func SeekToLastNLines(f *os.File, n int) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+	if n <= 0 {
+		_, err := f.Seek(end, io.SeekStart)
+		return err
+	}
+
+	buf := make([]byte, seekChunkSize)
+	pos := end
+	for pos > 0 {
+		start := max(pos-seekChunkSize, 0)
+		chunk := buf[:pos-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			// 文件末尾的换行符不算作新的一行
+			if chunk[i] != '\n' || start+int64(i) == end-1 {
+				continue
+			}
+			if n--; n == 0 {
+				_, err := f.Seek(start+int64(i)+1, io.SeekStart)
+				return err
+			}
+		}
+		pos = start
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// fileFollower reads a log file like tail -F: at the end of the file it checks the file for more data
+// when wake receives, or every interval without wake, reopening the path when the file was rotated and
+// reading it again from the start when it was truncated. Read returns io.EOF once ctx is done.
+type fileFollower struct {
+	ctx      context.Context
+	path     string
+	file     *os.File
+	offset   int64
+	interval time.Duration
+	wake     <-chan struct{}
+}
+
+func (f *fileFollower) Read(p []byte) (int, error) {
+	for {
+		n, err := f.file.Read(p)
+		f.offset += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		reopened, err := f.reopen()
+		if err != nil {
+			return 0, err
+		}
+		if reopened {
+			continue
+		}
+		if !f.wait() {
+			return 0, io.EOF
+		}
+	}
+}
+
+// reopen switches to the file now at the path if the file read was rotated, once its remaining data is
+// read, or reads it from the start if it was truncated below the offset read, and reports whether there
+// is more to read
+func (f *fileFollower) reopen() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		// 轮转后新文件还未创建，继续等待
+		return false, nil
+	}
+	current, err := f.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if current.Size() > f.offset {
+		// 先读完轮转前写入旧文件的行
+		return true, nil
+	}
+	if !os.SameFile(info, current) {
+		file, err := os.Open(f.path)
+		if err != nil {
+			return false, nil
+		}
+		log.Printf("Log file %s was rotated, reading the new file", f.path)
+		f.file.Close()
+		f.file, f.offset = file, 0
+		return true, nil
+	}
+	if info.Size() < f.offset {
+		log.Printf("Log file %s was truncated, reading it from the start", f.path)
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		f.offset = 0
+		return true, nil
+	}
+	return false, nil
+}
+
+// wait waits for the next check of the file and reports whether ctx is still running
+func (f *fileFollower) wait() bool {
+	interval := f.interval
+	if f.wake != nil {
+		interval = notifyRecheckInterval
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-f.ctx.Done():
+		return false
+	case <-f.wake:
+		logFileChecks.WithLabelValues("inotify").Inc()
+		return true
+	case <-timer.C:
+		logFileChecks.WithLabelValues("poll").Inc()
+		return true
+	}
+}
+
+func (f *fileFollower) Close() error {
+	return f.file.Close()
+}
+
+// tailFile processes the lines appended to the -log-files file of m until ctx is done, starting with its
+// last m.TailNLines lines the first time it is tailed. The file is followed with m.FileNotifier, or by
+// polling it every m.LogFilePoll where inotify cannot see its changes.
+func tailFile(ctx context.Context, m *Monitor) error {
+	log.Printf("Starting to monitor log file %s of program %s", m.LogFile, m.Program)
+	m.refreshAppVersion()
+	file, err := os.Open(m.LogFile)
+	if err != nil {
+		return err
+	}
+	if err := SeekToLastNLines(file, m.TailNLines); err != nil {
+		file.Close()
+		return fmt.Errorf("seeking to the last %d lines of %s: %w", m.TailNLines, m.LogFile, err)
+	}
+	m.TailNLines = 0
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	interval := m.LogFilePoll
+	if interval <= 0 {
+		interval = defaultLogFilePoll
+	}
+	follower := &fileFollower{ctx: ctx, path: m.LogFile, file: file, offset: offset, interval: interval}
+	defer follower.Close()
+	// inotify 不可用时退回轮询
+	if m.FileNotifier != nil {
+		wake, stop, err := m.FileNotifier.Watch(m.LogFile)
+		if err != nil {
+			log.Printf("Following log file %s by polling every %s: %v", m.LogFile, interval, err)
+		} else {
+			log.Printf("Following log file %s with inotify", m.LogFile)
+			follower.wake = wake
+			defer stop()
+		}
+	} else {
+		log.Printf("Following log file %s by polling every %s", m.LogFile, interval)
+	}
+	m.Counters.SetRunning(true, 0)
+	defer m.Counters.SetRunning(false, 0)
+	if err := processLogs(m, follower); err != nil {
+		return fmt.Errorf("reading %s: %w", m.LogFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeekToLastNLines(t *testing.T) {
+	tests := []struct {
+		name, content string
+		n             int
+		want          string
+	}{
+		{"trailing newline", "a\nb\nc\n", 2, "b\nc\n"},
+		{"trailing newline, all lines", "a\nb\nc\n", 3, "a\nb\nc\n"},
+		{"trailing newline, more lines than the file", "a\nb\nc\n", 10, "a\nb\nc\n"},
+		{"no trailing newline", "a\nb\nc", 2, "b\nc"},
+		{"no trailing newline, last line", "a\nb\nc", 1, "c"},
+		{"no trailing newline, more lines than the file", "a\nb\nc", 4, "a\nb\nc"},
+		{"single line", "only\n", 1, "only\n"},
+		{"empty lines", "a\n\n\nb\n", 3, "\n\nb\n"},
+		{"zero lines", "a\nb\n", 0, ""},
+		{"empty file", "", 5, ""},
+	}
+	for _, chunk := range []int64{1, 3, 64 << 10} {
+		seekChunkSize = chunk
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("chunk=%d/%s", chunk, tt.name), func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "app.log")
+				if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				f, err := os.Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				if err := SeekToLastNLines(f, tt.n); err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != tt.want {
+					t.Errorf("SeekToLastNLines(%q, %d) then read %q, want %q", tt.content, tt.n, got, tt.want)
+				}
+			})
+		}
+	}
+	seekChunkSize = 64 << 10
+}
+
+func TestParseLogFiles(t *testing.T) {
+	files, err := ParseLogFiles(" api=/var/log/api.log, worker = /var/log/worker.log ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files["api"] != "/var/log/api.log" || files["worker"] != "/var/log/worker.log" {
+		t.Errorf("ParseLogFiles = %v", files)
+	}
+	for _, s := range []string{"api", "api=", "=/var/log/api.log"} {
+		if _, err := ParseLogFiles(s); err == nil {
+			t.Errorf("ParseLogFiles(%q) did not fail", s)
+		}
+	}
+}
+
+// followLines reads the lines of a follower of path from its current end into a channel until ctx is done
+func followLines(ctx context.Context, t *testing.T, path string) <-chan string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower := &fileFollower{ctx: ctx, path: path, file: file, offset: offset, interval: time.Millisecond}
+	lines := make(chan string, 100)
+	go func() {
+		defer close(lines)
+		defer follower.Close()
+		scanner := bufio.NewScanner(follower)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
+// expectLines fails the test unless the next lines of lines are want
+func expectLines(t *testing.T, lines <-chan string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-lines:
+			if got != w {
+				t.Fatalf("read %q, want %q", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", w)
+		}
+	}
+}
+
+// appendFile appends s to the file at path, creating it if needed
+func appendFile(t *testing.T, path, s string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileFollowerRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "history\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	lines := followLines(ctx, t, path)
+
+	appendFile(t, path, "one\ntw")
+	appendFile(t, path, "o\n")
+	expectLines(t, lines, "one", "two")
+
+	// 轮转：重命名后创建新文件
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "three\n")
+	appendFile(t, path, "four\n")
+	expectLines(t, lines, "three", "four")
+
+	// copytruncate 方式的轮转
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	appendFile(t, path, "5\n")
+	expectLines(t, lines, "5")
+
+	cancel()
+	for line := range lines {
+		t.Errorf("read %q after the context was canceled", line)
+	}
+}
+
+func TestTailFileTailNLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+	appendFile(t, path, ginLines(5))
+	backend := &MemoryBackend{}
+	m := testMonitor(backend, 1)
+	m.LogFile, m.TailNLines, m.LogFilePoll = path, 2, time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- tailFile(ctx, m) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(backend.Entries()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, entry := range backend.Entries() {
+		paths = append(paths, entry.RawPath)
+	}
+	if got := strings.Join(paths, " "); got != "/api/v1/users/3 /api/v1/users/4" {
+		t.Errorf("stored %s, want the last 2 lines /api/v1/users/3 /api/v1/users/4", got)
+	}
+	if m.TailNLines != 0 {
+		t.Errorf("TailNLines = %d after the first tail, want 0", m.TailNLines)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// forwardedEntry is the wire form of an entry parsed by an agent. It holds the fields read from the line,
+// before scrubbing, matching and sampling, which the collector applies.
+type forwardedEntry struct {
+	Date       string  `json:"date"`
+	Time       string  `json:"time"`
+	StatusCode string  `json:"status_code"`
+	DurationMS float64 `json:"duration_ms"`
+	IP         string  `json:"ip"`
+	Method     string  `json:"method"`
+	// Path is the request path with its query string, as logged
+	Path       string `json:"path"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	Line       string `json:"line"`
+	AppVersion string `json:"app_version,omitempty"`
+	// Labels is the JSON object of the static labels of the agent
+	Labels     json.RawMessage `json:"labels,omitempty"`
+	Protocol   string          `json:"protocol,omitempty"`
+	TLSVersion string          `json:"tls_version,omitempty"`
+}
+
+// forwardedBatch is the body of POST /api/ingest, the entries of one program of one server
+type forwardedBatch struct {
+	// ID identifies the batch across retries, so the collector stores it once, CreatedAt is when the
+	// agent created it
+	ID        string    `json:"id,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	// Env is the environment of the agent, batches of agents older than -env have none
+	Env     string           `json:"env,omitempty"`
+	Server  string           `json:"server"`
+	Program string           `json:"program"`
+	Entries []forwardedEntry `json:"entries"`
+}
+
+// newForwardedEntry returns the wire form of a parsed entry
+func newForwardedEntry(entry *LogEntry) forwardedEntry {
+	return forwardedEntry{
+		Date: entry.Date, Time: entry.Time, StatusCode: entry.StatusCode,
+		DurationMS: float64(entry.Duration) / float64(time.Millisecond), IP: entry.IP, Method: entry.Method,
+		Path: entry.RawPath, UserAgent: entry.UserAgent, Line: entry.Line, AppVersion: entry.AppVersion,
+		Labels: json.RawMessage(entry.Labels), Protocol: entry.Protocol, TLSVersion: entry.TLSVersion,
+	}
+}
+
+// logEntry returns a pooled entry of a forwarded entry, as ParseLogLine would have returned it on the agent
+func (e forwardedEntry) logEntry(env, server, program string) *LogEntry {
+	entry := newLogEntry()
+	*entry = LogEntry{
+		Env: env, Server: server, Program: program, Date: e.Date, Time: e.Time, StatusCode: e.StatusCode,
+		Duration: time.Duration(e.DurationMS * float64(time.Millisecond)), IP: e.IP, Method: e.Method,
+		APIPath: e.Path, RawPath: e.Path, UserAgent: e.UserAgent, Line: e.Line, AppVersion: e.AppVersion,
+		Labels: string(e.Labels), Protocol: e.Protocol, TLSVersion: e.TLSVersion,
+	}
+	return entry
+}
+
+// ForwardingBackend posts batches of parsed entries to the /api/ingest endpoint of a collector, for agents
+// that run without database credentials. Matching, storage and retention are done by the collector.
+type ForwardingBackend struct {
+	// URL is the base URL of the collector, e.g. https://collector:8089
+	URL    string
+	Client *http.Client
+	// Token is sent as a bearer token when the collector requires one
+	Token string
+	// Spool keeps the batches that cannot be delivered until the collector is reachable again, nil
+	// returns the error so the batch goes to the dead letters
+	Spool *Spool
+	// Format is auto to send protobuf and gzip once the collector's responses list them in Accept-Post
+	// and Accept-Encoding, or json to always send uncompressed JSON
+	Format string
+
+	mu       sync.Mutex
+	protobuf bool
+	gzip     bool
+}
+
+// rejectedBatchError is the response of a collector that did not accept a batch
+type rejectedBatchError struct {
+	Status int
+	Reason string
+}
+
+func (e *rejectedBatchError) Error() string {
+	return fmt.Sprintf("collector rejected the batch with status %d: %s", e.Status, e.Reason)
+}
+
+// Permanent reports whether sending the batch again cannot succeed
+func (e *rejectedBatchError) Permanent() bool {
+	return e.Status == http.StatusBadRequest || e.Status == http.StatusRequestEntityTooLarge
+}
+
+// NewForwardingBackend creates a backend forwarding to the collector at url in format, auto or json. A nil
+// tlsConfig verifies the collector against the system roots.
+func NewForwardingBackend(url, token, format string, tlsConfig *tls.Config) (*ForwardingBackend, error) {
+	switch format {
+	case "auto", "json":
+	default:
+		return nil, fmt.Errorf("unknown forward format %q, expected auto or json", format)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &ForwardingBackend{
+		URL:    strings.TrimSuffix(url, "/"),
+		Client: &http.Client{Timeout: 30 * time.Second, Transport: transport},
+		Token:  token,
+		Format: format,
+	}, nil
+}
+
+// Insert posts the entries, one request per environment, server and program. With a spool, batches that cannot be
+// delivered are spooled, and new batches wait behind the spooled ones to keep their order.
+func (b *ForwardingBackend) Insert(entries []*LogEntry) error {
+	var batches []*forwardedBatch
+	byKey := make(map[[3]string]*forwardedBatch)
+	for _, entry := range entries {
+		key := [3]string{entry.Env, entry.Server, entry.Program}
+		batch, ok := byKey[key]
+		if !ok {
+			batch = &forwardedBatch{ID: newBatchID(), CreatedAt: time.Now(), Env: entry.Env, Server: entry.Server, Program: entry.Program}
+			byKey[key] = batch
+			batches = append(batches, batch)
+		}
+		batch.Entries = append(batch.Entries, newForwardedEntry(entry))
+	}
+	for _, batch := range batches {
+		if b.Spool.Len() > 0 {
+			if err := b.Spool.Push(batch); err != nil {
+				return fmt.Errorf("spooling batch: %w", err)
+			}
+			continue
+		}
+		err := b.post(batch)
+		var rejected *rejectedBatchError
+		if err == nil || b.Spool == nil || errors.As(err, &rejected) && rejected.Permanent() {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		log.Printf("Spooling %d entries of %s, the collector is unreachable: %v", len(batch.Entries), batch.Program, err)
+		if err := b.Spool.Push(batch); err != nil {
+			return fmt.Errorf("spooling batch: %w", err)
+		}
+	}
+	return nil
+}
+
+// post sends a batch in the negotiated format. A protobuf or compressed batch the collector cannot read is
+// sent again as plain JSON, e.g. after the collector was downgraded.
+func (b *ForwardingBackend) post(batch *forwardedBatch) error {
+	b.mu.Lock()
+	protobuf, compress := b.protobuf, b.gzip
+	b.mu.Unlock()
+	err := b.send(batch, protobuf, compress)
+	var rejected *rejectedBatchError
+	if (protobuf || compress) && errors.As(err, &rejected) &&
+		(rejected.Status == http.StatusUnsupportedMediaType || rejected.Status == http.StatusBadRequest) {
+		log.Printf("Collector cannot read the batch in %s, sending it as JSON: %v", describeFormat(protobuf, compress), err)
+		b.negotiate(http.Header{})
+		return b.send(batch, false, false)
+	}
+	return err
+}
+
+// describeFormat names a batch format for logging
+func describeFormat(protobuf, compress bool) string {
+	format := "JSON"
+	if protobuf {
+		format = "protobuf"
+	}
+	if compress {
+		format = "gzipped " + format
+	}
+	return format
+}
+
+// negotiate sets the format of the next batches from the headers of a collector's response, collectors
+// that do not send them only read JSON
+func (b *ForwardingBackend) negotiate(header http.Header) {
+	if b.Format != "auto" {
+		return
+	}
+	protobuf, compress := acceptsProtobuf(header.Get("Accept-Post")), acceptsGzip(header.Get("Accept-Encoding"))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if protobuf != b.protobuf || compress != b.gzip {
+		log.Printf("Forwarding batches to %s as %s", b.URL, describeFormat(protobuf, compress))
+	}
+	b.protobuf, b.gzip = protobuf, compress
+}
+
+// send posts a batch in a format, the error names the certificate problem when the TLS handshake fails
+// and includes the collector's reason when it rejects the batch
+func (b *ForwardingBackend) send(batch *forwardedBatch, protobuf, compress bool) error {
+	body, contentType, err := encodeBatch(batch, protobuf, compress)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, b.URL+"/api/ingest", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if b.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.Token)
+	}
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return describeTLSAlert(err)
+	}
+	defer resp.Body.Close()
+	b.negotiate(resp.Header)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &rejectedBatchError{Status: resp.StatusCode, Reason: strings.TrimSpace(string(reason))}
+	}
+	return nil
+}
+
+// CleanOld is a no-op, the collector owns retention
+func (b *ForwardingBackend) CleanOld() error {
+	return nil
+}
+
+// IsHealthy reports whether the collector is healthy
+func (b *ForwardingBackend) IsHealthy(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL+"/-/health", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		log.Printf("Error checking collector health: %v", describeTLSAlert(err))
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// Collector accepts the batches forwarded by agents on POST /api/ingest and processes them like the lines
+// of a local program: each server and program gets its own monitor, which matches, aggregates, samples and
+// stores the entries.
+type Collector struct {
+	// NewMonitor creates the monitor of a program of an agent
+	NewMonitor func(program, server string) *Monitor
+	// Token is the bearer token agents must send, empty accepts any request
+	Token string
+	// RequireClientCert only accepts requests with a client certificate verified by the status server
+	RequireClientCert bool
+	// Dedup skips the batches that were already received, nil stores every batch
+	Dedup *BatchDeduplicator
+	// Env is the environment of the batches of agents that do not send one
+	Env string
+
+	mu       sync.Mutex
+	monitors map[[2]string]*Monitor
+}
+
+// NewCollector creates a collector whose monitors are created by newMonitor
+func NewCollector(newMonitor func(program, server string) *Monitor) *Collector {
+	return &Collector{NewMonitor: newMonitor, monitors: make(map[[2]string]*Monitor)}
+}
+
+// monitor returns the monitor of program on server, creating it on its first batch
+func (c *Collector) monitor(server, program string) *Monitor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := [2]string{server, program}
+	m, ok := c.monitors[key]
+	if !ok {
+		log.Printf("Receiving logs of %s from %s", program, server)
+		m = c.NewMonitor(program, server)
+		c.monitors[key] = m
+	}
+	return m
+}
+
+// ServeHTTP handles POST /api/ingest. A batch that fails to be stored is answered with 503 so the agent
+// records the failure. Every response lists the formats it reads in Accept-Post and Accept-Encoding, so
+// agents switch from JSON to protobuf and gzip.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Accept-Post", acceptPost)
+	w.Header().Set("Accept-Encoding", "gzip")
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.RequireClientCert && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+		log.Printf("Rejected batch from %s without a client certificate", r.RemoteAddr)
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	if c.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+c.Token)) != 1 {
+		log.Printf("Rejected batch from %s with a missing or wrong token", r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	batch, status, err := decodeBatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if batch.Program == "" {
+		http.Error(w, "invalid batch: program is empty", http.StatusBadRequest)
+		return
+	}
+	if batch.Env == "" {
+		batch.Env = c.Env
+	}
+	if err := ValidateEnv(batch.Env); err != nil {
+		http.Error(w, "invalid batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 超时重试的批次可能已经写入
+	fresh, err := c.Dedup.Claim(r.Context(), batch.Env, batch.Server, batch.ID, batch.CreatedAt)
+	if err != nil {
+		log.Printf("Error recording batch %s from %s: %v", batch.ID, batch.Server, err)
+		http.Error(w, "recording batch failed", http.StatusServiceUnavailable)
+		return
+	}
+	if !fresh {
+		log.Printf("Ignoring batch %s of %s from %s, it was already received", batch.ID, batch.Program, batch.Server)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"received": len(batch.Entries), "duplicate": true})
+		return
+	}
+
+	m := c.monitor(batch.Server, batch.Program)
+	var matched []*LogEntry
+	for _, e := range batch.Entries {
+		m.Activity.Touch(m.Program)
+		m.Counters.LineRead()
+		entry := e.logEntry(batch.Env, batch.Server, batch.Program)
+		if err := entry.Validate(); err != nil {
+			log.Printf("Skipping entry of %s from %s: %v", batch.Program, batch.Server, err)
+			releaseLogEntry(entry)
+			continue
+		}
+		entry = m.matchEntry(entry)
+		if entry == nil {
+			continue
+		}
+		m.Counters.LineMatched()
+		m.Redactor.Apply(entry)
+		matched = append(matched, entry)
+	}
+	if len(matched) > 0 {
+		err := m.backend().Insert(matched)
+		releaseLogEntries(matched)
+		if err != nil {
+			c.Dedup.Release(context.Background(), batch.Env, batch.Server, batch.ID)
+			log.Printf("Error inserting %d entries of %s from %s: %v", len(matched), batch.Program, batch.Server, err)
+			http.Error(w, "insert failed", http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("Inserted %d of %d entries of %s from %s", len(matched), len(batch.Entries), batch.Program, batch.Server)
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"received": len(batch.Entries), "matched": len(matched)})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// defaultGeoIPCacheSize is the number of recent IPs whose lookup is cached when the config sets none
+const defaultGeoIPCacheSize = 10000
+
+// GeoIPConfig locates the MaxMind-format databases used to enrich client IPs
+type GeoIPConfig struct {
+	// CountryDB is a GeoLite2/GeoIP2 Country or City database
+	CountryDB string `json:"country_db,omitempty"`
+	// ASNDB is a GeoLite2/GeoIP2 ASN database
+	ASNDB string `json:"asn_db,omitempty"`
+	// CacheSize is the number of recent IPs whose lookup is cached
+	CacheSize int `json:"cache_size,omitempty"`
+}
+
+// GeoInfo is the location of a client IP, empty for unknown and private addresses
+type GeoInfo struct {
+	Country string
+	ASN     uint32
+}
+
+// geoIPCacheEntry is a cached lookup
+type geoIPCacheEntry struct {
+	IP   string
+	Info GeoInfo
+}
+
+// GeoIP resolves the country and ASN of client IPs. The databases are read into memory, so a reload
+// swaps them without disturbing lookups in progress, and the results of the most recent IPs are kept
+// in an LRU cache so lookups do not slow down parsing.
+type GeoIP struct {
+	config  GeoIPConfig
+	country atomic.Pointer[maxminddb.Reader]
+	asn     atomic.Pointer[maxminddb.Reader]
+
+	mu    sync.Mutex
+	cache map[string]*list.Element
+	order *list.List
+}
+
+// NewGeoIP opens the configured databases
+func NewGeoIP(config GeoIPConfig) (*GeoIP, error) {
+	if config.CacheSize <= 0 {
+		config.CacheSize = defaultGeoIPCacheSize
+	}
+	g := &GeoIP{config: config, cache: make(map[string]*list.Element), order: list.New()}
+	for _, db := range g.databases() {
+		reader, err := openGeoIPDatabase(db.path)
+		if err != nil {
+			return nil, err
+		}
+		db.reader.Store(reader)
+	}
+	return g, nil
+}
+
+// geoIPDatabase is a configured database and where its reader is kept
+type geoIPDatabase struct {
+	path   string
+	reader *atomic.Pointer[maxminddb.Reader]
+}
+
+// databases returns the configured databases
+func (g *GeoIP) databases() []geoIPDatabase {
+	var dbs []geoIPDatabase
+	if g.config.CountryDB != "" {
+		dbs = append(dbs, geoIPDatabase{g.config.CountryDB, &g.country})
+	}
+	if g.config.ASNDB != "" {
+		dbs = append(dbs, geoIPDatabase{g.config.ASNDB, &g.asn})
+	}
+	return dbs
+}
+
+// openGeoIPDatabase reads a database into memory
+func openGeoIPDatabase(path string) (*maxminddb.Reader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return maxminddb.FromBytes(data)
+}
+
+// Watch reloads each database when its file changes until ctx is done. A file that fails to load keeps the previous database.
+func (g *GeoIP) Watch(ctx context.Context, interval time.Duration) {
+	for _, db := range g.databases() {
+		db := db
+		go watchFile(ctx, "GeoIP database", db.path, interval, func() {
+			g.reload(db)
+		})
+	}
+}
+
+// Reload reloads every database, a nil GeoIP is a no-op
+func (g *GeoIP) Reload() {
+	if g == nil {
+		return
+	}
+	for _, db := range g.databases() {
+		g.reload(db)
+	}
+}
+
+// reload reads a database again and clears the lookup cache, keeping the previous database on error
+func (g *GeoIP) reload(db geoIPDatabase) {
+	reader, err := openGeoIPDatabase(db.path)
+	if err != nil {
+		log.Printf("Error reloading GeoIP database %s, keeping the previous one: %v", db.path, err)
+		return
+	}
+	db.reader.Store(reader)
+	g.mu.Lock()
+	g.cache = make(map[string]*list.Element)
+	g.order.Init()
+	g.mu.Unlock()
+	log.Printf("Reloaded GeoIP database %s", db.path)
+}
+
+// Lookup returns the location of ip, a nil GeoIP returns an empty location
+func (g *GeoIP) Lookup(ip string) GeoInfo {
+	if g == nil {
+		return GeoInfo{}
+	}
+
+	g.mu.Lock()
+	if e, ok := g.cache[ip]; ok {
+		g.order.MoveToFront(e)
+		info := e.Value.(*geoIPCacheEntry).Info
+		g.mu.Unlock()
+		return info
+	}
+	g.mu.Unlock()
+
+	info := g.lookup(ip)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.cache[ip]; !ok {
+		g.cache[ip] = g.order.PushFront(&geoIPCacheEntry{IP: ip, Info: info})
+		if g.order.Len() > g.config.CacheSize {
+			oldest := g.order.Back()
+			g.order.Remove(oldest)
+			delete(g.cache, oldest.Value.(*geoIPCacheEntry).IP)
+		}
+	}
+	return info
+}
+
+// lookup queries the databases, private, loopback and unparsable addresses are not looked up
+func (g *GeoIP) lookup(ip string) GeoInfo {
+	var info GeoInfo
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return info
+	}
+	addr = addr.Unmap()
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return info
+	}
+	netIP := net.IP(addr.AsSlice())
+
+	if reader := g.country.Load(); reader != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := reader.Lookup(netIP, &record); err == nil {
+			info.Country = record.Country.ISOCode
+		}
+	}
+	if reader := g.asn.Load(); reader != nil {
+		var record struct {
+			ASN uint32 `maxminddb:"autonomous_system_number"`
+		}
+		if err := reader.Lookup(netIP, &record); err == nil {
+			info.ASN = record.ASN
+		}
+	}
+	return info
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HeartbeatPath is the API path of the synthetic lines of -emit-heartbeat-log, it must be in the API list
+const HeartbeatPath = "/logmonitor/heartbeat"
+
+// heartbeatLine returns the synthetic GIN line of a heartbeat at now, in GIN's default layout
+func heartbeatLine(now time.Time, tf TimestampFormat) string {
+	return fmt.Sprintf("[GIN] %s - %s | 200 |      0s |       127.0.0.1 | GET      %q\n", now.Format(tf.Date), now.Format(tf.Time), HeartbeatPath)
+}
+
+// heartbeatKey identifies the heartbeats of a program on a server
+type heartbeatKey struct {
+	Server  string
+	Program string
+}
+
+// heartbeatState holds when a program's heartbeats started to be checked and its alert state
+type heartbeatState struct {
+	Since  time.Time
+	Firing bool
+}
+
+// HeartbeatChecker alerts when the heartbeat rows of a program stop reaching oula_logs_record, which means
+// that lines are no longer parsed, matched or inserted although the program may still be logging. A
+// program is checked once it has been watched for two intervals, and a recovery alert is sent when its
+// heartbeats are stored again.
+type HeartbeatChecker struct {
+	DB       *sql.DB
+	Server   string
+	Interval time.Duration
+	Alerter  *Dispatcher
+
+	mu       sync.Mutex
+	programs map[heartbeatKey]*heartbeatState
+}
+
+// NewHeartbeatChecker creates a checker of the heartbeats emitted every interval
+func NewHeartbeatChecker(db *sql.DB, server string, interval time.Duration, alerter *Dispatcher) *HeartbeatChecker {
+	return &HeartbeatChecker{DB: db, Server: server, Interval: interval, Alerter: alerter, programs: make(map[heartbeatKey]*heartbeatState)}
+}
+
+// Watch starts checking the heartbeats of program on server, if not already. A nil checker is a no-op.
+func (c *HeartbeatChecker) Watch(server, program string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := heartbeatKey{Server: server, Program: program}
+	if _, ok := c.programs[key]; !ok {
+		c.programs[key] = &heartbeatState{Since: time.Now()}
+	}
+}
+
+// Run checks the heartbeats every interval until ctx is done
+func (c *HeartbeatChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, alert := range c.check(ctx, now) {
+				c.Alerter.Notify(alert)
+			}
+		}
+	}
+}
+
+// check returns the missing and recovery alerts to send
+func (c *HeartbeatChecker) check(ctx context.Context, now time.Time) []*Alert {
+	c.mu.Lock()
+	var keys []heartbeatKey
+	for key, state := range c.programs {
+		if now.Sub(state.Since) >= 2*c.Interval {
+			keys = append(keys, key)
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Server != keys[j].Server {
+			return keys[i].Server < keys[j].Server
+		}
+		return keys[i].Program < keys[j].Program
+	})
+
+	var alerts []*Alert
+	for _, key := range keys {
+		last, err := c.lastHeartbeat(ctx, key, now)
+		if err != nil {
+			log.Printf("Error reading the last heartbeat of %s on %s: %v", key.Program, key.Server, err)
+			continue
+		}
+		missing := last.IsZero() || now.Sub(last) > 2*c.Interval
+
+		c.mu.Lock()
+		state := c.programs[key]
+		alert := &Alert{Server: key.Server, Program: key.Program, Endpoint: HeartbeatPath, Threshold: (2 * c.Interval).Seconds(), Time: now}
+		switch {
+		case missing && !state.Firing:
+			state.Firing = true
+			alert.Type = "heartbeat_missing"
+			if last.IsZero() {
+				alert.Message = fmt.Sprintf("No heartbeat of %s on %s was stored in the last %s", key.Program, key.Server, 2*c.Interval)
+			} else {
+				alert.Value = now.Sub(last).Seconds()
+				alert.Message = fmt.Sprintf("No heartbeat of %s on %s was stored since %s", key.Program, key.Server, last.Format("2006-01-02 15:04:05"))
+			}
+			alerts = append(alerts, alert)
+		case !missing && state.Firing:
+			state.Firing = false
+			alert.Type = "heartbeat_recovered"
+			alert.Message = fmt.Sprintf("Heartbeats of %s on %s are stored again", key.Program, key.Server)
+			alerts = append(alerts, alert)
+		}
+		c.mu.Unlock()
+	}
+	return alerts
+}
+
+// lastHeartbeat returns the time of the latest stored heartbeat of a program within the last two
+// intervals, zero if there is none
+func (c *HeartbeatChecker) lastHeartbeat(ctx context.Context, key heartbeatKey, now time.Time) (time.Time, error) {
+	from := now.Add(-2 * c.Interval)
+	var last sql.NullString
+	err := c.DB.QueryRowContext(ctx, `
+		SELECT DATE_FORMAT(MAX(TIMESTAMP(date, time)), '%Y-%m-%d %H:%i:%s')
+		FROM oula_logs_record
+		WHERE server = ? AND program = ? AND api_path = ? AND date >= ?
+	`, key.Server, key.Program, HeartbeatPath, from.Format("2006-01-02")).Scan(&last)
+	if err != nil || !last.Valid {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", last.String, time.Local)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of hash bits selecting a register, 2^12 registers give a standard error of about 1.6%
+const hllPrecision = 12
+
+const hllRegisters = 1 << hllPrecision
+
+const hllVersion = 1
+
+// HyperLogLog estimates the number of distinct values added to it in a fixed 4KB of registers.
+// Sketches are merged by taking the maximum of each register, which is idempotent, so a sketch can
+// be merged into its stored copy any number of times and sketches of several servers can be combined.
+type HyperLogLog struct {
+	Registers [hllRegisters]uint8
+}
+
+// hllHash returns a well-mixed 64-bit hash of value
+func hllHash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	// FNV 的高位分布不够均匀，再做一次 splitmix64 混合
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add records a value
+func (h *HyperLogLog) Add(value string) {
+	x := hllHash(value)
+	i := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.Registers[i] {
+		h.Registers[i] = rank
+	}
+}
+
+// Merge folds other into h
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, r := range other.Registers {
+		if r > h.Registers[i] {
+			h.Registers[i] = r
+		}
+	}
+}
+
+// Estimate returns the estimated number of distinct values
+func (h *HyperLogLog) Estimate() uint64 {
+	const m = float64(hllRegisters)
+	var sum float64
+	zeros := 0
+	for _, r := range h.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// 基数较小时用线性计数修正
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// MarshalBinary encodes the sketch as a version byte, the precision and the raw registers
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, 2+hllRegisters)
+	buf = append(buf, hllVersion, hllPrecision)
+	return append(buf, h.Registers[:]...), nil
+}
+
+// UnmarshalBinary decodes a sketch written by MarshalBinary
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 || data[0] != hllVersion {
+		return errors.New("unsupported HyperLogLog version")
+	}
+	if data[1] != hllPrecision || len(data) != 2+hllRegisters {
+		return errors.New("corrupt HyperLogLog sketch")
+	}
+	copy(h.Registers[:], data[2:])
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ignoredRequestsTotal counts the requests dropped by the IP ignore list, by program and matching range
+var ignoredRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_ignored_requests_total",
+	Help: "Requests from ignored IP ranges, such as health checkers, dropped before matching, by program and range.",
+}, []string{"program", "cidr"})
+
+func init() {
+	prometheus.MustRegister(ignoredRequestsTotal)
+}
+
+// IPIgnoreList drops the requests of internal clients such as blackbox probes and load balancer
+// health checks. Ranges are IPv4 or IPv6 CIDRs, a bare address is its own range. The IP is the client
+// IP GIN logged, which is taken from X-Forwarded-For when the service trusts its proxies, and is checked
+// before anonymization.
+type IPIgnoreList struct {
+	prefixes []netip.Prefix
+}
+
+// ParseIPIgnoreList parses the ranges, nil if there are none
+func ParseIPIgnoreList(ranges []string) (*IPIgnoreList, error) {
+	var l IPIgnoreList
+	for _, r := range ranges {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		if !strings.Contains(r, "/") {
+			addr, err := netip.ParseAddr(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ignored IP %q: %w", r, err)
+			}
+			addr = addr.Unmap()
+			l.prefixes = append(l.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignored range %q: %w", r, err)
+		}
+		l.prefixes = append(l.prefixes, prefix.Masked())
+	}
+	if len(l.prefixes) == 0 {
+		return nil, nil
+	}
+	return &l, nil
+}
+
+// Ignore reports whether the entry comes from an ignored range and counts it, a nil list ignores nothing
+func (l *IPIgnoreList) Ignore(entry *LogEntry) bool {
+	if l == nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(entry.IP)
+	if err != nil {
+		return false
+	}
+	// IPv4 映射的 IPv6 地址按 IPv4 匹配
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(addr) {
+			ignoredRequestsTotal.WithLabelValues(entry.Program, prefix.String()).Inc()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Content types of the batches posted to /api/ingest
+const (
+	jsonContentType     = "application/json"
+	protobufContentType = "application/x-protobuf"
+)
+
+// batchSchemaVersion is the newest schema_version of forward.proto this build reads and writes
+const batchSchemaVersion = 1
+
+// Field numbers of the Batch message of forward.proto
+const (
+	batchFieldSchemaVersion protowire.Number = 1
+	batchFieldID            protowire.Number = 2
+	batchFieldCreatedAt     protowire.Number = 3
+	batchFieldServer        protowire.Number = 4
+	batchFieldProgram       protowire.Number = 5
+	batchFieldEntries       protowire.Number = 6
+	batchFieldEnv           protowire.Number = 7
+)
+
+// Field numbers of the Entry message of forward.proto
+const (
+	entryFieldDate       protowire.Number = 1
+	entryFieldTime       protowire.Number = 2
+	entryFieldStatusCode protowire.Number = 3
+	entryFieldDurationMS protowire.Number = 4
+	entryFieldIP         protowire.Number = 5
+	entryFieldMethod     protowire.Number = 6
+	entryFieldPath       protowire.Number = 7
+	entryFieldUserAgent  protowire.Number = 8
+	entryFieldLine       protowire.Number = 9
+	entryFieldAppVersion protowire.Number = 10
+	entryFieldLabels     protowire.Number = 11
+	entryFieldProtocol   protowire.Number = 12
+	entryFieldTLSVersion protowire.Number = 13
+)
+
+// unsupportedSchemaError is returned when decoding a batch of a newer schema than batchSchemaVersion
+type unsupportedSchemaError struct {
+	Version uint64
+}
+
+func (e *unsupportedSchemaError) Error() string {
+	return fmt.Sprintf("batch schema version %d is newer than the supported version %d", e.Version, batchSchemaVersion)
+}
+
+// appendProtoString appends a string field, omitted when empty as in proto3
+func appendProtoString(buf []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return buf
+	}
+	buf = protowire.AppendTag(buf, num, protowire.BytesType)
+	return protowire.AppendString(buf, s)
+}
+
+// MarshalProto encodes the batch as a Batch message of forward.proto
+func (b *forwardedBatch) MarshalProto() []byte {
+	buf := protowire.AppendTag(nil, batchFieldSchemaVersion, protowire.VarintType)
+	buf = protowire.AppendVarint(buf, batchSchemaVersion)
+	buf = appendProtoString(buf, batchFieldID, b.ID)
+	if !b.CreatedAt.IsZero() {
+		buf = protowire.AppendTag(buf, batchFieldCreatedAt, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(b.CreatedAt.UnixNano()))
+	}
+	buf = appendProtoString(buf, batchFieldServer, b.Server)
+	buf = appendProtoString(buf, batchFieldProgram, b.Program)
+	buf = appendProtoString(buf, batchFieldEnv, b.Env)
+	var entry []byte
+	for i := range b.Entries {
+		entry = b.Entries[i].appendProto(entry[:0])
+		buf = protowire.AppendTag(buf, batchFieldEntries, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, entry)
+	}
+	return buf
+}
+
+// appendProto appends the entry encoded as an Entry message of forward.proto
+func (e *forwardedEntry) appendProto(buf []byte) []byte {
+	buf = appendProtoString(buf, entryFieldDate, e.Date)
+	buf = appendProtoString(buf, entryFieldTime, e.Time)
+	buf = appendProtoString(buf, entryFieldStatusCode, e.StatusCode)
+	if e.DurationMS != 0 {
+		buf = protowire.AppendTag(buf, entryFieldDurationMS, protowire.Fixed64Type)
+		buf = protowire.AppendFixed64(buf, math.Float64bits(e.DurationMS))
+	}
+	buf = appendProtoString(buf, entryFieldIP, e.IP)
+	buf = appendProtoString(buf, entryFieldMethod, e.Method)
+	buf = appendProtoString(buf, entryFieldPath, e.Path)
+	buf = appendProtoString(buf, entryFieldUserAgent, e.UserAgent)
+	buf = appendProtoString(buf, entryFieldLine, e.Line)
+	buf = appendProtoString(buf, entryFieldAppVersion, e.AppVersion)
+	buf = appendProtoString(buf, entryFieldLabels, string(e.Labels))
+	buf = appendProtoString(buf, entryFieldProtocol, e.Protocol)
+	return appendProtoString(buf, entryFieldTLSVersion, e.TLSVersion)
+}
+
+// protoFields calls field for each field of a message with the field's number, type and the data
+// starting at its value, which must return the length of the value it consumed or a negative
+// protowire error code
+func protoFields(data []byte, field func(num protowire.Number, typ protowire.Type, data []byte) int) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		n = field(num, typ, data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// consumeProtoString decodes a string value into s, or skips the value if it is not length-delimited
+func consumeProtoString(num protowire.Number, typ protowire.Type, data []byte, s *string) int {
+	if typ != protowire.BytesType {
+		return protowire.ConsumeFieldValue(num, typ, data)
+	}
+	v, n := protowire.ConsumeString(data)
+	if n >= 0 {
+		*s = v
+	}
+	return n
+}
+
+// UnmarshalProto decodes a Batch message of forward.proto, skipping unknown fields. A batch of a newer
+// schema version returns an *unsupportedSchemaError.
+func (b *forwardedBatch) UnmarshalProto(data []byte) error {
+	*b = forwardedBatch{}
+	var version uint64
+	var entryErr error
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, data []byte) int {
+		switch {
+		case num == batchFieldSchemaVersion && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			version = v
+			return n
+		case num == batchFieldID:
+			return consumeProtoString(num, typ, data, &b.ID)
+		case num == batchFieldCreatedAt && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n >= 0 && v != 0 {
+				b.CreatedAt = time.Unix(0, int64(v))
+			}
+			return n
+		case num == batchFieldServer:
+			return consumeProtoString(num, typ, data, &b.Server)
+		case num == batchFieldProgram:
+			return consumeProtoString(num, typ, data, &b.Program)
+		case num == batchFieldEnv:
+			return consumeProtoString(num, typ, data, &b.Env)
+		case num == batchFieldEntries && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return n
+			}
+			var entry forwardedEntry
+			if entryErr = entry.unmarshalProto(v); entryErr != nil {
+				return -1
+			}
+			b.Entries = append(b.Entries, entry)
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, data)
+	})
+	if entryErr != nil {
+		err = entryErr
+	}
+	if err != nil {
+		return fmt.Errorf("decoding protobuf batch: %w", err)
+	}
+	if version > batchSchemaVersion {
+		return &unsupportedSchemaError{Version: version}
+	}
+	return nil
+}
+
+// unmarshalProto decodes an Entry message of forward.proto, skipping unknown fields
+func (e *forwardedEntry) unmarshalProto(data []byte) error {
+	return protoFields(data, func(num protowire.Number, typ protowire.Type, data []byte) int {
+		switch num {
+		case entryFieldDate:
+			return consumeProtoString(num, typ, data, &e.Date)
+		case entryFieldTime:
+			return consumeProtoString(num, typ, data, &e.Time)
+		case entryFieldStatusCode:
+			return consumeProtoString(num, typ, data, &e.StatusCode)
+		case entryFieldDurationMS:
+			if typ != protowire.Fixed64Type {
+				break
+			}
+			v, n := protowire.ConsumeFixed64(data)
+			e.DurationMS = math.Float64frombits(v)
+			return n
+		case entryFieldIP:
+			return consumeProtoString(num, typ, data, &e.IP)
+		case entryFieldMethod:
+			return consumeProtoString(num, typ, data, &e.Method)
+		case entryFieldPath:
+			return consumeProtoString(num, typ, data, &e.Path)
+		case entryFieldUserAgent:
+			return consumeProtoString(num, typ, data, &e.UserAgent)
+		case entryFieldLine:
+			return consumeProtoString(num, typ, data, &e.Line)
+		case entryFieldAppVersion:
+			return consumeProtoString(num, typ, data, &e.AppVersion)
+		case entryFieldLabels:
+			var labels string
+			n := consumeProtoString(num, typ, data, &labels)
+			if labels != "" {
+				e.Labels = json.RawMessage(labels)
+			}
+			return n
+		case entryFieldProtocol:
+			return consumeProtoString(num, typ, data, &e.Protocol)
+		case entryFieldTLSVersion:
+			return consumeProtoString(num, typ, data, &e.TLSVersion)
+		}
+		return protowire.ConsumeFieldValue(num, typ, data)
+	})
+}
+
+// acceptPost lists the batch formats /api/ingest reads, sent in the Accept-Post header of its responses
+var acceptPost = fmt.Sprintf("%s; version=%d, %s", protobufContentType, batchSchemaVersion, jsonContentType)
+
+// acceptsProtobuf reports whether the Accept-Post header of a collector's response lists a protobuf schema
+// version that reads the batches of this build
+func acceptsProtobuf(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != protobufContentType {
+			continue
+		}
+		version, err := strconv.Atoi(params["version"])
+		return err == nil && version >= batchSchemaVersion
+	}
+	return false
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of a collector's response lists gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, _, _ := strings.Cut(part, ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeBatch returns the body and content type of a batch in protobuf or JSON, compressed with gzip
+// if compress is set
+func encodeBatch(batch *forwardedBatch, protobuf, compress bool) ([]byte, string, error) {
+	contentType := jsonContentType
+	var body []byte
+	if protobuf {
+		contentType = protobufContentType
+		body = batch.MarshalProto()
+	} else {
+		var err error
+		if body, err = json.Marshal(batch); err != nil {
+			return nil, "", err
+		}
+	}
+	if !compress {
+		return body, contentType, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), contentType, nil
+}
+
+// decodeBatch reads the batch of an /api/ingest request in the format of its Content-Type and
+// Content-Encoding, returning the HTTP status of the error when it cannot be read
+func decodeBatch(r *http.Request) (*forwardedBatch, int, error) {
+	body := io.Reader(r.Body)
+	switch encoding := strings.ToLower(r.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	// 旧版 agent 不设置 Content-Type 时按 JSON 处理
+	mediaType := jsonContentType
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("invalid content type %q", contentType)
+		}
+	}
+	var batch forwardedBatch
+	switch mediaType {
+	case jsonContentType:
+		if err := json.NewDecoder(body).Decode(&batch); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid batch: %w", err)
+		}
+	case protobufContentType:
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("reading batch: %w", err)
+		}
+		if err := batch.UnmarshalProto(data); err != nil {
+			var unsupported *unsupportedSchemaError
+			if errors.As(err, &unsupported) {
+				return nil, http.StatusUnsupportedMediaType, err
+			}
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid batch: %w", err)
+		}
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q, expected %s", mediaType, acceptPost)
+	}
+	return &batch, http.StatusOK, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testForwardedBatch returns a batch of n entries with every field set, the entries alternating between
+// all optional fields set and none
+func testForwardedBatch(n int) *forwardedBatch {
+	batch := &forwardedBatch{
+		ID: "web-01-1704067200000000000-7", CreatedAt: time.Unix(1704067200, 123456789),
+		Env: "production", Server: "web-01", Program: "api",
+	}
+	for i := range n {
+		entry := forwardedEntry{
+			Date: "2024/01/01", Time: fmt.Sprintf("00:%02d:%02d", i/60%60, i%60), StatusCode: "200",
+			DurationMS: 1.234 + float64(i), IP: fmt.Sprintf("10.0.%d.%d", i/256%256, i%256), Method: "GET",
+			Path: fmt.Sprintf("/api/v1/users/%d?page=2&sort=名前", i),
+			Line: fmt.Sprintf(`[GIN] 2024/01/01 - 00:00:00 | 200 |    1.234ms |   10.0.0.1 | GET      "/api/v1/users/%d"`, i),
+		}
+		if i%2 == 0 {
+			entry.UserAgent = "Mozilla/5.0 (X11; Linux x86_64)"
+			entry.AppVersion = "v1.2.3"
+			entry.Labels = []byte(`{"env":"prod","region":"ap-east-1"}`)
+			entry.Protocol = "HTTP/2.0"
+			entry.TLSVersion = "TLSv1.3"
+		}
+		batch.Entries = append(batch.Entries, entry)
+	}
+	return batch
+}
+
+func TestForwardedBatchProtoRoundTrip(t *testing.T) {
+	for _, batch := range []*forwardedBatch{testForwardedBatch(10), {Server: "web-01", Program: "api"}} {
+		var got forwardedBatch
+		if err := got.UnmarshalProto(batch.MarshalProto()); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&got, batch) {
+			t.Errorf("round trip of %+v = %+v", batch, got)
+		}
+	}
+}
+
+// TestForwardedEntryLogEntry checks that every field an agent reads from a line reaches the collector's
+// entry through both formats
+func TestForwardedEntryLogEntry(t *testing.T) {
+	want := &LogEntry{
+		Env: "production", Server: "web-01", Program: "api", Date: "2024/01/01", Time: "12:00:00",
+		StatusCode: "503", Duration: 1500 * time.Microsecond, IP: "2001:db8::1", Method: "POST",
+		APIPath: "/api/v1/users/42?page=2", RawPath: "/api/v1/users/42?page=2", Line: "[GIN] ...",
+		UserAgent: "curl/8.0", AppVersion: "v1.2.3", Labels: `{"region":"ap-east-1"}`,
+		Protocol: "HTTP/1.1", TLSVersion: "TLSv1.2",
+	}
+	for _, protobuf := range []bool{false, true} {
+		batch := &forwardedBatch{Env: want.Env, Server: want.Server, Program: want.Program,
+			Entries: []forwardedEntry{newForwardedEntry(want)}}
+		got := roundTripBatch(t, batch, protobuf, false)
+		entry := got.Entries[0].logEntry(got.Env, got.Server, got.Program)
+		if !reflect.DeepEqual(entry, want) {
+			t.Errorf("protobuf %t: entry = %+v, want %+v", protobuf, entry, want)
+		}
+	}
+}
+
+// roundTripBatch encodes batch like an agent and decodes it like the collector
+func roundTripBatch(t testing.TB, batch *forwardedBatch, protobuf, compress bool) *forwardedBatch {
+	t.Helper()
+	body, contentType, err := encodeBatch(batch, protobuf, compress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/ingest", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	if compress {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	got, status, err := decodeBatch(r)
+	if err != nil {
+		t.Fatalf("decoding %s (gzip %t): %d %v", contentType, compress, status, err)
+	}
+	return got
+}
+
+func TestEncodeDecodeBatch(t *testing.T) {
+	batch := testForwardedBatch(100)
+	for _, protobuf := range []bool{false, true} {
+		for _, compress := range []bool{false, true} {
+			got := roundTripBatch(t, batch, protobuf, compress)
+			// JSON 解码的时间带固定时区
+			if !got.CreatedAt.Equal(batch.CreatedAt) {
+				t.Errorf("protobuf %t, gzip %t: created_at = %s, want %s", protobuf, compress, got.CreatedAt, batch.CreatedAt)
+			}
+			got.CreatedAt = batch.CreatedAt
+			if !reflect.DeepEqual(got, batch) {
+				t.Errorf("protobuf %t, gzip %t: batch differs after the round trip", protobuf, compress)
+			}
+		}
+	}
+}
+
+func TestForwardedBatchProtoCompatibility(t *testing.T) {
+	data := testForwardedBatch(1).MarshalProto()
+
+	// 新版本增加的字段被跳过
+	unknown := protowire.AppendTag(append([]byte(nil), data...), 99, protowire.BytesType)
+	unknown = protowire.AppendString(unknown, "added later")
+	unknown = protowire.AppendTag(unknown, 100, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 42)
+	var got forwardedBatch
+	if err := got.UnmarshalProto(unknown); err != nil || !reflect.DeepEqual(&got, testForwardedBatch(1)) {
+		t.Errorf("batch with unknown fields = %+v, %v", got, err)
+	}
+
+	newer := protowire.AppendTag(nil, batchFieldSchemaVersion, protowire.VarintType)
+	newer = protowire.AppendVarint(newer, batchSchemaVersion+1)
+	var unsupported *unsupportedSchemaError
+	if err := got.UnmarshalProto(newer); !errors.As(err, &unsupported) {
+		t.Errorf("batch of schema version %d = %v, want an unsupported schema error", batchSchemaVersion+1, err)
+	}
+
+	if err := got.UnmarshalProto(data[:len(data)-3]); err == nil {
+		t.Error("truncated batch did not fail")
+	}
+}
+
+// BenchmarkEncodeBatch encodes batches of 100 entries in each format an agent can send, reporting the
+// bytes of a batch to compare the bandwidth of JSON and protobuf with and without gzip
+func BenchmarkEncodeBatch(b *testing.B) {
+	batch := testForwardedBatch(100)
+	for _, format := range []struct {
+		name               string
+		protobuf, compress bool
+	}{{"json", false, false}, {"json+gzip", false, true}, {"protobuf", true, false}, {"protobuf+gzip", true, true}} {
+		b.Run(format.name, func(b *testing.B) {
+			var size int
+			b.ReportAllocs()
+			for range b.N {
+				body, _, err := encodeBatch(batch, format.protobuf, format.compress)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(body)
+			}
+			b.ReportMetric(float64(size), "bytes/batch")
+			b.ReportMetric(float64(b.N*len(batch.Entries))/b.Elapsed().Seconds(), "entries/s")
+		})
+	}
+}
+
+// BenchmarkDecodeBatch decodes batches of 100 entries in each format like the collector
+func BenchmarkDecodeBatch(b *testing.B) {
+	batch := testForwardedBatch(100)
+	for _, format := range []struct {
+		name               string
+		protobuf, compress bool
+	}{{"json", false, false}, {"json+gzip", false, true}, {"protobuf", true, false}, {"protobuf+gzip", true, true}} {
+		b.Run(format.name, func(b *testing.B) {
+			body, contentType, err := encodeBatch(batch, format.protobuf, format.compress)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			for range b.N {
+				r := httptest.NewRequest(http.MethodPost, "/api/ingest", bytes.NewReader(body))
+				r.Header.Set("Content-Type", contentType)
+				if format.compress {
+					r.Header.Set("Content-Encoding", "gzip")
+				}
+				if _, _, err := decodeBatch(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*len(batch.Entries))/b.Elapsed().Seconds(), "entries/s")
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// InsertFailureTracker alerts when inserts keep failing for longer than a threshold and again when they
+// succeed. Repeated outage alerts are sent at most once per interval.
+type InsertFailureTracker struct {
+	Server   string
+	After    time.Duration
+	Interval time.Duration
+	Alerter  *Dispatcher
+
+	mu           sync.Mutex
+	failingSince time.Time
+	lastErr      error
+	failed       int64
+	alerted      bool
+	lastAlert    time.Time
+}
+
+// NewInsertFailureTracker creates a tracker alerting through alerter
+func NewInsertFailureTracker(server string, after, interval time.Duration, alerter *Dispatcher) *InsertFailureTracker {
+	return &InsertFailureTracker{Server: server, After: after, Interval: interval, Alerter: alerter}
+}
+
+// Record records the outcome of inserting n entries, a nil tracker is a no-op
+func (t *InsertFailureTracker) Record(n int, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if err != nil {
+		if t.failingSince.IsZero() {
+			t.failingSince = time.Now()
+		}
+		t.lastErr = err
+		t.failed += int64(n)
+		t.mu.Unlock()
+		return
+	}
+
+	var alert *Alert
+	if t.alerted {
+		alert = &Alert{
+			Type:    "insert_recovered",
+			Server:  t.Server,
+			Message: fmt.Sprintf("inserts are succeeding again after %s, %d entries were lost", time.Since(t.failingSince).Round(time.Second), t.failed),
+		}
+	}
+	t.failingSince = time.Time{}
+	t.lastErr = nil
+	t.failed = 0
+	t.alerted = false
+	t.mu.Unlock()
+
+	if alert != nil {
+		t.Alerter.Notify(alert)
+	}
+}
+
+// Run checks for a sustained outage every interval until ctx is done
+func (t *InsertFailureTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if alert := t.check(now); alert != nil {
+				t.Alerter.Notify(alert)
+			}
+		}
+	}
+}
+
+// check returns an outage alert if inserts have been failing for at least t.After
+func (t *InsertFailureTracker) check(now time.Time) *Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failingSince.IsZero() || now.Sub(t.failingSince) < t.After {
+		return nil
+	}
+	if t.alerted && now.Sub(t.lastAlert) < t.Interval {
+		return nil
+	}
+	t.alerted = true
+	t.lastAlert = now
+	return &Alert{
+		Type:   "insert_outage",
+		Server: t.Server,
+		Value:  float64(t.failed),
+		Message: fmt.Sprintf("inserts failing for %s (%s): %d entries not stored, last error: %v",
+			now.Sub(t.failingSince).Round(time.Second), ErrorClass(t.lastErr), t.failed, t.lastErr),
+	}
+}
+
+// ErrorClass returns a short category for a database error
+func ErrorClass(err error) string {
+	var mysqlErr *mysql.MySQLError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return "none"
+	case errors.As(err, &mysqlErr):
+		return fmt.Sprintf("mysql_%d", mysqlErr.Number)
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	default:
+		return "other"
+	}
+}
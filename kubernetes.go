@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubernetesRetryDelay is the wait before listing pods again after an API error
+const kubernetesRetryDelay = 5 * time.Second
+
+// NewKubernetesClient connects to the cluster of kubeconfig, or of $KUBECONFIG and ~/.kube/config if it
+// is empty, falling back to the in-cluster service account. It returns the namespace of the context,
+// which is the pod's own namespace in the cluster.
+func NewKubernetesClient(kubeconfig string) (kubernetes.Interface, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("loading kubeconfig: %w", err)
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", fmt.Errorf("reading namespace: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, namespace, nil
+}
+
+// KubernetesSource monitors the logs of the pods matching a label selector instead of supervisord
+// programs. Each running pod is streamed into a monitor whose Program is the pod name and Server the
+// node name. Pods are listed, then watched to follow new and deleted pods, and listed again when the
+// watch fails or ends. A pod's stream is restarted after its container restarts from where the previous
+// one stopped, pods running at startup are streamed from startup on.
+type KubernetesSource struct {
+	Client        kubernetes.Interface
+	Namespace     string
+	LabelSelector string
+	// Container is the container whose logs are read, required for pods with several containers
+	Container string
+	// NewMonitor creates the monitor of a pod
+	NewMonitor func(program, server string) *Monitor
+
+	ctx      context.Context
+	mu       sync.Mutex
+	monitors map[string]*Monitor
+	streams  map[string]context.CancelFunc
+	since    map[string]time.Time
+}
+
+// Run follows the pods until ctx is done
+func (s *KubernetesSource) Run(ctx context.Context) {
+	s.ctx = ctx
+	s.monitors = make(map[string]*Monitor)
+	s.streams = make(map[string]context.CancelFunc)
+	s.since = make(map[string]time.Time)
+	pods := s.Client.CoreV1().Pods(s.Namespace)
+	first := true
+	for ctx.Err() == nil {
+		list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: s.LabelSelector})
+		if err != nil {
+			log.Printf("Error listing pods %s in %s: %v", s.LabelSelector, s.Namespace, err)
+			sleepContext(ctx, kubernetesRetryDelay)
+			continue
+		}
+		log.Printf("Found %d pods matching %s in %s", len(list.Items), s.LabelSelector, s.Namespace)
+		for i := range list.Items {
+			pod := &list.Items[i]
+			if first {
+				// 启动时已存在的 pod 只读取新日志
+				s.mu.Lock()
+				s.since[pod.Name] = time.Now()
+				s.mu.Unlock()
+			}
+			s.sync(pod)
+		}
+		first = false
+
+		w, err := pods.Watch(ctx, metav1.ListOptions{LabelSelector: s.LabelSelector, ResourceVersion: list.ResourceVersion})
+		if err != nil {
+			log.Printf("Error watching pods %s in %s: %v", s.LabelSelector, s.Namespace, err)
+			sleepContext(ctx, kubernetesRetryDelay)
+			continue
+		}
+		s.watch(w)
+		w.Stop()
+		if ctx.Err() == nil {
+			log.Printf("Watch of pods %s ended, listing them again", s.LabelSelector)
+		}
+	}
+}
+
+// watch handles the events of w until it ends or fails
+func (s *KubernetesSource) watch(w watch.Interface) {
+	for event := range w.ResultChan() {
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			if pod, ok := event.Object.(*corev1.Pod); ok {
+				s.sync(pod)
+			}
+		case watch.Deleted:
+			if pod, ok := event.Object.(*corev1.Pod); ok {
+				s.remove(pod.Name)
+			}
+		case watch.Error:
+			log.Printf("Error watching pods %s: %v", s.LabelSelector, apierrors.FromObject(event.Object))
+			return
+		}
+	}
+}
+
+// sync starts streaming a running pod that is not streamed yet
+func (s *KubernetesSource) sync(pod *corev1.Pod) {
+	if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.streams[pod.Name]; ok {
+		return
+	}
+	m, ok := s.monitors[pod.Name]
+	if !ok {
+		m = s.NewMonitor(pod.Name, pod.Spec.NodeName)
+		s.monitors[pod.Name] = m
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.streams[pod.Name] = cancel
+	go s.stream(ctx, pod.Name, m, s.since[pod.Name])
+}
+
+// stream processes the logs of a pod from since, or from its start if since is zero, until they end.
+// The pod is then checked again after a delay, so a pod that is still running is streamed again.
+func (s *KubernetesSource) stream(ctx context.Context, name string, m *Monitor, since time.Time) {
+	log.Printf("Starting to monitor logs for pod %s on %s", name, m.Server)
+	opts := &corev1.PodLogOptions{Follow: true, Container: s.Container}
+	if !since.IsZero() {
+		sinceTime := metav1.NewTime(since)
+		opts.SinceTime = &sinceTime
+	}
+	pods := s.Client.CoreV1().Pods(s.Namespace)
+	var err error
+	withProgramLabel(ctx, m.Program, func(ctx context.Context) {
+		logs, streamErr := pods.GetLogs(name, opts).Stream(ctx)
+		if streamErr != nil {
+			err = streamErr
+			return
+		}
+		defer logs.Close()
+		m.Counters.SetRunning(true, 0)
+		defer m.Counters.SetRunning(false, 0)
+		err = processLogs(m, logs)
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Error streaming logs of pod %s: %v", name, err)
+	}
+	log.Printf("Stopped monitoring pod %s", name)
+
+	s.mu.Lock()
+	if cancel, ok := s.streams[name]; ok {
+		cancel()
+		delete(s.streams, name)
+	}
+	_, known := s.monitors[name]
+	if known {
+		// 容器重启后从上次结束的时间继续读取
+		s.since[name] = time.Now()
+	}
+	s.mu.Unlock()
+	if !known {
+		return
+	}
+
+	sleepContext(s.ctx, kubernetesRetryDelay)
+	if s.ctx.Err() != nil {
+		return
+	}
+	pod, err := pods.Get(s.ctx, name, metav1.GetOptions{})
+	if err == nil {
+		s.sync(pod)
+	}
+}
+
+// remove stops streaming a deleted pod and forgets it
+func (s *KubernetesSource) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel, ok := s.streams[name]; ok {
+		cancel()
+		delete(s.streams, name)
+	}
+	delete(s.monitors, name)
+	delete(s.since, name)
+	programMetrics.Remove(name)
+	log.Printf("Pod %s was deleted", name)
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
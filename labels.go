@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// labelNamePattern is the syntax of Prometheus label names, which static labels must follow
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidateLabels checks that static label names are valid Prometheus label names
+func ValidateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+// EncodeLabels returns the static labels as the JSON object stored in the labels column, "" if there are none
+func EncodeLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(labels)
+	return string(b)
+}
+
+// LabeledGatherer adds static labels, such as the environment and region of the deployment, to every
+// metric of Gatherer. A metric that already has a label of the same name keeps its own value.
+type LabeledGatherer struct {
+	Gatherer prometheus.Gatherer
+	Labels   map[string]string
+}
+
+// Gather returns the metrics of Gatherer with the labels added
+func (g *LabeledGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	if len(g.Labels) == 0 {
+		return families, err
+	}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			has := make(map[string]bool, len(metric.Label))
+			for _, label := range metric.Label {
+				has[label.GetName()] = true
+			}
+			for name, value := range g.Labels {
+				if !has[name] {
+					metric.Label = append(metric.Label, &dto.LabelPair{Name: &name, Value: &value})
+				}
+			}
+			sort.Slice(metric.Label, func(i, j int) bool { return metric.Label[i].GetName() < metric.Label[j].GetName() })
+		}
+	}
+	return families, err
+}
@@ -2,36 +2,82 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unsafe"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 // LogEntry represents the structure of a log entry
 type LogEntry struct {
+	// Env is the environment the entry belongs to, see -env
+	Env        string
 	Server     string
 	Program    string
 	Date       string
 	Time       string
 	StatusCode string
-	Duration   string
-	IP         string
-	Method     string
-	APIPath    string
+	// Duration is the request latency, stored as whole milliseconds
+	Duration time.Duration
+	IP       string
+	Method   string
+	APIPath  string
+	// RawPath is the request path as logged, with its query string, stored in raw_path without it
+	RawPath string
+	Line    string
+	IsSlow  bool
+	// SampledWeight is the number of requests this stored entry stands for
+	SampledWeight float64
+	// SampleRate is the fraction of the requests kept by the sample rate of the program or API, whatever
+	// the sampling of fast successful requests that SampledWeight also accounts for; 0 is stored as 1
+	SampleRate float64
+	// Country and ASN locate the client IP, empty and 0 when unknown
+	Country string
+	ASN     uint32
+	// UserAgent is the user agent of the request when the log format includes it
+	UserAgent string
+	// IsBot flags requests from crawlers and uptime checkers
+	IsBot bool
+	// QueryParams holds the whitelisted query parameters as a URL-encoded string, empty if none
+	QueryParams string
+	// AppVersion is the deployed version of the program, empty if unknown
+	AppVersion string
+	// Labels holds the static labels of the deployment as a JSON object, empty if none
+	Labels string
+	// Protocol and TLSVersion are the HTTP protocol and TLS version of the request, e.g. "HTTP/1.1" and
+	// "TLSv1.2", when the format logs them, see OptionalFields, empty otherwise
+	Protocol   string
+	TLSVersion string
 }
 
-// ParseLogWithAWK uses awk to process a log line and returns a LogEntry
+// ParseLogWithAWK uses awk to process a log line and returns a LogEntry.
+//
+// The line is given to awk on its standard input and awk is run without a shell, so quotes, $(...) and
+// backticks in the line, such as a request path ending in '; rm -rf /tmp/test ', are plain text. The
+// first versions pasted the line into "echo '%s'" run by sh, where a single quote closed the quoting
+// and the rest of the line ran as a command. ParseLogLine parses lines in process and is what the
+// monitor uses.
 func ParseLogWithAWK(line, server, program string) (*LogEntry, error) {
-	awkCmd := `awk '{print $2,$4,$6,$8,$10,$12,$13}'`
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("echo '%s' | %s", line, awkCmd))
+	cmd := exec.Command("awk", "{print $2,$4,$6,$8,$10,$12,$13}")
+	cmd.Stdin = strings.NewReader(line + "\n")
 
 	output, err := cmd.Output()
 	if err != nil {
@@ -42,6 +88,10 @@ func ParseLogWithAWK(line, server, program string) (*LogEntry, error) {
 	if len(fields) >= 7 {
 		// 去掉 apiPath 两端的引号
 		apiPath := strings.Trim(fields[6], "\"")
+		duration, err := ParseGINDuration(fields[3])
+		if err != nil {
+			return nil, err
+		}
 
 		return &LogEntry{
 			Server:     server,
@@ -49,164 +99,1760 @@ func ParseLogWithAWK(line, server, program string) (*LogEntry, error) {
 			Date:       fields[0],
 			Time:       fields[1],
 			StatusCode: fields[2],
-			Duration:   fields[3],
+			Duration:   duration,
 			IP:         fields[4],
 			Method:     fields[5],
 			APIPath:    apiPath,
+			RawPath:    apiPath,
 		}, nil
 	}
 
 	return nil, fmt.Errorf("failed to parse log line: %s", line)
 }
 
-// LongestMatch finds the longest matching API path in the list
-func LongestMatch(apiPath string, apiList map[string]struct{}) string {
+// LongestMatch finds the longest matching API path in the list, skipping the entries whose min_depth
+// the path does not reach
+func LongestMatch(apiPath string, apiList map[string]APIEntry) string {
 	longestMatch := ""
-	for api := range apiList {
-		if strings.HasPrefix(apiPath, api) && len(api) > len(longestMatch) {
+	for api, entry := range apiList {
+		if strings.HasPrefix(apiPath, api) && len(api) > len(longestMatch) && MinDepthMatch(apiPath, api, entry.MinDepth) {
 			longestMatch = api
 		}
 	}
 	return longestMatch
 }
 
-// InsertLogEntry inserts a log entry into the database
-func InsertLogEntry(db *sql.DB, entries []*LogEntry) error {
-	log.Printf("Inserting %d log entries", len(entries))
-	query := `
-		INSERT INTO oula_logs_record (server, program, date, time, status_code, duration, ip, method, api_path)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
+// MinDepthMatch reports whether apiPath has at least minDepth non-empty path segments past
+// matchedPrefix, e.g. "/api/v1/pay" has 2 past "/api". minDepth <= 0 always matches.
+func MinDepthMatch(apiPath, matchedPrefix string, minDepth int) bool {
+	if minDepth <= 0 {
+		return true
+	}
+	rest, _, _ := strings.Cut(strings.TrimPrefix(apiPath, matchedPrefix), "?")
+	depth := 0
+	for _, segment := range strings.Split(rest, "/") {
+		if segment != "" {
+			depth++
+		}
+	}
+	return depth >= minDepth
+}
+
+// insertColumns is the number of oula_logs_record columns written per entry
+const insertColumns = 22
+
+// Data types a column of oula_logs_record may have in INFORMATION_SCHEMA.COLUMNS
+var (
+	textTypes    = []string{"varchar", "char", "tinytext", "text", "mediumtext", "longtext"}
+	integerTypes = []string{"tinyint", "smallint", "mediumint", "int", "bigint"}
+	numberTypes  = []string{"double", "float", "decimal"}
+)
+
+// recordColumn is a column BuildInsertSQL writes and the data types it may have
+type recordColumn struct {
+	Name  string
+	Types []string
+}
+
+// recordColumns are the insertColumns columns BuildInsertSQL writes, in order. SchemaCheck verifies
+// that oula_logs_record has them before monitoring starts.
+var recordColumns = []recordColumn{
+	{"env", textTypes},
+	{"server", textTypes},
+	{"program", textTypes},
+	{"date", append([]string{"date"}, textTypes...)},
+	{"time", append([]string{"time"}, textTypes...)},
+	{"status_code", append(integerTypes, textTypes...)},
+	// 旧版本以 GIN 格式的字符串存储耗时
+	{"duration", append(integerTypes, textTypes...)},
+	{"ip", textTypes},
+	{"method", textTypes},
+	{"api_path", textTypes},
+	{"is_slow", integerTypes},
+	{"sampled_weight", numberTypes},
+	{"country", textTypes},
+	{"asn", integerTypes},
+	{"is_bot", integerTypes},
+	{"query_params", textTypes},
+	{"app_version", textTypes},
+	{"labels", append([]string{"json"}, textTypes...)},
+	{"protocol", textTypes},
+	{"tls_version", textTypes},
+	{"raw_path", textTypes},
+	{"sample_rate", numberTypes},
+}
+
+// insertColumnList and insertRowPlaceholders are the column list and the placeholders of a row of BuildInsertSQL
+var insertColumnList, insertRowPlaceholders = func() (string, string) {
+	names := make([]string, len(recordColumns))
+	for i, column := range recordColumns {
+		names[i] = column.Name
+	}
+	return strings.Join(names, ", "), "(" + strings.TrimSuffix(strings.Repeat("?, ", len(recordColumns)), ", ") + ")"
+}()
+
+// maxInsertRows keeps a multi-value INSERT below MySQL's limit of 65535 placeholders per statement
+const maxInsertRows = 65535 / insertColumns
 
-	for _, entry := range entries {
-		_, err := db.Exec(query, entry.Server, entry.Program, entry.Date, entry.Time, entry.StatusCode, entry.Duration, entry.IP, entry.Method, entry.APIPath)
+// insertVerbs are the statements of the -insert-type values. They only differ for a row that conflicts
+// with a primary or unique key: insert fails the whole statement, insert-ignore skips the row, and also
+// stores values MySQL would reject, e.g. too long, truncated with a warning, replace deletes the stored
+// row and inserts the new one. oula_logs_record is keyed by an auto-increment id alone, so its rows never
+// conflict until a unique key is added to it, e.g. on the columns that identify a request to make
+// dead-letter replays idempotent with insert-ignore.
+var insertVerbs = map[string]string{
+	"insert":        "INSERT",
+	"insert-ignore": "INSERT IGNORE",
+	"replace":       "REPLACE",
+}
+
+// ValidateInsertType returns an error if insertType is not a key of insertVerbs
+func ValidateInsertType(insertType string) error {
+	if _, ok := insertVerbs[insertType]; !ok {
+		return fmt.Errorf("unknown insert type %q, expected insert, insert-ignore or replace", insertType)
+	}
+	return nil
+}
+
+// defaultMaxPacketBytes is MySQL's default max_allowed_packet
+const defaultMaxPacketBytes = 4 << 20
+
+// InsertLogEntry inserts log entries into the database with one multi-value statement of insertType per
+// chunk, chunks are sized by InsertChunkSize to stay below maxPacketBytes. It stops when ctx is done,
+// chunks inserted before stay in the database.
+func InsertLogEntry(ctx context.Context, db *sql.DB, entries []*LogEntry, maxPacketBytes int, insertType string) error {
+	log.Printf("Inserting %d log entries", len(entries))
+	for _, chunk := range InsertChunkSize(entries, maxPacketBytes) {
+		query, args, err := BuildInsertSQL("oula_logs_record", chunk, insertType)
 		if err != nil {
-			log.Printf("Error inserting log entry: %v", err)
+			return err
+		}
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			log.Printf("Error inserting log entries: %v", err)
 			return err
 		}
 	}
 	return nil
 }
 
-// monitorLogs monitors the logs from supervisorctl and processes them
-func monitorLogs(program string, db *sql.DB, apiList map[string]struct{}, server string) {
-	log.Printf("Starting to monitor logs for program: %s", program)
-	cmd := exec.Command("supervisorctl", "tail", "-f", program)
+// BuildInsertSQL returns the multi-value statement of insertType, see insertVerbs, of entries into
+// tableName, which has the columns of oula_logs_record, with one row of placeholders per entry and their
+// arguments. An empty insertType is insert. Optional fields that are empty are written as NULL. It fails
+// with an unknown insert type, without entries, with a nil entry, or with more entries than the
+// placeholders of a statement allow.
+func BuildInsertSQL(tableName string, entries []*LogEntry, insertType string) (string, []interface{}, error) {
+	if insertType == "" {
+		insertType = "insert"
+	}
+	verb, ok := insertVerbs[insertType]
+	if !ok {
+		return "", nil, ValidateInsertType(insertType)
+	}
+	if len(entries) == 0 {
+		return "", nil, fmt.Errorf("no entries to insert into %s", tableName)
+	}
+	if len(entries) > maxInsertRows {
+		return "", nil, fmt.Errorf("%d entries exceed the %d rows of a statement", len(entries), maxInsertRows)
+	}
+	query := verb + ` INTO ` + tableName + ` (` + insertColumnList + `) VALUES ` +
+		strings.TrimSuffix(strings.Repeat(insertRowPlaceholders+", ", len(entries)), ", ")
+	args := make([]interface{}, 0, len(entries)*insertColumns)
+	for i, entry := range entries {
+		if entry == nil {
+			return "", nil, fmt.Errorf("entry %d is nil", i)
+		}
+		// 未知位置写入 NULL
+		country := sql.NullString{String: entry.Country, Valid: entry.Country != ""}
+		asn := sql.NullInt64{Int64: int64(entry.ASN), Valid: entry.ASN != 0}
+		queryParams := sql.NullString{String: entry.QueryParams, Valid: entry.QueryParams != ""}
+		appVersion := sql.NullString{String: entry.AppVersion, Valid: entry.AppVersion != ""}
+		labels := sql.NullString{String: entry.Labels, Valid: entry.Labels != ""}
+		protocol := sql.NullString{String: entry.Protocol, Valid: entry.Protocol != ""}
+		tlsVersion := sql.NullString{String: entry.TLSVersion, Valid: entry.TLSVersion != ""}
+		rawPath := sql.NullString{String: StoredRawPath(entry), Valid: entry.RawPath != ""}
+		args = append(args, entry.Env, entry.Server, entry.Program, entry.Date, entry.Time, entry.StatusCode, entry.Duration.Milliseconds(), entry.IP, entry.Method, entry.APIPath, entry.IsSlow, entry.SampledWeight, country, asn, entry.IsBot, queryParams, appVersion, labels, protocol, tlsVersion, rawPath, storedSampleRate(entry))
+	}
+	return query, args, nil
+}
+
+// storedSampleRate returns the sample rate of an entry as stored in sample_rate, 1 if it was not sampled
+func storedSampleRate(entry *LogEntry) float64 {
+	if entry.SampleRate <= 0 {
+		return 1
+	}
+	return entry.SampleRate
+}
+
+// StoredRawPath returns the raw path of an entry as stored in raw_path, next to the template or prefix of
+// api_path: without its query string, whose whitelisted parameters are stored in query_params
+func StoredRawPath(entry *LogEntry) string {
+	path, _, _ := strings.Cut(entry.RawPath, "?")
+	return path
+}
+
+// InsertChunkSize splits entries into chunks whose estimated size stays below maxPacketBytes, 0 uses 4MB.
+// A row is estimated as the struct overhead plus the length of its string fields, and a chunk never
+// exceeds the placeholder limit of a prepared statement. A single row larger than the limit gets its own chunk.
+func InsertChunkSize(entries []*LogEntry, maxPacketBytes int) [][]*LogEntry {
+	if maxPacketBytes <= 0 {
+		maxPacketBytes = defaultMaxPacketBytes
+	}
+	var chunks [][]*LogEntry
+	start, size := 0, 0
+	for i, entry := range entries {
+		row := int(unsafe.Sizeof(*entry)) + len(entry.Env) + len(entry.Server) + len(entry.Program) + len(entry.Date) + len(entry.Time) +
+			len(entry.StatusCode) + len(entry.IP) + len(entry.Method) + len(entry.APIPath) + len(entry.Country) + len(entry.QueryParams) + len(entry.AppVersion) + len(entry.Labels) +
+			len(entry.Protocol) + len(entry.TLSVersion) + len(entry.RawPath)
+		if i > start && (size+row > maxPacketBytes || i-start >= maxInsertRows) {
+			chunks = append(chunks, entries[start:i])
+			start, size = i, 0
+		}
+		size += row
+	}
+	if start < len(entries) {
+		chunks = append(chunks, entries[start:])
+	}
+	return chunks
+}
+
+// Monitor holds the settings and sinks used to process the logs of one program
+type Monitor struct {
+	Program    string
+	Server     string
+	APIList    *atomic.Pointer[map[string]APIEntry]
+	Backend    Backend
+	Alerter    *Dispatcher
+	Aggregator *Aggregator
+	ErrorRates *ErrorRateTracker
+	// Activity records when the program last produced a line
+	Activity *ActivityTracker
+	// Counters holds the lines, batches and errors of the program for /-/status and /metrics
+	Counters *ProgramCounters
+	// Bursts captures the raw lines of endpoints throwing bursts of 5xx
+	Bursts *BurstSampler
+	// Statuses counts entries per API path and status class for GET /api/error-rates
+	Statuses *StatusTable
+	// RateAnomalies detects endpoints whose request rate leaves its baseline
+	RateAnomalies *RateAnomalyDetector
+	// SLOs tracks the error budget burn rate of APIs with an SLO
+	SLOs *SLOTracker
+	// UniqueIPs estimates the distinct client IPs per endpoint and day
+	UniqueIPs *UniqueIPCounter
+	// Slowest keeps the slowest request of each endpoint and hour
+	Slowest *SlowestTracker
+	// TopIPs keeps the IPs with the most requests over a rolling window
+	TopIPs *TopIPTracker
+	// ParseErrors tracks lines that fail to parse
+	ParseErrors *ParseErrorTracker
+	// DeadLetter keeps batches that failed to insert, nil drops them
+	DeadLetter *TimestampedDeadLetter
+	// InsertFailures tracks failed inserts across all programs
+	InsertFailures *InsertFailureTracker
+
+	BatchSize int
+	// Scrubber removes sensitive values from paths and lines before matching, nil disables it
+	Scrubber *Scrubber
+	// Redactor replaces sensitive field values of specific endpoints before storage, nil disables it
+	Redactor *Redactor
+	// Bots flags crawler traffic, BotPolicy is "keep", "exclude" from metrics and aggregations, or "drop"
+	Bots      *BotClassifier
+	BotPolicy string
+	// IgnoreIPs drops the requests of internal clients, nil keeps all
+	IgnoreIPs *IPIgnoreList
+	// Anonymizer anonymizes client IPs before storage, nil keeps them
+	Anonymizer *Anonymizer
+	// QueryParams keeps the whitelisted query parameters of matched entries
+	QueryParams *QueryParamFilter
+	// Locker makes sure a single instance monitors the program, nil monitors it unconditionally
+	Locker *RedisLocker
+	// Leases makes sure a single instance writes the rows of the program for its server, nil writes them
+	// unconditionally
+	Leases   *WriterLeases
+	Sampling *SamplingPolicy
+	// GeoIP resolves the country and ASN of client IPs, nil disables enrichment
+	GeoIP *GeoIP
+	// FieldMap holds the field positions, DetectFields > 0 detects them from that many lines first
+	FieldMap FieldMap
+	// OptionalFields holds the positions of the optional fields, whatever the positions of FieldMap
+	OptionalFields OptionalFields
+	DetectFields   int
+	// FieldSep separates the fields of a line, whitespace if empty
+	FieldSep string
+	// Labels is the JSON object of the static labels stored with every entry
+	Labels string
+	// Env is the environment stored with every entry
+	Env string
+	// Version reads the deployed version of the program when it is tailed, AppVersion is the last one read
+	Version    *VersionSource
+	AppVersion string
+	// TailFromStart processes up to this many bytes of the program's buffered output before its live
+	// output, the first time it is tailed, 0 starts from the live output
+	TailFromStart int
+	// LogFile is the file the program logs to, read instead of supervisorctl tail if set, starting with
+	// its last TailNLines lines. It is checked for more data when FileNotifier reports a change, or every
+	// LogFilePoll without FileNotifier or where inotify cannot be used.
+	LogFile      string
+	TailNLines   int
+	LogFilePoll  time.Duration
+	FileNotifier *FileNotifier
+	// Processes notifies the monitor when supervisord starts the program again, to restart its tail at
+	// once; nil monitors a single tail until it ends
+	Processes *ProcessWatcher
+	// lastStamp is the timestamp of the last GIN line parsed, tracked with Processes so that a restarted
+	// tail resumes after it
+	lastStampMu sync.Mutex
+	lastStamp   string
+	// TimestampFormat holds the layouts of the date and time fields
+	TimestampFormat TimestampFormat
+	// GINMode is "release" for plain lines, "dev" for lines colored with ANSI escapes, or "auto" to
+	// decide from the first GIN line
+	GINMode string
+	// FlushInterval writes partial batches periodically, FlushJitter spreads the flushes of different programs
+	FlushInterval time.Duration
+	FlushJitter   time.Duration
+	// SlowThreshold flags entries at least this slow, unless the API list entry overrides it
+	SlowThreshold time.Duration
+	// ParseOnly stores the parsed entries without matching them, for agents forwarding to a collector
+	ParseOnly bool
+	// HeartbeatInterval injects a synthetic line for HeartbeatPath at this interval, 0 disables it.
+	// Heartbeats checks that the heartbeat rows are stored.
+	HeartbeatInterval time.Duration
+	Heartbeats        *HeartbeatChecker
+}
+
+// monitorLogs monitors the logs from supervisorctl or the program's -log-files file and processes them
+// until the tail ends. With a
+// Locker, the program is only monitored while this instance holds its lock, and with Leases while no
+// other instance writes it for the same server, as its conflict policy decides. Its goroutines carry
+// the program's pprof label, see ServeProfiles.
+func monitorLogs(m *Monitor) error {
+	tail := func(ctx context.Context) error {
+		return tailLogs(ctx, m)
+	}
+	if m.Leases != nil {
+		leased := tail
+		tail = func(ctx context.Context) error {
+			return m.Leases.Hold(ctx, m.Program, leased)
+		}
+	}
+	var err error
+	withProgramLabel(context.Background(), m.Program, func(ctx context.Context) {
+		if m.Locker != nil {
+			err = m.Locker.Hold(m.Program, tail)
+			return
+		}
+		err = tail(ctx)
+	})
+	return err
+}
+
+// tailLogs processes the output of supervisorctl tail, or the lines of m.LogFile, until it ends or ctx is
+// done. With m.Processes
+// the tail is restarted as soon as supervisord reports that the program started again, first reading
+// the output the new process wrote before, and a tail that ends is restarted once the program is
+// RUNNING; it only returns when the program is no longer known to supervisord or cannot be polled.
+func tailLogs(ctx context.Context, m *Monitor) error {
+	if m.LogFile != "" {
+		return tailFile(ctx, m)
+	}
+	if m.Processes == nil {
+		return tailOnce(ctx, m, "")
+	}
+	starts := m.Processes.Subscribe(m.Program)
+	defer m.Processes.Unsubscribe(m.Program, starts)
+	after := ""
+	for {
+		tailCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func(after string) { done <- tailOnce(tailCtx, m, after) }(after)
+		var err error
+		select {
+		case start := <-starts:
+			log.Printf("Program %s restarted, restarting its tail", m.Program)
+			cancel()
+			<-done
+			after = m.resumeAfter(start)
+			continue
+		case err = <-done:
+			cancel()
+		}
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+
+		// tail 结束后等待程序重新运行
+		log.Printf("Tail of %s ended, waiting for supervisord to report it RUNNING", m.Program)
+		ticker := time.NewTicker(m.Processes.Interval)
+		for after == "" {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return nil
+			case start := <-starts:
+				after = m.resumeAfter(start)
+			case <-ticker.C:
+				info, ok := m.Processes.Process(m.Program)
+				if !ok {
+					ticker.Stop()
+					return nil
+				}
+				if info.State == "RUNNING" {
+					after = m.resumeAfter(info)
+				}
+			}
+		}
+		ticker.Stop()
+	}
+}
+
+// resumeAfter returns the timestamp after which a tail restarted for the process started by start
+// resumes: the last line already parsed, or the second before the process started if that is later
+func (m *Monitor) resumeAfter(start ProcessInfo) string {
+	m.lastStampMu.Lock()
+	after := m.lastStamp
+	m.lastStampMu.Unlock()
+	if before := start.Started.Add(-time.Second).Format(DefaultTimestampFormat.Date + " " + DefaultTimestampFormat.Time); before > after {
+		after = before
+	}
+	return after
+}
+
+// restartHistoryBytes is how much of the buffered output is read for the lines a restarted program
+// wrote before its tail was restarted
+const restartHistoryBytes = 1 << 20
+
+// tailOnce runs supervisorctl tail -f once. With after, the buffered output from the first GIN line
+// stamped after it is processed before the live output.
+func tailOnce(ctx context.Context, m *Monitor, after string) error {
+	log.Printf("Starting to monitor logs for program: %s", m.Program)
+	m.refreshAppVersion()
+	cmd := exec.CommandContext(ctx, "supervisorctl", "tail", "-f", m.Program)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Fatalf("Error getting stdout for %s: %v", program, err)
+		return fmt.Errorf("getting stdout: %w", err)
 	}
 
 	if err := cmd.Start(); err != nil {
-		log.Fatalf("Error starting command for %s: %v", program, err)
+		return fmt.Errorf("starting command: %w", err)
 	}
+	defer cmd.Wait()
+	m.Counters.SetRunning(true, cmd.Process.Pid)
+	defer m.Counters.SetRunning(false, 0)
 
-	reader := bufio.NewReader(stdout)
-	batchSize := 100
-	entries := []*LogEntry{}
-	for {
-		line, err := reader.ReadString('\n')
+	// 首次监控时先处理 supervisord 缓存的输出
+	var r io.Reader = stdout
+	if maxBytes := m.TailFromStart; maxBytes > 0 || after != "" {
+		if after != "" {
+			// 重启后的 tail 读取新进程已写入的输出
+			maxBytes = restartHistoryBytes
+		}
+		history, err := withHistory(ctx, m, stdout, maxBytes, after)
 		if err != nil {
-			if err == io.EOF {
-				break
+			log.Printf("Error reading buffered output of %s, starting from live output: %v", m.Program, err)
+		} else {
+			r = history
+		}
+		m.TailFromStart = 0
+	}
+	if err := processLogs(m, r); err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("reading stdout: %w", err)
+	}
+	return nil
+}
+
+// runMonitors starts a monitor per program. With maxPrograms > 0 at most that many run at once and the
+// others wait in order for a slot, which is freed when a monitor finishes or crashes. Without a limit a
+// failing monitor stops the process, as all programs are expected to be monitored.
+func runMonitors(monitors []*Monitor, maxPrograms int) {
+	if maxPrograms <= 0 {
+		for _, m := range monitors {
+			go func(m *Monitor) {
+				if err := monitorLogs(m); err != nil {
+					log.Fatalf("Error monitoring %s: %v", m.Program, err)
+				}
+			}(m)
+		}
+		return
+	}
+
+	slots := make(chan struct{}, maxPrograms)
+	go func() {
+		for i, m := range monitors {
+			if i >= maxPrograms {
+				log.Printf("Program %s is waiting for a free slot (-max-programs %d)", m.Program, maxPrograms)
 			}
-			log.Fatalf("Error reading stdout: %v", err)
+			slots <- struct{}{}
+			go func(m *Monitor) {
+				defer func() { <-slots }()
+				defer func() {
+					if r := recover(); r != nil {
+						log.Printf("Monitor for %s crashed: %v", m.Program, r)
+					}
+				}()
+				if err := monitorLogs(m); err != nil {
+					log.Printf("Error monitoring %s: %v", m.Program, err)
+				}
+				log.Printf("Stopped monitoring %s", m.Program)
+			}(m)
 		}
+	}()
+}
 
-		if strings.Contains(line, "GIN") {
-			log.Println("Found GIN log line")
-			entry, err := ParseLogWithAWK(line, server, program)
+// processLogs parses the GIN lines read from r and inserts the matched entries in batches of m.BatchSize,
+// flushing partial batches every m.FlushInterval and the remaining entries when r reaches EOF
+func processLogs(m *Monitor, r io.Reader) error {
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
 			if err != nil {
-				log.Printf("Error parsing log line with awk: %v", err)
-				continue
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
 			}
-			// Find the longest matching APIPath
-			matchedAPIPath := LongestMatch(entry.APIPath, apiList)
-			if matchedAPIPath != "" {
-				entry.APIPath = matchedAPIPath
-				entries = append(entries, entry)
-
-				// Insert in batch when batchSize is reached
-				if len(entries) >= batchSize {
-					err := InsertLogEntry(db, entries)
-					if err != nil {
-						log.Printf("Error inserting log entry: %v", err)
+			lines <- line
+		}
+	}()
+
+	ticker := newFlushTicker(m.FlushInterval, m.FlushJitter)
+	defer ticker.Stop()
+
+	// 定时注入心跳行，检查解析、匹配和写入是否正常
+	var heartbeats <-chan time.Time
+	if m.HeartbeatInterval > 0 {
+		heartbeat := time.NewTicker(m.HeartbeatInterval)
+		defer heartbeat.Stop()
+		heartbeats = heartbeat.C
+		m.Heartbeats.Watch(m.Server, m.Program)
+	}
+
+	// 持续有日志时，批次最多等待到定时器最晚触发的时间
+	config := BatchConfig{Size: m.BatchSize}
+	if m.FlushInterval > 0 {
+		config.MaxAge = m.FlushInterval + m.FlushJitter
+	}
+	writer := NewBatchWriter(m.backend(), config)
+	if !m.ParseOnly {
+		// 转发的条目由 collector 匹配接口后再替换
+		writer.Redactor = m.Redactor
+	}
+	addEntry := func(entry *LogEntry) {
+		if entry == nil {
+			return
+		}
+		m.Counters.LineMatched()
+		n := writer.Len() + 1
+		if err := writer.Add(entry); err != nil {
+			log.Printf("Error inserting log entry: %v", err)
+		} else if writer.Len() == 0 {
+			log.Printf("Inserted %d log entries", n)
+		}
+	}
+
+	addLine := func(line string) {
+		addEntry(m.handleLine(line))
+	}
+
+	// 自动识别字段位置时，先缓存前 DetectFields 行 GIN 日志
+	var samples []string
+	detecting := m.DetectFields > 0
+	detect := func() {
+		m.detectFieldMap(samples)
+		for _, sample := range samples {
+			addLine(sample)
+		}
+		samples = nil
+		detecting = false
+	}
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if detecting && len(samples) > 0 {
+					detect()
+				}
+				// Insert any remaining entries
+				if n := writer.Len(); n > 0 {
+					if err := writer.Flush(context.Background()); err != nil {
+						log.Printf("Error inserting remaining log entries: %v", err)
 					} else {
-						log.Println("Log entries inserted successfully")
+						log.Printf("Inserted %d remaining log entries", n)
 					}
-					entries = []*LogEntry{} // Reset the batch
 				}
-			} else {
-				log.Printf("APIPath did not match: %s", entry.APIPath)
+				select {
+				case err := <-readErr:
+					m.Counters.Error()
+					return err
+				default:
+					return nil
+				}
 			}
+			m.Activity.Touch(m.Program)
+			m.Counters.LineRead()
+
+			if detecting {
+				if strings.Contains(line, "GIN") {
+					samples = append(samples, m.ginLine(line))
+				}
+				if len(samples) >= m.DetectFields {
+					detect()
+				}
+				continue
+			}
+			addLine(line)
+
+		case <-ticker.C():
+			if n := writer.Len(); n > 0 {
+				if err := writer.Flush(context.Background()); err != nil {
+					log.Printf("Error inserting log entry: %v", err)
+				} else {
+					log.Printf("Flushed %d log entries", n)
+				}
+			}
+			ticker.Next()
+
+		case now := <-heartbeats:
+			addEntry(m.heartbeat(now))
 		}
 	}
+}
 
-	// Insert any remaining entries
-	if len(entries) > 0 {
-		err := InsertLogEntry(db, entries)
-		if err != nil {
-			log.Printf("Error inserting remaining log entries: %v", err)
-		} else {
-			log.Println("Remaining log entries inserted successfully")
+// detectFieldMap sets m.FieldMap from sample lines, keeping the current positions if detection fails
+func (m *Monitor) detectFieldMap(samples []string) {
+	fm, err := DetectFieldPositions(samples, m.fieldSep())
+	if err != nil {
+		log.Printf("Error detecting field positions for %s, using %+v: %v", m.Program, m.fieldMap(), err)
+		return
+	}
+	log.Printf("Detected field positions for %s: %+v", m.Program, fm)
+	m.FieldMap = fm
+}
+
+// fieldMap returns the field positions in use, DefaultFieldMap if none is set
+func (m *Monitor) fieldMap() FieldMap {
+	fm := m.FieldMap
+	if fm == (FieldMap{}) {
+		fm = DefaultFieldMap
+	}
+	fm.OptionalFields = m.OptionalFields
+	return fm
+}
+
+// fieldSep returns the field separator in use, DefaultFieldSeparator if none is set
+func (m *Monitor) fieldSep() string {
+	if m.FieldSep == "" {
+		return DefaultFieldSeparator
+	}
+	return m.FieldSep
+}
+
+// ginLine returns a GIN line with its ANSI colors removed when the program logs in GIN's debug mode.
+// In auto mode the first GIN line decides, colored lines are always written by the debug mode logger.
+func (m *Monitor) ginLine(line string) string {
+	if m.GINMode == "auto" {
+		m.GINMode = "release"
+		if strings.IndexByte(line, 0x1b) >= 0 {
+			m.GINMode = "dev"
 		}
+		log.Printf("Detected GIN %s mode output for %s", m.GINMode, m.Program)
+	}
+	if m.GINMode == "dev" {
+		return StripANSI(line)
 	}
+	return line
 }
 
-// CleanOldLogs deletes logs older than 8 days from the database
-func CleanOldLogs(db *sql.DB) {
-	log.Println("Cleaning old logs older than 8 days")
-	query := `DELETE FROM oula_logs_record WHERE date < NOW() - INTERVAL 8 DAY`
-	_, err := db.Exec(query)
+// handleLine parses a GIN line and returns the matched entry, or nil if the line is skipped. With
+// ParseOnly the parsed entry is returned unmatched.
+func (m *Monitor) handleLine(line string) *LogEntry {
+	entry := m.parseLine(line)
+	if entry == nil || m.ParseOnly {
+		return entry
+	}
+	return m.matchEntry(entry)
+}
+
+// parseLine parses a GIN line into an entry with its raw line, version, labels and environment, or returns
+// nil if the line is not a GIN line or fails to parse
+func (m *Monitor) parseLine(line string) *LogEntry {
+	if !strings.Contains(line, "GIN") {
+		return nil
+	}
+	line = m.ginLine(line)
+	log.Println("Found GIN log line")
+	entry, err := ParseLogLine(line, m.Server, m.Program, m.fieldMap(), m.fieldSep(), m.TimestampFormat)
+	m.ParseErrors.Add(m.Program, err != nil, line)
+	if err != nil {
+		log.Printf("Error parsing log line: %v", err)
+		return nil
+	}
+	entry.Line = strings.TrimSpace(line)
+	entry.AppVersion = m.AppVersion
+	entry.Labels = m.Leases.Labels(m.Program, m.Labels)
+	entry.Env = m.Env
+	if m.Processes != nil {
+		m.lastStampMu.Lock()
+		m.lastStamp = entry.Date + " " + entry.Time
+		m.lastStampMu.Unlock()
+	}
+	return entry
+}
+
+// heartbeat parses the heartbeat line of now and returns its entry like handleLine. The line is always
+// parsed with GIN's default layout and does not count as activity or as a parse result of the program.
+func (m *Monitor) heartbeat(now time.Time) *LogEntry {
+	line := heartbeatLine(now, m.TimestampFormat)
+	entry, err := ParseLogLine(line, m.Server, m.Program, DefaultFieldMap, DefaultFieldSeparator, m.TimestampFormat)
 	if err != nil {
-		log.Printf("Error cleaning old logs: %v", err)
+		log.Printf("Error parsing heartbeat line: %v", err)
+		return nil
+	}
+	entry.Line = strings.TrimSpace(line)
+	entry.AppVersion = m.AppVersion
+	entry.Labels = m.Leases.Labels(m.Program, m.Labels)
+	entry.Env = m.Env
+	if m.ParseOnly {
+		return entry
+	}
+	return m.matchEntry(entry)
+}
+
+// matchEntry scrubs, enriches, matches and samples a parsed entry and returns it, or releases it and
+// returns nil if it is skipped. Heartbeats are never ignored, sampled or counted in metrics.
+func (m *Monitor) matchEntry(entry *LogEntry) *LogEntry {
+	heartbeat := entry.RawPath == HeartbeatPath
+	// 内部探测和健康检查的请求不计入任何指标
+	if !heartbeat && m.IgnoreIPs.Ignore(entry) {
+		releaseLogEntry(entry)
+		return nil
+	}
+	m.Scrubber.Apply(entry)
+	// 在匿名化之前解析位置
+	geo := m.GeoIP.Lookup(entry.IP)
+	entry.Country, entry.ASN = geo.Country, geo.ASN
+	m.Anonymizer.Apply(entry)
+	m.Bots.Classify(entry)
+	if entry.IsBot && m.BotPolicy == "drop" {
+		releaseLogEntry(entry)
+		return nil
+	}
+	// 排除爬虫时只存储，不计入指标和聚合
+	aggregate := (!entry.IsBot || m.BotPolicy != "exclude") && !heartbeat
+	// 矩阵参数不参与匹配
+	entry.APIPath = StripMatrixParams(entry.APIPath)
+	// Find the longest matching APIPath
+	apiList := *m.APIList.Load()
+	matchedAPIPath := LongestMatch(entry.APIPath, apiList)
+	if aggregate {
+		countRequest(entry, matchedAPIPath)
+		countProtocol(entry)
+	}
+	if matchedAPIPath == "" {
+		log.Printf("APIPath did not match: %s", entry.APIPath)
+		releaseLogEntry(entry)
+		return nil
+	}
+	// 查询字符串在匹配前保留在 RawPath 中，匹配后只保留白名单参数
+	entry.QueryParams = m.QueryParams.Extract(entry.RawPath, apiList[matchedAPIPath].QueryParams)
+	entry.APIPath = matchedAPIPath
+	entry.IsSlow = m.isSlow(entry, apiList[matchedAPIPath])
+	if aggregate {
+		countSlowRequest(entry, matchedAPIPath)
+		m.SLOs.Add(entry, apiList[matchedAPIPath].SLO)
+		m.Aggregator.Add(entry)
+		m.ErrorRates.Add(entry)
+		m.Statuses.Add(entry)
+		m.Bursts.Add(entry)
+		m.UniqueIPs.Add(entry)
+		m.Slowest.Add(entry)
+		m.TopIPs.Add(entry)
+		m.RateAnomalies.Add(entry)
+	}
+
+	if heartbeat {
+		m.Heartbeats.Watch(entry.Server, entry.Program)
+		entry.SampledWeight, entry.SampleRate = 1, 1
+		return entry
+	}
+
+	// 接口的采样率在匹配之后生效
+	sampling := m.Sampling.WithSampleRate(apiList[matchedAPIPath].SampleRate)
+	keep, weight := sampling.Sample(entry)
+	if !keep {
+		releaseLogEntry(entry)
+		return nil
+	}
+	entry.SampledWeight, entry.SampleRate = weight, sampling.Rate()
+	return entry
+}
+
+// isSlow reports whether the entry took at least the slow threshold of its API
+func (m *Monitor) isSlow(entry *LogEntry, api APIEntry) bool {
+	threshold := m.SlowThreshold
+	if api.SlowThreshold > 0 {
+		threshold = api.SlowThreshold
+	}
+	if threshold <= 0 {
+		return false
 	}
+	return entry.Duration >= threshold
+}
+
+// backend returns the backend of the program, recording insert failures and keeping failed batches as dead letters
+func (m *Monitor) backend() Backend {
+	return &trackedBackend{Backend: m.Backend, Program: m.Program, DeadLetter: m.DeadLetter, Failures: m.InsertFailures, Counters: m.Counters}
+}
+
+// RetentionCutoff returns the time retentionDays days before now, as YYYY-MM-DD HH:MM:SS: the raw rows
+// dated before it are deleted, so the day retentionDays ago goes too unless now is exactly midnight
+func RetentionCutoff(now time.Time, retentionDays int) string {
+	return now.AddDate(0, 0, -retentionDays).Format("2006-01-02 15:04:05")
+}
+
+// CleanOldLogs deletes the logs of env older than retentionDays days before now from the database.
+// Deleting is idempotent, calling it again with the same now deletes nothing more.
+func CleanOldLogs(db *sql.DB, env string, now time.Time, retentionDays int) error {
+	log.Printf("Cleaning old logs of %s older than %d days", env, retentionDays)
+	cutoff := RetentionCutoff(now, retentionDays)
+	query := `DELETE FROM oula_logs_record WHERE env = ? AND date < ?`
+	_, err := db.Exec(query, env, cutoff)
+	return err
 }
 
 var dsn = flag.String("dsn", "", "Data Source Name for MySQL")
+var configFile = flag.String("config", "", "Path to the JSON config file with per-program settings")
+var printConfig = flag.Bool("print-config", false, "Print the effective configuration and exit")
 var programList = flag.String("programs", "", "Comma-separated list of programs to monitor")
+var listMatchedPrograms = flag.Bool("list-matched-programs", false, "Print which -programs are RUNNING in supervisorctl status and exit, with status 1 unless all are")
 var apiListFile = flag.String("apilist", "", "Path to the API list file")
 var server = flag.String("server", "", "Servername")
+var dbCompress = flag.Bool("db-compress", false, "Use MySQL's compressed protocol")
+var dbMaxPacket = flag.Int("db-max-packet", defaultMaxPacketBytes, "Maximum size in bytes of a multi-value INSERT, keep it below the server's max_allowed_packet")
+var insertType = flag.String("insert-type", "insert", "Statement used to store entries: insert, insert-ignore or replace")
+var insertTimeout = flag.Duration("insert-timeout", 30*time.Second, "Maximum time of a batch insert into MySQL (0 for no limit)")
+var fileBackendDir = flag.String("file-backend-dir", "", "Write entries as NDJSON to <dir>/<program>-<YYYY-MM-DD>.ndjson instead of MySQL (disabled if empty)")
+var fileBackendMaxFiles = flag.Int("file-backend-max-files", 0, "Files kept per program by -file-backend-dir, older ones are deleted (0 for no limit)")
+var generateSQL = flag.Bool("generate-sql", false, "Print the INSERT statement of each program's first matched line and exit")
+var simulateLoad = flag.Bool("simulate-load", false, "Process synthetic GIN lines through the whole pipeline, print the throughput and exit")
+var simulateLinesPerSec = flag.Int("simulate-lines-per-sec", 1000, "Lines per second generated by -simulate-load")
+var simulateDuration = flag.Duration("simulate-duration", 30*time.Second, "How long -simulate-load generates lines")
+var sampleLine = flag.String("sample-line", "", "GIN log line used by -generate-sql instead of the programs' recent output")
+var dryRun = flag.Bool("dry-run", false, "Print matched entries to stdout instead of inserting them")
+var dryRunFormat = flag.String("dry-run-format", "json", "Output format of -dry-run: json, table or csv")
+var deadLetterDir = flag.String("dead-letter-dir", "", "Directory where batches that fail to insert are kept for the replay subcommand (disabled if empty)")
+var truncatedDir = flag.String("truncated-dir", "", "Directory where entries cut to their column size are kept (disabled if empty)")
+var redisLockURL = flag.String("redis-lock-url", "", "Redis URL of the per-program locks, e.g. redis://:password@host:6379/0 (disabled if empty)")
+var redisLockTTL = flag.Duration("redis-lock-ttl", 30*time.Second, "Expiry of the per-program locks, renewed every third of it")
+var instanceID = flag.String("instance-id", "", "Value identifying this instance in the per-program locks and writer leases, hostname-pid if empty")
+var writerLeaseTTL = flag.Duration("writer-lease-ttl", 0, "Expiry of the writer leases in oula_writer_leases (disabled if 0)")
+var writerLeasePolicy = flag.String("writer-lease-conflict", "refuse", "What to do with a program another instance writes: refuse or tag")
+var maxPrograms = flag.Int("max-programs", 0, "Maximum number of programs monitored at once, the others wait for a slot (0 for no limit)")
+var watchAPIList = flag.Bool("watch-api-list", true, "Reload the API list file when it changes")
+var reloadOnSIGHUP = flag.Bool("reload-on-sighup", true, "Reload the config file, API list and certificates on SIGHUP")
+var watchAPIListInterval = flag.Duration("watch-api-list-interval", 30*time.Second, "Polling interval used to watch the API list when inotify is unavailable")
+var migrate = flag.Bool("migrate", false, "Apply pending schema migrations at startup")
+var reportingViews = flag.Bool("reporting-views", true, "Create the reporting views of oula_logs_record with -migrate")
+var programProfiles = flag.Bool("program-profiles", false, "Serve the goroutine stacks of each program's monitor on -http-addr")
+var printReportingViews = flag.Bool("print-reporting-views", false, "Print the DDL of the reporting views of oula_logs_record and exit")
+var schemaVersion = flag.Bool("schema-version", false, "Print the current schema version from the database and exit")
+var emitHeartbeatLog = flag.Bool("emit-heartbeat-log", false, "Inject a synthetic "+HeartbeatPath+" line every -heartbeat-interval and alert when it is not stored")
+var heartbeatInterval = flag.Duration("heartbeat-interval", time.Minute, "Interval of the heartbeat lines of -emit-heartbeat-log")
+var httpAddr = flag.String("http-addr", "", "Address for the status HTTP server, e.g. :8089 (disabled if empty)")
+var mode = flag.String("mode", "standalone", "standalone, agent or collector")
+var collectorURL = flag.String("collector", "", "Base URL of the collector of -mode agent, e.g. https://collector:8089")
+var collectorCA = flag.String("collector-ca", "", "CA bundle of the collector's certificate, instead of the system roots")
+var collectorCert = flag.String("collector-cert", "", "Client certificate the agent presents to the collector for mutual TLS, reloaded when it changes")
+var collectorKey = flag.String("collector-key", "", "Key of -collector-cert")
+var forwardFormat = flag.String("forward-format", "auto", "Format of the batches -mode agent sends: auto, json or protobuf")
+var spoolDir = flag.String("spool-dir", "", "Directory where -mode agent keeps the batches not yet sent (disabled if empty)")
+var spoolMaxBytes = flag.Int64("spool-max-bytes", 1<<30, "Maximum size of -spool-dir, the oldest segments are deleted beyond it (0 for no limit)")
+var spoolSegmentBytes = flag.Int64("spool-segment-bytes", 64<<20, "Size of the spool's segment files")
+var spoolRetryInterval = flag.Duration("spool-retry-interval", 10*time.Second, "Interval between attempts to send the spooled batches")
+var ingestToken = flag.String("ingest-token", "", "Bearer token required by /api/ingest of -mode collector and sent by -mode agent (disabled if empty)")
+var dedupWindow = flag.Duration("dedup-window", 24*time.Hour, "How long -mode collector remembers the batches it received")
+var dedupMaxBatches = flag.Int("dedup-max-batches", 1000000, "Maximum batch IDs remembered in memory by -mode collector")
+var dedupPersist = flag.Bool("dedup-persist", false, "Also record received batch IDs in oula_ingest_batches")
+var tlsCert = flag.String("tls-cert", "", "Certificate served by -http-addr over HTTPS, reloaded when it changes (plain HTTP if empty)")
+var tlsKey = flag.String("tls-key", "", "Key of -tls-cert")
+var tlsClientCA = flag.String("tls-client-ca", "", "CA bundle of the agents' client certificates (mutual TLS)")
+var tlsPublicStatus = flag.Bool("tls-public-status", false, "Serve the status endpoints without -tls-client-ca's client certificate")
+var retentionDays = flag.Int("retention-days", 8, "Days of raw log entries kept in oula_logs_record or -file-backend-dir")
+var env = flag.String("env", DefaultEnv, "Environment stored with every entry, e.g. staging or production")
+var envRetentionList = flag.String("env-retention-days", "", "Retention of the raw rows of each environment as env=days pairs")
+var retentionMaxBytes = flag.Int64("retention-max-bytes", 0, "Maximum size of oula_logs_record, oldest days deleted first (0 disables)")
+var retentionMinDays = flag.Int("retention-min-days", 1, "Days of raw rows never deleted by -retention-max-bytes")
+var force = flag.Bool("force", false, "Delete raw rows past -retention-days even when their day has not been rolled up by -daily-rollup")
+var ginMode = flag.String("gin-mode", "auto", "GIN logger output: release (plain), dev (ANSI colored) or auto to detect from the first GIN line")
+var k8sLabelSelector = flag.String("k8s-label-selector", "", "Monitor the Kubernetes pods matching this label selector instead of -programs")
+var k8sNamespace = flag.String("k8s-namespace", "", "Namespace of the pods, defaults to the kubeconfig's or log-monitor's")
+var k8sContainer = flag.String("k8s-container", "", "Container whose logs are read, required for pods with several containers")
+var kubeconfig = flag.String("kubeconfig", "", "Path to the kubeconfig file, defaults to $KUBECONFIG or ~/.kube/config")
+var tailFromStart = flag.Bool("tail-from-start", false, "Process each program's output buffered by supervisord before following it")
+var tailFromStartBytes = flag.Int("tail-from-start-bytes", 1<<20, "Bytes of buffered output processed with -tail-from-start")
+var logFileList = flag.String("log-files", "", "Log files of programs read instead of supervisorctl tail, as program=path pairs")
+var tailNLines = flag.Int("tail-n-lines", 0, "Lines at the end of each -log-files file processed before following it")
+var logFilePollInterval = flag.Duration("log-file-poll-interval", defaultLogFilePoll, "How often -log-files files are checked for more data where inotify cannot be used")
+var supervisorPollInterval = flag.Duration("supervisor-poll-interval", 0, "Poll supervisorctl status this often to follow restarts (0 to disable)")
+var dateFormat = flag.String("date-format", DefaultTimestampFormat.Date, "Go reference-time layout of the date field of log lines, without spaces")
+var timeFormat = flag.String("time-format", DefaultTimestampFormat.Time, "Go reference-time layout of the time field of log lines, without spaces")
+var fieldSep = flag.String("field-sep", DefaultFieldSeparator, "Separator of the log fields")
+var detectFields = flag.Int("detect-fields", 0, "Detect the log field positions from this many lines, 0 disables")
+var batchSize = flag.Int("batch-size", 100, "Number of entries inserted per batch")
+var flushInterval = flag.Duration("flush-interval", 10*time.Second, "Insert partial batches at this interval, 0 disables")
+var flushJitter = flag.Duration("flush-jitter", 0, "Random delay added to each program's flush ticker to spread database writes")
+var scrub = flag.Bool("scrub", false, "Replace API keys, tokens and email addresses in paths and raw lines")
+var ignoreIPs = flag.String("ignore-ips", "", "Comma-separated IPs and CIDRs whose requests are dropped")
+var queryParams = flag.String("query-params", "", "Comma-separated query parameters stored in query_params")
+var queryParamMaxLength = flag.Int("query-param-max-length", 64, "Maximum characters kept of a query parameter value")
+var botSignatures = flag.String("bot-signatures", "", "File of additional bot user agent substrings, one per line, reloaded when it changes")
+var anonymizeIP = flag.Bool("anonymize-ip", false, "Truncate client IPs before storage: IPv4 to /24, IPv6 to /48")
+var slowThreshold = flag.Duration("slow-threshold", 0, "Flag requests at least this slow as is_slow, 0 disables")
+var cloudWatchNamespace = flag.String("cloudwatch-namespace", "", "Publish metrics to this CloudWatch namespace (disabled if empty)")
+var cloudWatchRegion = flag.String("cloudwatch-region", "", "AWS region for CloudWatch, defaults to the AWS SDK configuration")
+var cloudWatchInterval = flag.Duration("cloudwatch-interval", time.Minute, "Interval between CloudWatch metric publications")
+var webhookURL = flag.String("webhook-url", "", "Webhook URL to post alerts to")
+var testAlert = flag.Bool("test-alert", false, "Send a test alert through every configured channel at startup")
+var webhookHeaders = flag.String("webhook-headers", "", "Comma-separated Key:Value headers added to every webhook request")
+var aggregate = flag.Bool("aggregate", false, "Aggregate matched entries per minute into oula_logs_minute (created by -migrate)")
+var aggregateGrace = flag.Duration("aggregate-grace", 2*time.Minute, "How long a minute bucket stays open for late entries")
+var statusMinuteRetention = flag.Duration("status-minute-retention", 90*24*time.Hour, "How long the per-minute status code counts are kept, 0 keeps them forever")
+var dailyRollup = flag.Bool("daily-rollup", false, "Aggregate each finished day into oula_logs_daily and oula_api_availability before cleaning old logs")
+var topHourly = flag.Bool("top-hourly", false, "Write the slowest and most error-prone endpoints of each hour to oula_logs_top_hourly")
+var topHourlyN = flag.Int("top-hourly-n", 20, "Number of endpoints ranked per hour and list")
+var topHourlyMinRequests = flag.Int64("top-hourly-min-requests", 100, "Minimum requests in the hour for an endpoint to be ranked")
+var topHourlyRetention = flag.Duration("top-hourly-retention", 90*24*time.Hour, "How long oula_logs_top_hourly rows are kept")
+var slowestHourly = flag.Bool("slowest-hourly", false, "Write the slowest request of each endpoint and hour to oula_logs_slowest_hourly")
+var slowestHourlyLines = flag.Bool("slowest-hourly-lines", false, "Also store the raw line of the slowest requests")
+var slowestHourlyRetention = flag.Duration("slowest-hourly-retention", 90*24*time.Hour, "How long oula_logs_slowest_hourly rows are kept, 0 keeps them forever")
+var insertFailureAlertAfter = flag.Duration("insert-failure-alert-after", 5*time.Minute, "Alert when inserts have been failing for this long")
+var insertFailureAlertInterval = flag.Duration("insert-failure-alert-interval", 30*time.Minute, "Minimum time between repeated insert failure alerts")
+var errorRateThreshold = flag.Float64("error-rate-threshold", 0, "Alert when an endpoint's 5xx ratio reaches this value (0 to 1), 0 disables")
+var errorRateWindow = flag.Duration("error-rate-window", time.Minute, "Window over which endpoint error rates are computed")
+var errorRateIntervals = flag.Int("error-rate-intervals", 3, "Consecutive windows above the threshold before alerting")
+var errorRateMinRequests = flag.Int64("error-rate-min-requests", 20, "Minimum requests in a window for an endpoint to be evaluated")
+var errorRateCooldown = flag.Duration("error-rate-cooldown", 30*time.Minute, "Minimum time between repeated alerts for the same endpoint")
+var anomalyFactor = flag.Float64("anomaly-factor", 0, "Alert on request rates this many deviations from the baseline, 0 disables")
+var anomalyMinutes = flag.Int("anomaly-minutes", 3, "Consecutive deviating minutes before alerting")
+var anomalyHistory = flag.Int("anomaly-history", 60, "Minutes of history the request rate baseline is computed from")
+var anomalyMinBaseline = flag.Float64("anomaly-min-baseline", 10, "Endpoints with a baseline below this many requests per minute are not checked")
+var sloShortWindow = flag.Duration("slo-short-window", 5*time.Minute, "Short window of the SLO burn rate")
+var sloLongWindow = flag.Duration("slo-long-window", time.Hour, "Long window of the SLO burn rate")
+var sloBurnRateAlert = flag.Float64("slo-burn-rate-alert", 0, "Alert when both SLO windows burn the error budget at least this fast, e.g. 14.4, 0 disables")
+var silenceAfter = flag.Duration("silence-after", 0, "Alert when a program logs nothing for this long, 0 disables")
+var errorBurstThreshold = flag.Int("error-burst-threshold", 0, "Capture raw lines of endpoints with more 5xx per minute than this, 0 disables")
+var errorBurstTail = flag.Duration("error-burst-tail", 5*time.Minute, "How long lines are still captured after the last minute above the burst threshold")
+var errorBurstMaxSamples = flag.Int("error-burst-max-samples", 1000, "Maximum raw lines captured per burst")
+var errorSamplesRetention = flag.Duration("error-samples-retention", 72*time.Hour, "How long oula_error_samples rows are kept")
+var regressionRatio = flag.Float64("regression-ratio", 0, "Alert when an endpoint's p95 latency grows by this factor, 0 disables")
+var regressionWindow = flag.Duration("regression-window", 30*time.Minute, "Window whose p95 latency is compared with the baseline")
+var regressionBaseline = flag.String("regression-baseline", "previous", "Baseline of latency regressions: previous or yesterday")
+var regressionMinSamples = flag.Uint64("regression-min-samples", 100, "Minimum requests in both windows for an endpoint to be compared")
+var uniqueIPs = flag.Bool("unique-ips", false, "Estimate distinct client IPs per endpoint and day into oula_logs_unique_ips (created by -migrate)")
+var uniqueIPsInterval = flag.Duration("unique-ips-interval", 5*time.Minute, "Interval between writes of the unique IP sketches")
+var topIPs = flag.Int("top-ips", 0, "Number of top IPs kept per program over -top-ips-window, 0 disables")
+var topIPsWindow = flag.Duration("top-ips-window", time.Hour, "Rolling window of the top IP list")
+var topIPsAlert = flag.Int64("top-ips-alert", 0, "Alert when one IP makes more requests than this over -top-ips-window, 0 disables")
+var parseErrorThreshold = flag.Float64("parse-error-threshold", 0, "Alert when the fraction of lines failing to parse exceeds this, 0 disables")
+var parseErrorWindow = flag.Duration("parse-error-window", 5*time.Minute, "Rolling window over which the parse failure fraction is computed")
+var parseErrorFor = flag.Duration("parse-error-for", 5*time.Minute, "How long the parse failure fraction must exceed the threshold before alerting")
+var parseErrorMinLines = flag.Int64("parse-error-min-lines", 100, "Minimum GIN lines in the window for the parse failure fraction to be evaluated")
 
 func main() {
+	// 子命令
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		if err := runReport(os.Args[2:]); err != nil {
+			log.Fatalf("Error running report: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			log.Fatalf("Error replaying dead letters: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil {
+			log.Fatalf("Error exporting: %v", err)
+		}
+		return
+	}
+
 	// 提取参数
 	flag.Parse()
+	switch *ginMode {
+	case "auto", "release", "dev":
+	default:
+		log.Fatalf("Unknown -gin-mode %q, expected auto, release or dev", *ginMode)
+	}
+	timestampFormat := TimestampFormat{Date: *dateFormat, Time: *timeFormat}
+	if err := timestampFormat.Validate(); err != nil {
+		log.Fatalf("Invalid -date-format or -time-format: %v", err)
+	}
+	separator, err := ParseFieldSeparator(*fieldSep)
+	if err != nil {
+		log.Fatalf("Invalid -field-sep: %v", err)
+	}
+	if separator != DefaultFieldSeparator && *detectFields == 0 {
+		log.Printf("Warning: -field-sep %q is used with GIN's default field positions, set -detect-fields if lines do not parse", separator)
+	}
+	if err := ValidateInsertType(*insertType); err != nil {
+		log.Fatalf("Invalid -insert-type: %v", err)
+	}
+	if err := ValidateEnv(*env); err != nil {
+		log.Fatalf("Invalid -env: %v", err)
+	}
+	envRetentionDays, err := ParseEnvRetention(*envRetentionList)
+	if err != nil {
+		log.Fatalf("Invalid -env-retention-days: %v", err)
+	}
+	if err := ValidateSizeRetention(*retentionMaxBytes, *retentionMinDays); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	switch *mode {
+	case "standalone":
+	case "agent":
+		if *collectorURL == "" {
+			log.Fatalf("-mode agent requires -collector")
+		}
+	case "collector":
+		if *httpAddr == "" {
+			log.Fatalf("-mode collector requires -http-addr")
+		}
+	default:
+		log.Fatalf("Unknown -mode %q, expected standalone, agent or collector", *mode)
+	}
 
-	// 加载API列表
-	apiList, err := LoadAPIList(*apiListFile)
+	// 加载配置文件
+	config, err := LoadConfig(*configFile)
 	if err != nil {
-		log.Fatalf("Error loading API list: %v", err)
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if *printConfig {
+		if err := PrintConfig(os.Stdout, config); err != nil {
+			log.Fatalf("Error printing config: %v", err)
+		}
+		return
+	}
+	if *listMatchedPrograms {
+		states, err := SupervisorStatus()
+		if err != nil {
+			log.Fatalf("Error checking programs: %v", err)
+		}
+		if !ListMatchedPrograms(os.Stdout, strings.Split(*programList, ","), states) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 配置告警渠道
+	alerter := &Dispatcher{}
+	if *webhookURL != "" {
+		headers, err := ParseWebhookHeaders(*webhookHeaders)
+		if err != nil {
+			log.Fatalf("Error parsing webhook headers: %v", err)
+		}
+		alerter.Add("webhook", NewWebhookAlerter(*webhookURL, headers), nil)
+	}
+	if err := config.AddNotifiers(alerter); err != nil {
+		log.Fatalf("Error configuring notifiers: %v", err)
+	}
+	if *testAlert {
+		alerter.Notify(&Alert{Type: TestAlertType, Server: *server, Message: "test alert from log-monitor"})
 	}
 
-	// 连接数据库
+	// 连接数据库，不写数据库的模式可以不配置 DSN
+	if *dsn != "" || !*dryRun && *fileBackendDir == "" && !*generateSQL && *mode != "agent" {
+		if err := ValidateDSN(*dsn, "mysql"); err != nil {
+			log.Fatalf("Invalid -dsn: %v", err)
+		}
+	}
+	dataSource := *dsn
+	if *dbCompress && dataSource != "" {
+		var err error
+		if dataSource, err = CompressDSN(dataSource); err != nil {
+			log.Fatalf("Invalid -dsn: %v", err)
+		}
+	}
 	log.Printf("Connecting to database with DSN: %s", *dsn)
-	db, err := sql.Open("mysql", *dsn)
+	db, err := sql.Open("mysql", dataSource)
 	if err != nil {
 		log.Fatalf("Error connecting to the database: %v", err)
 	}
 	defer db.Close()
 
-	// 定期清理旧数据，每天清理一次
+	// 收到退出信号时取消 ctx
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 打印数据库版本后退出
+	if *schemaVersion {
+		version, err := GetSchemaVersion(ctx, db)
+		if err != nil {
+			log.Fatalf("Error reading schema version: %v", err)
+		}
+		fmt.Println(version)
+		return
+	}
+
+	// 打印报表视图的 DDL 后退出，供 DBA 审阅
+	if *printReportingViews {
+		views, err := LoadReportingViews(ctx, db, "oula_logs_record")
+		if err != nil {
+			log.Printf("Error reading the columns of oula_logs_record, printing the views of the latest schema: %v", err)
+			views = defaultReportingViews("oula_logs_record")
+		}
+		for _, view := range views {
+			fmt.Printf("-- %s\n%s;\n\n", view.Description, view.DDL())
+		}
+		return
+	}
+
+	// 数据库迁移
+	if *migrate {
+		if err := MigrateSchema(ctx, db); err != nil {
+			log.Fatalf("Error migrating schema: %v", err)
+		}
+		if *reportingViews {
+			if err := EnsureReportingViews(ctx, db, "oula_logs_record"); err != nil {
+				log.Fatalf("Error creating reporting views: %v", err)
+			}
+		}
+	}
+
+	// 加载API列表
+	apiList, err := LoadAPIList(*apiListFile)
+	if err != nil {
+		log.Fatalf("Error loading API list: %v", err)
+	}
+
+	if len(apiList) > 0 {
+		RegisterRequestMetrics()
+	}
+	if _, ok := apiList[HeartbeatPath]; *emitHeartbeatLog && *mode != "agent" && !ok {
+		log.Fatalf("-emit-heartbeat-log requires %s in the API list", HeartbeatPath)
+	}
+	currentAPIList := &atomic.Pointer[map[string]APIEntry]{}
+	currentAPIList.Store(&apiList)
+	if *watchAPIList {
+		go WatchAPIList(ctx, *apiListFile, currentAPIList, *watchAPIListInterval)
+	}
+
+	// 客户端 IP 的国家和 ASN
+	var geoIP *GeoIP
+	if config.GeoIP != nil {
+		geoIP, err = NewGeoIP(*config.GeoIP)
+		if err != nil {
+			log.Fatalf("Error opening GeoIP database: %v", err)
+		}
+		geoIP.Watch(ctx, *watchAPIListInterval)
+	}
+
+	// 日汇总完成前不删除原始记录
+	var daily *DailyRollup
+	if *dailyRollup {
+		daily = &DailyRollup{DB: db, Lookback: 7}
+	}
+	var backend Backend = &MySQLBackend{DB: db, RetentionDays: *retentionDays, Env: *env, EnvRetentionDays: envRetentionDays, MaxPacketBytes: *dbMaxPacket, InsertType: *insertType, InsertTimeout: *insertTimeout, Daily: daily, Force: *force, MaxBytes: *retentionMaxBytes, MinRetentionDays: *retentionMinDays}
+	backendName := "mysql"
+	if *fileBackendDir != "" {
+		// 没有数据库的环境写本地文件
+		if err := os.MkdirAll(*fileBackendDir, 0o755); err != nil {
+			log.Fatalf("Error creating file backend directory: %v", err)
+		}
+		backend = &RotatingFileBackend{Dir: *fileBackendDir, MaxFiles: *fileBackendMaxFiles, RetentionDays: *retentionDays}
+		backendName = "file"
+	}
+	// 开始监控前检查表结构，无法连接数据库时照常启动
+	if backendName == "mysql" && *mode != "agent" && !*dryRun && !*generateSQL {
+		if err := SchemaCheck(ctx, db); err != nil {
+			var schemaErr *SchemaError
+			if errors.As(err, &schemaErr) {
+				log.Fatalf("Error: %v, run with -migrate to add the missing columns", err)
+			}
+			log.Printf("Error checking the schema of oula_logs_record, starting anyway: %v", err)
+		}
+		// 超长的值按列宽截断，不让整批插入失败
+		mysqlBackend := backend.(*MySQLBackend)
+		mysqlBackend.ColumnLimits, _ = LoadColumnLimits(ctx, db)
+		if *truncatedDir != "" {
+			if err := os.MkdirAll(*truncatedDir, 0o755); err != nil {
+				log.Fatalf("Error creating truncated entries directory: %v", err)
+			}
+			mysqlBackend.Truncated = &TimestampedDeadLetter{Dir: *truncatedDir}
+		}
+	}
+	var deadLetter *TimestampedDeadLetter
+	if *deadLetterDir != "" {
+		if err := os.MkdirAll(*deadLetterDir, 0o755); err != nil {
+			log.Fatalf("Error creating dead-letter directory: %v", err)
+		}
+		deadLetter = &TimestampedDeadLetter{Dir: *deadLetterDir}
+	}
+	var certFiles []*CertFiles
+	if *mode == "agent" {
+		// 解析后的条目转发给 collector，由它写数据库
+		var tlsConfig *tls.Config
+		if *collectorCA != "" || *collectorCert != "" || *collectorKey != "" {
+			files, err := NewCertFiles(*collectorCert, *collectorKey, *collectorCA)
+			if err != nil {
+				log.Fatalf("Error loading the collector TLS files: %v", err)
+			}
+			files.Watch(ctx, *watchAPIListInterval)
+			certFiles = append(certFiles, files)
+			u, err := url.Parse(*collectorURL)
+			if err != nil || u.Scheme != "https" {
+				log.Fatalf("-collector must be an https:// URL to use -collector-ca or -collector-cert")
+			}
+			tlsConfig = NewClientTLSConfig(files, u.Hostname())
+		}
+		forwarding, err := NewForwardingBackend(*collectorURL, *ingestToken, *forwardFormat, tlsConfig)
+		if err != nil {
+			log.Fatalf("Invalid -forward-format: %v", err)
+		}
+		if *spoolDir != "" {
+			// collector 不可达时先写入本地磁盘
+			spool, err := OpenSpool(*spoolDir, *spoolMaxBytes, *spoolSegmentBytes)
+			if err != nil {
+				log.Fatalf("Error opening spool: %v", err)
+			}
+			forwarding.Spool = spool
+			go spool.Run(ctx, *spoolRetryInterval, forwarding.post)
+		}
+		backend = forwarding
+		backendName = "collector"
+	}
+	var dryRunBackend *DryRunBackend
+	if *dryRun {
+		// 只打印到标准输出，不写数据库
+		dryRunBackend, err = NewDryRunBackend(*dryRunFormat, os.Stdout, os.Stderr)
+		if err != nil {
+			log.Fatalf("Error configuring dry run: %v", err)
+		}
+		backend = dryRunBackend
+		backendName = "dry-run"
+	}
+
+	// 按分钟聚合
+	var agg *Aggregator
+	aggDone := make(chan struct{})
+	if *aggregate {
+		agg = NewAggregator(db, *aggregateGrace, *statusMinuteRetention)
+		go func() {
+			agg.Run(ctx, 10*time.Second)
+			close(aggDone)
+		}()
+	} else {
+		close(aggDone)
+	}
+
+	// 按接口和天估算独立 IP 数
+	var uniqueIPCounter *UniqueIPCounter
+	uniqueIPsDone := make(chan struct{})
+	if *uniqueIPs {
+		uniqueIPCounter = NewUniqueIPCounter(db, *server)
+		go func() {
+			uniqueIPCounter.Run(ctx, *uniqueIPsInterval)
+			close(uniqueIPsDone)
+		}()
+	} else {
+		close(uniqueIPsDone)
+	}
+
+	// 按接口和小时记录最慢的请求
+	var slowest *SlowestTracker
+	slowestDone := make(chan struct{})
+	if *slowestHourly {
+		slowest = NewSlowestTracker(db, *server, *aggregateGrace, *slowestHourlyLines, *slowestHourlyRetention)
+		go func() {
+			slowest.Run(ctx, 30*time.Second)
+			close(slowestDone)
+		}()
+	} else {
+		close(slowestDone)
+	}
+
+	// 按程序统计请求最多的 IP
+	var topIPTracker *TopIPTracker
+	if *topIPs > 0 {
+		topIPTracker = NewTopIPTracker(*topIPs, *topIPsWindow, *topIPsAlert, *server, alerter)
+		go topIPTracker.Run(ctx)
+	}
+
+	// 写入持续失败告警
+	insertFailures := NewInsertFailureTracker(*server, *insertFailureAlertAfter, *insertFailureAlertInterval, alerter)
+	go insertFailures.Run(ctx, 30*time.Second)
+
+	// 心跳行超过两个周期没有写入数据库时告警
+	var heartbeats *HeartbeatChecker
+	var heartbeatEvery time.Duration
+	if *emitHeartbeatLog {
+		if *heartbeatInterval <= 0 {
+			log.Fatalf("-heartbeat-interval must be positive")
+		}
+		heartbeatEvery = *heartbeatInterval
+		if backendName == "mysql" {
+			heartbeats = NewHeartbeatChecker(db, *server, *heartbeatInterval, alerter)
+			go heartbeats.Run(ctx)
+		}
+	}
+
+	// 接口错误率告警
+	var errorRates *ErrorRateTracker
+	if *errorRateThreshold > 0 {
+		errorRates = NewErrorRateTracker(*server, *errorRateThreshold, *errorRateIntervals, *errorRateMinRequests, *errorRateCooldown, alerter)
+		go errorRates.Run(ctx, *errorRateWindow)
+	}
+
+	// 处理要监控的程序列表
+	programs := strings.Split(*programList, ",")
+	logFiles, err := ParseLogFiles(*logFileList)
+	if err != nil {
+		log.Fatalf("Invalid -log-files: %v", err)
+	}
+	for program := range logFiles {
+		if !slices.Contains(programs, program) {
+			log.Fatalf("Invalid -log-files: %s is not in -programs", program)
+		}
+	}
+
+	// API 列表中配置了 SLO 的接口计算错误预算消耗速度
+	slos := NewSLOTracker(*server, *sloShortWindow, *sloLongWindow, *sloBurnRateAlert, alerter)
+	go slos.Run(ctx)
+
+	// 5xx 突发时保存原始日志
+	var bursts *BurstSampler
+	burstsDone := make(chan struct{})
+	if *errorBurstThreshold > 0 {
+		bursts = NewBurstSampler(db, *server, *errorBurstThreshold, *errorBurstTail, *errorBurstMaxSamples, *errorSamplesRetention, alerter)
+		go func() {
+			bursts.Run(ctx, 5*time.Second)
+			close(burstsDone)
+		}()
+	} else {
+		close(burstsDone)
+	}
+
+	// 接口状态码统计，每个错误率窗口重置
+	statuses := NewStatusTable()
+	go statuses.Run(ctx, *errorRateWindow)
+
+	// 请求量异常检测
+	var rateAnomalies *RateAnomalyDetector
+	if *anomalyFactor > 0 {
+		rateAnomalies = NewRateAnomalyDetector(*server, *anomalyFactor, *anomalyMinutes, *anomalyHistory, *anomalyMinBaseline, alerter)
+		go rateAnomalies.Run(ctx)
+	}
+
+	// 程序长时间没有日志时告警
+	activity := NewActivityTracker(*server, alerter)
+	for _, program := range programs {
+		if err := activity.Register(program, silencePolicy(config, program, Duration(*silenceAfter))); err != nil {
+			log.Fatalf("Error configuring silence alert for %s: %v", program, err)
+		}
+	}
+	go activity.Run(ctx, 30*time.Second)
+
+	// 日志解析失败告警，按程序配置阈值
+	parseErrors := NewParseErrorTracker(*server, time.Minute, alerter)
+	defaultParseErrors := ParseErrorPolicy{
+		Threshold: *parseErrorThreshold,
+		Window:    Duration(*parseErrorWindow),
+		For:       Duration(*parseErrorFor),
+		MinLines:  *parseErrorMinLines,
+	}
+	for _, program := range programs {
+		parseErrors.Register(program, parseErrorPolicy(config, program, defaultParseErrors))
+	}
+	go parseErrors.Run(ctx)
+
+	// 延迟回归检测，基于分钟聚合表
+	if *regressionRatio > 0 {
+		if _, err := baselineWindow(time.Time{}, time.Time{}, *regressionBaseline); err != nil {
+			log.Fatalf("Error configuring latency regressions: %v", err)
+		}
+		regressions := &RegressionDetector{
+			DB:         db,
+			Server:     *server,
+			Env:        *env,
+			Window:     *regressionWindow,
+			Delay:      *aggregateGrace + time.Minute,
+			Baseline:   *regressionBaseline,
+			Ratio:      *regressionRatio,
+			MinSamples: *regressionMinSamples,
+			Alerter:    alerter,
+		}
+		go regressions.Run(ctx, 5*time.Minute)
+	}
+
+	// 每小时统计最慢和错误最多的接口，等待聚合桶写入后再计算
+	if *topHourly {
+		top := &TopOffenders{DB: db, N: *topHourlyN, MinRequests: *topHourlyMinRequests, Retention: *topHourlyRetention}
+		go top.Run(ctx, *aggregateGrace+time.Minute)
+	}
+
+	// 定期清理旧数据，每天清理一次，清理前先完成日汇总
 	go func() {
 		for {
-			CleanOldLogs(db)
+			if daily != nil {
+				if err := daily.RunPending(ctx); err != nil {
+					log.Printf("Error running daily rollup: %v", err)
+				}
+			}
+			if err := backend.CleanOld(); err != nil {
+				log.Printf("Error cleaning old logs: %v", err)
+			}
 			time.Sleep(24 * time.Hour)
 		}
 	}()
 
-	// 处理要监控的程序列表
-	programs := strings.Split(*programList, ",")
+	// 发布 CloudWatch 指标
+	if *cloudWatchNamespace != "" {
+		cw, err := NewCloudWatchBackend(ctx, *cloudWatchNamespace, *cloudWatchRegion)
+		if err != nil {
+			log.Fatalf("Error configuring CloudWatch: %v", err)
+		}
+		cw.Gatherer = &LabeledGatherer{Gatherer: cw.Gatherer, Labels: config.Labels}
+		go cw.Run(ctx, *cloudWatchInterval)
+	}
 
-	for _, program := range programs {
-		go monitorLogs(program, db, apiList, *server)
+	// 状态接口
+	var status *StatusServer
+	if *httpAddr != "" {
+		status = NewStatusServer(*server, programs, db, map[string]Backend{backendName: backend})
+		status.Daily = daily
+		status.Statuses = statuses
+		status.Activity = activity
+		status.ProgramMetrics = programMetrics
+		status.TopIPs = topIPTracker
+		status.Labels = config.Labels
+		if *programProfiles {
+			status.ServeProfiles()
+		}
+		if *tlsCert != "" || *tlsClientCA != "" {
+			if *tlsCert == "" {
+				log.Fatalf("-tls-client-ca needs -tls-cert")
+			}
+			files, err := NewCertFiles(*tlsCert, *tlsKey, *tlsClientCA)
+			if err != nil {
+				log.Fatalf("Error loading the status server TLS files: %v", err)
+			}
+			files.Watch(ctx, *watchAPIListInterval)
+			certFiles = append(certFiles, files)
+			status.TLS = NewServerTLSConfig(files)
+			status.RequireClientCert = *tlsClientCA != "" && !*tlsPublicStatus
+			status.Token = *ingestToken
+		}
+		go func() {
+			if err := status.ListenAndServe(ctx, *httpAddr); err != nil {
+				log.Fatalf("Error running status server: %v", err)
+			}
+		}()
+	}
+
+	// 路径中的敏感信息在匹配前替换
+	var scrubber *Scrubber
+	if *scrub || config.Scrub != nil {
+		scrubConfig := ScrubConfig{}
+		if config.Scrub != nil {
+			scrubConfig = *config.Scrub
+		}
+		scrubber, err = NewScrubber(scrubConfig)
+		if err != nil {
+			log.Fatalf("Error configuring scrubbing: %v", err)
+		}
+	}
+
+	// 按接口替换敏感字段，在写入批次时生效
+	redactor, err := NewRedactor(config.Redact)
+	if err != nil {
+		log.Fatalf("Error configuring redaction: %v", err)
+	}
+
+	// 忽略内部监控 IP
+	ignoreList, err := ParseIPIgnoreList(append(strings.Split(*ignoreIPs, ","), config.IgnoreIPs...))
+	if err != nil {
+		log.Fatalf("Error parsing ignored IPs: %v", err)
+	}
+
+	// 白名单查询参数的值总是经过敏感信息清理
+	queryParamFilter := &QueryParamFilter{MaxLength: *queryParamMaxLength, Scrubber: scrubber}
+	for _, name := range strings.Split(*queryParams, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			queryParamFilter.Names = append(queryParamFilter.Names, name)
+		}
+	}
+	if queryParamFilter.Scrubber == nil {
+		queryParamFilter.Scrubber, _ = NewScrubber(ScrubConfig{})
+	}
+
+	// 按 User-Agent 识别爬虫
+	bots, err := NewBotClassifier(*botSignatures)
+	if err != nil {
+		log.Fatalf("Error loading bot signatures: %v", err)
+	}
+	bots.Watch(ctx, *watchAPIListInterval)
+
+	// 按程序配置 IP 匿名化
+	newAnonymizer := func(program string) *Anonymizer {
+		policy := AnonymizePolicy{Mode: "none"}
+		if *anonymizeIP {
+			policy.Mode = "truncate"
+		}
+		if p := config.Program(program).Anonymize; p != nil {
+			policy = *p
+		}
+		anonymizer, err := NewAnonymizer(policy)
+		if err != nil {
+			log.Fatalf("Error configuring IP anonymization for %s: %v", program, err)
+		}
+		return anonymizer
+	}
+
+	// 收到 SIGHUP 时重新加载配置文件和 API 列表，不重启监控
+	if *reloadOnSIGHUP {
+		currentConfig := &atomic.Pointer[Config]{}
+		currentConfig.Store(config)
+		reloader := &Reloader{
+			ConfigFile:         *configFile,
+			APIListFile:        *apiListFile,
+			APIList:            currentAPIList,
+			Config:             currentConfig,
+			Programs:           programs,
+			Activity:           activity,
+			ParseErrors:        parseErrors,
+			SilenceAfter:       Duration(*silenceAfter),
+			ParseErrorDefaults: defaultParseErrors,
+			Bots:               bots,
+			GeoIP:              geoIP,
+			Certs:              certFiles,
+		}
+		go reloader.Run(ctx)
+	}
+
+	// 多实例部署时每个程序只由持有锁的实例监控
+	hostname, _ := os.Hostname()
+	id := *instanceID
+	if id == "" {
+		id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	var locker *RedisLocker
+	if *redisLockURL != "" {
+		if *redisLockTTL < 3*time.Second {
+			log.Fatalf("-redis-lock-ttl must be at least 3s")
+		}
+		locker = &RedisLocker{URL: *redisLockURL, InstanceID: id, TTL: *redisLockTTL}
+	}
+
+	// 同一 server 的程序被多个主机写入时告警，并按策略拒绝写入或标记
+	var leases *WriterLeases
+	if *writerLeaseTTL != 0 && backendName == "mysql" && *mode != "agent" {
+		if *writerLeaseTTL < 3*time.Second {
+			log.Fatalf("-writer-lease-ttl must be at least 3s")
+		}
+		if err := ValidateLeasePolicy(*writerLeasePolicy); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		leases = &WriterLeases{
+			DB:         db,
+			Env:        *env,
+			Server:     *server,
+			InstanceID: id,
+			Hostname:   hostname,
+			TTL:        *writerLeaseTTL,
+			Policy:     *writerLeasePolicy,
+			Alerter:    alerter,
+		}
+		if status != nil {
+			status.Leases = leases
+		}
 	}
 
-	// 保持主程序持续运行
-	select {}
+	newMonitor := func(program, server string) *Monitor {
+		var optionalFields OptionalFields
+		if p := config.Program(program).Fields; p != nil {
+			optionalFields = *p
+		}
+		return &Monitor{
+			Program:        program,
+			Server:         server,
+			APIList:        currentAPIList,
+			Backend:        backend,
+			Alerter:        alerter,
+			Aggregator:     agg,
+			ErrorRates:     errorRates,
+			Activity:       activity,
+			Counters:       programMetrics.Program(program),
+			Statuses:       statuses,
+			Bursts:         bursts,
+			RateAnomalies:  rateAnomalies,
+			SLOs:           slos,
+			UniqueIPs:      uniqueIPCounter,
+			Slowest:        slowest,
+			TopIPs:         topIPTracker,
+			ParseErrors:    parseErrors,
+			DeadLetter:     deadLetter,
+			InsertFailures: insertFailures,
+
+			BatchSize:     *batchSize,
+			Scrubber:      scrubber,
+			Redactor:      redactor,
+			IgnoreIPs:     ignoreList,
+			Anonymizer:    newAnonymizer(program),
+			QueryParams:   queryParamFilter,
+			Locker:        locker,
+			Leases:        leases,
+			Bots:          bots,
+			BotPolicy:     config.Program(program).Bots,
+			Sampling:      config.Program(program).Sampling,
+			GeoIP:         geoIP,
+			DetectFields:  *detectFields,
+			FieldSep:      separator,
+			GINMode:       *ginMode,
+			FlushInterval: *flushInterval,
+			FlushJitter:   *flushJitter,
+			SlowThreshold: *slowThreshold,
+			ParseOnly:     *mode == "agent",
+
+			HeartbeatInterval: heartbeatEvery,
+			Heartbeats:        heartbeats,
+
+			TimestampFormat: timestampFormat,
+			Version:         config.Program(program).Version,
+			OptionalFields:  optionalFields,
+			Labels:          EncodeLabels(config.Labels),
+			Env:             *env,
+		}
+	}
+
+	// 压测整个处理流程后退出
+	if *simulateLoad {
+		generator, err := NewLoadGenerator(*currentAPIList.Load(), timestampFormat)
+		if err != nil {
+			log.Fatalf("Error simulating load: %v", err)
+		}
+		m := newMonitor(SimulatedProgram, *server)
+		// 生成的行使用 GIN 默认格式
+		m.FieldSep, m.DetectFields, m.GINMode = DefaultFieldSeparator, 0, "release"
+		log.Printf("Simulating %d lines/sec for %s", *simulateLinesPerSec, *simulateDuration)
+		report, err := SimulateLoad(ctx, m, generator, *simulateLinesPerSec, *simulateDuration)
+		if err != nil {
+			log.Fatalf("Error simulating load: %v", err)
+		}
+		if err := report.Print(os.Stdout); err != nil {
+			log.Fatalf("Error printing load report: %v", err)
+		}
+		return
+	}
+
+	if *mode == "collector" {
+		// 接收 agent 转发的条目，不监控本机程序
+		collector := NewCollector(newMonitor)
+		collector.Token = *ingestToken
+		collector.RequireClientCert = *tlsClientCA != ""
+		collector.Env = *env
+		var dedupDB *sql.DB
+		if *dedupPersist {
+			dedupDB = db
+		}
+		collector.Dedup = NewBatchDeduplicator(*dedupWindow, *dedupMaxBatches, dedupDB)
+		go collector.Dedup.Run(ctx, time.Hour)
+		status.Handle("/api/ingest", collector)
+		log.Printf("Accepting entries from agents on %s/api/ingest", *httpAddr)
+	} else if *k8sLabelSelector != "" {
+		// Kubernetes 中按标签选择 pod，代替 supervisord 程序
+		client, namespace, err := NewKubernetesClient(*kubeconfig)
+		if err != nil {
+			log.Fatalf("Error connecting to Kubernetes: %v", err)
+		}
+		if *k8sNamespace != "" {
+			namespace = *k8sNamespace
+		}
+		source := &KubernetesSource{
+			Client:        client,
+			Namespace:     namespace,
+			LabelSelector: *k8sLabelSelector,
+			Container:     *k8sContainer,
+			NewMonitor:    newMonitor,
+		}
+		go source.Run(ctx)
+	} else {
+		monitors := make([]*Monitor, 0, len(programs))
+		for _, program := range programs {
+			monitors = append(monitors, newMonitor(program, *server))
+		}
+		if *tailFromStart {
+			for _, m := range monitors {
+				m.TailFromStart = *tailFromStartBytes
+			}
+		}
+		// 日志文件由 inotify 唤醒，不可用时轮询
+		var notifier *FileNotifier
+		if len(logFiles) > 0 {
+			if notifier, err = NewFileNotifier(); err != nil {
+				log.Printf("Following -log-files by polling every %s (inotify unavailable: %v)", *logFilePollInterval, err)
+			}
+		}
+		for _, m := range monitors {
+			if path, ok := logFiles[m.Program]; ok {
+				m.LogFile, m.TailNLines, m.LogFilePoll, m.FileNotifier = path, *tailNLines, *logFilePollInterval, notifier
+			}
+		}
+
+		// 打印示例 INSERT 语句后退出
+		if *generateSQL {
+			if err := GenerateSQL(os.Stdout, monitors, *sampleLine, *insertType); err != nil {
+				log.Fatalf("Error generating SQL: %v", err)
+			}
+			return
+		}
+		// 轮询 supervisord，程序重启后立即重新 tail
+		if *supervisorPollInterval > 0 {
+			processes := NewProcessWatcher(*supervisorPollInterval)
+			go processes.Run(ctx)
+			for _, m := range monitors {
+				m.Processes = processes
+			}
+		}
+		runMonitors(monitors, *maxPrograms)
+	}
+
+	// 保持主程序持续运行，收到退出信号后写入未关闭的聚合桶、独立 IP 估算、最慢请求和错误样本
+	<-ctx.Done()
+	log.Println("Shutting down")
+	<-aggDone
+	<-uniqueIPsDone
+	<-slowestDone
+	<-burstsDone
+	if dryRunBackend != nil {
+		dryRunBackend.PrintSummary()
+	}
+}
+
+// APIEntry holds the per-API options of an API list line
+type APIEntry struct {
+	SlowThreshold time.Duration
+	// SLO is the availability target as a fraction, e.g. 0.995, 0 if the API has none
+	SLO float64
+	// QueryParams are the query parameters kept for the API in addition to -query-params
+	QueryParams []string
+	// SampleRate replaces the sample_rate of the program's sampling policy for the API, 0 if unset
+	SampleRate float64
+	// MinDepth skips the API for paths with fewer segments past it, so that a short prefix such as
+	// "/api" does not group unrelated paths, 0 if unset
+	MinDepth int
 }
 
-// LoadAPIList loads the APIPath from a file into a map for quick lookup
-func LoadAPIList(filePath string) (map[string]struct{}, error) {
+// LoadAPIList loads the APIPath from a file into a map for quick lookup.
+// Each line is an API path optionally followed by key=value options, e.g. "/api/v1/pay slow=5s slo=99.5 params=coin,version min_depth=1".
+// A bare number is the sample rate of the API, "/api/v1/ping 0.01" is the same as "/api/v1/ping sample=0.01".
+func LoadAPIList(filePath string) (map[string]APIEntry, error) {
 	log.Printf("Loading API list from file: %s", filePath)
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -214,14 +1860,20 @@ func LoadAPIList(filePath string) (map[string]struct{}, error) {
 	}
 	defer file.Close()
 
-	apiList := make(map[string]struct{})
+	apiList := make(map[string]APIEntry)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" {
-			apiList[line] = struct{}{}
-			log.Printf("Loaded API: %s", line)
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
 		}
+		api := fields[0]
+		entry, err := parseAPIOptions(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("API %s: %w", api, err)
+		}
+		apiList[api] = entry
+		log.Printf("Loaded API: %s", api)
 	}
 	if err := scanner.Err(); err != nil {
 		log.Printf("Error reading API list file: %v", err)
@@ -229,3 +1881,52 @@ func LoadAPIList(filePath string) (map[string]struct{}, error) {
 	}
 	return apiList, nil
 }
+
+// parseAPIOptions parses the key=value options following an API path
+func parseAPIOptions(options []string) (APIEntry, error) {
+	var entry APIEntry
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			if _, err := strconv.ParseFloat(option, 64); err != nil {
+				return entry, fmt.Errorf("invalid option %q", option)
+			}
+			key, value = "sample", option
+		}
+		switch key {
+		case "slow":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return entry, fmt.Errorf("invalid slow threshold %q: %w", value, err)
+			}
+			entry.SlowThreshold = d
+		case "slo":
+			percent, err := strconv.ParseFloat(value, 64)
+			if err != nil || percent <= 0 || percent >= 100 {
+				return entry, fmt.Errorf("invalid SLO %q, expected a percentage below 100", value)
+			}
+			entry.SLO = percent / 100
+		case "sample":
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || !(rate > 0 && rate <= 1) {
+				return entry, fmt.Errorf("invalid sample rate %q, expected a fraction in (0,1]", value)
+			}
+			entry.SampleRate = rate
+		case "min_depth":
+			depth, err := strconv.Atoi(value)
+			if err != nil || depth < 0 {
+				return entry, fmt.Errorf("invalid min_depth %q, expected a number of path segments", value)
+			}
+			entry.MinDepth = depth
+		case "params":
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					entry.QueryParams = append(entry.QueryParams, name)
+				}
+			}
+		default:
+			return entry, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return entry, nil
+}
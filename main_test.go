@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testMonitor returns a monitor of program "api" matching /api/v1/users, writing to backend
+func testMonitor(backend Backend, batchSize int) *Monitor {
+	apiList := &atomic.Pointer[map[string]APIEntry]{}
+	apiList.Store(&map[string]APIEntry{"/api/v1/users": {}})
+	return &Monitor{
+		Program:   "api",
+		Server:    "web-01",
+		APIList:   apiList,
+		Backend:   backend,
+		BatchSize: batchSize,
+		GINMode:   "release",
+
+		TimestampFormat: DefaultTimestampFormat,
+	}
+}
+
+// ginLines returns n GIN lines of distinct paths under /api/v1/users
+func ginLines(n int) string {
+	var b strings.Builder
+	for i := range n {
+		fmt.Fprintf(&b, "[GIN] 2024/01/01 - 00:00:%02d | 200 |    1.234ms |   127.0.0.1 | GET      \"/api/v1/users/%d\"\n", i%60, i)
+	}
+	return b.String()
+}
+
+// batchSizes returns the number of entries of each batch
+func batchSizes(batches [][]*LogEntry) []int {
+	sizes := make([]int, len(batches))
+	for i, batch := range batches {
+		sizes[i] = len(batch)
+	}
+	return sizes
+}
+
+func TestMonitorLogs_BatchFlush(t *testing.T) {
+	backend := &MemoryBackend{}
+	m := testMonitor(backend, 100)
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- processLogs(m, r) }()
+
+	if _, err := io.WriteString(w, ginLines(250)); err != nil {
+		t.Fatal(err)
+	}
+	// 没有定时刷新，最后 50 条要等到 EOF 才写入
+	deadline := time.Now().Add(5 * time.Second)
+	for len(backend.Batches()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := batchSizes(backend.Batches()); fmt.Sprint(got) != "[100 100]" {
+		t.Fatalf("batches before EOF = %v, want [100 100]", got)
+	}
+
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("processLogs: %v", err)
+	}
+	if got := batchSizes(backend.Batches()); fmt.Sprint(got) != "[100 100 50]" {
+		t.Fatalf("batches after EOF = %v, want [100 100 50]", got)
+	}
+	entries := backend.Entries()
+	for i, entry := range entries {
+		if want := fmt.Sprintf("/api/v1/users/%d", i); entry.RawPath != want || entry.APIPath != "/api/v1/users" {
+			t.Fatalf("entry %d has path %s matched as %s, want %s matched as /api/v1/users", i, entry.RawPath, entry.APIPath, want)
+		}
+	}
+}
+
+func TestMonitorLogs_BatchFlushSizeOne(t *testing.T) {
+	backend := &MemoryBackend{}
+	if err := processLogs(testMonitor(backend, 1), strings.NewReader(ginLines(250))); err != nil {
+		t.Fatalf("processLogs: %v", err)
+	}
+	batches := backend.Batches()
+	if len(batches) != 250 {
+		t.Fatalf("got %d batches, want 250", len(batches))
+	}
+	for i, batch := range batches {
+		if len(batch) != 1 {
+			t.Fatalf("batch %d has %d entries, want 1", i, len(batch))
+		}
+	}
+}
+
+// TestParseLogWithAWK_Injection checks that shell syntax in a line is not run. ParseLogWithAWK used to
+// paste the line into "echo '%s' | awk ..." run by sh, where a single quote in a request path closed the
+// quoting and ran the rest of the path as a command, so each payload must now come back as plain text
+// in the path and the canary file the payloads try to create must not exist.
+func TestParseLogWithAWK_Injection(t *testing.T) {
+	canary := filepath.Join(t.TempDir(), "pwned")
+	tests := []struct {
+		name, path string
+		// want is the path as awk splits it, up to its first space
+		want string
+	}{
+		{"quote and rm", "/api/x'; rm -rf /tmp/test '", "/api/x';"},
+		{"quote and touch", "/api/x'; touch " + canary + " '", "/api/x';"},
+		{"command substitution", "/api/$(whoami)", "/api/$(whoami)"},
+		{"quoted command substitution", "/api/x'$(touch " + canary + ")'", "/api/x'$(touch"},
+		{"backticks", "/api/`whoami`", "/api/`whoami`"},
+		{"quoted backticks", "/api/x'`touch " + canary + "`'", "/api/x'`touch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := `[GIN] 2024/01/01 - 00:00:00 | 200 |    1.234ms |   127.0.0.1 | GET      "` + tt.path + `"`
+			entry, err := ParseLogWithAWK(line, "web-01", "api")
+			if err != nil {
+				t.Fatalf("ParseLogWithAWK(%q): %v", line, err)
+			}
+			if entry.APIPath != tt.want || entry.Method != "GET" || entry.IP != "127.0.0.1" {
+				t.Errorf("ParseLogWithAWK(%q) = %s %s from %s, want GET %s from 127.0.0.1", line, entry.Method, entry.APIPath, entry.IP, tt.want)
+			}
+			if _, err := os.Stat(canary); err == nil {
+				t.Fatalf("the payload of %q was run by a shell and created %s", line, canary)
+			}
+		})
+	}
+}
+
+func TestBuildInsertSQL(t *testing.T) {
+	for _, entries := range [][]*LogEntry{nil, {}} {
+		if _, _, err := BuildInsertSQL("oula_logs_record", entries, "insert"); err == nil {
+			t.Errorf("BuildInsertSQL of %d entries did not fail", len(entries))
+		}
+	}
+
+	t.Run("single entry", func(t *testing.T) {
+		entry := &LogEntry{
+			Env: "production", Server: "web-01", Program: "api", Date: "2024/01/01", Time: "12:00:00",
+			StatusCode: "500", Duration: 1500 * time.Millisecond, IP: "10.0.0.1", Method: "POST",
+			APIPath: "/api/v1/users", RawPath: "/api/v1/users/42?page=2", IsSlow: true, SampledWeight: 4,
+			SampleRate: 0.5, Country: "JP", ASN: 64500, IsBot: true, QueryParams: "page=2", AppVersion: "v1.2.3",
+			Labels: `{"region":"ap-east-1"}`, Protocol: "HTTP/2.0", TLSVersion: "TLSv1.3",
+		}
+		query, args, err := BuildInsertSQL("oula_logs_record", []*LogEntry{entry}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "INSERT INTO oula_logs_record (" + insertColumnList + ") VALUES " + insertRowPlaceholders; query != want {
+			t.Errorf("query = %s, want %s", query, want)
+		}
+		want := []any{"production", "web-01", "api", "2024/01/01", "12:00:00", "500", int64(1500), "10.0.0.1", "POST",
+			"/api/v1/users", true, 4.0, sql.NullString{String: "JP", Valid: true}, sql.NullInt64{Int64: 64500, Valid: true},
+			true, sql.NullString{String: "page=2", Valid: true}, sql.NullString{String: "v1.2.3", Valid: true},
+			sql.NullString{String: `{"region":"ap-east-1"}`, Valid: true}, sql.NullString{String: "HTTP/2.0", Valid: true},
+			sql.NullString{String: "TLSv1.3", Valid: true}, sql.NullString{String: "/api/v1/users/42", Valid: true}, 0.5}
+		if len(want) != insertColumns || !reflect.DeepEqual(args, want) {
+			t.Errorf("args = %#v, want %#v", args, want)
+		}
+	})
+
+	// 未知的位置、参数、版本、标签、协议和原始路径写入 NULL
+	t.Run("empty optional fields", func(t *testing.T) {
+		_, args, err := BuildInsertSQL("oula_logs_record", []*LogEntry{{Method: "GET"}}, "insert")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range []int{12, 13, 15, 16, 17, 18, 19, 20} {
+			if v, ok := args[i].(driver.Valuer); !ok {
+				t.Errorf("arg %d (%s) = %#v, want a NULL", i, recordColumns[i].Name, args[i])
+			} else if value, _ := v.Value(); value != nil {
+				t.Errorf("arg %d (%s) = %#v, want NULL", i, recordColumns[i].Name, value)
+			}
+		}
+		if args[21] != 1.0 {
+			t.Errorf("sample_rate of an unsampled entry = %v, want 1", args[21])
+		}
+	})
+
+	t.Run("100 entries", func(t *testing.T) {
+		entries := make([]*LogEntry, 100)
+		for i := range entries {
+			entries[i] = &LogEntry{Server: fmt.Sprintf("web-%02d", i), Method: "GET", RawPath: fmt.Sprintf("/api/v1/users/%d", i)}
+		}
+		query, args, err := BuildInsertSQL("oula_logs_record", entries, "insert-ignore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(query, "INSERT IGNORE INTO oula_logs_record (") {
+			t.Errorf("query = %.60s..., want an INSERT IGNORE", query)
+		}
+		if n := strings.Count(query, "?"); n != 100*insertColumns {
+			t.Errorf("query has %d placeholders, want %d", n, 100*insertColumns)
+		}
+		if n := strings.Count(query, insertRowPlaceholders); n != 100 {
+			t.Errorf("query has %d rows, want 100", n)
+		}
+		if len(args) != 100*insertColumns {
+			t.Fatalf("got %d args, want %d", len(args), 100*insertColumns)
+		}
+		for i := range entries {
+			row := args[i*insertColumns : (i+1)*insertColumns]
+			if want := fmt.Sprintf("web-%02d", i); row[1] != want {
+				t.Errorf("server of row %d = %v, want %s", i, row[1], want)
+			}
+			if want := (sql.NullString{String: fmt.Sprintf("/api/v1/users/%d", i), Valid: true}); row[20] != want {
+				t.Errorf("raw_path of row %d = %v, want %v", i, row[20], want)
+			}
+		}
+	})
+
+	t.Run("nil entry", func(t *testing.T) {
+		entries := []*LogEntry{{Method: "GET"}, nil, {Method: "GET"}}
+		if _, _, err := BuildInsertSQL("oula_logs_record", entries, "insert"); err == nil || !strings.Contains(err.Error(), "entry 1 is nil") {
+			t.Errorf("BuildInsertSQL with a nil entry = %v, want entry 1 is nil", err)
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		if _, _, err := BuildInsertSQL("oula_logs_record", []*LogEntry{{}}, "upsert"); err == nil {
+			t.Error("an unknown insert type did not fail")
+		}
+		if _, _, err := BuildInsertSQL("oula_logs_record", make([]*LogEntry, maxInsertRows+1), "insert"); err == nil {
+			t.Errorf("%d entries did not fail", maxInsertRows+1)
+		}
+	})
+}
+
+// testDB opens the MySQL database of LOG_MONITOR_TEST_DSN and migrates it, skipping the test if it is not
+// set. The tests write rows of their own environment and delete them, so a shared database can be used.
+func testDB(tb testing.TB) *sql.DB {
+	tb.Helper()
+	dsn := os.Getenv("LOG_MONITOR_TEST_DSN")
+	if dsn == "" {
+		tb.Skip("LOG_MONITOR_TEST_DSN is not set, e.g. root:secret@tcp(127.0.0.1:3306)/logmonitor_test")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	if err := MigrateSchema(context.Background(), db); err != nil {
+		tb.Fatalf("migrating %s: %v", dsn, err)
+	}
+	return db
+}
+
+// deleteEnv deletes the raw rows of env now and when the test ends
+func deleteEnv(tb testing.TB, db *sql.DB, env string) {
+	tb.Helper()
+	clean := func() {
+		if _, err := db.Exec(`DELETE FROM oula_logs_record WHERE env = ?`, env); err != nil {
+			tb.Errorf("deleting the rows of %s: %v", env, err)
+		}
+	}
+	clean()
+	tb.Cleanup(clean)
+}
+
+// testEntry returns an entry of env on the day daysAgo days before now
+func testEntry(env string, now time.Time, daysAgo int) *LogEntry {
+	return &LogEntry{
+		Env: env, Server: "web-01", Program: "api",
+		Date: now.AddDate(0, 0, -daysAgo).Format(DefaultTimestampFormat.Date), Time: "12:00:00",
+		StatusCode: "200", Duration: 5 * time.Millisecond, IP: "127.0.0.1", Method: "GET",
+		APIPath: "/api/v1/users", RawPath: "/api/v1/users/42", SampledWeight: 1,
+	}
+}
+
+func TestRetentionCutoff(t *testing.T) {
+	tests := []struct {
+		now  string
+		days int
+		want string
+	}{
+		{"2024-01-10 00:00:01", 8, "2024-01-02 00:00:01"},
+		{"2024-01-10 23:59:59", 8, "2024-01-02 23:59:59"},
+		{"2024-03-01 12:00:00", 1, "2024-02-29 12:00:00"},
+		{"2024-01-10 12:00:00", 0, "2024-01-10 12:00:00"},
+	}
+	for _, tt := range tests {
+		now, err := time.Parse("2006-01-02 15:04:05", tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := RetentionCutoff(now, tt.days); got != tt.want {
+			t.Errorf("RetentionCutoff(%s, %d) = %s, want %s", tt.now, tt.days, got, tt.want)
+		}
+	}
+}
+
+// TestCleanOldLogs runs CleanOldLogs against a SQLite table with the env and date columns of
+// oula_logs_record, so that it runs without LOG_MONITOR_TEST_DSN
+func TestCleanOldLogs(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "logs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE oula_logs_record (id INTEGER PRIMARY KEY, env TEXT NOT NULL, date TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)
+	for _, env := range []string{"production", "staging"} {
+		for _, daysAgo := range []int{7, 8, 9} {
+			if _, err := db.Exec(`INSERT INTO oula_logs_record (env, date) VALUES (?, ?)`, env, now.AddDate(0, 0, -daysAgo).Format("2006-01-02")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// 第二次调用不再删除任何行
+	for i := range 2 {
+		if err := CleanOldLogs(db, "production", now, 8); err != nil {
+			t.Fatalf("call %d: %v", i+1, err)
+		}
+		rows, err := db.Query(`SELECT env, date FROM oula_logs_record ORDER BY env, date`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kept []string
+		for rows.Next() {
+			var env, day string
+			if err := rows.Scan(&env, &day); err != nil {
+				t.Fatal(err)
+			}
+			kept = append(kept, env+" "+day)
+		}
+		rows.Close()
+		// 只删除 production 的行
+		want := "[production 2024-01-03 staging 2024-01-01 staging 2024-01-02 staging 2024-01-03]"
+		if got := fmt.Sprint(kept); got != want {
+			t.Errorf("call %d kept the rows %s, want %s", i+1, got, want)
+		}
+	}
+}
+
+// BenchmarkInsertLogEntry inserts batches of 1 to 1000 entries into the database of LOG_MONITOR_TEST_DSN,
+// e.g. the MySQL container of make bench-mysql or one started for the run:
+//
+//	docker run -d -p 3306:3306 -e MYSQL_ROOT_PASSWORD=secret -e MYSQL_DATABASE=logmonitor_test mysql:8
+//	LOG_MONITOR_TEST_DSN='root:secret@tcp(127.0.0.1:3306)/logmonitor_test' go test -run '^$' -bench BenchmarkInsertLogEntry
+func BenchmarkInsertLogEntry(b *testing.B) {
+	db := testDB(b)
+	const env = "bench-insert-log-entry"
+	deleteEnv(b, db, env)
+	// 每次插入都会记录日志
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	now := time.Now()
+	for _, size := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			entries := make([]*LogEntry, size)
+			for i := range entries {
+				entries[i] = testEntry(env, now, 0)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if err := InsertLogEntry(context.Background(), db, entries, 0, "insert"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*size), "ns/entry")
+		})
+	}
+}
+
+// countingConn counts the bytes read and written on a connection
+type countingConn struct {
+	net.Conn
+	bytes *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.bytes.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytes.Add(int64(n))
+	return n, err
+}
+
+// BenchmarkInsertLogEntryCompression inserts batches of 100 entries with long paths into the database of
+// LOG_MONITOR_TEST_DSN with and without the compressed protocol of -db-compress, and reports the bytes
+// sent and received per batch. The server should be local so that the network does not dominate.
+func BenchmarkInsertLogEntryCompression(b *testing.B) {
+	const env = "bench-insert-compression"
+	deleteEnv(b, testDB(b), env)
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	now := time.Now()
+	entries := make([]*LogEntry, 100)
+	for i := range entries {
+		entries[i] = testEntry(env, now, 0)
+		entries[i].RawPath = fmt.Sprintf("/api/v1/users/%d/orders/%d/items?page=%d&sort=created_at", i, i*7, i%5)
+		entries[i].QueryParams = fmt.Sprintf("page=%d&sort=created_at", i%5)
+	}
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%t", compress), func(b *testing.B) {
+			cfg, err := mysql.ParseDSN(os.Getenv("LOG_MONITOR_TEST_DSN"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := cfg.Apply(mysql.EnableCompression(compress)); err != nil {
+				b.Fatal(err)
+			}
+			var transferred atomic.Int64
+			var dialer net.Dialer
+			cfg.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &countingConn{Conn: conn, bytes: &transferred}, nil
+			}
+			connector, err := mysql.NewConnector(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			db := sql.OpenDB(connector)
+			defer db.Close()
+			// 不计入建立连接和握手的流量
+			if err := db.Ping(); err != nil {
+				b.Fatal(err)
+			}
+			transferred.Store(0)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if err := InsertLogEntry(context.Background(), db, entries, 0, "insert"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(transferred.Load())/float64(b.N), "bytes/batch")
+		})
+	}
+}
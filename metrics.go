@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherEndpoint is the endpoint label of requests that matched no API list entry
+const otherEndpoint = "other"
+
+// requestsTotal counts parsed requests by program, matched API list entry and status class.
+// The API list is curated, so the endpoint label stays bounded. It is registered by
+// RegisterRequestMetrics only when an API list is loaded.
+var requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_requests_total",
+	Help: "Parsed requests by program, matched API list entry (\"other\" when unmatched) and status class.",
+}, []string{"program", "endpoint", "status_class"})
+
+// slowRequestsTotal counts the requests flagged is_slow by program and API list entry, to tune
+// -slow-threshold and the per-API slow= thresholds against logmonitor_requests_total. It is bounded
+// and registered like requestsTotal.
+var slowRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_slow_requests_total",
+	Help: "Requests at least as slow as the slow threshold of their endpoint, by program and matched API list entry.",
+}, []string{"program", "endpoint"})
+
+// requestMetricsEnabled is set once the request counters are registered
+var requestMetricsEnabled bool
+
+// RegisterRequestMetrics registers the per-endpoint request counters
+func RegisterRequestMetrics() {
+	prometheus.MustRegister(requestsTotal, slowRequestsTotal)
+	requestMetricsEnabled = true
+}
+
+// countRequest increments the request counter for an entry, endpoint is the matched API or "" when unmatched
+func countRequest(entry *LogEntry, endpoint string) {
+	if !requestMetricsEnabled {
+		return
+	}
+	if endpoint == "" {
+		endpoint = otherEndpoint
+	}
+	requestsTotal.WithLabelValues(entry.Program, endpoint, StatusClass(entry.StatusCode)).Inc()
+}
+
+// countSlowRequest increments the slow request counter for an entry flagged is_slow, endpoint is the
+// matched API or "" when unmatched
+func countSlowRequest(entry *LogEntry, endpoint string) {
+	if !requestMetricsEnabled || !entry.IsSlow {
+		return
+	}
+	if endpoint == "" {
+		endpoint = otherEndpoint
+	}
+	slowRequestsTotal.WithLabelValues(entry.Program, endpoint).Inc()
+}
+
+// protocolRequestsTotal counts parsed requests by program, HTTP protocol and TLS version, for programs
+// whose format logs them, see OptionalFields
+var protocolRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_protocol_requests_total",
+	Help: "Parsed requests by program, HTTP protocol and TLS version (\"none\" over plain HTTP), for formats that log them.",
+}, []string{"program", "protocol", "tls_version"})
+
+func init() {
+	prometheus.MustRegister(protocolRequestsTotal)
+}
+
+// knownProtocols are the protocol and TLS version label values, others are counted as "other" so that
+// malformed fields cannot grow the number of series
+var knownProtocols = map[string]struct{}{
+	"HTTP/0.9": {}, "HTTP/1.0": {}, "HTTP/1.1": {}, "HTTP/2": {}, "HTTP/2.0": {}, "HTTP/3": {}, "HTTP/3.0": {},
+	"SSLv2": {}, "SSLv3": {}, "TLSv1": {}, "TLSv1.1": {}, "TLSv1.2": {}, "TLSv1.3": {},
+}
+
+// protocolLabel returns the label value of a protocol or TLS version, empty if it was not logged
+func protocolLabel(value, empty string) string {
+	if value == "" {
+		return empty
+	}
+	if _, ok := knownProtocols[value]; !ok {
+		return "other"
+	}
+	return value
+}
+
+// countProtocol increments the protocol counter for an entry whose format logs its protocol or TLS version
+func countProtocol(entry *LogEntry) {
+	if entry.Protocol == "" && entry.TLSVersion == "" {
+		return
+	}
+	protocolRequestsTotal.WithLabelValues(entry.Program, protocolLabel(entry.Protocol, "unknown"), protocolLabel(entry.TLSVersion, "none")).Inc()
+}
@@ -0,0 +1,83 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: backend.go
+//
+// Generated by this command:
+//
+//	mockgen -source=backend.go -destination=mock_backend_test.go -package=main
+//
+
+// Package main is a generated GoMock package.
+package main
+
+import (
+	context "context"
+	reflect "reflect"
+
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockBackend is a mock of Backend interface.
+type MockBackend struct {
+	ctrl     *gomock.Controller
+	recorder *MockBackendMockRecorder
+	isgomock struct{}
+}
+
+// MockBackendMockRecorder is the mock recorder for MockBackend.
+type MockBackendMockRecorder struct {
+	mock *MockBackend
+}
+
+// NewMockBackend creates a new mock instance.
+func NewMockBackend(ctrl *gomock.Controller) *MockBackend {
+	mock := &MockBackend{ctrl: ctrl}
+	mock.recorder = &MockBackendMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockBackend) EXPECT() *MockBackendMockRecorder {
+	return m.recorder
+}
+
+// CleanOld mocks base method.
+func (m *MockBackend) CleanOld() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CleanOld")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CleanOld indicates an expected call of CleanOld.
+func (mr *MockBackendMockRecorder) CleanOld() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CleanOld", reflect.TypeOf((*MockBackend)(nil).CleanOld))
+}
+
+// Insert mocks base method.
+func (m *MockBackend) Insert(entries []*LogEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Insert", entries)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Insert indicates an expected call of Insert.
+func (mr *MockBackendMockRecorder) Insert(entries any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Insert", reflect.TypeOf((*MockBackend)(nil).Insert), entries)
+}
+
+// IsHealthy mocks base method.
+func (m *MockBackend) IsHealthy(ctx context.Context) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsHealthy", ctx)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsHealthy indicates an expected call of IsHealthy.
+func (mr *MockBackendMockRecorder) IsHealthy(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsHealthy", reflect.TypeOf((*MockBackend)(nil).IsHealthy), ctx)
+}
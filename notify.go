@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Alert is the JSON body posted to the webhook
+type Alert struct {
+	Type      string    `json:"type"`
+	Server    string    `json:"server"`
+	Program   string    `json:"program,omitempty"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	Value     float64   `json:"value,omitempty"`
+	Threshold float64   `json:"threshold,omitempty"`
+	Window    string    `json:"window,omitempty"`
+	Sample    string    `json:"sample,omitempty"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+// TestAlertType is sent to every notifier regardless of its event filter
+const TestAlertType = "test"
+
+// IsRecovery reports whether the alert announces that a condition has cleared
+func (a *Alert) IsRecovery() bool {
+	return strings.HasSuffix(a.Type, "_recovered")
+}
+
+// WebhookAlerter posts alerts as JSON to a webhook URL. With a template, the request body is the
+// template rendered over the Alert instead, for gateways expecting their own payload shape.
+type WebhookAlerter struct {
+	URL     string
+	Headers http.Header
+	Client  *http.Client
+	// Method is the HTTP method, POST if empty
+	Method string
+	// ExpectStatus lists the status codes accepted as delivered, any 2xx if empty
+	ExpectStatus []int
+
+	template *template.Template
+}
+
+// NewWebhookAlerter creates an alerter for url, adding headers to every request
+func NewWebhookAlerter(url string, headers http.Header) *WebhookAlerter {
+	return &WebhookAlerter{
+		URL:     url,
+		Headers: headers,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// webhookTemplateFuncs are the functions available to webhook templates: json encodes a value,
+// e.g. {{json .Message}} for a quoted and escaped string
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// webhookTemplateSample is the alert a template is rendered over when it is set, with every field filled
+var webhookTemplateSample = &Alert{
+	Type: "error_rate_high", Server: "server", Program: "program", Endpoint: "/api/v1/sample",
+	Value: 0.5, Threshold: 0.1, Window: "1m0s", Sample: "[GIN] sample line", Message: "sample alert",
+	Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+}
+
+// SetTemplate parses the body template and renders it once over a sample alert, so that both syntax
+// errors and references to unknown fields are reported when the config is loaded. Unless a Content-Type
+// header says otherwise the body is sent as JSON, and the sample rendering must be valid JSON.
+func (w *WebhookAlerter) SetTemplate(source string) error {
+	t, err := template.New("webhook").Funcs(webhookTemplateFuncs).Parse(source)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, webhookTemplateSample); err != nil {
+		return err
+	}
+	if w.contentType() == "application/json" && !json.Valid(b.Bytes()) {
+		return fmt.Errorf("template does not render valid JSON: %s", b.String())
+	}
+	w.template = t
+	return nil
+}
+
+// contentType returns the Content-Type of the requests
+func (w *WebhookAlerter) contentType() string {
+	if ct := w.Headers.Get("Content-Type"); ct != "" {
+		return ct
+	}
+	return "application/json"
+}
+
+// Send posts the alert to the webhook
+func (w *WebhookAlerter) Send(alert *Alert) error {
+	var body []byte
+	if w.template != nil {
+		var b bytes.Buffer
+		if err := w.template.Execute(&b, alert); err != nil {
+			return err
+		}
+		body = b.Bytes()
+	} else {
+		var err error
+		if body, err = json.Marshal(alert); err != nil {
+			return err
+		}
+	}
+
+	method := w.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range w.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("Content-Type", w.contentType())
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if len(w.ExpectStatus) > 0 {
+		for _, code := range w.ExpectStatus {
+			if resp.StatusCode == code {
+				return nil
+			}
+		}
+		return fmt.Errorf("webhook returned status %d, expected %v", resp.StatusCode, w.ExpectStatus)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Notifier delivers alerts to one channel
+type Notifier interface {
+	Send(alert *Alert) error
+}
+
+// notifyFailuresTotal counts alerts that could not be delivered
+var notifyFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_notify_failures_total",
+	Help: "Alerts that failed to be delivered or were dropped, by notifier.",
+}, []string{"notifier"})
+
+func init() {
+	prometheus.MustRegister(notifyFailuresTotal)
+}
+
+// namedNotifier is a notifier registered in a Dispatcher
+type namedNotifier struct {
+	name     string
+	notifier Notifier
+	// events limits the alert types sent to the notifier, nil sends all
+	events map[string]struct{}
+}
+
+// dispatchQueueSize is the number of alerts buffered before new ones are dropped
+const dispatchQueueSize = 100
+
+// Dispatcher sends every alert to all registered notifiers from a background goroutine,
+// so a slow or failing channel never blocks ingestion
+type Dispatcher struct {
+	notifiers []namedNotifier
+	once      sync.Once
+	queue     chan *Alert
+}
+
+// Add registers a notifier under name, used in log messages and metrics.
+// If events is not empty only those alert types are sent to it.
+func (d *Dispatcher) Add(name string, notifier Notifier, events []string) {
+	n := namedNotifier{name: name, notifier: notifier}
+	if len(events) > 0 {
+		n.events = make(map[string]struct{})
+		for _, event := range events {
+			n.events[event] = struct{}{}
+		}
+	}
+	d.notifiers = append(d.notifiers, n)
+}
+
+// Notify queues the alert for delivery, a nil dispatcher is a no-op
+func (d *Dispatcher) Notify(alert *Alert) {
+	if d == nil || len(d.notifiers) == 0 {
+		return
+	}
+	if alert.Time.IsZero() {
+		alert.Time = time.Now()
+	}
+	d.once.Do(func() {
+		d.queue = make(chan *Alert, dispatchQueueSize)
+		go d.run()
+	})
+	select {
+	case d.queue <- alert:
+	default:
+		log.Printf("Alert queue full, dropping %s alert", alert.Type)
+		notifyFailuresTotal.WithLabelValues("queue").Inc()
+	}
+}
+
+// run delivers queued alerts
+func (d *Dispatcher) run() {
+	for alert := range d.queue {
+		d.deliver(alert)
+	}
+}
+
+// deliver sends the alert to every notifier accepting its type and logs delivery errors
+func (d *Dispatcher) deliver(alert *Alert) {
+	for _, n := range d.notifiers {
+		if n.events != nil && alert.Type != TestAlertType {
+			if _, ok := n.events[alert.Type]; !ok {
+				continue
+			}
+		}
+		if err := n.notifier.Send(alert); err != nil {
+			log.Printf("Error sending %s alert to %s: %v", alert.Type, n.name, err)
+			notifyFailuresTotal.WithLabelValues(n.name).Inc()
+		}
+	}
+}
+
+// SlackNotifier posts alerts to a Slack incoming webhook
+type SlackNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewSlackNotifier creates a notifier for a Slack incoming webhook URL
+func NewSlackNotifier(url string) *SlackNotifier {
+	return &SlackNotifier{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Send posts the alert as a Slack message
+func (s *SlackNotifier) Send(alert *Alert) error {
+	return postJSON(s.Client, s.URL, map[string]string{"text": FormatAlertText(alert)})
+}
+
+// FormatAlertText renders an alert as a short plain text message
+func FormatAlertText(alert *Alert) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", alert.Type, alert.Server)
+	if alert.Program != "" {
+		fmt.Fprintf(&b, "/%s", alert.Program)
+	}
+	if alert.Endpoint != "" {
+		fmt.Fprintf(&b, " %s", alert.Endpoint)
+	}
+	fmt.Fprintf(&b, ": %s", alert.Message)
+	if alert.Sample != "" {
+		fmt.Fprintf(&b, "\nSample: %s", alert.Sample)
+	}
+	return b.String()
+}
+
+// FormatAlertMarkdown renders an alert as a markdown message body
+func FormatAlertMarkdown(alert *Alert) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s**\n\n", alert.Message)
+	fmt.Fprintf(&b, "- Server: %s\n", alert.Server)
+	if alert.Program != "" {
+		fmt.Fprintf(&b, "- Program: %s\n", alert.Program)
+	}
+	if alert.Endpoint != "" {
+		fmt.Fprintf(&b, "- Endpoint: %s\n", alert.Endpoint)
+	}
+	if alert.Window != "" {
+		fmt.Fprintf(&b, "- Window: %s\n", alert.Window)
+	}
+	fmt.Fprintf(&b, "- Time: %s\n", alert.Time.Format("2006-01-02 15:04:05"))
+	if alert.Sample != "" {
+		fmt.Fprintf(&b, "\n`%s`\n", alert.Sample)
+	}
+	return b.String()
+}
+
+// postJSON posts v as JSON and expects a 2xx response
+func postJSON(client *http.Client, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// ParseWebhookHeaders parses a "Key:Value,Key:Value" list into an http.Header.
+// Values cannot contain commas.
+func ParseWebhookHeaders(s string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q: expected Key:Value", pair)
+		}
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if !ValidHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("invalid value for header %q", name)
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
+
+// ValidHeaderName reports whether name is a token as defined by RFC 7230 section 3.2.6
+func ValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// EmailConfig configures the SMTP notifier
+type EmailConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// TLS is "none", "starttls" (default) or "tls" for implicit TLS
+	TLS  string   `json:"tls,omitempty"`
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	// Subject and Body map an alert type, or "default", to a text/template rendered over the Alert
+	Subject map[string]string `json:"subject,omitempty"`
+	Body    map[string]string `json:"body,omitempty"`
+	// Timeout bounds a whole delivery, 30s if unset
+	Timeout Duration `json:"timeout,omitempty"`
+	// Coalesce suppresses identical alerts within this window and reports how many were suppressed in the next mail
+	Coalesce Duration `json:"coalesce,omitempty"`
+}
+
+const (
+	defaultEmailSubject = `[log-monitor] {{.Type}} on {{.Server}}{{if .Program}}/{{.Program}}{{end}}`
+	defaultEmailBody    = `{{.Message}}
+
+Server:   {{.Server}}
+{{- if .Program}}
+Program:  {{.Program}}{{end}}
+{{- if .Endpoint}}
+Endpoint: {{.Endpoint}}{{end}}
+{{- if .Window}}
+Window:   {{.Window}}{{end}}
+Time:     {{.Time.Format "2006-01-02 15:04:05"}}
+{{- if .Sample}}
+
+Sample:
+{{.Sample}}{{end}}
+`
+)
+
+// EmailNotifier sends alerts by SMTP
+type EmailNotifier struct {
+	config   EmailConfig
+	subjects map[string]*template.Template
+	bodies   map[string]*template.Template
+
+	mu         sync.Mutex
+	lastSent   map[string]time.Time
+	suppressed map[string]int
+}
+
+// NewEmailNotifier parses the templates of config, template errors are returned here rather than at delivery
+func NewEmailNotifier(config EmailConfig) (*EmailNotifier, error) {
+	if config.Host == "" || config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("email notifier needs host, from and to")
+	}
+	if config.Port == 0 {
+		config.Port = 587
+	}
+	switch config.TLS {
+	case "":
+		config.TLS = "starttls"
+	case "none", "starttls", "tls":
+	default:
+		return nil, fmt.Errorf("unknown tls mode %q", config.TLS)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = Duration(30 * time.Second)
+	}
+
+	n := &EmailNotifier{
+		config:     config,
+		lastSent:   make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+	var err error
+	if n.subjects, err = parseAlertTemplates("subject", config.Subject, defaultEmailSubject); err != nil {
+		return nil, err
+	}
+	if n.bodies, err = parseAlertTemplates("body", config.Body, defaultEmailBody); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// parseAlertTemplates parses a template per alert type, adding def as "default" when not configured
+func parseAlertTemplates(name string, sources map[string]string, def string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	if _, ok := sources["default"]; !ok {
+		templates["default"] = template.Must(template.New(name).Parse(def))
+	}
+	for alertType, source := range sources {
+		t, err := template.New(name + ":" + alertType).Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("%s template for %s: %w", name, alertType, err)
+		}
+		templates[alertType] = t
+	}
+	return templates, nil
+}
+
+// render executes the template for the alert type, falling back to "default"
+func render(templates map[string]*template.Template, alert *Alert) (string, error) {
+	t, ok := templates[alert.Type]
+	if !ok {
+		t = templates["default"]
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, alert); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Send mails the alert unless an identical one was sent within the coalesce window
+func (n *EmailNotifier) Send(alert *Alert) error {
+	key := strings.Join([]string{alert.Type, alert.Server, alert.Program, alert.Endpoint}, "\x00")
+
+	n.mu.Lock()
+	window := time.Duration(n.config.Coalesce)
+	if window > 0 && alert.Time.Sub(n.lastSent[key]) < window {
+		n.suppressed[key]++
+		n.mu.Unlock()
+		return nil
+	}
+	suppressed := n.suppressed[key]
+	delete(n.suppressed, key)
+	n.lastSent[key] = alert.Time
+	n.mu.Unlock()
+
+	subject, err := render(n.subjects, alert)
+	if err != nil {
+		return err
+	}
+	body, err := render(n.bodies, alert)
+	if err != nil {
+		return err
+	}
+	if suppressed > 0 {
+		body += fmt.Sprintf("\n(%d identical alerts suppressed in the last %s)\n", suppressed, window)
+	}
+	return n.send(strings.TrimSpace(subject), body)
+}
+
+// send delivers one message, the whole exchange is bounded by the configured timeout
+func (n *EmailNotifier) send(subject, body string) error {
+	timeout := time.Duration(n.config.Timeout)
+	addr := net.JoinHostPort(n.config.Host, strconv.Itoa(n.config.Port))
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if n.config.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: n.config.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, n.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if n.config.TLS == "starttls" {
+		if err := c.StartTLS(&tls.Config{ServerName: n.config.Host}); err != nil {
+			return err
+		}
+	}
+	if n.config.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.config.Username, n.config.Password, n.config.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.config.From); err != nil {
+		return err
+	}
+	for _, to := range n.config.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		n.config.From, strings.Join(n.config.To, ", "), subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DingTalkNotifier sends alerts as markdown messages to a DingTalk custom robot.
+// When Secret is set, requests are signed as required by robots with signature verification enabled.
+type DingTalkNotifier struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+// NewDingTalkNotifier creates a notifier for a DingTalk robot webhook URL
+func NewDingTalkNotifier(webhookURL, secret string) *DingTalkNotifier {
+	return &DingTalkNotifier{URL: webhookURL, Secret: secret, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Send posts the alert to the robot
+func (d *DingTalkNotifier) Send(alert *Alert) error {
+	target := d.URL
+	if d.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		mac := hmac.New(sha256.New, []byte(d.Secret))
+		mac.Write([]byte(timestamp + "\n" + d.Secret))
+		sign := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+		u, err := url.Parse(d.URL)
+		if err != nil {
+			return err
+		}
+		q := u.Query()
+		q.Set("timestamp", timestamp)
+		q.Set("sign", sign)
+		u.RawQuery = q.Encode()
+		target = u.String()
+	}
+
+	body := map[string]interface{}{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"title": alert.Type,
+			"text":  "### " + alert.Type + "\n\n" + FormatAlertMarkdown(alert),
+		},
+	}
+	return postJSON(d.Client, target, body)
+}
+
+// FeishuNotifier sends alerts as interactive cards to a Feishu (Lark) bot webhook.
+// When Secret is set, requests carry the signature required by bots with signature verification enabled.
+type FeishuNotifier struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+// NewFeishuNotifier creates a notifier for a Feishu bot webhook URL
+func NewFeishuNotifier(webhookURL, secret string) *FeishuNotifier {
+	return &FeishuNotifier{URL: webhookURL, Secret: secret, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Send posts the alert to the bot
+func (f *FeishuNotifier) Send(alert *Alert) error {
+	template := "red"
+	if alert.IsRecovery() {
+		template = "green"
+	}
+	body := map[string]interface{}{
+		"msg_type": "interactive",
+		"card": map[string]interface{}{
+			"header": map[string]interface{}{
+				"title":    map[string]string{"tag": "plain_text", "content": alert.Type},
+				"template": template,
+			},
+			"elements": []interface{}{
+				map[string]string{"tag": "markdown", "content": FormatAlertMarkdown(alert)},
+			},
+		},
+	}
+	if f.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(timestamp+"\n"+f.Secret))
+		body["timestamp"] = timestamp
+		body["sign"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return postJSON(f.Client, f.URL, body)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultPagerDutyURL is the PagerDuty Events API v2 endpoint
+const defaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDutyRecoveries maps each recovery alert type to the alert type it resolves, for the types whose
+// names differ beyond the "_recovered" suffix
+var pagerDutyRecoveries = map[string]string{
+	"error_rate_recovered":    "error_rate_high",
+	"insert_recovered":        "insert_outage",
+	"parse_errors_recovered":  "parse_errors_high",
+	"request_rate_recovered":  "request_rate_anomaly",
+	"slo_burn_rate_recovered": "slo_burn_rate_high",
+	"program_recovered":       "program_silent",
+	"ip_rate_recovered":       "ip_rate_high",
+}
+
+// PagerDutyConfig configures the "pagerduty" notifier
+type PagerDutyConfig struct {
+	// RoutingKey is the integration key of the PagerDuty service
+	RoutingKey string `json:"routing_key"`
+	// URL overrides the Events API endpoint
+	URL string `json:"url,omitempty"`
+	// Severity maps an alert type, or "default", to critical, error, warning or info, critical if unset
+	// and info for test alerts
+	Severity map[string]string `json:"severity,omitempty"`
+	// DryRun logs the events instead of sending them
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// PagerDutyNotifier turns alerts into PagerDuty Events API v2 events. Alerts trigger an incident and the
+// matching recovery alerts resolve it, both carrying a dedup key built from the server, program, endpoint
+// and trigger alert type so PagerDuty groups repeats and auto-resolves on recovery.
+type PagerDutyNotifier struct {
+	config PagerDutyConfig
+	Client *http.Client
+}
+
+// NewPagerDutyNotifier validates the config and creates the notifier
+func NewPagerDutyNotifier(config PagerDutyConfig) (*PagerDutyNotifier, error) {
+	if config.RoutingKey == "" {
+		return nil, fmt.Errorf("missing routing_key")
+	}
+	if config.URL == "" {
+		config.URL = defaultPagerDutyURL
+	}
+	for alertType, severity := range config.Severity {
+		switch severity {
+		case "critical", "error", "warning", "info":
+		default:
+			return nil, fmt.Errorf("severity of %s: unknown severity %q, expected critical, error, warning or info", alertType, severity)
+		}
+	}
+	return &PagerDutyNotifier{config: config, Client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// pagerDutyTriggerType returns the alert type a recovery alert resolves
+func pagerDutyTriggerType(recoveryType string) string {
+	if t, ok := pagerDutyRecoveries[recoveryType]; ok {
+		return t
+	}
+	return strings.TrimSuffix(recoveryType, "_recovered")
+}
+
+// pagerDutyEvents adds the recovery types of the listed trigger types to an event filter, so incidents
+// triggered through a filtered notifier are still resolved
+func pagerDutyEvents(events []string) []string {
+	if len(events) == 0 {
+		return nil
+	}
+	listed := make(map[string]bool, len(events))
+	for _, event := range events {
+		listed[event] = true
+	}
+	withRecoveries := append([]string(nil), events...)
+	for _, event := range events {
+		recovery := event + "_recovered"
+		for r, t := range pagerDutyRecoveries {
+			if t == event {
+				recovery = r
+			}
+		}
+		if !listed[recovery] {
+			listed[recovery] = true
+			withRecoveries = append(withRecoveries, recovery)
+		}
+	}
+	return withRecoveries
+}
+
+// pagerDutyEvent is the body of an Events API v2 request
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+// pagerDutyPayload describes the incident of a trigger event
+type pagerDutyPayload struct {
+	Summary       string `json:"summary"`
+	Source        string `json:"source"`
+	Severity      string `json:"severity"`
+	Timestamp     string `json:"timestamp"`
+	Component     string `json:"component,omitempty"`
+	Group         string `json:"group,omitempty"`
+	Class         string `json:"class"`
+	CustomDetails *Alert `json:"custom_details"`
+}
+
+// severity returns the configured severity of an alert type
+func (p *PagerDutyNotifier) severity(alertType string) string {
+	if s, ok := p.config.Severity[alertType]; ok {
+		return s
+	}
+	if alertType == TestAlertType {
+		return "info"
+	}
+	if s, ok := p.config.Severity["default"]; ok {
+		return s
+	}
+	return "critical"
+}
+
+// event builds the trigger or resolve event of an alert
+func (p *PagerDutyNotifier) event(alert *Alert) pagerDutyEvent {
+	triggerType := alert.Type
+	action := "trigger"
+	if alert.IsRecovery() {
+		triggerType = pagerDutyTriggerType(alert.Type)
+		action = "resolve"
+	}
+	event := pagerDutyEvent{
+		RoutingKey:  p.config.RoutingKey,
+		EventAction: action,
+		DedupKey:    strings.Join([]string{"log-monitor", alert.Server, alert.Program, alert.Endpoint, triggerType}, "/"),
+	}
+	if action == "resolve" {
+		return event
+	}
+
+	summary := FormatAlertText(alert)
+	// 摘要最长 1024 字符，样本行放在详情里
+	if i := strings.IndexByte(summary, '\n'); i >= 0 {
+		summary = summary[:i]
+	}
+	if len(summary) > 1024 {
+		summary = summary[:1021] + "..."
+	}
+	event.Payload = &pagerDutyPayload{
+		Summary:       summary,
+		Source:        alert.Server,
+		Severity:      p.severity(alert.Type),
+		Timestamp:     alert.Time.Format(time.RFC3339),
+		Component:     alert.Program,
+		Group:         alert.Endpoint,
+		Class:         alert.Type,
+		CustomDetails: alert,
+	}
+	return event
+}
+
+// Send sends the event of the alert. A test alert triggers an incident and resolves it right away.
+func (p *PagerDutyNotifier) Send(alert *Alert) error {
+	if alert.Type == TestAlertType {
+		event := p.event(alert)
+		event.DedupKey += "/" + alert.Time.Format(time.RFC3339Nano)
+		if err := p.post(event); err != nil {
+			return err
+		}
+		return p.post(pagerDutyEvent{RoutingKey: event.RoutingKey, EventAction: "resolve", DedupKey: event.DedupKey})
+	}
+	return p.post(p.event(alert))
+}
+
+// post sends an event, or logs it in dry-run mode
+func (p *PagerDutyNotifier) post(event pagerDutyEvent) error {
+	if p.config.DryRun {
+		event.RoutingKey = "xxxxx"
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		log.Printf("PagerDuty dry run, would send: %s", body)
+		return nil
+	}
+	return postJSON(p.Client, p.config.URL, event)
+}
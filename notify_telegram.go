@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TelegramConfig configures the "telegram" notifier
+type TelegramConfig struct {
+	BotToken string `json:"bot_token"`
+	// ChatID is the numeric ID of the chat, or @channelname for a public channel
+	ChatID string `json:"chat_id"`
+	// APIURL overrides the Bot API base URL
+	APIURL string `json:"api_url,omitempty"`
+	// Interval is the minimum time between two messages, 3s if unset, which keeps a group under
+	// Telegram's limit of 20 messages per minute
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// telegramQueueSize is the number of messages buffered before new alerts are dropped
+const telegramQueueSize = 50
+
+// telegramMaxSample is the number of characters of a sample line included in a message
+const telegramMaxSample = 1000
+
+// TelegramNotifier sends alerts as MarkdownV2 messages through the Telegram Bot API. Messages go through
+// an internal queue sent at most one per Interval, and a 429 response is retried after the delay Telegram
+// asks for, so a storm of alerts is delivered late rather than rejected.
+type TelegramNotifier struct {
+	name   string
+	config TelegramConfig
+	Client *http.Client
+
+	once  sync.Once
+	queue chan string
+}
+
+// NewTelegramNotifier validates the config and creates the notifier, name labels its delivery failures
+func NewTelegramNotifier(name string, config TelegramConfig) (*TelegramNotifier, error) {
+	if config.BotToken == "" || config.ChatID == "" {
+		return nil, fmt.Errorf("telegram notifier needs bot_token and chat_id")
+	}
+	if config.APIURL == "" {
+		config.APIURL = "https://api.telegram.org"
+	}
+	if config.Interval == 0 {
+		config.Interval = Duration(3 * time.Second)
+	}
+	return &TelegramNotifier{name: name, config: config, Client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// telegramEscaper escapes the characters reserved by MarkdownV2 outside of code blocks
+var telegramEscaper = strings.NewReplacer(
+	`\`, `\\`, "_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`, "~", `\~`, "`", "\\`",
+	">", `\>`, "#", `\#`, "+", `\+`, "-", `\-`, "=", `\=`, "|", `\|`, "{", `\{`, "}", `\}`, ".", `\.`, "!", `\!`,
+)
+
+// telegramCodeEscaper escapes the characters reserved by MarkdownV2 inside code blocks
+var telegramCodeEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`")
+
+// FormatAlertTelegram renders an alert as a compact MarkdownV2 message
+func FormatAlertTelegram(alert *Alert) string {
+	var b strings.Builder
+	where := alert.Server
+	if alert.Program != "" {
+		where += "/" + alert.Program
+	}
+	fmt.Fprintf(&b, "*%s* %s", telegramEscaper.Replace(alert.Type), telegramEscaper.Replace(where))
+	if alert.Endpoint != "" {
+		fmt.Fprintf(&b, " `%s`", telegramCodeEscaper.Replace(alert.Endpoint))
+	}
+	fmt.Fprintf(&b, "\n%s", telegramEscaper.Replace(alert.Message))
+	if alert.Window != "" {
+		fmt.Fprintf(&b, "\n_%s_", telegramEscaper.Replace("window "+alert.Window))
+	}
+	if alert.Sample != "" {
+		sample := alert.Sample
+		if len([]rune(sample)) > telegramMaxSample {
+			sample = string([]rune(sample)[:telegramMaxSample]) + "…"
+		}
+		fmt.Fprintf(&b, "\n```\n%s\n```", telegramCodeEscaper.Replace(sample))
+	}
+	return b.String()
+}
+
+// Send queues the alert message, returning an error if the queue is full
+func (t *TelegramNotifier) Send(alert *Alert) error {
+	t.once.Do(func() {
+		t.queue = make(chan string, telegramQueueSize)
+		go t.run()
+	})
+	select {
+	case t.queue <- FormatAlertTelegram(alert):
+		return nil
+	default:
+		return fmt.Errorf("telegram queue full, dropping %s alert", alert.Type)
+	}
+}
+
+// run sends the queued messages, waiting Interval between two messages
+func (t *TelegramNotifier) run() {
+	for text := range t.queue {
+		if err := t.send(text); err != nil {
+			log.Printf("Error sending alert to %s: %v", t.name, err)
+			notifyFailuresTotal.WithLabelValues(t.name).Inc()
+		}
+		time.Sleep(time.Duration(t.config.Interval))
+	}
+}
+
+// telegramResponse is the body of a Bot API response
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// send posts one message, retrying up to three times when rate limited
+func (t *TelegramNotifier) send(text string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"chat_id":                  t.config.ChatID,
+		"text":                     text,
+		"parse_mode":               "MarkdownV2",
+		"disable_web_page_preview": true,
+	})
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(t.config.APIURL, "/") + "/bot" + t.config.BotToken + "/sendMessage"
+	for attempt := 0; ; attempt++ {
+		resp, err := t.Client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			// 错误信息中的 URL 含有 token
+			return fmt.Errorf("sendMessage: %s", strings.ReplaceAll(err.Error(), t.config.BotToken, "xxxxx"))
+		}
+		var result telegramResponse
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < 3 {
+			retryAfter := time.Duration(result.Parameters.RetryAfter) * time.Second
+			if retryAfter <= 0 {
+				retryAfter = time.Duration(t.config.Interval)
+			}
+			time.Sleep(retryAfter)
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 || err != nil || !result.OK {
+			return fmt.Errorf("sendMessage returned status %d: %s", resp.StatusCode, result.Description)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWebhookExampleTemplates renders every example template over a firing and a recovered alert and
+// checks that the receiver gets valid JSON holding the alert's fields
+func TestWebhookExampleTemplates(t *testing.T) {
+	paths, err := filepath.Glob("examples/webhook-templates/*.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no templates in examples/webhook-templates")
+	}
+	alerts := []*Alert{
+		{
+			Type: "error_rate_high", Server: "web-01", Program: "order-api", Endpoint: "/api/v1/orders",
+			Value: 0.42, Threshold: 0.05, Window: "1m0s", Sample: `[GIN] 2024/01/01 - 00:00:00 | 500 | "/api/v1/orders"`,
+			// 消息中的引号和换行必须被转义
+			Message: "5xx rate of \"/api/v1/orders\" is 42%\nfor 3 windows",
+			Time:    time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		},
+		{
+			Type: "error_rate_recovered", Server: "web-01", Program: "order-api", Endpoint: "/api/v1/orders",
+			Message: "5xx rate of /api/v1/orders is back to normal", Time: time.Date(2024, 5, 6, 7, 18, 9, 0, time.UTC),
+		},
+	}
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			source, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = io.ReadAll(r.Body)
+			}))
+			defer server.Close()
+
+			w := NewWebhookAlerter(server.URL, http.Header{})
+			if err := w.SetTemplate(string(source)); err != nil {
+				t.Fatalf("SetTemplate: %v", err)
+			}
+			for _, alert := range alerts {
+				if err := w.Send(alert); err != nil {
+					t.Fatalf("Send(%s): %v", alert.Type, err)
+				}
+				var payload interface{}
+				if err := json.Unmarshal(body, &payload); err != nil {
+					t.Fatalf("%s body is not valid JSON: %v\n%s", alert.Type, err, body)
+				}
+				for _, field := range []string{alert.Program, alert.Server} {
+					if !strings.Contains(string(body), field) {
+						t.Errorf("%s body does not contain %q: %s", alert.Type, field, body)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookSetTemplateErrors(t *testing.T) {
+	tests := map[string]string{
+		"syntax error":  `{"text": {{json .Message}`,
+		"unknown field": `{"text": {{json .Missing}}}`,
+		"invalid JSON":  `{"text": {{.Message}}}`,
+	}
+	for name, source := range tests {
+		if err := NewWebhookAlerter("http://127.0.0.1", http.Header{}).SetTemplate(source); err == nil {
+			t.Errorf("%s: SetTemplate(%s) did not fail", name, source)
+		}
+	}
+}
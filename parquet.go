@@ -0,0 +1,899 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// parquetMagic starts and ends every Parquet file
+const parquetMagic = "PAR1"
+
+// Parquet physical types, repetitions, converted types, encodings, codecs and page types, see
+// https://github.com/apache/parquet-format/blob/master/src/main/thrift/parquet.thrift
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	convertedNone = -1
+	convertedUTF8 = 0
+	convertedDate = 6
+	convertedJSON = 19
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+	codecGzip         = 2
+
+	pageData = 0
+)
+
+// LogicalType union fields of the columns
+const (
+	logicalNone      = 0
+	logicalString    = 1
+	logicalDate      = 6
+	logicalTimestamp = 8
+	logicalJSON      = 12
+)
+
+// parquetTimestampLayout is the layout of the date and time of an entry, see DefaultTimestampFormat
+var parquetTimestampLayout = DefaultTimestampFormat.Date + " " + DefaultTimestampFormat.Time
+
+// entryTimestamp returns the date and time of an entry as a wall clock time, in UTC so that it is
+// stored as is
+func entryTimestamp(e *LogEntry) (time.Time, error) {
+	return time.Parse(parquetTimestampLayout, e.Date+" "+e.Time)
+}
+
+// parquetColumn is a column of the Parquet files of the export subcommand
+type parquetColumn struct {
+	Name      string
+	Type      int32
+	Optional  bool
+	Converted int32
+	Logical   int16
+	// Append appends the PLAIN encoding of the value of e to buf and reports whether it is not null.
+	// Booleans are appended as one byte and bit-packed when the page is written.
+	Append func(buf []byte, e *LogEntry) ([]byte, bool)
+	// Read sets the field of e from the PLAIN value at the start of data and returns its size
+	Read func(data []byte, e *LogEntry) (int, error)
+}
+
+// stringColumn returns a BYTE_ARRAY column of a string field, null when empty if optional
+func stringColumn(name string, optional bool, logical int16, field func(*LogEntry) *string) parquetColumn {
+	converted := int32(convertedUTF8)
+	if logical == logicalJSON {
+		converted = convertedJSON
+	}
+	return parquetColumn{
+		Name: name, Type: parquetByteArray, Optional: optional, Converted: converted, Logical: logical,
+		Append: func(buf []byte, e *LogEntry) ([]byte, bool) {
+			v := *field(e)
+			if optional && v == "" {
+				return buf, false
+			}
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(v)))
+			return append(buf, v...), true
+		},
+		Read: func(data []byte, e *LogEntry) (int, error) {
+			if len(data) < 4 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			n := int(binary.LittleEndian.Uint32(data))
+			if len(data) < 4+n {
+				return 0, io.ErrUnexpectedEOF
+			}
+			*field(e) = string(data[4 : 4+n])
+			return 4 + n, nil
+		},
+	}
+}
+
+// boolColumn returns a required BOOLEAN column of a bool field
+func boolColumn(name string, field func(*LogEntry) *bool) parquetColumn {
+	return parquetColumn{
+		Name: name, Type: parquetBoolean, Converted: convertedNone,
+		Append: func(buf []byte, e *LogEntry) ([]byte, bool) {
+			if *field(e) {
+				return append(buf, 1), true
+			}
+			return append(buf, 0), true
+		},
+		Read: func(data []byte, e *LogEntry) (int, error) {
+			if len(data) < 1 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			*field(e) = data[0] != 0
+			return 1, nil
+		},
+	}
+}
+
+// doubleColumn returns a required DOUBLE column
+func doubleColumn(name string, get func(*LogEntry) float64, set func(*LogEntry, float64)) parquetColumn {
+	return parquetColumn{
+		Name: name, Type: parquetDouble, Converted: convertedNone,
+		Append: func(buf []byte, e *LogEntry) ([]byte, bool) {
+			return binary.LittleEndian.AppendUint64(buf, math.Float64bits(get(e))), true
+		},
+		Read: func(data []byte, e *LogEntry) (int, error) {
+			if len(data) < 8 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			set(e, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+			return 8, nil
+		},
+	}
+}
+
+// parquetColumns are the columns of the exported files, in order. The columns of fields that older
+// entries do not have, such as protocol, are optional and null in the rows without them.
+var parquetColumns = []parquetColumn{
+	stringColumn("env", false, logicalString, func(e *LogEntry) *string { return &e.Env }),
+	stringColumn("server", false, logicalString, func(e *LogEntry) *string { return &e.Server }),
+	stringColumn("program", false, logicalString, func(e *LogEntry) *string { return &e.Program }),
+	{
+		Name: "timestamp", Type: parquetInt64, Converted: convertedNone, Logical: logicalTimestamp,
+		Append: func(buf []byte, e *LogEntry) ([]byte, bool) {
+			t, _ := entryTimestamp(e)
+			return binary.LittleEndian.AppendUint64(buf, uint64(t.UnixMicro())), true
+		},
+		Read: func(data []byte, e *LogEntry) (int, error) {
+			if len(data) < 8 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			t := time.UnixMicro(int64(binary.LittleEndian.Uint64(data))).UTC()
+			e.Date, e.Time = t.Format(DefaultTimestampFormat.Date), t.Format(DefaultTimestampFormat.Time)
+			return 8, nil
+		},
+	},
+	{
+		Name: "date", Type: parquetInt32, Converted: convertedDate, Logical: logicalDate,
+		Append: func(buf []byte, e *LogEntry) ([]byte, bool) {
+			t, _ := entryTimestamp(e)
+			return binary.LittleEndian.AppendUint32(buf, uint32(int32(t.Unix()/86400))), true
+		},
+		// 日期已由 timestamp 读出
+		Read: func(data []byte, e *LogEntry) (int, error) {
+			if len(data) < 4 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 4, nil
+		},
+	},
+	{
+		Name: "status_code", Type: parquetInt32, Optional: true, Converted: convertedNone,
+		Append: func(buf []byte, e *LogEntry) ([]byte, bool) {
+			code, err := strconv.Atoi(e.StatusCode)
+			if err != nil {
+				return buf, false
+			}
+			return binary.LittleEndian.AppendUint32(buf, uint32(int32(code))), true
+		},
+		Read: func(data []byte, e *LogEntry) (int, error) {
+			if len(data) < 4 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			e.StatusCode = strconv.Itoa(int(int32(binary.LittleEndian.Uint32(data))))
+			return 4, nil
+		},
+	},
+	doubleColumn("duration_ms",
+		func(e *LogEntry) float64 { return float64(e.Duration) / float64(time.Millisecond) },
+		func(e *LogEntry, v float64) { e.Duration = time.Duration(math.Round(v * float64(time.Millisecond))) }),
+	stringColumn("ip", false, logicalString, func(e *LogEntry) *string { return &e.IP }),
+	stringColumn("method", false, logicalString, func(e *LogEntry) *string { return &e.Method }),
+	stringColumn("api_path", false, logicalString, func(e *LogEntry) *string { return &e.APIPath }),
+	boolColumn("is_slow", func(e *LogEntry) *bool { return &e.IsSlow }),
+	doubleColumn("sampled_weight",
+		func(e *LogEntry) float64 { return e.SampledWeight },
+		func(e *LogEntry, v float64) { e.SampledWeight = v }),
+	stringColumn("country", true, logicalString, func(e *LogEntry) *string { return &e.Country }),
+	{
+		Name: "asn", Type: parquetInt64, Optional: true, Converted: convertedNone,
+		Append: func(buf []byte, e *LogEntry) ([]byte, bool) {
+			if e.ASN == 0 {
+				return buf, false
+			}
+			return binary.LittleEndian.AppendUint64(buf, uint64(e.ASN)), true
+		},
+		Read: func(data []byte, e *LogEntry) (int, error) {
+			if len(data) < 8 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			e.ASN = uint32(binary.LittleEndian.Uint64(data))
+			return 8, nil
+		},
+	},
+	boolColumn("is_bot", func(e *LogEntry) *bool { return &e.IsBot }),
+	stringColumn("query_params", true, logicalString, func(e *LogEntry) *string { return &e.QueryParams }),
+	stringColumn("app_version", true, logicalString, func(e *LogEntry) *string { return &e.AppVersion }),
+	stringColumn("labels", true, logicalJSON, func(e *LogEntry) *string { return &e.Labels }),
+	stringColumn("protocol", true, logicalString, func(e *LogEntry) *string { return &e.Protocol }),
+	stringColumn("tls_version", true, logicalString, func(e *LogEntry) *string { return &e.TLSVersion }),
+}
+
+// ParquetCodec returns the Parquet codec of a -compression value
+func ParquetCodec(compression string) (int32, error) {
+	switch compression {
+	case "none":
+		return codecUncompressed, nil
+	case "gzip":
+		return codecGzip, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q, expected none or gzip", compression)
+}
+
+// parquetChunk is the metadata of a column chunk written to the file
+type parquetChunk struct {
+	Offset           int64
+	NumValues        int64
+	UncompressedSize int64
+	CompressedSize   int64
+}
+
+// parquetRowGroup is the metadata of a row group written to the file
+type parquetRowGroup struct {
+	NumRows int64
+	Chunks  []parquetChunk
+}
+
+// ParquetWriter writes entries as a Parquet file with the columns of parquetColumns, buffering
+// RowGroupSize entries per row group, each column chunk as a single PLAIN data page
+type ParquetWriter struct {
+	w            io.Writer
+	offset       int64
+	codec        int32
+	rowGroupSize int
+	rows         []LogEntry
+	rowGroups    []parquetRowGroup
+	numRows      int64
+}
+
+// NewParquetWriter starts a Parquet file on w. Its entries must have a valid date and time, see
+// entryTimestamp.
+func NewParquetWriter(w io.Writer, codec int32, rowGroupSize int) (*ParquetWriter, error) {
+	if rowGroupSize <= 0 {
+		return nil, fmt.Errorf("invalid row group size %d", rowGroupSize)
+	}
+	pw := &ParquetWriter{w: w, codec: codec, rowGroupSize: rowGroupSize}
+	if err := pw.write([]byte(parquetMagic)); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// write writes data, tracking the offset of the next write
+func (pw *ParquetWriter) write(data []byte) error {
+	n, err := pw.w.Write(data)
+	pw.offset += int64(n)
+	return err
+}
+
+// Write adds an entry to the current row group, writing it once it is full
+func (pw *ParquetWriter) Write(entry *LogEntry) error {
+	pw.rows = append(pw.rows, *entry)
+	if len(pw.rows) >= pw.rowGroupSize {
+		return pw.flush()
+	}
+	return nil
+}
+
+// NumRows returns the number of entries written
+func (pw *ParquetWriter) NumRows() int64 {
+	return pw.numRows + int64(len(pw.rows))
+}
+
+// flush writes the buffered entries as a row group
+func (pw *ParquetWriter) flush() error {
+	if len(pw.rows) == 0 {
+		return nil
+	}
+	group := parquetRowGroup{NumRows: int64(len(pw.rows))}
+	for _, column := range parquetColumns {
+		chunk, err := pw.writeChunk(column)
+		if err != nil {
+			return err
+		}
+		group.Chunks = append(group.Chunks, chunk)
+	}
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.numRows += group.NumRows
+	pw.rows = pw.rows[:0]
+	return nil
+}
+
+// writeChunk writes the values of column in the buffered entries as a single data page
+func (pw *ParquetWriter) writeChunk(column parquetColumn) (parquetChunk, error) {
+	var values []byte
+	defined := make([]bool, len(pw.rows))
+	for i := range pw.rows {
+		values, defined[i] = column.Append(values, &pw.rows[i])
+	}
+	if column.Type == parquetBoolean {
+		values = packBits(values)
+	}
+	var page []byte
+	if column.Optional {
+		levels := encodeLevels(defined)
+		page = binary.LittleEndian.AppendUint32(page, uint32(len(levels)))
+		page = append(page, levels...)
+	}
+	page = append(page, values...)
+
+	compressed := page
+	if pw.codec == codecGzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(page)
+		if err := zw.Close(); err != nil {
+			return parquetChunk{}, err
+		}
+		compressed = buf.Bytes()
+	}
+
+	var header thriftWriter
+	header.begin()
+	header.i32(1, pageData)
+	header.i32(2, int32(len(page)))
+	header.i32(3, int32(len(compressed)))
+	header.beginStruct(5)
+	header.i32(1, int32(len(pw.rows)))
+	header.i32(2, encodingPlain)
+	header.i32(3, encodingRLE)
+	header.i32(4, encodingRLE)
+	header.end()
+	header.end()
+
+	chunk := parquetChunk{
+		Offset:           pw.offset,
+		NumValues:        int64(len(pw.rows)),
+		UncompressedSize: int64(len(header.buf) + len(page)),
+		CompressedSize:   int64(len(header.buf) + len(compressed)),
+	}
+	if err := pw.write(header.buf); err != nil {
+		return chunk, err
+	}
+	return chunk, pw.write(compressed)
+}
+
+// Close writes the remaining entries and the footer. It does not close the underlying writer.
+func (pw *ParquetWriter) Close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+	var meta thriftWriter
+	meta.begin()
+	meta.i32(1, 1)
+	meta.beginList(2, thriftStruct, len(parquetColumns)+1)
+	meta.beginElem()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(parquetColumns)))
+	meta.end()
+	for _, column := range parquetColumns {
+		meta.beginElem()
+		meta.i32(1, column.Type)
+		if column.Optional {
+			meta.i32(3, parquetOptional)
+		} else {
+			meta.i32(3, parquetRequired)
+		}
+		meta.binary(4, column.Name)
+		if column.Converted != convertedNone {
+			meta.i32(6, column.Converted)
+		}
+		if column.Logical != logicalNone {
+			meta.beginStruct(10)
+			meta.beginStruct(column.Logical)
+			if column.Logical == logicalTimestamp {
+				// 本地时间，不换算为 UTC
+				meta.boolean(1, false)
+				meta.beginStruct(2)
+				meta.beginStruct(2)
+				meta.end()
+				meta.end()
+			}
+			meta.end()
+			meta.end()
+		}
+		meta.end()
+	}
+	meta.i64(3, pw.numRows)
+	meta.beginList(4, thriftStruct, len(pw.rowGroups))
+	for _, group := range pw.rowGroups {
+		meta.beginElem()
+		meta.beginList(1, thriftStruct, len(group.Chunks))
+		var totalSize int64
+		for i, chunk := range group.Chunks {
+			column := parquetColumns[i]
+			totalSize += chunk.UncompressedSize
+			meta.beginElem()
+			meta.i64(2, chunk.Offset)
+			meta.beginStruct(3)
+			meta.i32(1, column.Type)
+			encodings := []int32{encodingPlain}
+			if column.Optional {
+				encodings = append(encodings, encodingRLE)
+			}
+			meta.beginList(2, thriftI32, len(encodings))
+			for _, encoding := range encodings {
+				meta.elemI32(encoding)
+			}
+			meta.beginList(3, thriftBinary, 1)
+			meta.elemBinary(column.Name)
+			meta.i32(4, pw.codec)
+			meta.i64(5, chunk.NumValues)
+			meta.i64(6, chunk.UncompressedSize)
+			meta.i64(7, chunk.CompressedSize)
+			meta.i64(9, chunk.Offset)
+			meta.end()
+			meta.end()
+		}
+		meta.i64(2, totalSize)
+		meta.i64(3, group.NumRows)
+		meta.end()
+	}
+	meta.binary(6, "log-monitor")
+	meta.end()
+
+	if err := pw.write(meta.buf); err != nil {
+		return err
+	}
+	if err := pw.write(binary.LittleEndian.AppendUint32(nil, uint32(len(meta.buf)))); err != nil {
+		return err
+	}
+	return pw.write([]byte(parquetMagic))
+}
+
+// packBits packs one byte per boolean into bits, least significant first
+func packBits(values []byte) []byte {
+	packed := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v != 0 {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return packed
+}
+
+// encodeLevels encodes definition levels of width 1 as RLE runs of the RLE/bit-packing hybrid encoding
+func encodeLevels(defined []bool) []byte {
+	var buf []byte
+	for i := 0; i < len(defined); {
+		j := i
+		for j < len(defined) && defined[j] == defined[i] {
+			j++
+		}
+		buf = binary.AppendUvarint(buf, uint64(j-i)<<1)
+		if defined[i] {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		i = j
+	}
+	return buf
+}
+
+// decodeLevels decodes n definition levels of width 1 of the RLE/bit-packing hybrid encoding
+func decodeLevels(data []byte, n int) ([]bool, error) {
+	levels := make([]bool, 0, n)
+	for len(levels) < n {
+		header, size := binary.Uvarint(data)
+		if size <= 0 {
+			return nil, errors.New("invalid definition levels")
+		}
+		data = data[size:]
+		if header&1 == 0 {
+			// RLE 段
+			if len(data) < 1 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			for k := uint64(0); k < header>>1 && len(levels) < n; k++ {
+				levels = append(levels, data[0] != 0)
+			}
+			data = data[1:]
+			continue
+		}
+		// 位打包段，每组 8 个值占 1 字节
+		groups := int(header >> 1)
+		if len(data) < groups {
+			return nil, io.ErrUnexpectedEOF
+		}
+		for k := 0; k < groups*8 && len(levels) < n; k++ {
+			levels = append(levels, data[k/8]&(1<<(k%8)) != 0)
+		}
+		data = data[groups:]
+	}
+	return levels, nil
+}
+
+// ReadParquet reads the entries of a Parquet file written by ParquetWriter. Columns are matched by
+// name: the fields of columns missing from the file, such as those added after it was written, are left
+// empty, and columns unknown to this version are skipped.
+func ReadParquet(path string) ([]*LogEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || string(data[:4]) != parquetMagic || string(data[len(data)-4:]) != parquetMagic {
+		return nil, fmt.Errorf("%s: not a Parquet file", path)
+	}
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	if footerLen > len(data)-12 {
+		return nil, fmt.Errorf("%s: invalid footer length", path)
+	}
+	meta, err := (&thriftReader{data: data[len(data)-8-footerLen : len(data)-8]}).readStruct()
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading footer: %w", path, err)
+	}
+
+	byName := make(map[string]parquetColumn, len(parquetColumns))
+	for _, column := range parquetColumns {
+		byName[column.Name] = column
+	}
+	var entries []*LogEntry
+	for _, g := range meta.list(4) {
+		group, _ := g.(thriftFields)
+		numRows := int(group.i64(3))
+		rows := make([]LogEntry, numRows)
+		for _, c := range group.list(1) {
+			chunk, _ := c.(thriftFields)
+			columnMeta := chunk.fields(3)
+			columnPath := columnMeta.list(3)
+			if len(columnPath) != 1 {
+				continue
+			}
+			name, _ := columnPath[0].([]byte)
+			column, ok := byName[string(name)]
+			if !ok {
+				continue
+			}
+			if err := readChunk(data, columnMeta, column, rows); err != nil {
+				return nil, fmt.Errorf("%s: column %s: %w", path, name, err)
+			}
+		}
+		for i := range rows {
+			entry := rows[i]
+			entry.RawPath = entry.APIPath
+			entries = append(entries, &entry)
+		}
+	}
+	return entries, nil
+}
+
+// readChunk sets the field of column in rows from the data pages of a column chunk
+func readChunk(data []byte, meta thriftFields, column parquetColumn, rows []LogEntry) error {
+	offset := meta.i64(9)
+	codec := meta.i64(4)
+	row := 0
+	for row < len(rows) {
+		if offset < 0 || offset >= int64(len(data)) {
+			return errors.New("page offset out of range")
+		}
+		r := &thriftReader{data: data[offset:]}
+		header, err := r.readStruct()
+		if err != nil {
+			return err
+		}
+		start := offset + int64(r.pos)
+		end := start + header.i64(3)
+		if end > int64(len(data)) {
+			return io.ErrUnexpectedEOF
+		}
+		offset = end
+		if header.i64(1) != pageData {
+			continue
+		}
+		page := data[start:end]
+		if codec == codecGzip {
+			zr, err := gzip.NewReader(bytes.NewReader(page))
+			if err != nil {
+				return err
+			}
+			if page, err = io.ReadAll(zr); err != nil {
+				return err
+			}
+		} else if codec != codecUncompressed {
+			return fmt.Errorf("unsupported codec %d", codec)
+		}
+		n := int(header.fields(5).i64(1))
+		if row+n > len(rows) {
+			return errors.New("more values than rows")
+		}
+		defined := make([]bool, n)
+		for i := range defined {
+			defined[i] = true
+		}
+		if column.Optional {
+			if len(page) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			size := int(binary.LittleEndian.Uint32(page))
+			if len(page) < 4+size {
+				return io.ErrUnexpectedEOF
+			}
+			if defined, err = decodeLevels(page[4:4+size], n); err != nil {
+				return err
+			}
+			page = page[4+size:]
+		}
+		if column.Type == parquetBoolean {
+			unpacked := make([]byte, 0, n)
+			for i := 0; i < n && i/8 < len(page); i++ {
+				unpacked = append(unpacked, page[i/8]>>(i%8)&1)
+			}
+			page = unpacked
+		}
+		for i := 0; i < n; i++ {
+			if !defined[i] {
+				continue
+			}
+			size, err := column.Read(page, &rows[row+i])
+			if err != nil {
+				return err
+			}
+			page = page[size:]
+		}
+		row += n
+	}
+	return nil
+}
+
+// Thrift compact protocol types
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the Parquet metadata with the Thrift compact protocol
+type thriftWriter struct {
+	buf []byte
+	// last holds the id of the last field written in each open struct
+	last []int16
+}
+
+// begin starts the top-level struct
+func (w *thriftWriter) begin() {
+	w.last = append(w.last, 0)
+}
+
+// end closes the innermost struct
+func (w *thriftWriter) end() {
+	w.buf = append(w.buf, 0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|typ)
+	} else {
+		w.buf = append(w.buf, typ)
+		w.buf = binary.AppendVarint(w.buf, int64(id))
+	}
+	*last = id
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.buf = binary.AppendVarint(w.buf, int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *thriftWriter) boolean(id int16, v bool) {
+	if v {
+		w.field(id, thriftTrue)
+	} else {
+		w.field(id, thriftFalse)
+	}
+}
+
+func (w *thriftWriter) binary(id int16, v string) {
+	w.field(id, thriftBinary)
+	w.elemBinary(v)
+}
+
+// beginStruct starts a struct field, closed by end
+func (w *thriftWriter) beginStruct(id int16) {
+	w.field(id, thriftStruct)
+	w.last = append(w.last, 0)
+}
+
+// beginList starts a list field of n elements of type elem, written with the elem methods
+func (w *thriftWriter) beginList(id int16, elem byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.buf = append(w.buf, byte(n)<<4|elem)
+	} else {
+		w.buf = append(w.buf, 0xf0|elem)
+		w.buf = binary.AppendUvarint(w.buf, uint64(n))
+	}
+}
+
+// beginElem starts a struct element of a list, closed by end
+func (w *thriftWriter) beginElem() {
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) elemI32(v int32) {
+	w.buf = binary.AppendVarint(w.buf, int64(v))
+}
+
+func (w *thriftWriter) elemBinary(v string) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// thriftFields are the fields of a decoded struct by id: int64, float64, bool, []byte, []any or
+// thriftFields values
+type thriftFields map[int16]any
+
+func (f thriftFields) i64(id int16) int64 {
+	v, _ := f[id].(int64)
+	return v
+}
+
+func (f thriftFields) fields(id int16) thriftFields {
+	v, _ := f[id].(thriftFields)
+	return v
+}
+
+func (f thriftFields) list(id int16) []any {
+	v, _ := f[id].([]any)
+	return v
+}
+
+// thriftReader decodes Thrift compact protocol structs
+type thriftReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *thriftReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *thriftReader) varint() (int64, error) {
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.pos += n
+	return v, nil
+}
+
+// readStruct decodes a struct up to its stop field
+func (r *thriftReader) readStruct() (thriftFields, error) {
+	fields := make(thriftFields)
+	var last int16
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			return fields, nil
+		}
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		last = id
+		if fields[id], err = r.readValue(b & 0x0f); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readValue decodes a value of type typ
+func (r *thriftReader) readValue(typ byte) (any, error) {
+	switch typ {
+	case thriftTrue:
+		return true, nil
+	case thriftFalse:
+		return false, nil
+	case thriftByte:
+		b, err := r.byte()
+		return int64(int8(b)), err
+	case thriftI16, thriftI32, thriftI64:
+		return r.varint()
+	case thriftDouble:
+		if r.pos+8 > len(r.data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.data[r.pos:]))
+		r.pos += 8
+		return v, nil
+	case thriftBinary:
+		n, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(r.data)-r.pos) < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := r.data[r.pos : r.pos+int(n)]
+		r.pos += int(n)
+		return v, nil
+	case thriftList, thriftSet:
+		h, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		n, elem := uint64(h>>4), h&0x0f
+		if n == 15 {
+			if n, err = r.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		if n > uint64(len(r.data)) {
+			return nil, errors.New("invalid list size")
+		}
+		list := make([]any, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var v any
+			if elem == thriftTrue || elem == thriftFalse {
+				// 列表中的布尔值各占一个字节
+				b, err := r.byte()
+				if err != nil {
+					return nil, err
+				}
+				v = b == thriftTrue
+			} else if v, err = r.readValue(elem); err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case thriftStruct:
+		return r.readStruct()
+	}
+	return nil, fmt.Errorf("unsupported thrift type %d", typ)
+}
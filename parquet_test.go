@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testParquetEntries returns n entries setting every column of parquetColumns, with the optional columns
+// null in runs of different lengths, including a run of all the first half of the entries for labels
+func testParquetEntries(n int) []*LogEntry {
+	entries := make([]*LogEntry, n)
+	for i := range entries {
+		path := fmt.Sprintf("/api/v1/用户/%d", i)
+		e := &LogEntry{
+			Env: "production", Server: fmt.Sprintf("web-%02d", i%3), Program: "api",
+			Date: fmt.Sprintf("2024/01/%02d", 1+i%28), Time: fmt.Sprintf("%02d:%02d:%02d", i%24, i%60, (i*7)%60),
+			StatusCode: []string{"200", "404", "503"}[i%3], Duration: time.Duration(i)*time.Millisecond + 1234*time.Microsecond,
+			IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Method: []string{"GET", "POST"}[i%2],
+			APIPath: path, RawPath: path, IsSlow: i%5 == 0, SampledWeight: float64(1 + i%4), IsBot: i%7 == 3,
+		}
+		if i%2 == 0 {
+			e.Country, e.ASN = "JP", 64500+uint32(i)
+		}
+		if i%3 != 0 {
+			e.QueryParams = fmt.Sprintf("page=%d", i)
+		}
+		if i%10 < 6 {
+			e.AppVersion = "v1.2.3"
+		}
+		if i >= n/2 {
+			e.Labels = `{"region":"ap-east-1"}`
+		}
+		if i%4 == 1 {
+			e.Protocol, e.TLSVersion = "HTTP/2.0", "TLSv1.3"
+		}
+		entries[i] = e
+	}
+	return entries
+}
+
+// writeParquet writes entries to a file of dir and returns its path
+func writeParquet(t *testing.T, dir string, entries []*LogEntry, codec int32, rowGroupSize int) string {
+	t.Helper()
+	path := filepath.Join(dir, fmt.Sprintf("codec%d-group%d.parquet", codec, rowGroupSize))
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := NewParquetWriter(f, codec, rowGroupSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := w.Write(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.NumRows() != int64(len(entries)) {
+		t.Errorf("NumRows() = %d, want %d", w.NumRows(), len(entries))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	// 200 行：每组 1 行、不满 8 行的布尔位组、不整除的最后一组、整除、单组
+	for _, n := range []int{0, 1, 200} {
+		entries := testParquetEntries(n)
+		for _, codec := range []int32{codecUncompressed, codecGzip} {
+			for _, rowGroupSize := range []int{1, 13, 50, 1000} {
+				t.Run(fmt.Sprintf("rows=%d/codec=%d/group=%d", n, codec, rowGroupSize), func(t *testing.T) {
+					got, err := ReadParquet(writeParquet(t, dir, entries, codec, rowGroupSize))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(got) != len(entries) {
+						t.Fatalf("read %d entries, want %d", len(got), len(entries))
+					}
+					for i := range entries {
+						if !reflect.DeepEqual(got[i], entries[i]) {
+							t.Fatalf("entry %d = %+v, want %+v", i, got[i], entries[i])
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestParquetNulls checks that empty optional values are written as nulls and read back empty, and that
+// a status code that is not a number is written as null
+func TestParquetNulls(t *testing.T) {
+	entries := []*LogEntry{
+		{Date: "2024/01/01", Time: "00:00:00", StatusCode: "-", Method: "GET", APIPath: "/api", RawPath: "/api"},
+		{Date: "2024/01/01", Time: "00:00:01", StatusCode: "200", Method: "GET", APIPath: "/api", RawPath: "/api",
+			Country: "JP", ASN: 1, QueryParams: "q=1", AppVersion: "v1", Labels: `{}`, Protocol: "HTTP/1.1", TLSVersion: "TLSv1.2"},
+	}
+	got, err := ReadParquet(writeParquet(t, t.TempDir(), entries, codecUncompressed, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries[0].StatusCode = ""
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("read %+v and %+v, want %+v and %+v", got[0], got[1], entries[0], entries[1])
+	}
+}
+
+// TestParquetSchemaEvolution reads a file written without the newest columns, as by an older version,
+// leaving their fields empty
+func TestParquetSchemaEvolution(t *testing.T) {
+	current := parquetColumns
+	t.Cleanup(func() { parquetColumns = current })
+	var older []parquetColumn
+	for _, column := range current {
+		if column.Name != "protocol" && column.Name != "tls_version" {
+			older = append(older, column)
+		}
+	}
+	parquetColumns = older
+	entries := testParquetEntries(20)
+	path := writeParquet(t, t.TempDir(), entries, codecGzip, 8)
+	parquetColumns = current
+
+	got, err := ReadParquet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range entries {
+		want := *entry
+		want.Protocol, want.TLSVersion = "", ""
+		if !reflect.DeepEqual(got[i], &want) {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], want)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FieldMap holds the positions of the log fields among the fields of a line, which are separated by
+// whitespace unless another separator is set, see SplitFields
+type FieldMap struct {
+	Date     int `json:"date"`
+	Time     int `json:"time"`
+	Status   int `json:"status"`
+	Duration int `json:"duration"`
+	IP       int `json:"ip"`
+	Method   int `json:"method"`
+	Path     int `json:"path"`
+	OptionalFields
+}
+
+// OptionalFields are the positions of the fields only some formats log, set per program in the config
+// file, e.g. {"protocol": 13, "tls_version": 14} for nginx's $server_protocol and $ssl_protocol.
+// 0 leaves a field out, position 0 of a GIN line being the [GIN] marker.
+type OptionalFields struct {
+	Protocol   int `json:"protocol,omitempty"`
+	TLSVersion int `json:"tls_version,omitempty"`
+}
+
+// DefaultFieldMap is the layout of GIN's default logger:
+// [GIN] 2024/01/01 - 00:00:00 | 200 |    1.234ms |   127.0.0.1 | GET      "/api/v1"
+var DefaultFieldMap = FieldMap{Date: 1, Time: 3, Status: 5, Duration: 7, IP: 9, Method: 11, Path: 12}
+
+// max returns the highest position of the required fields in the map
+func (fm FieldMap) max() int {
+	n := 0
+	for _, p := range []int{fm.Date, fm.Time, fm.Status, fm.Duration, fm.IP, fm.Method, fm.Path} {
+		if p > n {
+			n = p
+		}
+	}
+	return n
+}
+
+// TimestampFormat holds the Go reference-time layouts of the date and time fields
+type TimestampFormat struct {
+	Date string
+	Time string
+}
+
+// DefaultTimestampFormat is the layout of GIN's default logger, entries are stored with it
+var DefaultTimestampFormat = TimestampFormat{Date: "2006/01/02", Time: "15:04:05"}
+
+// Validate checks that each layout is a single whitespace-free field and formats and parses back a
+// reference time to its day for the date and to its second for the time
+func (tf TimestampFormat) Validate() error {
+	ref := time.Date(2024, time.March, 15, 13, 45, 30, 0, time.Local)
+	for _, layout := range []string{tf.Date, tf.Time} {
+		if layout == "" || strings.IndexFunc(layout, unicode.IsSpace) >= 0 {
+			return fmt.Errorf("layout %q must be a single field", layout)
+		}
+	}
+	d, err := time.ParseInLocation(tf.Date, ref.Format(tf.Date), time.Local)
+	if err != nil {
+		return fmt.Errorf("date layout %q: %w", tf.Date, err)
+	}
+	if y, m, day := d.Date(); y != 2024 || m != time.March || day != 15 {
+		return fmt.Errorf("date layout %q does not hold the year, month and day", tf.Date)
+	}
+	t, err := time.ParseInLocation(tf.Time, ref.Format(tf.Time), time.Local)
+	if err != nil {
+		return fmt.Errorf("time layout %q: %w", tf.Time, err)
+	}
+	if h, m, s := t.Clock(); h != 13 || m != 45 || s != 30 {
+		return fmt.Errorf("time layout %q does not hold the hour, minute and second", tf.Time)
+	}
+	return nil
+}
+
+// normalize parses the date and time fields with the layouts and returns them in DefaultTimestampFormat,
+// which the aggregations and the database expect
+func (tf TimestampFormat) normalize(date, clock string) (string, string, error) {
+	d, err := time.ParseInLocation(tf.Date, date, time.Local)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing date: %w", err)
+	}
+	t, err := time.ParseInLocation(tf.Time, clock, time.Local)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing time: %w", err)
+	}
+	return d.Format(DefaultTimestampFormat.Date), t.Format(DefaultTimestampFormat.Time), nil
+}
+
+// DefaultFieldSeparator splits fields on runs of whitespace, like awk's default
+const DefaultFieldSeparator = " "
+
+// SplitFields splits a line into fields on sep. The default separator splits on runs of whitespace, a
+// single-character separator such as a tab or a pipe on runs of that character, and a multi-character
+// separator on each occurrence, keeping empty fields. Fields split on another separator than whitespace
+// have their surrounding whitespace trimmed.
+func SplitFields(line, sep string) []string {
+	if sep == DefaultFieldSeparator || sep == "" {
+		return strings.Fields(line)
+	}
+	var fields []string
+	if utf8.RuneCountInString(sep) == 1 {
+		r, _ := utf8.DecodeRuneInString(sep)
+		fields = strings.FieldsFunc(line, func(c rune) bool { return c == r })
+	} else {
+		fields = strings.Split(line, sep)
+	}
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+	}
+	return fields
+}
+
+// ParseFieldSeparator returns the separator given to -field-sep, where \t and "tab" stand for a tab
+func ParseFieldSeparator(s string) (string, error) {
+	switch s {
+	case "":
+		return "", errors.New("empty field separator")
+	case `\t`, "tab":
+		return "\t", nil
+	}
+	return s, nil
+}
+
+// ParseLogLine splits a log line on sep, see SplitFields, and returns the entry found at the positions
+// of fm, with the date and time read with the layouts of tf. The entry comes from the entry pool. A line
+// whose entry fails Validate fails to parse, and is counted and logged as a parse failure by the monitor.
+func ParseLogLine(line, server, program string, fm FieldMap, sep string, tf TimestampFormat) (*LogEntry, error) {
+	fields := SplitFields(line, sep)
+	if len(fields) <= fm.max() {
+		return nil, fmt.Errorf("failed to parse log line: %s", line)
+	}
+	date, clock, err := tf.normalize(fields[fm.Date], fields[fm.Time])
+	if err != nil {
+		return nil, err
+	}
+
+	// 去掉 apiPath 两端的引号
+	apiPath := strings.Trim(fields[fm.Path], "\"")
+	duration, err := ParseGINDuration(fields[fm.Duration])
+	if err != nil {
+		return nil, err
+	}
+	entry := newLogEntry()
+	*entry = LogEntry{
+		Server:     server,
+		Program:    program,
+		Date:       date,
+		Time:       clock,
+		StatusCode: fields[fm.Status],
+		Duration:   duration,
+		IP:         fields[fm.IP],
+		Method:     fields[fm.Method],
+		APIPath:    apiPath,
+		RawPath:    apiPath,
+		UserAgent:  ExtractUserAgent(line),
+		Protocol:   optionalField(fields, fm.Protocol),
+		TLSVersion: optionalField(fields, fm.TLSVersion),
+	}
+	if err := entry.Validate(); err != nil {
+		releaseLogEntry(entry)
+		return nil, fmt.Errorf("%w: %s", err, line)
+	}
+	return entry, nil
+}
+
+// maxProtocolLength is the size of the protocol and tls_version columns
+const maxProtocolLength = 16
+
+// optionalField returns the unquoted field at pos, "" if pos is 0, past the end of the line, or the
+// field is "-" as nginx logs an empty variable, e.g. $ssl_protocol on a plain HTTP connection
+func optionalField(fields []string, pos int) string {
+	if pos <= 0 || pos >= len(fields) {
+		return ""
+	}
+	value := strings.Trim(fields[pos], "\"")
+	if value == "-" {
+		return ""
+	}
+	if len(value) > maxProtocolLength {
+		value = value[:maxProtocolLength]
+	}
+	return value
+}
+
+// Validate returns an error if the entry has a method outside ValidHTTPMethods
+func (e *LogEntry) Validate() error {
+	if _, ok := ValidHTTPMethods[e.Method]; !ok {
+		return fmt.Errorf("invalid HTTP method %q", e.Method)
+	}
+	return nil
+}
+
+// ExtractUserAgent returns the user agent of a line, the last double-quoted field when it follows the
+// quoted path, as written by GIN formatters that append c.Request.UserAgent():
+// [GIN] 2024/01/01 - 00:00:00 | 200 |    1.234ms |   127.0.0.1 | GET      "/api/v1" "Mozilla/5.0 ..."
+// GIN's default logger does not log the user agent, lines without one return "".
+func ExtractUserAgent(line string) string {
+	end := strings.LastIndexByte(line, '"')
+	if end <= 0 {
+		return ""
+	}
+	start := strings.LastIndexByte(line[:end], '"')
+	if start < 0 || strings.Count(line[:start], "\"") < 2 {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+// ParseGINDuration parses the latency field of a GIN log line, which is a time.Duration printed with %v,
+// e.g. "123.456µs", "1.5ms" or "1m2s" (GIN truncates latencies above a minute to whole seconds)
+func ParseGINDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %q", s)
+	}
+	return d, nil
+}
+
+// ansiPattern matches ANSI escape sequences, such as the colors of GIN's debug mode logger
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+// StripANSI removes ANSI escape sequences from s. GIN's debug mode logger colors the status and method:
+// [GIN] 2024/01/01 - 00:00:00 |\x1b[97;42m 200 \x1b[0m|    1.234ms |   127.0.0.1 |\x1b[97;44m GET     \x1b[0m "/api/v1"
+// and stripping the colors leaves the fields at the positions of DefaultFieldMap.
+func StripANSI(s string) string {
+	if strings.IndexByte(s, 0x1b) < 0 {
+		return s
+	}
+	return ansiPattern.ReplaceAllString(s, "")
+}
+
+var (
+	datePattern   = regexp.MustCompile(`^\d{4}[/-]\d{2}[/-]\d{2}$`)
+	timePattern   = regexp.MustCompile(`^\d{2}:\d{2}:\d{2}(\.\d+)?$`)
+	statusPattern = regexp.MustCompile(`^[1-5]\d{2}$`)
+)
+
+// ValidHTTPMethods are the request methods of RFC 7231 and PATCH of RFC 5789. They are recognized when
+// detecting field positions, and a method field outside them usually means the line was split wrong.
+var ValidHTTPMethods = map[string]struct{}{
+	"GET": {}, "POST": {}, "PUT": {}, "PATCH": {}, "DELETE": {}, "HEAD": {}, "OPTIONS": {}, "TRACE": {}, "CONNECT": {},
+}
+
+// fieldKinds classifies a field by its format, in the order FieldMap declares them
+var fieldKinds = []struct {
+	name  string
+	match func(string) bool
+}{
+	{"date", datePattern.MatchString},
+	{"time", timePattern.MatchString},
+	{"status", statusPattern.MatchString},
+	{"duration", func(s string) bool {
+		_, err := time.ParseDuration(s)
+		return err == nil && strings.IndexFunc(s, func(r rune) bool { return r >= 'a' && r <= 'z' || r == 'µ' || r == 'μ' }) >= 0
+	}},
+	{"ip", func(s string) bool {
+		_, err := netip.ParseAddr(s)
+		return err == nil
+	}},
+	{"method", func(s string) bool {
+		_, ok := ValidHTTPMethods[s]
+		return ok
+	}},
+	{"path", func(s string) bool { return strings.HasPrefix(strings.Trim(s, "\""), "/") }},
+}
+
+// DetectFieldPositions infers the FieldMap from sample lines by recognizing each field's format:
+// a date, a time, a 3-digit status code, a duration with a unit, an IP address, an HTTP method and a path.
+// Each field gets the position where it matches the most lines, which must be more than half of them.
+// Lines are split on sep, see SplitFields.
+func DetectFieldPositions(sampleLines []string, sep string) (FieldMap, error) {
+	counts := make([]map[int]int, len(fieldKinds))
+	for i := range counts {
+		counts[i] = make(map[int]int)
+	}
+
+	lines := 0
+	for _, line := range sampleLines {
+		fields := SplitFields(line, sep)
+		if len(fields) == 0 {
+			continue
+		}
+		lines++
+		for i, kind := range fieldKinds {
+			for pos, field := range fields {
+				if kind.match(field) {
+					counts[i][pos]++
+					break
+				}
+			}
+		}
+	}
+	if lines == 0 {
+		return FieldMap{}, errors.New("no sample lines")
+	}
+
+	positions := make([]int, len(fieldKinds))
+	for i, kind := range fieldKinds {
+		best, bestCount := -1, 0
+		for pos, n := range counts[i] {
+			if n > bestCount || n == bestCount && pos < best {
+				best, bestCount = pos, n
+			}
+		}
+		if bestCount*2 <= lines {
+			return FieldMap{}, fmt.Errorf("could not detect the %s field", kind.name)
+		}
+		positions[i] = best
+	}
+	return FieldMap{
+		Date:     positions[0],
+		Time:     positions[1],
+		Status:   positions[2],
+		Duration: positions[3],
+		IP:       positions[4],
+		Method:   positions[5],
+		Path:     positions[6],
+	}, nil
+}
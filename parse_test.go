@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitFields(t *testing.T) {
+	tests := []struct {
+		name, line, sep string
+		want            []string
+	}{
+		{"whitespace", "  a b\t c  ", DefaultFieldSeparator, []string{"a", "b", "c"}},
+		{"empty separator", "a  b", "", []string{"a", "b"}},
+		{"tab", "2024/01/01\t00:00:00\t200\t/api/v1/users list", "\t", []string{"2024/01/01", "00:00:00", "200", "/api/v1/users list"}},
+		{"tab run", "a\t\tb\t", "\t", []string{"a", "b"}},
+		{"tab trims spaces", " a \t b ", "\t", []string{"a", "b"}},
+		{"pipe", "2024/01/01 | 00:00:00 | 200 | GET /api", "|", []string{"2024/01/01", "00:00:00", "200", "GET /api"}},
+		{"pipe run", "a||b|", "|", []string{"a", "b"}},
+		{"multi-character", "a || b ||c", "||", []string{"a", "b", "c"}},
+		{"multi-character keeps empty fields", "a||||b", "||", []string{"a", "", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SplitFields(tt.line, tt.sep); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitFields(%q, %q) = %q, want %q", tt.line, tt.sep, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFieldSeparator(t *testing.T) {
+	for in, want := range map[string]string{`\t`: "\t", "tab": "\t", "|": "|", " ": " ", "||": "||"} {
+		if got, err := ParseFieldSeparator(in); err != nil || got != want {
+			t.Errorf("ParseFieldSeparator(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseFieldSeparator(""); err == nil {
+		t.Error("ParseFieldSeparator of an empty separator did not fail")
+	}
+}
+
+func TestParseLogLineSeparators(t *testing.T) {
+	// 日期 时间 状态码 耗时 IP 方法 路径
+	fm := FieldMap{Date: 0, Time: 1, Status: 2, Duration: 3, IP: 4, Method: 5, Path: 6}
+	tests := []struct {
+		name, line, sep string
+	}{
+		{"tab", "2024/01/01\t12:30:45\t404\t1.5ms\t10.0.0.1\tPOST\t/api/v1/users", "\t"},
+		{"tab with empty column runs", "2024/01/01\t\t12:30:45\t404\t1.5ms\t10.0.0.1\tPOST\t\"/api/v1/users\"", "\t"},
+		{"pipe", `2024/01/01 | 12:30:45 | 404 |    1.5ms |   10.0.0.1 | POST     | "/api/v1/users"`, "|"},
+		{"multi-character", "2024/01/01 :: 12:30:45 :: 404 :: 1.5ms :: 10.0.0.1 :: POST :: /api/v1/users", "::"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := ParseLogLine(tt.line, "web-01", "api", fm, tt.sep, DefaultTimestampFormat)
+			if err != nil {
+				t.Fatalf("ParseLogLine(%q): %v", tt.line, err)
+			}
+			got := []any{entry.Date, entry.Time, entry.StatusCode, entry.Duration, entry.IP, entry.Method, entry.APIPath}
+			want := []any{"2024/01/01", "12:30:45", "404", 1500 * time.Microsecond, "10.0.0.1", "POST", "/api/v1/users"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ParseLogLine(%q) = %v, want %v", tt.line, got, want)
+			}
+		})
+	}
+
+	// 用空格拆分时，以制表符或竖线分隔的行字段位置不对
+	if _, err := ParseLogLine("2024/01/01|12:30:45|404|1.5ms|10.0.0.1|POST|/api/v1/users", "web-01", "api", fm, DefaultFieldSeparator, DefaultTimestampFormat); err == nil {
+		t.Error("a pipe-separated line parsed with the default separator did not fail")
+	}
+}
+
+// TestParseGINDuration parses the latency field of lines written by GIN's default logger, which prints
+// the latency with %13v and truncates latencies above a minute to whole seconds
+func TestParseGINDuration(t *testing.T) {
+	tests := []struct {
+		line string
+		want time.Duration
+		ms   int64
+	}{
+		{`[GIN] 2024/01/01 - 12:30:45 | 200 |         850ns |   127.0.0.1 | GET      "/api/v1/ping"`, 850 * time.Nanosecond, 0},
+		{`[GIN] 2024/01/01 - 12:30:45 | 200 |     123.456µs |   127.0.0.1 | GET      "/api/v1/ping"`, 123456 * time.Nanosecond, 0},
+		{`[GIN] 2024/01/01 - 12:30:45 | 200 |         999µs |   127.0.0.1 | GET      "/api/v1/ping"`, 999 * time.Microsecond, 0},
+		{`[GIN] 2024/01/01 - 12:30:45 | 200 |    1.234567ms |   127.0.0.1 | GET      "/api/v1/users"`, 1234567 * time.Nanosecond, 1},
+		{`[GIN] 2024/01/01 - 12:30:45 | 201 |        12.5ms |   127.0.0.1 | POST     "/api/v1/users"`, 12500 * time.Microsecond, 12},
+		{`[GIN] 2024/01/01 - 12:30:45 | 200 |  1.500123456s |   127.0.0.1 | GET      "/api/v1/export"`, 1500123456 * time.Nanosecond, 1500},
+		{`[GIN] 2024/01/01 - 12:30:45 | 200 | 59.999999999s |   127.0.0.1 | GET      "/api/v1/export"`, time.Minute - time.Nanosecond, 59999},
+		{`[GIN] 2024/01/01 - 12:30:45 | 504 |          1m2s |   127.0.0.1 | GET      "/api/v1/export"`, 62 * time.Second, 62000},
+		{`[GIN] 2024/01/01 - 12:30:45 | 504 |        1h2m3s |   127.0.0.1 | GET      "/api/v1/export"`, time.Hour + 2*time.Minute + 3*time.Second, 3723000},
+		{`[GIN] 2024/01/01 - 12:30:45 | 200 |            0s |   127.0.0.1 | GET      "/api/v1/ping"`, 0, 0},
+	}
+	for _, tt := range tests {
+		entry, err := ParseLogLine(tt.line, "web-01", "api", DefaultFieldMap, DefaultFieldSeparator, DefaultTimestampFormat)
+		if err != nil {
+			t.Errorf("ParseLogLine(%q): %v", tt.line, err)
+			continue
+		}
+		if entry.Duration != tt.want || entry.Duration.Milliseconds() != tt.ms {
+			t.Errorf("duration of %q = %s (%dms), want %s (%dms)", tt.line, entry.Duration, entry.Duration.Milliseconds(), tt.want, tt.ms)
+		}
+	}
+
+	for _, s := range []string{"", "1.234", "-1.5ms", "1.5 ms", "fast"} {
+		if d, err := ParseGINDuration(s); err == nil {
+			t.Errorf("ParseGINDuration(%q) = %s, want an error", s, d)
+		}
+	}
+}
+
+// BenchmarkParseLogLine parses GIN lines into batches of 100 entries, returning the entries of each
+// batch to the pool like InsertLogEntry or dropping them as before the pool, and reports the GC pauses
+// per line with the allocations
+func BenchmarkParseLogLine(b *testing.B) {
+	lines := strings.Split(strings.TrimSuffix(ginLines(100), "\n"), "\n")
+	for _, pooled := range []bool{true, false} {
+		name := "unpooled"
+		if pooled {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			batch := make([]*LogEntry, 0, len(lines))
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range b.N {
+				entry, err := ParseLogLine(lines[i%len(lines)], "web-01", "api", DefaultFieldMap, DefaultFieldSeparator, DefaultTimestampFormat)
+				if err != nil {
+					b.Fatal(err)
+				}
+				batch = append(batch, entry)
+				if len(batch) == cap(batch) {
+					if pooled {
+						releaseLogEntries(batch)
+					}
+					batch = batch[:0]
+				}
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+		})
+	}
+}
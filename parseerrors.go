@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseErrorPolicy configures parse failure alerts of a program. Zero fields in the config file
+// inherit the -parse-error-* flags.
+type ParseErrorPolicy struct {
+	// Threshold is the failed fraction of GIN lines (0 to 1) that must be exceeded, 0 disables
+	// the alert and 1 can never be exceeded
+	Threshold float64 `json:"threshold,omitempty"`
+	// Window is the rolling window over which the fraction is computed
+	Window Duration `json:"window,omitempty"`
+	// For is how long the fraction must stay above the threshold before alerting
+	For Duration `json:"for,omitempty"`
+	// MinLines is the minimum number of GIN lines in the window for it to be evaluated
+	MinLines int64 `json:"min_lines,omitempty"`
+}
+
+// withDefaults fills the zero fields of p from defaults
+func (p ParseErrorPolicy) withDefaults(defaults ParseErrorPolicy) ParseErrorPolicy {
+	if p.Threshold == 0 {
+		p.Threshold = defaults.Threshold
+	}
+	if p.Window == 0 {
+		p.Window = defaults.Window
+	}
+	if p.For == 0 {
+		p.For = defaults.For
+	}
+	if p.MinLines == 0 {
+		p.MinLines = defaults.MinLines
+	}
+	return p
+}
+
+// parseErrorBucket counts the lines of one resolution step
+type parseErrorBucket struct {
+	Total  int64
+	Failed int64
+	Sample string
+}
+
+// programParseErrors holds the rolling window of a program and its alert state
+type programParseErrors struct {
+	Policy      ParseErrorPolicy
+	Buckets     []parseErrorBucket
+	Current     int
+	BreachSince time.Time
+	Firing      bool
+}
+
+// ParseErrorTracker computes the ratio of GIN lines that fail to parse per program over a rolling
+// window and alerts when it stays above the program's threshold for a while, so a log format
+// change does not silently stop ingestion. A recovery alert is sent when the ratio drops back.
+type ParseErrorTracker struct {
+	Server     string
+	Resolution time.Duration
+	Alerter    *Dispatcher
+
+	mu       sync.Mutex
+	programs map[string]*programParseErrors
+}
+
+// NewParseErrorTracker creates a tracker whose windows advance every resolution
+func NewParseErrorTracker(server string, resolution time.Duration, alerter *Dispatcher) *ParseErrorTracker {
+	return &ParseErrorTracker{
+		Server:     server,
+		Resolution: resolution,
+		Alerter:    alerter,
+		programs:   make(map[string]*programParseErrors),
+	}
+}
+
+// Register enables tracking of program with policy, a disabled policy stops tracking it
+func (t *ParseErrorTracker) Register(program string, policy ParseErrorPolicy) {
+	if policy.Threshold <= 0 {
+		t.mu.Lock()
+		delete(t.programs, program)
+		t.mu.Unlock()
+		return
+	}
+	n := int(time.Duration(policy.Window) / t.Resolution)
+	if n < 1 {
+		n = 1
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.programs[program] = &programParseErrors{Policy: policy, Buckets: make([]parseErrorBucket, n)}
+}
+
+// Add counts a GIN line of program, line is kept as a sample if it failed to parse.
+// A nil tracker or an unregistered program is a no-op.
+func (t *ParseErrorTracker) Add(program string, failed bool, line string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.programs[program]
+	if !ok {
+		return
+	}
+	b := &w.Buckets[w.Current]
+	b.Total++
+	if failed {
+		b.Failed++
+		b.Sample = strings.TrimSpace(line)
+	}
+}
+
+// Run advances the windows every resolution until ctx is done
+func (t *ParseErrorTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.Resolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, alert := range t.evaluate(now) {
+				t.Alerter.Notify(alert)
+			}
+		}
+	}
+}
+
+// evaluate checks the rolling window of every program, starts a new bucket and returns the alerts to send
+func (t *ParseErrorTracker) evaluate(now time.Time) []*Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var alerts []*Alert
+	for program, w := range t.programs {
+		var total, failed int64
+		var sample string
+		for i := range w.Buckets {
+			// 从最旧的桶开始，保留最近一次失败的行
+			b := w.Buckets[(w.Current+1+i)%len(w.Buckets)]
+			total += b.Total
+			failed += b.Failed
+			if b.Sample != "" {
+				sample = b.Sample
+			}
+		}
+		var rate float64
+		if total > 0 {
+			rate = float64(failed) / float64(total)
+		}
+
+		window := time.Duration(w.Policy.Window)
+		alert := &Alert{
+			Server:    t.Server,
+			Program:   program,
+			Value:     rate,
+			Threshold: w.Policy.Threshold,
+			Window:    window.String(),
+			Time:      now,
+		}
+		if total >= w.Policy.MinLines && rate > w.Policy.Threshold {
+			if w.BreachSince.IsZero() {
+				w.BreachSince = now
+			}
+			if !w.Firing && now.Sub(w.BreachSince) >= time.Duration(w.Policy.For) {
+				alert.Type = "parse_errors_high"
+				alert.Message = fmt.Sprintf("%.1f%% of %s log lines (%d/%d) failed to parse over %s", rate*100, program, failed, total, window)
+				alert.Sample = sample
+				alerts = append(alerts, alert)
+				w.Firing = true
+			}
+		} else {
+			w.BreachSince = time.Time{}
+			if w.Firing {
+				alert.Type = "parse_errors_recovered"
+				alert.Message = fmt.Sprintf("%.1f%% of %s log lines (%d/%d) failed to parse over %s", rate*100, program, failed, total, window)
+				alerts = append(alerts, alert)
+				w.Firing = false
+			}
+		}
+
+		w.Current = (w.Current + 1) % len(w.Buckets)
+		w.Buckets[w.Current] = parseErrorBucket{}
+	}
+	return alerts
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// pathParamPattern matches path segments that are identifiers rather than routes:
+// decimal numbers, UUIDs and hex strings of 16 or more characters
+var pathParamPattern = regexp.MustCompile(`^(\d+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// ExtractPathTemplate replaces identifier segments of path with {id}, so
+// /api/v1/users/42/orders/7 becomes /api/v1/users/{id}/orders/{id}. The query string is dropped.
+func ExtractPathTemplate(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if pathParamPattern.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// matrixParamPattern matches the matrix parameters of a path segment, from its first ';' to the end of
+// the segment
+var matrixParamPattern = regexp.MustCompile(`;[^/]*`)
+
+// StripMatrixParams removes the matrix parameters of JAX-RS and Spring from each segment of path, so
+// /api/v1/users;role=admin becomes /api/v1/users and /data;format=json/records becomes /data/records.
+// The query string is kept as is.
+func StripMatrixParams(path string) string {
+	route, query, hasQuery := strings.Cut(path, "?")
+	if strings.IndexByte(route, ';') < 0 {
+		return path
+	}
+	route = matrixParamPattern.ReplaceAllString(route, "")
+	if hasQuery {
+		return route + "?" + query
+	}
+	return route
+}
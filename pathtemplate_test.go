@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripMatrixParams(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/api/v1/users;role=admin", "/api/v1/users"},
+		{"/data;format=json/records", "/data/records"},
+		{"/api/v1/users", "/api/v1/users"},
+		{"/", "/"},
+		{"", ""},
+		{"/users;sort=asc/42", "/users/42"},
+		{"/users;sort=asc;limit=10/42;v=2/orders", "/users/42/orders"},
+		{"/api/v1/users;role=admin/", "/api/v1/users/"},
+		{"/api/v1/users;role=admin?page=2", "/api/v1/users?page=2"},
+		// 查询字符串中的分号保持不变
+		{"/api/v1/users?filter=a;b", "/api/v1/users?filter=a;b"},
+		{"/api/v1/users;role=admin?filter=a;b", "/api/v1/users?filter=a;b"},
+		{"/api/v1/users;", "/api/v1/users"},
+	}
+	for _, tt := range tests {
+		if got := StripMatrixParams(tt.path); got != tt.want {
+			t.Errorf("StripMatrixParams(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+// TestMatrixParamsMatching checks that a path with matrix parameters matches the API list like the path
+// without them, and keeps them in its raw path
+func TestMatrixParamsMatching(t *testing.T) {
+	backend := &MemoryBackend{}
+	line := `[GIN] 2024/01/01 - 00:00:00 | 200 |    1.234ms |   127.0.0.1 | GET      "/api/v1/users;role=admin/42"` + "\n"
+	if err := processLogs(testMonitor(backend, 1), strings.NewReader(line)); err != nil {
+		t.Fatal(err)
+	}
+	entries := backend.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("stored %d entries, want 1", len(entries))
+	}
+	if entries[0].APIPath != "/api/v1/users" || entries[0].RawPath != "/api/v1/users;role=admin/42" {
+		t.Errorf("entry has path %s matched as %s, want /api/v1/users;role=admin/42 matched as /api/v1/users",
+			entries[0].RawPath, entries[0].APIPath)
+	}
+}
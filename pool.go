@@ -0,0 +1,26 @@
+package main
+
+import "sync"
+
+// logEntryPool recycles LogEntry structs between batches to reduce allocations at high line rates
+var logEntryPool = sync.Pool{
+	New: func() interface{} { return new(LogEntry) },
+}
+
+// newLogEntry returns a zeroed entry from the pool
+func newLogEntry() *LogEntry {
+	return logEntryPool.Get().(*LogEntry)
+}
+
+// releaseLogEntry returns an entry to the pool, it must not be used afterwards
+func releaseLogEntry(entry *LogEntry) {
+	*entry = LogEntry{}
+	logEntryPool.Put(entry)
+}
+
+// releaseLogEntries returns every entry of a batch to the pool
+func releaseLogEntries(entries []*LogEntry) {
+	for _, entry := range entries {
+		releaseLogEntry(entry)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// programRestarts counts the starts of each program seen by -supervisor-poll-interval after the first poll
+var programRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_program_restarts_total",
+	Help: "Starts of each program detected in supervisord, after the first poll.",
+}, []string{"program"})
+
+// programStarted is the time the running process of a program started, for deploy and restart markers
+var programStarted = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "logmonitor_program_started_timestamp_seconds",
+	Help: "Unix time at which the running process of each program was started by supervisord.",
+}, []string{"program"})
+
+func init() {
+	prometheus.MustRegister(programRestarts, programStarted)
+}
+
+// ProcessInfo is the supervisord state of a program. PID and Started are only set while it is RUNNING,
+// Started to the second as supervisorctl reports the uptime.
+type ProcessInfo struct {
+	Program string
+	State   string
+	PID     int
+	Started time.Time
+}
+
+// parseSupervisorProcesses parses the output of supervisorctl status at now, reading the pid and uptime
+// of RUNNING programs from lines such as "web:api   RUNNING   pid 123, uptime 2 days, 1:02:03"
+func parseSupervisorProcesses(out []byte, now time.Time) map[string]ProcessInfo {
+	processes := make(map[string]ProcessInfo)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		info := ProcessInfo{Program: fields[0], State: fields[1]}
+		if info.State == "RUNNING" {
+			pid, uptime, err := parseRunningDescription(strings.Join(fields[2:], " "))
+			if err != nil {
+				log.Printf("Error parsing supervisord status of %s: %v", info.Program, err)
+			} else {
+				info.PID = pid
+				info.Started = now.Add(-uptime).Truncate(time.Second)
+			}
+		}
+		processes[info.Program] = info
+	}
+	return processes
+}
+
+// parseRunningDescription parses "pid 123, uptime 2 days, 1:02:03"
+func parseRunningDescription(desc string) (int, time.Duration, error) {
+	pidPart, uptimePart, ok := strings.Cut(desc, ", uptime ")
+	if !ok || !strings.HasPrefix(pidPart, "pid ") {
+		return 0, 0, fmt.Errorf("unexpected description %q", desc)
+	}
+	pid, err := strconv.Atoi(strings.TrimPrefix(pidPart, "pid "))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid pid in %q", desc)
+	}
+	var uptime time.Duration
+	if days, clock, ok := strings.Cut(uptimePart, ", "); ok {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(days, " days"), " day"))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid uptime in %q", desc)
+		}
+		uptime = time.Duration(n) * 24 * time.Hour
+		uptimePart = clock
+	}
+	parts := strings.Split(uptimePart, ":")
+	if len(parts) != 3 {
+		return 0, 0, fmt.Errorf("invalid uptime in %q", desc)
+	}
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid uptime in %q", desc)
+		}
+		uptime += time.Duration(n) * unit
+	}
+	return pid, uptime, nil
+}
+
+// ProcessWatcher polls supervisorctl status to notice when programs are started again, by supervisorctl
+// restart, a deploy or autorestart, and notifies the monitors of those programs so they restart their
+// tail at once instead of finding out when it ends. Polling errors are logged when they start and stop
+// and never stop the watcher; while supervisord cannot be polled no start is reported.
+type ProcessWatcher struct {
+	Interval time.Duration
+	// status returns the output of supervisorctl status
+	status func() ([]byte, error)
+
+	mu          sync.Mutex
+	processes   map[string]ProcessInfo
+	failing     bool
+	subscribers map[string][]chan ProcessInfo
+}
+
+// NewProcessWatcher returns a watcher polling supervisorctl status every interval
+func NewProcessWatcher(interval time.Duration) *ProcessWatcher {
+	return &ProcessWatcher{
+		Interval:    interval,
+		status:      supervisorctlStatus,
+		subscribers: make(map[string][]chan ProcessInfo),
+	}
+}
+
+// Run polls supervisord until ctx is done
+func (w *ProcessWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	w.poll(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.poll(now)
+		}
+	}
+}
+
+// poll reads the state of the programs and reports the ones that started since the previous poll
+func (w *ProcessWatcher) poll(now time.Time) {
+	out, err := w.status()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		if !w.failing {
+			log.Printf("Error polling supervisord, program restarts are only noticed when their tail ends: %v", err)
+			w.failing = true
+		}
+		return
+	}
+	if w.failing {
+		log.Println("Polling supervisord again")
+		w.failing = false
+	}
+
+	processes := parseSupervisorProcesses(out, now)
+	for program, info := range processes {
+		prev, known := w.processes[program]
+		if info.State != "RUNNING" {
+			if known && prev.State == "RUNNING" {
+				log.Printf("Program %s is %s", program, info.State)
+			}
+			continue
+		}
+		if info.PID == 0 || (known && prev.State == "RUNNING" && prev.PID == info.PID) {
+			continue
+		}
+		programStarted.WithLabelValues(program).Set(float64(info.Started.Unix()))
+		// 首次轮询只记录当前进程，不算重启
+		if w.processes == nil {
+			continue
+		}
+		programRestarts.WithLabelValues(program).Inc()
+		log.Printf("Program %s started with pid %d at %s", program, info.PID, info.Started.Format(time.DateTime))
+		for _, ch := range w.subscribers[program] {
+			// 只保留最近一次启动
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- info
+		}
+	}
+	w.processes = processes
+}
+
+// Process returns the last polled state of program, false if it is unknown to supervisord or the last
+// poll failed. It is nil-receiver safe.
+func (w *ProcessWatcher) Process(program string) (ProcessInfo, bool) {
+	if w == nil {
+		return ProcessInfo{}, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failing {
+		return ProcessInfo{}, false
+	}
+	info, ok := w.processes[program]
+	return info, ok
+}
+
+// Subscribe returns a channel receiving the latest start of program
+func (w *ProcessWatcher) Subscribe(program string) chan ProcessInfo {
+	ch := make(chan ProcessInfo, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscribers[program] = append(w.subscribers[program], ch)
+	return ch
+}
+
+// Unsubscribe stops notifying ch of the starts of program
+func (w *ProcessWatcher) Unsubscribe(program string, ch chan ProcessInfo) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	subscribers := w.subscribers[program]
+	for i, c := range subscribers {
+		if c == ch {
+			w.subscribers[program] = append(subscribers[:i:i], subscribers[i+1:]...)
+			break
+		}
+	}
+	if len(w.subscribers[program]) == 0 {
+		delete(w.subscribers, program)
+	}
+}
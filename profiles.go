@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+)
+
+// programLabel is the pprof label holding the program of the goroutines of its monitor
+const programLabel = "program"
+
+// withProgramLabel runs fn with the pprof label of program, inherited by the goroutines it starts
+func withProgramLabel(ctx context.Context, program string, fn func(ctx context.Context)) {
+	pprof.Do(ctx, pprof.Labels(programLabel, program), fn)
+}
+
+// ServeProfiles registers GET /debug/pprof/programs/{name}/goroutine, which returns as plain text the
+// stacks of the goroutines labeled with the program name, grouped like /debug/pprof/goroutine?debug=1
+func (s *StatusServer) ServeProfiles() {
+	s.mux.Handle("GET /debug/pprof/programs/{name}/goroutine", s.protect(http.HandlerFunc(s.handleProgramGoroutines)))
+}
+
+func (s *StatusServer) handleProgramGoroutines(w http.ResponseWriter, r *http.Request) {
+	program := r.PathValue("name")
+	var profile bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&profile, 1); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stacks, n := filterGoroutineProfile(profile.String(), program)
+	if n == 0 {
+		http.Error(w, fmt.Sprintf("no goroutine of program %q", program), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "goroutine profile of program %s: total %d\n", program, n)
+	fmt.Fprint(w, stacks)
+}
+
+// filterGoroutineProfile returns the records of a debug=1 goroutine profile whose labels include the
+// program label of program, and the number of goroutines they count
+func filterGoroutineProfile(profile, program string) (string, int) {
+	label := strconv.Quote(programLabel) + ":" + strconv.Quote(program)
+	var out strings.Builder
+	total := 0
+	// 跳过 "goroutine profile: total N" 行，每条记录以 "<数量> @ <地址>" 开头，以空行结束
+	_, profile, _ = strings.Cut(profile, "\n")
+	for _, record := range strings.Split(profile, "\n\n") {
+		header, rest, _ := strings.Cut(record, "\n")
+		labels, _, _ := strings.Cut(rest, "\n")
+		count, _, ok := strings.Cut(header, " @ ")
+		if !ok || !strings.HasPrefix(labels, "# labels: ") {
+			continue
+		}
+		if !strings.Contains(labels, "{"+label+",") && !strings.Contains(labels, " "+label+",") &&
+			!strings.Contains(labels, " "+label+"}") && !strings.Contains(labels, "{"+label+"}") {
+			continue
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			continue
+		}
+		total += n
+		out.WriteString("\n" + strings.TrimSpace(record) + "\n")
+	}
+	return out.String(), total
+}
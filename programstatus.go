@@ -0,0 +1,189 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProgramStatus is the state of a monitored program, shown by /-/status
+type ProgramStatus struct {
+	Program        string    `json:"program"`
+	Running        bool      `json:"running"`
+	LinesRead      int64     `json:"lines_read"`
+	LinesMatched   int64     `json:"lines_matched"`
+	BatchesFlushed int64     `json:"batches_flushed"`
+	Errors         int64     `json:"errors"`
+	LastActivity   time.Time `json:"last_activity,omitempty"`
+	// ChildPID is the pid of the supervisorctl tail process, 0 when not running or not tailing supervisord
+	ChildPID int `json:"child_pid"`
+}
+
+// ProgramCounters holds the state of one program. Its fields are updated atomically by the monitor and
+// read by /-/status and /metrics without locking.
+type ProgramCounters struct {
+	program        string
+	running        atomic.Bool
+	linesRead      atomic.Int64
+	linesMatched   atomic.Int64
+	batchesFlushed atomic.Int64
+	errors         atomic.Int64
+	lastActivity   atomic.Int64
+	childPID       atomic.Int64
+}
+
+// SetRunning records that the program's log stream started or stopped, pid is the tail process or 0.
+// A nil counter is a no-op, as are the other methods.
+func (c *ProgramCounters) SetRunning(running bool, pid int) {
+	if c == nil {
+		return
+	}
+	c.running.Store(running)
+	c.childPID.Store(int64(pid))
+}
+
+// LineRead counts a line read from the program
+func (c *ProgramCounters) LineRead() {
+	if c == nil {
+		return
+	}
+	c.linesRead.Add(1)
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// LineMatched counts a line that produced an entry
+func (c *ProgramCounters) LineMatched() {
+	if c == nil {
+		return
+	}
+	c.linesMatched.Add(1)
+}
+
+// BatchFlushed counts a batch written to the backend
+func (c *ProgramCounters) BatchFlushed() {
+	if c == nil {
+		return
+	}
+	c.batchesFlushed.Add(1)
+}
+
+// Error counts a failed insert or a failed read of the log stream
+func (c *ProgramCounters) Error() {
+	if c == nil {
+		return
+	}
+	c.errors.Add(1)
+}
+
+// Status returns a snapshot of the counters
+func (c *ProgramCounters) Status() ProgramStatus {
+	status := ProgramStatus{
+		Program:        c.program,
+		Running:        c.running.Load(),
+		LinesRead:      c.linesRead.Load(),
+		LinesMatched:   c.linesMatched.Load(),
+		BatchesFlushed: c.batchesFlushed.Load(),
+		Errors:         c.errors.Load(),
+		ChildPID:       int(c.childPID.Load()),
+	}
+	if ns := c.lastActivity.Load(); ns > 0 {
+		status.LastActivity = time.Unix(0, ns)
+	}
+	return status
+}
+
+// Descriptions of the per-program gauges
+var (
+	programRunningDesc        = prometheus.NewDesc("logmonitor_program_running", "Whether the log stream of the program is open.", []string{"program"}, nil)
+	programLinesReadDesc      = prometheus.NewDesc("logmonitor_program_lines_read", "Lines read from the program since startup.", []string{"program"}, nil)
+	programLinesMatchedDesc   = prometheus.NewDesc("logmonitor_program_lines_matched", "Lines of the program that matched the API list since startup.", []string{"program"}, nil)
+	programBatchesFlushedDesc = prometheus.NewDesc("logmonitor_program_batches_flushed", "Batches of the program written to the backend since startup.", []string{"program"}, nil)
+	programErrorsDesc         = prometheus.NewDesc("logmonitor_program_errors", "Failed inserts and log stream reads of the program since startup.", []string{"program"}, nil)
+	programLastActivityDesc   = prometheus.NewDesc("logmonitor_program_last_activity_timestamp_seconds", "Unix time of the last line read from the program.", []string{"program"}, nil)
+	programChildPIDDesc       = prometheus.NewDesc("logmonitor_program_child_pid", "Pid of the supervisorctl tail process of the program, 0 if none.", []string{"program"}, nil)
+)
+
+// programMetrics holds the counters of the programs monitored by this process
+var programMetrics = NewPerProgramMetrics()
+
+func init() {
+	prometheus.MustRegister(programMetrics)
+}
+
+// PerProgramMetrics keeps the counters of every monitored program and exports them as gauges
+type PerProgramMetrics struct {
+	mu       sync.Mutex
+	programs map[string]*ProgramCounters
+}
+
+// NewPerProgramMetrics creates an empty set of counters
+func NewPerProgramMetrics() *PerProgramMetrics {
+	return &PerProgramMetrics{programs: make(map[string]*ProgramCounters)}
+}
+
+// Program returns the counters of program, creating them if needed
+func (p *PerProgramMetrics) Program(program string) *ProgramCounters {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.programs[program]
+	if !ok {
+		c = &ProgramCounters{program: program}
+		p.programs[program] = c
+	}
+	return c
+}
+
+// Remove forgets the counters of a program that is no longer monitored, such as a deleted pod
+func (p *PerProgramMetrics) Remove(program string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.programs, program)
+}
+
+// Statuses returns the status of every program, sorted by program
+func (p *PerProgramMetrics) Statuses() []ProgramStatus {
+	p.mu.Lock()
+	statuses := make([]ProgramStatus, 0, len(p.programs))
+	for _, c := range p.programs {
+		statuses = append(statuses, c.Status())
+	}
+	p.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Program < statuses[j].Program })
+	return statuses
+}
+
+// Describe implements prometheus.Collector
+func (p *PerProgramMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{programRunningDesc, programLinesReadDesc, programLinesMatchedDesc,
+		programBatchesFlushedDesc, programErrorsDesc, programLastActivityDesc, programChildPIDDesc} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (p *PerProgramMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range p.Statuses() {
+		running := 0.0
+		if s.Running {
+			running = 1
+		}
+		var lastActivity float64
+		if !s.LastActivity.IsZero() {
+			lastActivity = float64(s.LastActivity.UnixNano()) / 1e9
+		}
+		for desc, v := range map[*prometheus.Desc]float64{
+			programRunningDesc:        running,
+			programLinesReadDesc:      float64(s.LinesRead),
+			programLinesMatchedDesc:   float64(s.LinesMatched),
+			programBatchesFlushedDesc: float64(s.BatchesFlushed),
+			programErrorsDesc:         float64(s.Errors),
+			programLastActivityDesc:   lastActivity,
+			programChildPIDDesc:       float64(s.ChildPID),
+		} {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, s.Program)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestProgramStatusConcurrency updates the counters of several programs from many goroutines while
+// others read them through Statuses and Collect, as the monitors, /-/status and /metrics do. Run it with
+// go test -race.
+func TestProgramStatusConcurrency(t *testing.T) {
+	const programs, writers, lines = 4, 8, 1000
+	p := NewPerProgramMetrics()
+	done := make(chan struct{})
+
+	var readers sync.WaitGroup
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			// 计数只增不减，每次读到的快照不能比上一次小
+			last := make(map[string]ProgramStatus)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, s := range p.Statuses() {
+					prev := last[s.Program]
+					if s.LinesRead < prev.LinesRead || s.LinesMatched < prev.LinesMatched ||
+						s.BatchesFlushed < prev.BatchesFlushed || s.Errors < prev.Errors {
+						t.Errorf("status of %s went back from %+v to %+v", s.Program, prev, s)
+						return
+					}
+					last[s.Program] = s
+				}
+				ch := make(chan prometheus.Metric, 64)
+				go func() {
+					p.Collect(ch)
+					close(ch)
+				}()
+				for range ch {
+				}
+				// 读取不停占用锁会饿死写入
+				time.Sleep(10 * time.Microsecond)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range lines {
+				c := p.Program(fmt.Sprintf("program-%d", (w+i)%programs))
+				c.SetRunning(true, 1000+w)
+				c.LineRead()
+				c.LineMatched()
+				if i%10 == 0 {
+					c.BatchFlushed()
+				}
+				if i%100 == 0 {
+					c.Error()
+				}
+			}
+		}()
+	}
+	// 删除再创建的程序从零开始计数
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range lines {
+			p.Program("removed").LineRead()
+			p.Remove("removed")
+		}
+	}()
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	statuses := p.Statuses()
+	if len(statuses) != programs {
+		t.Fatalf("got the status of %d programs, want %d: %+v", len(statuses), programs, statuses)
+	}
+	var read, matched, flushed, errors int64
+	for i, s := range statuses {
+		if want := fmt.Sprintf("program-%d", i); s.Program != want || !s.Running || s.LastActivity.IsZero() {
+			t.Errorf("status %d = %+v, want %s running with an activity", i, s, want)
+		}
+		read += s.LinesRead
+		matched += s.LinesMatched
+		flushed += s.BatchesFlushed
+		errors += s.Errors
+	}
+	if read != writers*lines || matched != writers*lines || flushed != writers*lines/10 || errors != writers*lines/100 {
+		t.Errorf("counted %d read, %d matched, %d batches and %d errors, want %d, %d, %d and %d",
+			read, matched, flushed, errors, writers*lines, writers*lines, writers*lines/10, writers*lines/100)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// maxQueryParamsLength is the size of the query_params column
+const maxQueryParamsLength = 512
+
+// QueryParamFilter keeps the values of whitelisted query parameters, such as coin or version, which are
+// otherwise dropped with the rest of the query string when the path is matched against the API list.
+// The whitelist is the union of Names and the params= option of the matched API. The kept values are
+// capped at MaxLength characters, passed through Scrubber as if they were the only parameter of the
+// query, and stored as a sorted, URL-encoded key=value string, e.g. "coin=btc&version=2".
+type QueryParamFilter struct {
+	Names     []string
+	MaxLength int
+	Scrubber  *Scrubber
+}
+
+// Extract returns the whitelisted parameters of rawPath, "" if it has none. Only the first value of
+// a repeated parameter is kept.
+func (f *QueryParamFilter) Extract(rawPath string, apiNames []string) string {
+	if f == nil || len(f.Names)+len(apiNames) == 0 {
+		return ""
+	}
+	_, query, ok := strings.Cut(rawPath, "?")
+	if !ok {
+		return ""
+	}
+	query, _, _ = strings.Cut(query, "#")
+	// 格式错误的参数被忽略，其余参数照常解析
+	values, _ := url.ParseQuery(query)
+
+	kept := url.Values{}
+	for _, names := range [][]string{f.Names, apiNames} {
+		for _, name := range names {
+			v, ok := values[name]
+			if !ok || kept.Has(name) {
+				continue
+			}
+			kept.Set(name, f.value(name, v[0]))
+		}
+	}
+	encoded := kept.Encode()
+	for len(encoded) > maxQueryParamsLength {
+		i := strings.LastIndexByte(encoded, '&')
+		if i < 0 {
+			return ""
+		}
+		encoded = encoded[:i]
+	}
+	return encoded
+}
+
+// value caps a parameter value and scrubs it
+func (f *QueryParamFilter) value(name, v string) string {
+	if f.MaxLength > 0 && len([]rune(v)) > f.MaxLength {
+		v = string([]rune(v)[:f.MaxLength])
+	}
+	if f.Scrubber == nil {
+		return v
+	}
+	// 按查询字符串的形式清理，敏感参数名同样生效
+	scrubbed := f.Scrubber.scrub("?"+name+"="+v, true)
+	if rest, ok := strings.CutPrefix(scrubbed, "?"+name+"="); ok {
+		return rest
+	}
+	return f.Scrubber.placeholder
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisConn is a minimal RESP client for the few commands the program lock needs
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// dialRedis connects to a redis:// or rediss:// URL, authenticating with its user and password and
+// selecting the database of its path
+func dialRedis(rawURL string, timeout time.Duration) (*redisConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "redis":
+		conn, err = dialer.Dial("tcp", addr)
+	case "rediss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported redis URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if user := u.User.Username(); user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if _, err := c.do(timeout, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" && db != "0" {
+		if _, err := c.do(timeout, "SELECT", db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and returns its reply: a string for simple and bulk strings, an int64 for integers,
+// nil for a nil reply, or a redisError
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+// reply reads one reply
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// Close closes the connection
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// redisRenewScript extends the lock only if this instance still holds it
+const redisRenewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+
+// redisReleaseScript deletes the lock only if this instance still holds it
+const redisReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// RedisLocker elects one instance per program when several instances tail the same supervisord: an
+// instance monitors a program only while it holds logmonitor:lock:<program>, set with NX and a TTL and
+// renewed every TTL/3. An instance that fails to renew stops monitoring and waits for the lock again.
+type RedisLocker struct {
+	URL        string
+	InstanceID string
+	TTL        time.Duration
+
+	mu   sync.Mutex
+	conn *redisConn
+}
+
+// do runs a command on the shared connection, reconnecting after an error
+func (l *RedisLocker) do(args ...string) (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	timeout := l.TTL / 3
+	if l.conn == nil {
+		conn, err := dialRedis(l.URL, timeout)
+		if err != nil {
+			return nil, err
+		}
+		l.conn = conn
+	}
+	reply, err := l.conn.do(timeout, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// 连接出错后重新连接
+		l.conn.Close()
+		l.conn = nil
+	}
+	return reply, err
+}
+
+// lockKey returns the key of a program's lock
+func (l *RedisLocker) lockKey(program string) string {
+	return "logmonitor:lock:" + program
+}
+
+// acquire tries to take the lock of a program
+func (l *RedisLocker) acquire(program string) (bool, error) {
+	reply, err := l.do("SET", l.lockKey(program), l.InstanceID, "NX", "PX", strconv.FormatInt(l.TTL.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+// renew extends the lock of a program, false means another instance holds it
+func (l *RedisLocker) renew(program string) (bool, error) {
+	reply, err := l.do("EVAL", redisRenewScript, "1", l.lockKey(program), l.InstanceID, strconv.FormatInt(l.TTL.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+// release gives up the lock of a program if this instance holds it
+func (l *RedisLocker) release(program string) {
+	if _, err := l.do("EVAL", redisReleaseScript, "1", l.lockKey(program), l.InstanceID); err != nil {
+		log.Printf("Error releasing lock of %s: %v", program, err)
+	}
+}
+
+// Hold runs fn for program while this instance holds its lock. The context passed to fn is canceled
+// when the lock is lost, after which Hold waits to reacquire the lock and runs fn again. Hold returns
+// when fn returns without the lock being lost.
+func (l *RedisLocker) Hold(program string, fn func(ctx context.Context) error) error {
+	interval := l.TTL / 3
+	for {
+		waiting := false
+		for {
+			ok, err := l.acquire(program)
+			if err != nil {
+				log.Printf("Error acquiring lock of %s: %v", program, err)
+			} else if ok {
+				break
+			} else if !waiting {
+				log.Printf("Program %s is monitored by another instance, waiting for its lock", program)
+				waiting = true
+			}
+			time.Sleep(interval)
+		}
+		log.Printf("Acquired lock of %s as %s", program, l.InstanceID)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		lost := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			lastRenewed := time.Now()
+			for {
+				select {
+				case <-done:
+					return
+				case now := <-ticker.C:
+					ok, err := l.renew(program)
+					if err == nil && ok {
+						lastRenewed = now
+						continue
+					}
+					// 续期失败且锁可能已过期时停止监控
+					if err != nil && now.Sub(lastRenewed) < l.TTL-interval {
+						log.Printf("Error renewing lock of %s: %v", program, err)
+						continue
+					}
+					log.Printf("Lost lock of %s, stopping", program)
+					close(lost)
+					cancel()
+					return
+				}
+			}
+		}()
+
+		err := fn(ctx)
+		close(done)
+		cancel()
+		select {
+		case <-lost:
+			continue
+		default:
+		}
+		l.release(program)
+		return err
+	}
+}
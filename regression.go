@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// LatencyRegression is an endpoint whose latency quantile grew between a baseline and a current window
+type LatencyRegression struct {
+	Program         string
+	APIPath         string
+	BaselineMs      float64
+	CurrentMs       float64
+	Ratio           float64
+	BaselineSamples uint64
+	CurrentSamples  uint64
+}
+
+// CompareLatency returns the endpoints whose quantile q in current is at least ratio times the one in baseline,
+// sorted by ratio descending. Endpoints with fewer than minSamples durations in either window are skipped.
+func CompareLatency(baseline, current map[endpointKey]*EndpointStats, q, ratio float64, minSamples uint64) []LatencyRegression {
+	var regressions []LatencyRegression
+	for key, cur := range current {
+		base, ok := baseline[key]
+		if !ok || base.Latency.Total < minSamples || cur.Latency.Total < minSamples {
+			continue
+		}
+		baseMs, curMs := base.Latency.Quantile(q), cur.Latency.Quantile(q)
+		if baseMs <= 0 || curMs < baseMs*ratio {
+			continue
+		}
+		regressions = append(regressions, LatencyRegression{
+			Program:         key.Program,
+			APIPath:         key.APIPath,
+			BaselineMs:      baseMs,
+			CurrentMs:       curMs,
+			Ratio:           curMs / baseMs,
+			BaselineSamples: base.Latency.Total,
+			CurrentSamples:  cur.Latency.Total,
+		})
+	}
+	sort.Slice(regressions, func(i, j int) bool {
+		if regressions[i].Ratio != regressions[j].Ratio {
+			return regressions[i].Ratio > regressions[j].Ratio
+		}
+		if regressions[i].Program != regressions[j].Program {
+			return regressions[i].Program < regressions[j].Program
+		}
+		return regressions[i].APIPath < regressions[j].APIPath
+	})
+	return regressions
+}
+
+// baselineWindow returns the start of the baseline window for the window [from, to):
+// the same-length window right before it, or the same window a day earlier
+func baselineWindow(from, to time.Time, baseline string) (time.Time, error) {
+	switch baseline {
+	case "previous":
+		return from.Add(-to.Sub(from)), nil
+	case "yesterday":
+		return from.AddDate(0, 0, -1), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown baseline %q, expected previous or yesterday", baseline)
+}
+
+// FindLatencyRegressions compares the minute rollups of env, all environments if it is empty, in [from, to)
+// with its baseline window
+func FindLatencyRegressions(ctx context.Context, db *sql.DB, env string, from, to time.Time, baseline string, q, ratio float64, minSamples uint64) ([]LatencyRegression, error) {
+	baseFrom, err := baselineWindow(from, to, baseline)
+	if err != nil {
+		return nil, err
+	}
+	current, err := LoadStatsFromMinutes(ctx, db, env, from, to)
+	if err != nil {
+		return nil, err
+	}
+	base, err := LoadStatsFromMinutes(ctx, db, env, baseFrom, baseFrom.Add(to.Sub(from)))
+	if err != nil {
+		return nil, err
+	}
+	return CompareLatency(base, current, q, ratio, minSamples), nil
+}
+
+// RegressionDetector periodically compares the p95 latency of each endpoint over the last Window with its
+// baseline window in the minute rollups and alerts on regressions, with a recovery alert once an endpoint
+// is back below the ratio. Windows end Delay before now so the minute buckets are written. Only the
+// rollups of Env are compared.
+type RegressionDetector struct {
+	DB         *sql.DB
+	Server     string
+	Env        string
+	Window     time.Duration
+	Delay      time.Duration
+	Baseline   string
+	Ratio      float64
+	MinSamples uint64
+	Alerter    *Dispatcher
+
+	firing map[endpointKey]bool
+}
+
+// Run checks every interval until ctx is done
+func (d *RegressionDetector) Run(ctx context.Context, interval time.Duration) {
+	d.firing = make(map[endpointKey]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := d.check(ctx, now); err != nil {
+				log.Printf("Error checking latency regressions: %v", err)
+			}
+		}
+	}
+}
+
+// check compares the window ending at now minus the delay and sends the alerts
+func (d *RegressionDetector) check(ctx context.Context, now time.Time) error {
+	to := now.Add(-d.Delay).Truncate(time.Minute)
+	from := to.Add(-d.Window)
+	regressions, err := FindLatencyRegressions(ctx, d.DB, d.Env, from, to, d.Baseline, 0.95, d.Ratio, d.MinSamples)
+	if err != nil {
+		return err
+	}
+
+	regressed := make(map[endpointKey]bool)
+	for _, r := range regressions {
+		key := endpointKey{Program: r.Program, APIPath: r.APIPath}
+		regressed[key] = true
+		if d.firing[key] {
+			continue
+		}
+		d.firing[key] = true
+		d.Alerter.Notify(&Alert{
+			Type:      "latency_regression",
+			Server:    d.Server,
+			Program:   r.Program,
+			Endpoint:  r.APIPath,
+			Value:     r.CurrentMs,
+			Threshold: r.BaselineMs * d.Ratio,
+			Window:    d.Window.String(),
+			Message: fmt.Sprintf("p95 of %s rose from %.1fms to %.1fms (%.1fx) over the last %s compared to the %s window (%d vs %d requests)",
+				r.APIPath, r.BaselineMs, r.CurrentMs, r.Ratio, d.Window, d.Baseline, r.BaselineSamples, r.CurrentSamples),
+			Time: now,
+		})
+	}
+	for key := range d.firing {
+		if regressed[key] {
+			continue
+		}
+		delete(d.firing, key)
+		d.Alerter.Notify(&Alert{
+			Type:     "latency_regression_recovered",
+			Server:   d.Server,
+			Program:  key.Program,
+			Endpoint: key.APIPath,
+			Window:   d.Window.String(),
+			Message:  fmt.Sprintf("p95 of %s is back within %.1fx of the %s window", key.APIPath, d.Ratio, d.Baseline),
+			Time:     now,
+		})
+	}
+	return nil
+}
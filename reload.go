@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// silencePolicy returns the silence policy of program, -silence-after overridden by its config
+func silencePolicy(config *Config, program string, after Duration) SilencePolicy {
+	policy := SilencePolicy{After: after}
+	if p := config.Program(program).Silence; p != nil {
+		policy.QuietHours = p.QuietHours
+		if p.After != 0 {
+			policy.After = p.After
+		}
+	}
+	return policy
+}
+
+// parseErrorPolicy returns the parse failure policy of program, the -parse-error-* flags overridden by its config
+func parseErrorPolicy(config *Config, program string, defaults ParseErrorPolicy) ParseErrorPolicy {
+	if p := config.Program(program).ParseErrors; p != nil {
+		return p.withDefaults(defaults)
+	}
+	return defaults
+}
+
+// Reloader reloads the config file, the API list and the files watched for changes when the process
+// receives SIGHUP. Values read through atomic pointers and the per-program alert policies apply at once,
+// without restarting any monitor. Config settings that are read when the monitors start are only
+// reported as changed, they apply after a restart.
+type Reloader struct {
+	ConfigFile  string
+	APIListFile string
+	APIList     *atomic.Pointer[map[string]APIEntry]
+	Config      *atomic.Pointer[Config]
+	Programs    []string
+
+	// Activity and ParseErrors get the new silence and parse failure policies of the programs, computed
+	// from SilenceAfter and ParseErrorDefaults like at startup
+	Activity           *ActivityTracker
+	ParseErrors        *ParseErrorTracker
+	SilenceAfter       Duration
+	ParseErrorDefaults ParseErrorPolicy
+
+	Bots  *BotClassifier
+	GeoIP *GeoIP
+	Certs []*CertFiles
+}
+
+// Run reloads on every SIGHUP until ctx is done
+func (r *Reloader) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Println("Received SIGHUP, reloading")
+			r.Reload()
+		}
+	}
+}
+
+// Reload re-reads the API list, the config file and the watched files, keeping the current values of
+// those that fail to load
+func (r *Reloader) Reload() {
+	if r.APIListFile != "" {
+		reloadAPIList(r.APIListFile, r.APIList)
+	}
+	if r.ConfigFile != "" {
+		r.reloadConfig()
+	}
+	r.Bots.Reload()
+	r.GeoIP.Reload()
+	for _, certs := range r.Certs {
+		certs.Reload()
+	}
+}
+
+// reloadConfig swaps in the config file and applies the policies that can change at runtime
+func (r *Reloader) reloadConfig() {
+	config, err := LoadConfig(r.ConfigFile)
+	if err != nil {
+		log.Printf("Error reloading config, keeping the previous one: %v", err)
+		return
+	}
+	old := r.Config.Swap(config)
+	log.Printf("Reloaded config %s", r.ConfigFile)
+
+	for _, program := range r.Programs {
+		if silence := silencePolicy(config, program, r.SilenceAfter); !reflect.DeepEqual(silence, silencePolicy(old, program, r.SilenceAfter)) {
+			if err := r.Activity.Register(program, silence); err != nil {
+				log.Printf("Error applying the silence policy of %s, keeping the previous one: %v", program, err)
+			} else {
+				log.Printf("Reloaded silence policy of %s: after %s, quiet hours %q", program, time.Duration(silence.After), silence.QuietHours)
+			}
+		}
+		if policy := parseErrorPolicy(config, program, r.ParseErrorDefaults); policy != parseErrorPolicy(old, program, r.ParseErrorDefaults) {
+			r.ParseErrors.Register(program, policy)
+			log.Printf("Reloaded parse failure policy of %s: threshold %g over %s for %s, at least %d lines", program,
+				policy.Threshold, time.Duration(policy.Window), time.Duration(policy.For), policy.MinLines)
+		}
+		oldProgram, newProgram := old.Program(program), config.Program(program)
+		// 以下设置在启动监控时读取
+		for _, setting := range []struct {
+			Name     string
+			Old, New interface{}
+		}{
+			{"sampling", oldProgram.Sampling, newProgram.Sampling},
+			{"bots", oldProgram.Bots, newProgram.Bots},
+			{"anonymize", oldProgram.Anonymize, newProgram.Anonymize},
+			{"version", oldProgram.Version, newProgram.Version},
+			{"fields", oldProgram.Fields, newProgram.Fields},
+		} {
+			if !reflect.DeepEqual(setting.Old, setting.New) {
+				log.Printf("Warning: %s of program %s changed in the config, restart to apply it", setting.Name, program)
+			}
+		}
+	}
+	for _, setting := range []struct {
+		Name     string
+		Old, New interface{}
+	}{
+		{"notifiers", old.Notifiers, config.Notifiers},
+		{"geoip", old.GeoIP, config.GeoIP},
+		{"scrub", old.Scrub, config.Scrub},
+		{"redact", old.Redact, config.Redact},
+		{"ignore_ips", old.IgnoreIPs, config.IgnoreIPs},
+		{"labels", old.Labels, config.Labels},
+	} {
+		if !reflect.DeepEqual(setting.Old, setting.New) {
+			log.Printf("Warning: %s changed in the config, restart to apply it", setting.Name)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runReport implements the report subcommand, which prints per-endpoint statistics for a range of days:
+//
+//	log-monitor report -dsn ... [-from 2006-01-02] [-to 2006-01-02] [-program name] [-env name] [-apilist file] [-group-by endpoint|protocol]
+//
+// With an API list, the availability of the APIs that have an SLO is printed as well. -group-by protocol
+// prints one row per program, HTTP protocol and TLS version instead of per endpoint.
+// "report regressions" compares latencies instead, see runRegressionReport, "report top-ips" prints
+// the top IPs of a running instance, see runTopIPsReport, "report status-codes" prints the status
+// code distribution, see runStatusCodeReport, and "report availability" prints the month-to-date
+// availability of each endpoint, see runAvailabilityReport.
+func runReport(args []string) error {
+	if len(args) > 0 && args[0] == "regressions" {
+		return runRegressionReport(args[1:])
+	}
+	if len(args) > 0 && args[0] == "status-codes" {
+		return runStatusCodeReport(args[1:])
+	}
+	if len(args) > 0 && args[0] == "availability" {
+		return runAvailabilityReport(args[1:])
+	}
+	if len(args) > 0 && args[0] == "top-ips" {
+		return runTopIPsReport(args[1:])
+	}
+
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	dsn := fs.String("dsn", "", "Data Source Name for MySQL")
+	fromFlag := fs.String("from", "", "First day of the report (YYYY-MM-DD), defaults to today")
+	toFlag := fs.String("to", "", "Last day of the report (YYYY-MM-DD), defaults to -from")
+	program := fs.String("program", "", "Only report this program")
+	env := fs.String("env", "", "Only report this environment, all environments if empty")
+	apiListFile := fs.String("apilist", "", "API list whose SLO targets are reported")
+	groupBy := fs.String("group-by", "endpoint", "Rows of the report: endpoint, or protocol for the HTTP protocol and TLS version of each program")
+	fs.Parse(args)
+	if *groupBy != "endpoint" && *groupBy != "protocol" {
+		return fmt.Errorf("unknown -group-by %q, expected endpoint or protocol", *groupBy)
+	}
+
+	from := time.Now()
+	if *fromFlag != "" {
+		day, err := time.ParseInLocation("2006-01-02", *fromFlag, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+		from = day
+	}
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local)
+	to := from
+	if *toFlag != "" {
+		day, err := time.ParseInLocation("2006-01-02", *toFlag, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+		to = day
+	}
+	if to.Before(from) {
+		return fmt.Errorf("-to %s is before -from %s", to.Format("2006-01-02"), from.Format("2006-01-02"))
+	}
+
+	db, err := sql.Open("mysql", *dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if *groupBy == "protocol" {
+		stats, err := LoadProtocolStats(ctx, db, *env, from, to.AddDate(0, 0, 1))
+		if err != nil {
+			return err
+		}
+		return writeProtocolReport(os.Stdout, stats, *program)
+	}
+	stats, err := LoadStats(ctx, db, *env, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+	uniqueIPs, err := LoadUniqueIPs(ctx, db, *env, from, to)
+	if err != nil {
+		return err
+	}
+	if err := writeReport(os.Stdout, stats, uniqueIPs, *program); err != nil {
+		return err
+	}
+
+	if *apiListFile == "" {
+		return nil
+	}
+	apiList, err := LoadAPIList(*apiListFile)
+	if err != nil {
+		return err
+	}
+	// 原始记录按 API 列表路径存储，与 SLO 的配置对应
+	raw, err := LoadStatsFromRaw(ctx, db, *env, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	return writeSLOReport(os.Stdout, ComputeSLOStatus(raw, apiList), *program)
+}
+
+// writeSLOReport prints the SLO status of each endpoint, sorted by program and path
+func writeSLOReport(out io.Writer, statuses []SLOStatus, program string) error {
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Program != statuses[j].Program {
+			return statuses[i].Program < statuses[j].Program
+		}
+		return statuses[i].APIPath < statuses[j].APIPath
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROGRAM\tAPI_PATH\tSLO\tAVAILABILITY\tBUDGET_REMAINING\tSTATUS")
+	for _, s := range statuses {
+		if program != "" && s.Program != program {
+			continue
+		}
+		status := "OK"
+		if s.Availability < s.Target {
+			status = "VIOLATED"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.3f%%\t%.3f%%\t%.1f%%\t%s\n", s.Program, s.APIPath, s.Target*100, s.Availability*100, s.BudgetRemaining*100, status)
+	}
+	return w.Flush()
+}
+
+// writeReport prints one row per endpoint, sorted by program and path. Endpoints without unique IP data show "-".
+func writeReport(out io.Writer, stats map[endpointKey]*EndpointStats, uniqueIPs map[endpointKey]uint64, program string) error {
+	keys := make(map[endpointKey]struct{})
+	for key := range stats {
+		keys[key] = struct{}{}
+	}
+	for key := range uniqueIPs {
+		keys[key] = struct{}{}
+	}
+	var sorted []endpointKey
+	for key := range keys {
+		if program == "" || key.Program == program {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Program != sorted[j].Program {
+			return sorted[i].Program < sorted[j].Program
+		}
+		return sorted[i].APIPath < sorted[j].APIPath
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROGRAM\tAPI_PATH\tREQUESTS\tERRORS\tERROR_RATE\tP50_MS\tP99_MS\tUNIQUE_IPS")
+	for _, key := range sorted {
+		s, ok := stats[key]
+		if !ok {
+			s = &EndpointStats{Program: key.Program, APIPath: key.APIPath}
+		}
+		unique := "-"
+		if n, ok := uniqueIPs[key]; ok {
+			unique = fmt.Sprint(n)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.2f%%\t%.1f\t%.1f\t%s\n", key.Program, key.APIPath, s.Count, s.ErrorCount,
+			s.ErrorRate()*100, s.Latency.Quantile(0.50), s.Latency.Quantile(0.99), unique)
+	}
+	return w.Flush()
+}
+
+// writeProtocolReport prints one row per program, HTTP protocol and TLS version with its share of the
+// program's requests, sorted by program then protocol. Protocols that were not logged show "-".
+func writeProtocolReport(out io.Writer, stats map[protocolKey]*EndpointStats, program string) error {
+	totals := make(map[string]int64)
+	var sorted []protocolKey
+	for key, s := range stats {
+		if program == "" || key.Program == program {
+			sorted = append(sorted, key)
+			totals[key.Program] += s.Count
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Program != sorted[j].Program {
+			return sorted[i].Program < sorted[j].Program
+		}
+		if sorted[i].Protocol != sorted[j].Protocol {
+			return sorted[i].Protocol < sorted[j].Protocol
+		}
+		return sorted[i].TLSVersion < sorted[j].TLSVersion
+	})
+
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROGRAM\tPROTOCOL\tTLS_VERSION\tREQUESTS\tSHARE\tERRORS\tERROR_RATE\tP50_MS\tP99_MS")
+	for _, key := range sorted {
+		s := stats[key]
+		share := 0.0
+		if total := totals[key.Program]; total > 0 {
+			share = float64(s.Count) / float64(total)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%.2f%%\t%d\t%.2f%%\t%.1f\t%.1f\n", key.Program, orDash(key.Protocol), orDash(key.TLSVersion),
+			s.Count, share*100, s.ErrorCount, s.ErrorRate()*100, s.Latency.Quantile(0.50), s.Latency.Quantile(0.99))
+	}
+	return w.Flush()
+}
+
+// runRegressionReport implements "report regressions", which lists the endpoints whose latency quantile
+// over a time range grew compared to the same-length window before it or the same window a day earlier:
+//
+//	log-monitor report regressions -dsn ... -from "2006-01-02 15:04" -to "2006-01-02 15:04" [-baseline previous|yesterday]
+func runRegressionReport(args []string) error {
+	fs := flag.NewFlagSet("report regressions", flag.ExitOnError)
+	dsn := fs.String("dsn", "", "Data Source Name for MySQL")
+	fromFlag := fs.String("from", "", "Start of the compared window (YYYY-MM-DD HH:MM), defaults to one hour before -to")
+	toFlag := fs.String("to", "", "End of the compared window (YYYY-MM-DD HH:MM), defaults to the current minute")
+	baseline := fs.String("baseline", "previous", "Baseline window: previous or yesterday")
+	quantile := fs.Float64("quantile", 0.95, "Latency quantile compared")
+	ratio := fs.Float64("ratio", 1.5, "Minimum current to baseline ratio reported")
+	minSamples := fs.Uint64("min-samples", 100, "Minimum requests in both windows for an endpoint to be compared")
+	env := fs.String("env", "", "Only report this environment, all environments if empty")
+	fs.Parse(args)
+
+	to := time.Now().Truncate(time.Minute)
+	if *toFlag != "" {
+		t, err := time.ParseInLocation("2006-01-02 15:04", *toFlag, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+		to = t
+	}
+	from := to.Add(-time.Hour)
+	if *fromFlag != "" {
+		t, err := time.ParseInLocation("2006-01-02 15:04", *fromFlag, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("-from %s is not before -to %s", from.Format("2006-01-02 15:04"), to.Format("2006-01-02 15:04"))
+	}
+
+	db, err := sql.Open("mysql", *dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	regressions, err := FindLatencyRegressions(context.Background(), db, *env, from, to, *baseline, *quantile, *ratio, *minSamples)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "PROGRAM\tAPI_PATH\tBASELINE_P%.0f_MS\tCURRENT_P%.0f_MS\tRATIO\tBASELINE_REQUESTS\tCURRENT_REQUESTS\n", *quantile*100, *quantile*100)
+	for _, r := range regressions {
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%.1f\t%.2fx\t%d\t%d\n", r.Program, r.APIPath, r.BaselineMs, r.CurrentMs, r.Ratio, r.BaselineSamples, r.CurrentSamples)
+	}
+	return w.Flush()
+}
+
+// runStatusCodeReport implements "report status-codes", which prints the count of each exact status
+// code per program from oula_logs_status_minute, written by -aggregate:
+//
+//	log-monitor report status-codes -dsn ... -from "2006-01-02 15:04" -to "2006-01-02 15:04" [-program name] [-env name] [-step 1h]
+//
+// Without -step there is one row per program for the whole range.
+func runStatusCodeReport(args []string) error {
+	fs := flag.NewFlagSet("report status-codes", flag.ExitOnError)
+	dsn := fs.String("dsn", "", "Data Source Name for MySQL")
+	fromFlag := fs.String("from", "", "Start of the range (YYYY-MM-DD HH:MM), defaults to one hour before -to")
+	toFlag := fs.String("to", "", "End of the range (YYYY-MM-DD HH:MM), defaults to the current minute")
+	program := fs.String("program", "", "Only report this program")
+	env := fs.String("env", "", "Only report this environment, all environments if empty")
+	step := fs.Duration("step", 0, "Split the range into rows of this length, 0 prints one row per program")
+	fs.Parse(args)
+
+	to := time.Now().Truncate(time.Minute)
+	if *toFlag != "" {
+		t, err := time.ParseInLocation("2006-01-02 15:04", *toFlag, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+		to = t
+	}
+	from := to.Add(-time.Hour)
+	if *fromFlag != "" {
+		t, err := time.ParseInLocation("2006-01-02 15:04", *fromFlag, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("-from %s is not before -to %s", from.Format("2006-01-02 15:04"), to.Format("2006-01-02 15:04"))
+	}
+	if *step < 0 || *step > 0 && *step < time.Minute {
+		return fmt.Errorf("-step %s is shorter than a minute", *step)
+	}
+
+	db, err := sql.Open("mysql", *dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	matrix, err := LoadStatusMatrix(context.Background(), db, from, to, *step, *program, *env)
+	if err != nil {
+		return err
+	}
+	return writeStatusMatrix(os.Stdout, matrix, *step)
+}
+
+// runAvailabilityReport implements "report availability", which prints the availability of each endpoint
+// from the first day of a month up to today, from oula_api_availability written by -daily-rollup:
+//
+//	log-monitor report availability -dsn ... [-month 2006-01] [-program name] [-env name] [-apilist file]
+//
+// With an API list, each endpoint is compared with its SLO target. Today is only included once rolled up,
+// so month-to-date covers the finished days.
+func runAvailabilityReport(args []string) error {
+	fs := flag.NewFlagSet("report availability", flag.ExitOnError)
+	dsn := fs.String("dsn", "", "Data Source Name for MySQL")
+	monthFlag := fs.String("month", "", "Month of the report (YYYY-MM), defaults to the current month")
+	program := fs.String("program", "", "Only report this program")
+	env := fs.String("env", "", "Only report this environment, all environments if empty")
+	apiListFile := fs.String("apilist", "", "API list whose SLO targets are compared")
+	fs.Parse(args)
+
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	if *monthFlag != "" {
+		month, err := time.ParseInLocation("2006-01", *monthFlag, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid -month: %w", err)
+		}
+		from = month
+	}
+	to := from.AddDate(0, 1, -1)
+	if to.After(now) {
+		to = now
+	}
+
+	apiList := map[string]APIEntry{}
+	if *apiListFile != "" {
+		var err error
+		if apiList, err = LoadAPIList(*apiListFile); err != nil {
+			return err
+		}
+	}
+
+	db, err := sql.Open("mysql", *dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	availability, err := LoadAvailability(context.Background(), db, *env, from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Availability from %s to %s\n\n", from.Format("2006-01-02"), to.Format("2006-01-02"))
+	return writeAvailabilityReport(os.Stdout, availability, apiList, *program)
+}
+
+// runTopIPsReport implements "report top-ips", which prints the top IP list a running instance serves
+// at /debug/top-ips, since it is only kept in memory:
+//
+//	log-monitor report top-ips [-addr 127.0.0.1:8080] [-program name] [-n 20]
+func runTopIPsReport(args []string) error {
+	fs := flag.NewFlagSet("report top-ips", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "HTTP address (-http-addr) of the running instance")
+	program := fs.String("program", "", "Only report this program")
+	n := fs.Int("n", 20, "Number of IPs printed per program, 0 prints all")
+	fs.Parse(args)
+
+	u := url.URL{Scheme: "http", Host: *addr, Path: "/debug/top-ips"}
+	if *program != "" {
+		u.RawQuery = url.Values{"program": {*program}}.Encode()
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", u.String(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	var top map[string][]TopIP
+	if err := json.NewDecoder(resp.Body).Decode(&top); err != nil {
+		return err
+	}
+	return writeTopIPsReport(os.Stdout, top, *n)
+}
+
+// writeTopIPsReport prints the top IPs of each program, with the endpoints each IP hit most
+func writeTopIPsReport(out io.Writer, top map[string][]TopIP, n int) error {
+	programs := make([]string, 0, len(top))
+	for program := range top {
+		programs = append(programs, program)
+	}
+	sort.Strings(programs)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROGRAM\tIP\tREQUESTS\tMAX_ERROR\tTOP_ENDPOINTS")
+	for _, program := range programs {
+		ips := top[program]
+		if n > 0 && len(ips) > n {
+			ips = ips[:n]
+		}
+		for _, ip := range ips {
+			endpoints := make([]string, 0, len(ip.Endpoints))
+			for endpoint := range ip.Endpoints {
+				endpoints = append(endpoints, endpoint)
+			}
+			sort.Slice(endpoints, func(i, j int) bool {
+				return ip.Endpoints[endpoints[i]] > ip.Endpoints[endpoints[j]]
+			})
+			for i, endpoint := range endpoints {
+				endpoints[i] = fmt.Sprintf("%s=%d", endpoint, ip.Endpoints[endpoint])
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", program, ip.IP, ip.Count, ip.Error, strings.Join(endpoints, " "))
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sampledOutTotal counts the entries dropped from raw storage by sampling
+var sampledOutTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_sampled_out_total",
+	Help: "Matched entries not stored because of the program's sampling policy.",
+}, []string{"program"})
+
+func init() {
+	prometheus.MustRegister(sampledOutTotal)
+}
+
+// SamplingPolicy decides which matched entries of a program are stored in the raw table.
+// SampleRate keeps that fraction of all entries, for programs too busy to store every request. Of the
+// remaining entries, errors and slow requests are always kept and other requests are kept with probability
+// SuccessRate. Stored entries get sampled_weight 1/(SampleRate*SuccessRate) so counts can be scaled back up.
+// The in-process aggregations see every entry.
+type SamplingPolicy struct {
+	// SampleRate keeps one in round(1/SampleRate) entries of the program, 1 if unset. The decision hashes
+	// the client IP, minute and API path, so it is the same across restarts and keeps or drops all the
+	// requests of a client to an endpoint within a minute together.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	// SuccessRate is the fraction of fast successful requests kept, 1 if unset
+	SuccessRate float64 `json:"success_rate,omitempty"`
+	// KeepStatusAtLeast keeps every entry with a status code at or above it, 400 if unset
+	KeepStatusAtLeast int `json:"keep_status_at_least,omitempty"`
+	// KeepSlowerThan keeps every entry at least this slow, in addition to entries flagged is_slow
+	KeepSlowerThan Duration `json:"keep_slower_than,omitempty"`
+}
+
+// WithSampleRate returns the policy with its SampleRate replaced by rate, such as the sample rate of an
+// API list entry, or the policy itself if rate is 0. A rate of 1 stores every request of the API, only
+// thinned out by SuccessRate.
+func (p *SamplingPolicy) WithSampleRate(rate float64) *SamplingPolicy {
+	if rate == 0 {
+		return p
+	}
+	var q SamplingPolicy
+	if p != nil {
+		q = *p
+	}
+	q.SampleRate = rate
+	return &q
+}
+
+// Rate returns the fraction of the entries SampleRate keeps, one in round(1/SampleRate), stored in the
+// sample_rate column for query-time extrapolation, or 1 if the policy keeps every entry by sample rate
+func (p *SamplingPolicy) Rate() float64 {
+	if p == nil || p.SampleRate <= 0 || p.SampleRate >= 1 {
+		return 1
+	}
+	return 1 / math.Round(1/p.SampleRate)
+}
+
+// Sample reports whether entry is stored and returns its weight.
+// The decisions are hashes, so the same line always gets the same decision.
+func (p *SamplingPolicy) Sample(entry *LogEntry) (bool, float64) {
+	if p == nil {
+		return true, 1
+	}
+
+	weight := 1.0
+	if p.SampleRate > 0 && p.SampleRate < 1 {
+		n := uint64(math.Round(1 / p.SampleRate))
+		// 按日志时间取分钟，重启后重新读取的行得到相同的结果
+		minute := entry.Time
+		if len(minute) > 5 {
+			minute = minute[:5]
+		}
+		h := fnv.New64a()
+		for _, s := range []string{entry.IP, entry.Date, minute, entry.APIPath} {
+			h.Write([]byte(s))
+			h.Write([]byte{0})
+		}
+		if h.Sum64()%n != 0 {
+			sampledOutTotal.WithLabelValues(entry.Program).Inc()
+			return false, 0
+		}
+		weight = float64(n)
+	}
+	if p.SuccessRate <= 0 || p.SuccessRate >= 1 {
+		return true, weight
+	}
+
+	keepStatus := p.KeepStatusAtLeast
+	if keepStatus == 0 {
+		keepStatus = 400
+	}
+	if code, err := strconv.Atoi(entry.StatusCode); err != nil || code >= keepStatus {
+		return true, weight
+	}
+	if entry.IsSlow {
+		return true, weight
+	}
+	if p.KeepSlowerThan > 0 {
+		if entry.Duration >= time.Duration(p.KeepSlowerThan) {
+			return true, weight
+		}
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(entry.Program))
+	h.Write([]byte(entry.Line))
+	if float64(h.Sum64()%1000000)/1000000 < p.SuccessRate {
+		return true, weight / p.SuccessRate
+	}
+	sampledOutTotal.WithLabelValues(entry.Program).Inc()
+	return false, 0
+}
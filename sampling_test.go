@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSamplingPolicyRate(t *testing.T) {
+	tests := []struct {
+		policy *SamplingPolicy
+		want   float64
+	}{
+		{nil, 1},
+		{&SamplingPolicy{}, 1},
+		{&SamplingPolicy{SampleRate: 1}, 1},
+		{&SamplingPolicy{SampleRate: 0.01}, 0.01},
+		// 保留 round(1/0.3) = 3 条中的一条
+		{&SamplingPolicy{SampleRate: 0.3}, 1.0 / 3},
+		{&SamplingPolicy{SampleRate: 0.5, SuccessRate: 0.1}, 0.5},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Rate(); got != tt.want {
+			t.Errorf("Rate() of %+v = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestSamplingPolicyWeightMatchesRate(t *testing.T) {
+	policy := &SamplingPolicy{SampleRate: 0.1}
+	kept := 0
+	for i := range 1000 {
+		entry := &LogEntry{Program: "api", IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Date: "2024/01/01", Time: "00:00:00", APIPath: "/api"}
+		keep, weight := policy.Sample(entry)
+		if !keep {
+			continue
+		}
+		kept++
+		if weight*policy.Rate() != 1 {
+			t.Fatalf("kept entry has weight %v with rate %v, want weight 1/rate", weight, policy.Rate())
+		}
+	}
+	if kept < 50 || kept > 150 {
+		t.Errorf("kept %d of 1000 entries with sample rate 0.1", kept)
+	}
+}
+
+// TestAPIListSampleRateLongestMatch checks that the sample rate of an API list entry comes with its
+// longest match, and that an entry without a rate leaves the global rate
+func TestAPIListSampleRateLongestMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apis.txt")
+	list := "/api/v1\n/api/v1/ping 0.01\n/api/v1/ping/deep sample=0.5 slow=2s\n/api/v1/pay 1\n"
+	if err := os.WriteFile(path, []byte(list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	apiList, err := LoadAPIList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, match string
+		rate        float64
+	}{
+		{"/api/v1/ping", "/api/v1/ping", 0.01},
+		{"/api/v1/ping?verbose=1", "/api/v1/ping", 0.01},
+		{"/api/v1/ping/deep/42", "/api/v1/ping/deep", 0.5},
+		{"/api/v1/pay/orders", "/api/v1/pay", 1},
+		// 没有采样率的接口使用全局策略
+		{"/api/v1/users/42", "/api/v1", 0},
+	}
+	for _, tt := range tests {
+		match := LongestMatch(tt.path, apiList)
+		if match != tt.match || apiList[match].SampleRate != tt.rate {
+			t.Errorf("LongestMatch(%q) = %q with sample rate %v, want %q with %v", tt.path, match, apiList[match].SampleRate, tt.match, tt.rate)
+		}
+	}
+
+	for _, options := range [][]string{{"0"}, {"1.5"}, {"-0.1"}, {"sample=0"}, {"sample=abc"}} {
+		if entry, err := parseAPIOptions(options); err == nil {
+			t.Errorf("parseAPIOptions(%q) = %+v, want an error", options, entry)
+		}
+	}
+}
+
+// TestAPIListSampleRateStored processes lines of endpoints with and without a sample rate under a global
+// sample rate, checking that each stored entry carries the effective rate of its endpoint and the
+// weight that re-inflates it
+func TestAPIListSampleRateStored(t *testing.T) {
+	backend := &MemoryBackend{}
+	m := testMonitor(backend, 100)
+	m.APIList.Store(&map[string]APIEntry{
+		"/api/v1/ping":  {SampleRate: 0.01},
+		"/api/v1/pay":   {SampleRate: 1},
+		"/api/v1/users": {},
+	})
+	m.Sampling = &SamplingPolicy{SampleRate: 0.5}
+
+	var lines strings.Builder
+	const perEndpoint = 2000
+	for i := range perEndpoint {
+		for _, api := range []string{"/api/v1/ping", "/api/v1/pay", "/api/v1/users"} {
+			fmt.Fprintf(&lines, "[GIN] 2024/01/01 - 00:00:00 | 200 |    1.234ms |   10.%d.%d.%d | GET      \"%s/%d\"\n", i/65536, i/256%256, i%256, api, i)
+		}
+	}
+	if err := processLogs(m, strings.NewReader(lines.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{"/api/v1/ping": 0.01, "/api/v1/pay": 1, "/api/v1/users": 0.5}
+	stored := make(map[string]int)
+	for _, entry := range backend.Entries() {
+		stored[entry.APIPath]++
+		if rate := want[entry.APIPath]; entry.SampleRate != rate || storedSampleRate(entry) != rate || entry.SampledWeight != 1/rate {
+			t.Fatalf("entry of %s stored with sample rate %v and weight %v, want %v and %v",
+				entry.APIPath, entry.SampleRate, entry.SampledWeight, rate, 1/rate)
+		}
+	}
+	if stored["/api/v1/pay"] != perEndpoint {
+		t.Errorf("stored %d of %d /api/v1/pay entries with sample rate 1", stored["/api/v1/pay"], perEndpoint)
+	}
+	if n := stored["/api/v1/users"]; n < perEndpoint*4/10 || n > perEndpoint*6/10 {
+		t.Errorf("stored %d of %d /api/v1/users entries with the global sample rate 0.5", n, perEndpoint)
+	}
+	if n := stored["/api/v1/ping"]; n == 0 || n > perEndpoint/25 {
+		t.Errorf("stored %d of %d /api/v1/ping entries with sample rate 0.01", n, perEndpoint)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Column is a column definition used when adding columns to an existing table
+type Column struct {
+	Name       string
+	Definition string
+}
+
+// EnsureColumns adds the columns missing from table, in order
+func EnsureColumns(db *sql.DB, table string, columns []Column) error {
+	rows, err := db.Query(`SELECT COLUMN_NAME FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]struct{})
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		existing[name] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range columns {
+		if _, ok := existing[column.Name]; ok {
+			continue
+		}
+		log.Printf("Adding column %s to %s", column.Name, table)
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column.Name, column.Definition)
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureIndex adds a secondary index on columns to table unless an index of that name exists
+func EnsureIndex(db *sql.DB, table, name, columns string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM INFORMATION_SCHEMA.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`, table, name).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	log.Printf("Adding index %s to %s", name, table)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD INDEX %s (%s)", table, name, columns))
+	return err
+}
+
+// Migration is a versioned schema change
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(ctx context.Context, db *sql.DB) error
+}
+
+// migrations lists every schema change in version order, new migrations are appended
+var migrations = []Migration{
+	{1, "create oula_logs_record", func(ctx context.Context, db *sql.DB) error {
+		_, err := db.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS oula_logs_record (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				server VARCHAR(64) NOT NULL,
+				program VARCHAR(128) NOT NULL,
+				date DATE NOT NULL,
+				time TIME NOT NULL,
+				status_code INT NOT NULL,
+				duration VARCHAR(32) NOT NULL,
+				ip VARCHAR(64) NOT NULL,
+				method VARCHAR(16) NOT NULL,
+				api_path VARCHAR(255) NOT NULL,
+				PRIMARY KEY (id),
+				KEY idx_date (date)
+			)
+		`)
+		return err
+	}},
+	{2, "create oula_logs_minute", func(ctx context.Context, db *sql.DB) error {
+		return EnsureMinuteTable(db)
+	}},
+	{3, "add is_slow and slow_count", func(ctx context.Context, db *sql.DB) error {
+		if err := EnsureColumns(db, "oula_logs_record", []Column{{"is_slow", "TINYINT(1) NOT NULL DEFAULT 0"}}); err != nil {
+			return err
+		}
+		return EnsureColumns(db, "oula_logs_minute", []Column{{"slow_count", "BIGINT NOT NULL DEFAULT 0 AFTER error_count"}})
+	}},
+	{4, "create oula_logs_top_hourly", func(ctx context.Context, db *sql.DB) error {
+		return EnsureTopHourlyTable(db)
+	}},
+	{5, "create oula_logs_daily", func(ctx context.Context, db *sql.DB) error {
+		return EnsureDailyTables(db)
+	}},
+	{6, "add sampled_weight", func(ctx context.Context, db *sql.DB) error {
+		return EnsureColumns(db, "oula_logs_record", []Column{{"sampled_weight", "DOUBLE NOT NULL DEFAULT 1"}})
+	}},
+	{7, "create oula_logs_unique_ips", func(ctx context.Context, db *sql.DB) error {
+		return EnsureUniqueIPsTable(db)
+	}},
+	{8, "add country and asn", func(ctx context.Context, db *sql.DB) error {
+		err := EnsureColumns(db, "oula_logs_record", []Column{
+			{"country", "CHAR(2) NULL"},
+			{"asn", "INT UNSIGNED NULL"},
+		})
+		if err != nil {
+			return err
+		}
+		err = EnsureColumns(db, "oula_logs_minute", []Column{
+			{"country", "CHAR(2) NOT NULL DEFAULT '' AFTER status_class"},
+			{"asn", "INT UNSIGNED NOT NULL DEFAULT 0 AFTER country"},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, `ALTER TABLE oula_logs_minute DROP PRIMARY KEY, ADD PRIMARY KEY (minute, server, program, api_path, status_class, country, asn)`)
+		return err
+	}},
+	{9, "create oula_error_samples", func(ctx context.Context, db *sql.DB) error {
+		return EnsureErrorSamplesTable(db)
+	}},
+	{10, "add is_bot", func(ctx context.Context, db *sql.DB) error {
+		return EnsureColumns(db, "oula_logs_record", []Column{{"is_bot", "TINYINT(1) NOT NULL DEFAULT 0"}})
+	}},
+	{11, "add query_params", func(ctx context.Context, db *sql.DB) error {
+		return EnsureColumns(db, "oula_logs_record", []Column{{"query_params", "VARCHAR(512) NULL"}})
+	}},
+	{12, "add app_version", func(ctx context.Context, db *sql.DB) error {
+		return EnsureColumns(db, "oula_logs_record", []Column{{"app_version", "VARCHAR(64) NULL"}})
+	}},
+	{13, "add labels", func(ctx context.Context, db *sql.DB) error {
+		return EnsureColumns(db, "oula_logs_record", []Column{{"labels", "JSON NULL"}})
+	}},
+	{14, "create oula_logs_status_minute", func(ctx context.Context, db *sql.DB) error {
+		return EnsureStatusMinuteTable(db)
+	}},
+	{15, "create oula_logs_slowest_hourly", func(ctx context.Context, db *sql.DB) error {
+		return EnsureSlowestHourlyTable(db)
+	}},
+	{16, "create oula_api_availability", func(ctx context.Context, db *sql.DB) error {
+		return EnsureAvailabilityTable(db)
+	}},
+	{17, "create oula_ingest_batches", func(ctx context.Context, db *sql.DB) error {
+		return EnsureIngestBatchesTable(db)
+	}},
+	{18, "add env", func(ctx context.Context, db *sql.DB) error {
+		// 已有的行回填为 DefaultEnv
+		definition := fmt.Sprintf("VARCHAR(32) NOT NULL DEFAULT '%s'", DefaultEnv)
+		if err := EnsureColumns(db, "oula_logs_record", []Column{{"env", definition + " AFTER id"}}); err != nil {
+			return err
+		}
+		if err := EnsureIndex(db, "oula_logs_record", "idx_env_date", "env, date"); err != nil {
+			return err
+		}
+		if err := EnsureColumns(db, "oula_error_samples", []Column{{"env", definition + " AFTER burst_start"}}); err != nil {
+			return err
+		}
+		for _, t := range []struct {
+			Table, After, PrimaryKey string
+		}{
+			{"oula_logs_minute", "minute", "minute, env, server, program, api_path, status_class, country, asn"},
+			{"oula_logs_status_minute", "minute", "minute, env, server, program, status_code"},
+			{"oula_logs_slowest_hourly", "hour", "hour, env, server, program, api_path"},
+			{"oula_logs_unique_ips", "day", "day, env, server, program, api_path"},
+			{"oula_logs_daily", "day", "day, env, program, api_path"},
+			{"oula_api_availability", "day", "day, env, program, api_path"},
+			{"oula_logs_top_hourly", "hour", "hour, env, kind, rank_no"},
+			{"oula_ingest_batches", "", "env, server, batch_id"},
+		} {
+			position := " FIRST"
+			if t.After != "" {
+				position = " AFTER " + t.After
+			}
+			if err := EnsureColumns(db, t.Table, []Column{{"env", definition + position}}); err != nil {
+				return err
+			}
+			if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DROP PRIMARY KEY, ADD PRIMARY KEY (%s)", t.Table, t.PrimaryKey)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{19, "add protocol and tls_version", func(ctx context.Context, db *sql.DB) error {
+		err := EnsureColumns(db, "oula_logs_record", []Column{
+			{"protocol", "VARCHAR(16) NULL"},
+			{"tls_version", "VARCHAR(16) NULL"},
+		})
+		if err != nil {
+			return err
+		}
+		// 主键列不能为 NULL，未记录的协议聚合为空字符串
+		err = EnsureColumns(db, "oula_logs_minute", []Column{
+			{"protocol", "VARCHAR(16) NOT NULL DEFAULT '' AFTER asn"},
+			{"tls_version", "VARCHAR(16) NOT NULL DEFAULT '' AFTER protocol"},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, `ALTER TABLE oula_logs_minute DROP PRIMARY KEY, ADD PRIMARY KEY (minute, env, server, program, api_path, status_class, country, asn, protocol, tls_version)`)
+		return err
+	}},
+	{20, "create oula_writer_leases", func(ctx context.Context, db *sql.DB) error {
+		return EnsureWriterLeasesTable(db)
+	}},
+	{21, "add raw_path", func(ctx context.Context, db *sql.DB) error {
+		// api_path 存储匹配的接口，原始路径单独保留
+		return EnsureColumns(db, "oula_logs_record", []Column{{"raw_path", "VARCHAR(1024) NULL AFTER api_path"}})
+	}},
+	{22, "add sample_rate", func(ctx context.Context, db *sql.DB) error {
+		// 已有的行按未采样处理，sampled_weight 仍可用于外推
+		return EnsureColumns(db, "oula_logs_record", []Column{{"sample_rate", "FLOAT NOT NULL DEFAULT 1 AFTER sampled_weight"}})
+	}},
+	{23, "store duration as milliseconds", func(ctx context.Context, db *sql.DB) error {
+		columns, err := LoadColumns(ctx, db, "oula_logs_record")
+		if err != nil || slices.Contains(integerTypes, columns["duration"].DataType) {
+			return err
+		}
+		// 旧版本存储的 GIN 耗时字符串先改写为毫秒，再修改列类型
+		rewritten, invalid, err := rewriteGINDurations(ctx, db)
+		if err != nil {
+			return err
+		}
+		log.Printf("Rewrote %d GIN durations of oula_logs_record to milliseconds", rewritten)
+		if invalid > 0 {
+			log.Printf("Warning: %d durations of oula_logs_record could not be parsed and were set to 0", invalid)
+		}
+		_, err = db.ExecContext(ctx, `ALTER TABLE oula_logs_record MODIFY duration INT UNSIGNED NOT NULL`)
+		return err
+	}},
+}
+
+// durationRewriteBatch is how many rows rewriteGINDurations reads and updates at a time
+const durationRewriteBatch = 1000
+
+// rewriteGINDurations rewrites the durations of oula_logs_record stored as GIN latencies, e.g. "1.234ms",
+// by the versions before they were stored in milliseconds, to whole milliseconds, reading the rows in
+// batches by id. It returns the number of rows rewritten and of the values that are not durations,
+// which are set to 0 as the column cannot be NULL.
+func rewriteGINDurations(ctx context.Context, db *sql.DB) (rewritten, invalid int, err error) {
+	var lastID int64
+	for {
+		rows, err := db.QueryContext(ctx, `SELECT id, duration FROM oula_logs_record WHERE id > ? ORDER BY id LIMIT ?`, lastID, durationRewriteBatch)
+		if err != nil {
+			return rewritten, invalid, err
+		}
+		read := 0
+		updates := make(map[int64]int64)
+		for rows.Next() {
+			var id int64
+			var duration string
+			if err := rows.Scan(&id, &duration); err != nil {
+				rows.Close()
+				return rewritten, invalid, err
+			}
+			read++
+			lastID = id
+			if _, err := strconv.ParseUint(duration, 10, 64); err == nil {
+				continue
+			}
+			d, err := ParseGINDuration(duration)
+			if err != nil {
+				invalid++
+			}
+			updates[id] = d.Milliseconds()
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return rewritten, invalid, err
+		}
+		if read == 0 {
+			return rewritten, invalid, nil
+		}
+		if err := updateDurations(ctx, db, updates); err != nil {
+			return rewritten, invalid, err
+		}
+		rewritten += len(updates)
+	}
+}
+
+// updateDurations sets the duration of each row of updates by id in one transaction
+func updateDurations(ctx context.Context, db *sql.DB, updates map[int64]int64) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `UPDATE oula_logs_record SET duration = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, ms := range updates {
+		if _, err := stmt.ExecContext(ctx, strconv.FormatInt(ms, 10), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ensureSchemaVersionsTable creates the _schema_versions table if it does not exist
+func ensureSchemaVersionsTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS _schema_versions (
+			version INT NOT NULL,
+			description VARCHAR(255) NOT NULL,
+			applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (version)
+		)
+	`)
+	return err
+}
+
+// ColumnInfo is the type of a table column as INFORMATION_SCHEMA.COLUMNS describes it
+type ColumnInfo struct {
+	// DataType is the type without its size, e.g. "varchar"
+	DataType string
+	// MaxLength is the size of a character column in characters, 0 for other types
+	MaxLength int64
+}
+
+// LoadColumns returns the columns of table by name, none if the table does not exist
+func LoadColumns(ctx context.Context, db *sql.DB, table string) (map[string]ColumnInfo, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT COLUMN_NAME, DATA_TYPE, COALESCE(CHARACTER_MAXIMUM_LENGTH, 0)
+		FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+	`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]ColumnInfo)
+	for rows.Next() {
+		var name string
+		var info ColumnInfo
+		if err := rows.Scan(&name, &info.DataType, &info.MaxLength); err != nil {
+			return nil, err
+		}
+		info.DataType = strings.ToLower(info.DataType)
+		columns[name] = info
+	}
+	return columns, rows.Err()
+}
+
+// SchemaError lists the columns BuildInsertSQL writes that a table lacks or has with another type
+type SchemaError struct {
+	Table        string
+	Missing      []string
+	Incompatible []string
+}
+
+func (e *SchemaError) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, "missing columns "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Incompatible) > 0 {
+		problems = append(problems, "columns of incompatible types "+strings.Join(e.Incompatible, ", "))
+	}
+	return fmt.Sprintf("%s has %s", e.Table, strings.Join(problems, " and "))
+}
+
+// SchemaCheck verifies that oula_logs_record has every column InsertLogEntry writes, with a compatible
+// type, and returns a *SchemaError listing the others. Other errors mean the schema could not be read.
+func SchemaCheck(ctx context.Context, db *sql.DB) error {
+	columns, err := LoadColumns(ctx, db, "oula_logs_record")
+	if err != nil {
+		return err
+	}
+	schemaErr := &SchemaError{Table: "oula_logs_record"}
+	for _, column := range recordColumns {
+		info, ok := columns[column.Name]
+		switch {
+		case !ok:
+			schemaErr.Missing = append(schemaErr.Missing, column.Name)
+		case !slices.Contains(column.Types, info.DataType):
+			schemaErr.Incompatible = append(schemaErr.Incompatible, column.Name+" ("+info.DataType+")")
+		}
+	}
+	if len(schemaErr.Missing) > 0 || len(schemaErr.Incompatible) > 0 {
+		return schemaErr
+	}
+	return nil
+}
+
+// GetSchemaVersion returns the latest applied migration version, 0 if no migration has been applied
+func GetSchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = '_schema_versions'`).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		return 0, nil
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM _schema_versions`).Scan(&version)
+	return version, err
+}
+
+// LatestSchemaVersion returns the version this binary migrates to
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// migrationLockName is the MySQL named lock held while migrating
+const migrationLockName = "logmonitor_migration"
+
+// migrationLockTimeout is how long GET_LOCK waits for another instance to finish migrating, in seconds
+const migrationLockTimeout = 10
+
+// DBMigrationLock is a MySQL named lock that serializes migrations of instances sharing a database.
+// Named locks belong to a connection, so the lock keeps its own connection until released.
+type DBMigrationLock struct {
+	conn *sql.Conn
+}
+
+// AcquireMigrationLock takes the migration lock, returning an error if another instance holds it
+// for longer than the timeout
+func AcquireMigrationLock(ctx context.Context, db *sql.DB) (*DBMigrationLock, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, migrationLockName, migrationLockTimeout).Scan(&acquired)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !acquired.Valid || acquired.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("could not acquire migration lock %s within %ds, is another instance migrating?", migrationLockName, migrationLockTimeout)
+	}
+	return &DBMigrationLock{conn: conn}, nil
+}
+
+// Release releases the lock and its connection
+func (l *DBMigrationLock) Release(ctx context.Context) error {
+	defer l.conn.Close()
+	_, err := l.conn.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, migrationLockName)
+	return err
+}
+
+// MigrateSchema applies the migrations newer than the current schema version while holding the migration lock
+func MigrateSchema(ctx context.Context, db *sql.DB) error {
+	lock, err := AcquireMigrationLock(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(context.Background()); err != nil {
+			log.Printf("Error releasing migration lock: %v", err)
+		}
+	}()
+
+	if err := ensureSchemaVersionsTable(ctx, db); err != nil {
+		return err
+	}
+	current, err := GetSchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		log.Printf("Applying migration %d: %s", m.Version, m.Description)
+		if err := m.Apply(ctx, db); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		_, err := db.ExecContext(ctx, `INSERT INTO _schema_versions (version, description) VALUES (?, ?)`, m.Version, m.Description)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Schema is at version %d", LatestSchemaVersion())
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// TestRewriteGINDurations rewrites the GIN latencies of a SQLite table with the id and duration columns
+// of oula_logs_record, over more than one batch, leaving the durations already in milliseconds
+func TestRewriteGINDurations(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "logs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE oula_logs_record (id INTEGER PRIMARY KEY, duration TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+
+	values := []struct{ stored, want string }{
+		{"1.234ms", "1"},
+		{"250", "250"},
+		{"123.456µs", "0"},
+		{"12.5ms", "12"},
+		{"1.500123456s", "1500"},
+		{"1m2s", "62000"},
+		{"0", "0"},
+		{"fast", "0"},
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := 2*durationRewriteBatch + len(values)
+	for i := range rows {
+		if _, err := tx.Exec(`INSERT INTO oula_logs_record (duration) VALUES (?)`, values[i%len(values)].stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten, invalid, err := rewriteGINDurations(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perValue := rows / len(values); rewritten != 6*perValue || invalid != perValue {
+		t.Errorf("rewrote %d durations with %d invalid, want %d with %d", rewritten, invalid, 6*perValue, perValue)
+	}
+	for i, v := range values {
+		var got string
+		if err := db.QueryRow(`SELECT duration FROM oula_logs_record WHERE id = ?`, i+1).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != v.want {
+			t.Errorf("duration %q rewritten to %q, want %q", v.stored, got, v.want)
+		}
+	}
+	var left int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM oula_logs_record WHERE duration GLOB '*[^0-9]*'`).Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d durations are not in milliseconds after the rewrite", left)
+	}
+
+	// 再次运行不改写任何行
+	if rewritten, _, err := rewriteGINDurations(context.Background(), db); err != nil || rewritten != 0 {
+		t.Errorf("second rewrite = %d, %v, want 0 rows", rewritten, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrubbedTotal counts the sensitive values replaced in request paths, by pattern
+var scrubbedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_scrubbed_total",
+	Help: "Sensitive values replaced in request paths, by scrub pattern.",
+}, []string{"pattern"})
+
+func init() {
+	prometheus.MustRegister(scrubbedTotal)
+}
+
+// defaultScrubPlaceholder replaces scrubbed values, in the style of the {id} of path templates
+const defaultScrubPlaceholder = "{redacted}"
+
+// ScrubPattern is a user-defined pattern, every match of Regex is replaced
+type ScrubPattern struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+}
+
+// ScrubConfig configures the scrubbing of sensitive values from request paths and raw lines
+type ScrubConfig struct {
+	// Placeholder replaces the scrubbed values, "{redacted}" if empty
+	Placeholder string `json:"placeholder,omitempty"`
+	// MinHexLength is the length from which hex strings are scrubbed as tokens, 32 if unset
+	MinHexLength int `json:"min_hex_length,omitempty"`
+	// DisableBuiltin turns off the built-in patterns, leaving only Patterns
+	DisableBuiltin bool           `json:"disable_builtin,omitempty"`
+	Patterns       []ScrubPattern `json:"patterns,omitempty"`
+}
+
+// scrubPattern is a compiled pattern. With keepPrefix, the match keeps everything up to and
+// including its first '=' and only the value is replaced.
+type scrubPattern struct {
+	name       string
+	re         *regexp.Regexp
+	keepPrefix bool
+}
+
+// Scrubber replaces sensitive values such as API keys and email addresses that clients put in
+// query strings and path segments. The built-in patterns, applied in this order, are:
+//
+//	query_param  the value of query parameters named *token, *key, *secret or *password
+//	jwt          JSON Web Tokens
+//	email        email addresses, including URL-encoded ones
+//	hex_token    hex strings of at least MinHexLength characters
+type Scrubber struct {
+	placeholder string
+	patterns    []scrubPattern
+}
+
+// NewScrubber compiles the patterns of config
+func NewScrubber(config ScrubConfig) (*Scrubber, error) {
+	s := &Scrubber{placeholder: config.Placeholder}
+	if s.placeholder == "" {
+		s.placeholder = defaultScrubPlaceholder
+	}
+	minHex := config.MinHexLength
+	if minHex <= 0 {
+		minHex = 32
+	}
+	if !config.DisableBuiltin {
+		s.patterns = []scrubPattern{
+			{"query_param", regexp.MustCompile(`(?i)[?&;][a-z0-9_.-]*(token|key|secret|password)=[^&#\s"]+`), true},
+			{"jwt", regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), false},
+			{"email", regexp.MustCompile(`[A-Za-z0-9._%+-]+(@|%40)[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`), false},
+			{"hex_token", regexp.MustCompile(fmt.Sprintf(`\b[0-9a-fA-F]{%d,}\b`, minHex)), false},
+		}
+	}
+	for _, p := range config.Patterns {
+		if p.Name == "" {
+			return nil, fmt.Errorf("scrub pattern %q has no name", p.Regex)
+		}
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("scrub pattern %s: %w", p.Name, err)
+		}
+		s.patterns = append(s.patterns, scrubPattern{name: p.Name, re: re})
+	}
+	return s, nil
+}
+
+// scrub replaces the matches of every pattern in v, counting them when count is set
+func (s *Scrubber) scrub(v string, count bool) string {
+	for _, p := range s.patterns {
+		n := 0
+		v = p.re.ReplaceAllStringFunc(v, func(match string) string {
+			n++
+			if p.keepPrefix {
+				if i := strings.IndexByte(match, '='); i >= 0 {
+					return match[:i+1] + s.placeholder
+				}
+			}
+			return s.placeholder
+		})
+		if count && n > 0 {
+			scrubbedTotal.WithLabelValues(p.name).Add(float64(n))
+		}
+	}
+	return v
+}
+
+// Apply scrubs the path and raw line of an entry, a nil scrubber is a no-op. Only the matches in the
+// path are counted, the line holds the same path.
+func (s *Scrubber) Apply(entry *LogEntry) {
+	if s == nil {
+		return
+	}
+	entry.APIPath = s.scrub(entry.APIPath, true)
+	entry.RawPath = entry.APIPath
+	entry.Line = s.scrub(entry.Line, false)
+}
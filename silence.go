@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SilencePolicy configures the silence alert of a program
+type SilencePolicy struct {
+	// After is how long the program may produce no lines before alerting, 0 disables the alert
+	After Duration `json:"after,omitempty"`
+	// QuietHours are daily local time ranges such as "08:00-20:00" or "22:00-06:00" during which
+	// silence is expected, e.g. for batch jobs that only run at night. Silence is counted from the
+	// end of a quiet range.
+	QuietHours []string `json:"quiet_hours,omitempty"`
+}
+
+// quietRange is a parsed quiet hours range in minutes since midnight, end may be before start when it spans midnight
+type quietRange struct {
+	Start int
+	End   int
+}
+
+// parseQuietHours parses "HH:MM-HH:MM" ranges
+func parseQuietHours(ranges []string) ([]quietRange, error) {
+	var parsed []quietRange
+	for _, r := range ranges {
+		from, to, ok := strings.Cut(r, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid quiet hours %q, expected HH:MM-HH:MM", r)
+		}
+		start, err := time.Parse("15:04", strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("invalid quiet hours %q: %w", r, err)
+		}
+		end, err := time.Parse("15:04", strings.TrimSpace(to))
+		if err != nil {
+			return nil, fmt.Errorf("invalid quiet hours %q: %w", r, err)
+		}
+		parsed = append(parsed, quietRange{Start: start.Hour()*60 + start.Minute(), End: end.Hour()*60 + end.Minute()})
+	}
+	return parsed, nil
+}
+
+// contains reports whether the local time of t falls in the range
+func (q quietRange) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.Start <= q.End {
+		return m >= q.Start && m < q.End
+	}
+	return m >= q.Start || m < q.End
+}
+
+// programActivity holds the last activity of a program and its silence alert state
+type programActivity struct {
+	After   time.Duration
+	Quiet   []quietRange
+	Last    time.Time
+	QuietAt time.Time
+	Firing  bool
+	FiredAt time.Time
+}
+
+// ActivityTracker records when each program last produced a line and alerts when a program with a
+// silence threshold stays silent longer than that outside its quiet hours, usually because the app
+// is down or its logging broke. A recovery alert is sent when lines resume.
+type ActivityTracker struct {
+	Server  string
+	Alerter *Dispatcher
+
+	mu       sync.Mutex
+	programs map[string]*programActivity
+}
+
+// NewActivityTracker creates a tracker alerting through alerter
+func NewActivityTracker(server string, alerter *Dispatcher) *ActivityTracker {
+	return &ActivityTracker{Server: server, Alerter: alerter, programs: make(map[string]*programActivity)}
+}
+
+// Register starts tracking program, counting its silence from now
+func (t *ActivityTracker) Register(program string, policy SilencePolicy) error {
+	quiet, err := parseQuietHours(policy.QuietHours)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.programs[program] = &programActivity{After: time.Duration(policy.After), Quiet: quiet, Last: time.Now()}
+	return nil
+}
+
+// Touch records a line of program, a nil tracker or an unregistered program is a no-op
+func (t *ActivityTracker) Touch(program string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.programs[program]; ok {
+		p.Last = now
+	}
+}
+
+// LastActivity returns when each program last produced a line, or when tracking started if it has not yet
+func (t *ActivityTracker) LastActivity() map[string]time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last := make(map[string]time.Time, len(t.programs))
+	for program, p := range t.programs {
+		last[program] = p.Last
+	}
+	return last
+}
+
+// Run checks for silent programs every interval until ctx is done
+func (t *ActivityTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, alert := range t.check(now) {
+				t.Alerter.Notify(alert)
+			}
+		}
+	}
+}
+
+// check returns the silence and recovery alerts to send
+func (t *ActivityTracker) check(now time.Time) []*Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var alerts []*Alert
+	for program, p := range t.programs {
+		if p.After <= 0 {
+			continue
+		}
+		alert := &Alert{Server: t.Server, Program: program, Threshold: p.After.Seconds(), Time: now}
+
+		if p.Firing && p.Last.After(p.FiredAt) {
+			alert.Type = "program_recovered"
+			alert.Message = fmt.Sprintf("%s is producing log lines again", program)
+			alerts = append(alerts, alert)
+			p.Firing = false
+			continue
+		}
+
+		for _, q := range p.Quiet {
+			if q.contains(now) {
+				p.QuietAt = now
+			}
+		}
+		since := p.Last
+		if p.QuietAt.After(since) {
+			since = p.QuietAt
+		}
+		silent := now.Sub(since)
+		if !p.Firing && silent >= p.After {
+			alert.Type = "program_silent"
+			alert.Value = silent.Seconds()
+			alert.Message = fmt.Sprintf("%s produced no log lines for %s (last line at %s)", program, silent.Truncate(time.Second), p.Last.Format("2006-01-02 15:04:05"))
+			alerts = append(alerts, alert)
+			p.Firing = true
+			p.FiredAt = now
+		}
+	}
+	return alerts
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// SimulatedProgram is the program of the entries written by -simulate-load
+const SimulatedProgram = "simulate-load"
+
+// LoadGenerator produces synthetic GIN lines, in GIN's default layout, for the paths of an API list.
+// It is seeded so runs with the same API list generate the same lines.
+type LoadGenerator struct {
+	Paths           []string
+	TimestampFormat TimestampFormat
+
+	rand *rand.Rand
+}
+
+// NewLoadGenerator creates a generator of lines for the paths of apiList
+func NewLoadGenerator(apiList map[string]APIEntry, tf TimestampFormat) (*LoadGenerator, error) {
+	g := &LoadGenerator{TimestampFormat: tf, rand: rand.New(rand.NewSource(1))}
+	for path := range apiList {
+		if path != HeartbeatPath {
+			g.Paths = append(g.Paths, path)
+		}
+	}
+	if len(g.Paths) == 0 {
+		return nil, errors.New("the API list is empty, generated lines would not match any API")
+	}
+	sort.Strings(g.Paths)
+	return g, nil
+}
+
+// Line returns a line logged at now, mostly successful GETs with a long-tailed latency around 20ms
+func (g *LoadGenerator) Line(now time.Time) string {
+	status := 200
+	switch n := g.rand.Intn(100); {
+	case n < 2:
+		status = 500
+	case n < 5:
+		status = 404
+	}
+	method := "GET"
+	if g.rand.Intn(5) == 0 {
+		method = "POST"
+	}
+	path := g.Paths[g.rand.Intn(len(g.Paths))]
+	if g.rand.Intn(10) == 0 {
+		path += fmt.Sprintf("?page=%d", g.rand.Intn(20)+1)
+	}
+	latency := time.Duration(math.Exp(g.rand.NormFloat64()+math.Log(20)) * float64(time.Millisecond))
+	ip := fmt.Sprintf("10.%d.%d.%d", g.rand.Intn(256), g.rand.Intn(256), g.rand.Intn(254)+1)
+	return fmt.Sprintf("[GIN] %s - %s | %3d | %13v | %15s | %-7s %q\n",
+		now.Format(g.TimestampFormat.Date), now.Format(g.TimestampFormat.Time), status, latency, ip, method, path)
+}
+
+// LoadReport is the result of a -simulate-load run
+type LoadReport struct {
+	TargetRate int
+	Elapsed    time.Duration
+	Lines      int64
+	Matched    int64
+	// ParseLatency is the time to parse and match each line, in milliseconds
+	ParseLatency LatencySketch
+	// InsertLatency is the time of each batch insert, in milliseconds
+	InsertLatency LatencySketch
+	Flushes       int64
+	FailedFlushes int64
+}
+
+// Rate returns the lines processed per second
+func (r *LoadReport) Rate() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Lines) / r.Elapsed.Seconds()
+}
+
+// Print writes the report as aligned name and value lines
+func (r *LoadReport) Print(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "target lines/sec\t%d\n", r.TargetRate)
+	fmt.Fprintf(w, "actual lines/sec\t%.1f\n", r.Rate())
+	fmt.Fprintf(w, "lines processed\t%d\n", r.Lines)
+	fmt.Fprintf(w, "entries matched\t%d\n", r.Matched)
+	fmt.Fprintf(w, "elapsed\t%s\n", r.Elapsed.Truncate(time.Millisecond))
+	fmt.Fprintf(w, "p99 parse latency\t%.3fms\n", r.ParseLatency.Quantile(0.99))
+	fmt.Fprintf(w, "p99 insert latency\t%.3fms\n", r.InsertLatency.Quantile(0.99))
+	fmt.Fprintf(w, "batch flushes\t%d\n", r.Flushes)
+	fmt.Fprintf(w, "failed flushes\t%d\n", r.FailedFlushes)
+	return w.Flush()
+}
+
+// timedBackend records the latency and count of the inserts of a simulated load
+type timedBackend struct {
+	Backend
+	Report *LoadReport
+}
+
+// Insert writes the batch to the wrapped backend and records how long it took
+func (b *timedBackend) Insert(entries []*LogEntry) error {
+	start := time.Now()
+	err := b.Backend.Insert(entries)
+	b.Report.InsertLatency.Add(float64(time.Since(start)) / float64(time.Millisecond))
+	b.Report.Flushes++
+	if err != nil {
+		b.Report.FailedFlushes++
+	}
+	return err
+}
+
+// SimulateLoad feeds lines of g to m at rate lines per second for duration, or until ctx is done, and
+// inserts the matched entries in batches like processLogs. Lines are sent as scheduled when the pipeline
+// keeps up, otherwise as fast as it takes them, so the actual rate shows the sustainable throughput.
+func SimulateLoad(ctx context.Context, m *Monitor, g *LoadGenerator, rate int, duration time.Duration) (*LoadReport, error) {
+	if rate <= 0 || rate > int(time.Second) {
+		return nil, errors.New("-simulate-lines-per-sec must be between 1 and 1000000000")
+	}
+	if duration <= 0 {
+		return nil, errors.New("-simulate-duration must be positive")
+	}
+	report := &LoadReport{TargetRate: rate}
+	config := BatchConfig{Size: m.BatchSize}
+	if m.FlushInterval > 0 {
+		config.MaxAge = m.FlushInterval + m.FlushJitter
+	}
+	writer := NewBatchWriter(&timedBackend{Backend: m.backend(), Report: report}, config)
+	if !m.ParseOnly {
+		writer.Redactor = m.Redactor
+	}
+
+	interval := time.Second / time.Duration(rate)
+	start := time.Now()
+	deadline := start.Add(duration)
+loop:
+	for next := start; next.Before(deadline); next = next.Add(interval) {
+		if wait := time.Until(next); wait > 0 {
+			select {
+			case <-ctx.Done():
+				break loop
+			case <-time.After(wait):
+			}
+		} else if ctx.Err() != nil {
+			break loop
+		}
+		line := g.Line(time.Now())
+		m.Counters.LineRead()
+		begin := time.Now()
+		entry := m.handleLine(line)
+		report.ParseLatency.Add(float64(time.Since(begin)) / float64(time.Millisecond))
+		report.Lines++
+		if entry == nil {
+			continue
+		}
+		m.Counters.LineMatched()
+		report.Matched++
+		if err := writer.Add(entry); err != nil {
+			log.Printf("Error inserting simulated entries: %v", err)
+		}
+	}
+	if err := writer.Flush(context.Background()); err != nil {
+		log.Printf("Error inserting remaining simulated entries: %v", err)
+	}
+	report.Elapsed = time.Since(start)
+	// 处理跟不上时所有行都会处理完，耗时超过 duration
+	if report.Rate() < 0.99*float64(rate) && ctx.Err() == nil {
+		log.Printf("Warning: the pipeline processed %.1f lines/sec, below the target of %d", report.Rate(), rate)
+	}
+	return report, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// retentionTableBytes is the size of oula_logs_record observed by the latest size-based cleanup
+var retentionTableBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "logmonitor_retention_table_bytes",
+	Help: "Data and index size of oula_logs_record observed by the latest size-based cleanup.",
+})
+
+// retentionBudgetBytes is -retention-max-bytes
+var retentionBudgetBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "logmonitor_retention_budget_bytes",
+	Help: "Size budget of oula_logs_record set by -retention-max-bytes.",
+})
+
+// retentionSizeDeletedDays counts the days deleted to keep oula_logs_record under its size budget
+var retentionSizeDeletedDays = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "logmonitor_retention_size_deleted_days_total",
+	Help: "Days of raw rows deleted before their retention to keep oula_logs_record under -retention-max-bytes.",
+})
+
+// retentionSizeDeletedRows counts the rows deleted to keep oula_logs_record under its size budget
+var retentionSizeDeletedRows = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "logmonitor_retention_size_deleted_rows_total",
+	Help: "Raw rows deleted before their retention to keep oula_logs_record under -retention-max-bytes.",
+})
+
+func init() {
+	prometheus.MustRegister(retentionTableBytes, retentionBudgetBytes, retentionSizeDeletedDays, retentionSizeDeletedRows)
+}
+
+// TableSize returns the data and index size of table in bytes, after refreshing its statistics. Deleted
+// rows leave free space in the tablespace that new rows reuse, so this is the space the rows need, not
+// the size of the file.
+func TableSize(ctx context.Context, db *sql.DB, table string) (int64, error) {
+	if _, err := db.ExecContext(ctx, "ANALYZE TABLE "+table); err != nil {
+		return 0, err
+	}
+	var size int64
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(DATA_LENGTH, 0) + COALESCE(INDEX_LENGTH, 0)
+		FROM INFORMATION_SCHEMA.TABLES
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+	`, table).Scan(&size)
+	return size, err
+}
+
+// dayRows is the number of raw rows of a day
+type dayRows struct {
+	Day  string
+	Rows int64
+}
+
+// cleanToBudget deletes the raw rows of the environments of retention a day at a time, oldest first,
+// until oula_logs_record is estimated to fit in MaxBytes. Days younger than MinRetentionDays are never
+// deleted, and with Daily a day is only deleted once it is rolled up, unless Force is set. The rows of
+// other environments are counted in the size but never deleted, like with time-based retention. It
+// returns the days held back.
+func (b *MySQLBackend) cleanToBudget(ctx context.Context, now time.Time, retention []envRetention) ([]string, error) {
+	size, err := TableSize(ctx, b.DB, "oula_logs_record")
+	if err != nil {
+		return nil, err
+	}
+	retentionTableBytes.Set(float64(size))
+	retentionBudgetBytes.Set(float64(b.MaxBytes))
+	if size <= b.MaxBytes {
+		log.Printf("oula_logs_record uses %d bytes of its %d bytes budget", size, b.MaxBytes)
+		return nil, nil
+	}
+
+	var total int64
+	if err := b.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM oula_logs_record`).Scan(&total); err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return nil, nil
+	}
+	// 删除后表空间不会立即缩小，按每行的平均大小估算释放的空间
+	bytesPerRow := float64(size) / float64(total)
+
+	envs := make([]any, len(retention))
+	for i, r := range retention {
+		envs[i] = r.Env
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(envs)), ", ")
+	cutoff := now.AddDate(0, 0, -b.MinRetentionDays).Format("2006-01-02")
+	rows, err := b.DB.QueryContext(ctx, `
+		SELECT DATE_FORMAT(date, '%Y-%m-%d'), COUNT(*) FROM oula_logs_record
+		WHERE env IN (`+placeholders+`) AND date < ?
+		GROUP BY 1 ORDER BY 1
+	`, append(envs, cutoff)...)
+	if err != nil {
+		return nil, err
+	}
+	var days []dayRows
+	for rows.Next() {
+		var d dayRows
+		if err := rows.Scan(&d.Day, &d.Rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	excess := float64(size - b.MaxBytes)
+	var deleted, held []string
+	var deletedRows int64
+	for _, d := range days {
+		if excess <= 0 {
+			break
+		}
+		if b.Daily != nil && !b.Force {
+			ready, err := b.Daily.readyToDelete(ctx, d.Day)
+			if err != nil {
+				return held, err
+			}
+			if !ready {
+				held = append(held, d.Day)
+				continue
+			}
+		}
+		result, err := b.DB.ExecContext(ctx, `DELETE FROM oula_logs_record WHERE env IN (`+placeholders+`) AND date = ?`, append(envs, d.Day)...)
+		if err != nil {
+			return held, err
+		}
+		n, _ := result.RowsAffected()
+		excess -= float64(n) * bytesPerRow
+		deletedRows += n
+		deleted = append(deleted, d.Day)
+		retentionSizeDeletedDays.Inc()
+		retentionSizeDeletedRows.Add(float64(n))
+	}
+
+	log.Printf("oula_logs_record uses %d bytes of its %d bytes budget, deleted %d rows of %d days to fit: %s",
+		size, b.MaxBytes, deletedRows, len(deleted), strings.Join(deleted, ", "))
+	if excess > 0 {
+		log.Printf("Warning: oula_logs_record is still about %d bytes over its budget, the rows of the last %d days, of other environments and of held back days are kept",
+			int64(excess), b.MinRetentionDays)
+	}
+	return held, nil
+}
+
+// ValidateSizeRetention returns an error if the -retention-max-bytes settings are invalid
+func ValidateSizeRetention(maxBytes int64, minDays int) error {
+	if maxBytes < 0 {
+		return fmt.Errorf("-retention-max-bytes must not be negative")
+	}
+	if maxBytes > 0 && minDays < 1 {
+		return fmt.Errorf("-retention-min-days must be at least 1, so that today's rows are never deleted")
+	}
+	return nil
+}
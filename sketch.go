@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// LatencySketch bounds.
+// Bucket i counts durations in [sketchMinMs*sketchGamma^i, sketchMinMs*sketchGamma^(i+1)) milliseconds,
+// so the sketch covers 1µs to roughly 19 minutes with a relative error below 4.5%.
+// Smaller and larger values are clamped into the first and last bucket.
+const (
+	sketchBuckets = 256
+	sketchMinMs   = 0.001
+	sketchGamma   = 1.085
+)
+
+const sketchVersion = 1
+
+// LatencySketch is a fixed-size log-bucketed histogram used to estimate latency percentiles.
+// It always takes 1KB of counters plus the total regardless of how many values are added,
+// and two sketches are merged by adding their counters bucket by bucket, which is also how
+// serialized sketches from several servers can be combined in reporting.
+type LatencySketch struct {
+	Counts [sketchBuckets]uint32
+	Total  uint64
+}
+
+// sketchIndex returns the bucket for a duration in milliseconds
+func sketchIndex(ms float64) int {
+	if ms <= sketchMinMs {
+		return 0
+	}
+	i := int(math.Log(ms/sketchMinMs) / math.Log(sketchGamma))
+	if i >= sketchBuckets {
+		return sketchBuckets - 1
+	}
+	return i
+}
+
+// Add records a duration in milliseconds
+func (s *LatencySketch) Add(ms float64) {
+	i := sketchIndex(ms)
+	if s.Counts[i] < math.MaxUint32 {
+		s.Counts[i]++
+	}
+	s.Total++
+}
+
+// Merge adds the counters of other into s
+func (s *LatencySketch) Merge(other *LatencySketch) {
+	for i, c := range other.Counts {
+		sum := uint64(s.Counts[i]) + uint64(c)
+		if sum > math.MaxUint32 {
+			sum = math.MaxUint32
+		}
+		s.Counts[i] = uint32(sum)
+	}
+	s.Total += other.Total
+}
+
+// Quantile returns the estimated duration in milliseconds at quantile q (0 to 1), or 0 for an empty sketch
+func (s *LatencySketch) Quantile(q float64) float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(s.Total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range s.Counts {
+		seen += uint64(c)
+		if seen >= rank {
+			// 取桶的几何中点
+			return sketchMinMs * math.Pow(sketchGamma, float64(i)+0.5)
+		}
+	}
+	return sketchMinMs * math.Pow(sketchGamma, sketchBuckets-0.5)
+}
+
+// MarshalBinary encodes the sketch as a version byte followed by uvarint (bucket, count) pairs of the non-empty buckets
+func (s *LatencySketch) MarshalBinary() ([]byte, error) {
+	buf := []byte{sketchVersion}
+	for i, c := range s.Counts {
+		if c == 0 {
+			continue
+		}
+		buf = binary.AppendUvarint(buf, uint64(i))
+		buf = binary.AppendUvarint(buf, uint64(c))
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a sketch written by MarshalBinary
+func (s *LatencySketch) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != sketchVersion {
+		return errors.New("unsupported sketch version")
+	}
+	*s = LatencySketch{}
+	data = data[1:]
+	for len(data) > 0 {
+		i, n := binary.Uvarint(data)
+		if n <= 0 || i >= sketchBuckets {
+			return errors.New("corrupt sketch")
+		}
+		data = data[n:]
+		c, n := binary.Uvarint(data)
+		if n <= 0 || c > math.MaxUint32 {
+			return errors.New("corrupt sketch")
+		}
+		data = data[n:]
+		s.Counts[i] = uint32(c)
+		s.Total += c
+	}
+	return nil
+}
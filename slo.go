@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sloBurnRate is the error budget burn rate of each endpoint with an SLO, per window
+var sloBurnRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "logmonitor_slo_burn_rate",
+	Help: "Error budget burn rate of endpoints with an availability SLO, 1 spends the budget exactly over the SLO period.",
+}, []string{"program", "endpoint", "window"})
+
+func init() {
+	prometheus.MustRegister(sloBurnRate)
+}
+
+// sloBucket counts the requests of an endpoint in one minute
+type sloBucket struct {
+	Total  int64
+	Errors int64
+}
+
+// endpointSLO holds the per-minute counts of an endpoint over the long window and its alert state
+type endpointSLO struct {
+	Target  float64
+	Buckets []sloBucket
+	Current int
+	Firing  bool
+}
+
+// SLOTracker computes the error budget burn rate of endpoints with an availability SLO (the slo= option of
+// the API list) over a short and a long window. The burn rate is the 5xx ratio divided by the error budget
+// 1 - target, so at 1 the budget lasts exactly the SLO period. Like multi-window burn rate alerts, an alert
+// is sent when both windows burn faster than BurnRate, and a recovery alert when either drops back.
+type SLOTracker struct {
+	Server string
+	Short  time.Duration
+	Long   time.Duration
+	// BurnRate is the alert threshold, 0 only exposes the metrics
+	BurnRate float64
+	Alerter  *Dispatcher
+
+	mu        sync.Mutex
+	endpoints map[endpointKey]*endpointSLO
+}
+
+// NewSLOTracker creates a tracker alerting through alerter
+func NewSLOTracker(server string, short, long time.Duration, burnRate float64, alerter *Dispatcher) *SLOTracker {
+	return &SLOTracker{
+		Server:    server,
+		Short:     short,
+		Long:      long,
+		BurnRate:  burnRate,
+		Alerter:   alerter,
+		endpoints: make(map[endpointKey]*endpointSLO),
+	}
+}
+
+// windowMinutes returns the number of minute buckets covering d, at least one
+func windowMinutes(d time.Duration) int {
+	n := int((d + time.Minute - 1) / time.Minute)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Add counts an entry of an endpoint with availability target, a nil tracker or a zero target is a no-op
+func (t *SLOTracker) Add(entry *LogEntry, target float64) {
+	if t == nil || target <= 0 {
+		return
+	}
+	key := endpointKey{Program: entry.Program, APIPath: entry.APIPath}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.endpoints[key]
+	if !ok {
+		e = &endpointSLO{Buckets: make([]sloBucket, windowMinutes(t.Long))}
+		t.endpoints[key] = e
+	}
+	// API 列表重新加载后使用新的目标
+	e.Target = target
+	b := &e.Buckets[e.Current]
+	b.Total++
+	if StatusClass(entry.StatusCode) == "5xx" {
+		b.Errors++
+	}
+}
+
+// Run closes a minute every minute until ctx is done
+func (t *SLOTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, alert := range t.evaluate(now) {
+				t.Alerter.Notify(alert)
+			}
+		}
+	}
+}
+
+// burnRate returns the burn rate of the last n buckets ending at the current one
+func (e *endpointSLO) burnRate(n int) float64 {
+	var total, errors int64
+	for i := 0; i < n && i < len(e.Buckets); i++ {
+		b := e.Buckets[(e.Current-i+len(e.Buckets))%len(e.Buckets)]
+		total += b.Total
+		errors += b.Errors
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(errors) / float64(total) / (1 - e.Target)
+}
+
+// evaluate updates the burn rate metrics, starts a new minute and returns the alerts to send
+func (t *SLOTracker) evaluate(now time.Time) []*Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var alerts []*Alert
+	for key, e := range t.endpoints {
+		short := e.burnRate(windowMinutes(t.Short))
+		long := e.burnRate(len(e.Buckets))
+		sloBurnRate.WithLabelValues(key.Program, key.APIPath, t.Short.String()).Set(short)
+		sloBurnRate.WithLabelValues(key.Program, key.APIPath, t.Long.String()).Set(long)
+
+		if t.BurnRate > 0 {
+			alert := &Alert{
+				Server:    t.Server,
+				Program:   key.Program,
+				Endpoint:  key.APIPath,
+				Value:     short,
+				Threshold: t.BurnRate,
+				Window:    t.Short.String(),
+				Time:      now,
+			}
+			burning := short >= t.BurnRate && long >= t.BurnRate
+			switch {
+			case burning && !e.Firing:
+				alert.Type = "slo_burn_rate_high"
+				alert.Message = fmt.Sprintf("%s is burning its %.2f%% availability error budget %.1fx over %s and %.1fx over %s", key.APIPath, e.Target*100, short, t.Short, long, t.Long)
+				alerts = append(alerts, alert)
+				e.Firing = true
+			case !burning && e.Firing:
+				alert.Type = "slo_burn_rate_recovered"
+				alert.Message = fmt.Sprintf("%s error budget burn rate is back to %.1fx over %s and %.1fx over %s", key.APIPath, short, t.Short, long, t.Long)
+				alerts = append(alerts, alert)
+				e.Firing = false
+			}
+		}
+
+		e.Current = (e.Current + 1) % len(e.Buckets)
+		e.Buckets[e.Current] = sloBucket{}
+	}
+	return alerts
+}
+
+// SLOStatus is the availability of an endpoint with an SLO over a time range
+type SLOStatus struct {
+	Program      string
+	APIPath      string
+	Target       float64
+	Availability float64
+	// BudgetRemaining is the fraction of the error budget of the range that is left, negative when overspent
+	BudgetRemaining float64
+}
+
+// ComputeSLOStatus returns the status of the endpoints of stats that have a target in apiList
+func ComputeSLOStatus(stats map[endpointKey]*EndpointStats, apiList map[string]APIEntry) []SLOStatus {
+	var statuses []SLOStatus
+	for key, s := range stats {
+		api, ok := apiList[key.APIPath]
+		if !ok || api.SLO <= 0 || s.Count == 0 {
+			continue
+		}
+		availability := 1 - s.ErrorRate()
+		statuses = append(statuses, SLOStatus{
+			Program:         key.Program,
+			APIPath:         key.APIPath,
+			Target:          api.SLO,
+			Availability:    availability,
+			BudgetRemaining: 1 - (1-availability)/(1-api.SLO),
+		})
+	}
+	return statuses
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnsureSlowestHourlyTable creates the oula_logs_slowest_hourly table if it does not exist
+func EnsureSlowestHourlyTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS oula_logs_slowest_hourly (
+			hour DATETIME NOT NULL,
+			server VARCHAR(64) NOT NULL,
+			program VARCHAR(128) NOT NULL,
+			api_path VARCHAR(255) NOT NULL,
+			logged_at DATETIME NOT NULL,
+			ip VARCHAR(64) NOT NULL,
+			method VARCHAR(16) NOT NULL,
+			status_code INT NOT NULL,
+			line TEXT NULL,
+			duration_ms DOUBLE NOT NULL,
+			PRIMARY KEY (hour, server, program, api_path)
+		)
+	`)
+	return err
+}
+
+// slowestKey identifies an endpoint in an hour
+type slowestKey struct {
+	Hour    time.Time
+	Env     string
+	Program string
+	APIPath string
+}
+
+// slowestRequest is the slowest request of an endpoint in an hour so far
+type slowestRequest struct {
+	Duration   time.Duration
+	LoggedAt   time.Time
+	IP         string
+	Method     string
+	StatusCode string
+	Line       string
+}
+
+// SlowestTracker keeps the slowest request of each endpoint and hour, which percentiles hide, and writes
+// it to oula_logs_slowest_hourly once the hour has ended and the grace window has passed. Memory holds one
+// request per endpoint and open hour. A stored row is only replaced by a slower request, so the partial
+// hour written on shutdown is completed by the instance that takes over after a restart.
+type SlowestTracker struct {
+	DB     *sql.DB
+	Server string
+	Grace  time.Duration
+	// KeepLine stores the raw line of the request as well
+	KeepLine  bool
+	Retention time.Duration
+
+	mu       sync.Mutex
+	requests map[slowestKey]*slowestRequest
+}
+
+// NewSlowestTracker creates a tracker writing to db
+func NewSlowestTracker(db *sql.DB, server string, grace time.Duration, keepLine bool, retention time.Duration) *SlowestTracker {
+	return &SlowestTracker{
+		DB:        db,
+		Server:    server,
+		Grace:     grace,
+		KeepLine:  keepLine,
+		Retention: retention,
+		requests:  make(map[slowestKey]*slowestRequest),
+	}
+}
+
+// Add records an entry if it is the slowest of its endpoint and hour, a nil tracker is a no-op
+func (t *SlowestTracker) Add(entry *LogEntry) {
+	if t == nil {
+		return
+	}
+	ts, err := time.ParseInLocation("2006/01/02 15:04:05", entry.Date+" "+entry.Time, time.Local)
+	if err != nil {
+		log.Printf("Error parsing entry time %s %s: %v", entry.Date, entry.Time, err)
+		return
+	}
+	key := slowestKey{Hour: ts.Truncate(time.Hour), Env: entry.Env, Program: entry.Program, APIPath: entry.APIPath}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r, ok := t.requests[key]; ok && r.Duration >= entry.Duration {
+		return
+	}
+	r := &slowestRequest{Duration: entry.Duration, LoggedAt: ts, IP: entry.IP, Method: entry.Method, StatusCode: entry.StatusCode}
+	if t.KeepLine {
+		// 日志条目会被复用，复制一份原始行
+		r.Line = strings.Clone(entry.Line)
+	}
+	t.requests[key] = r
+}
+
+// Run writes the hours closed every interval and prunes old rows every hour until ctx is done, then
+// writes the open hours as well
+func (t *SlowestTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			t.Flush(time.Time{})
+			return
+		case now := <-ticker.C:
+			t.Flush(now)
+			if t.Retention > 0 && now.Sub(lastPrune) >= time.Hour {
+				if err := t.Prune(now); err != nil {
+					log.Printf("Error pruning slowest requests: %v", err)
+				}
+				lastPrune = now
+			}
+		}
+	}
+}
+
+// Flush writes the hours closed at now, a zero now writes all hours. Requests that fail to be written
+// are kept for the next flush unless a slower one arrived meanwhile.
+func (t *SlowestTracker) Flush(now time.Time) {
+	t.mu.Lock()
+	closed := make(map[slowestKey]*slowestRequest)
+	for key, r := range t.requests {
+		if now.IsZero() || !now.Before(key.Hour.Add(time.Hour+t.Grace)) {
+			closed[key] = r
+			delete(t.requests, key)
+		}
+	}
+	t.mu.Unlock()
+	if len(closed) == 0 {
+		return
+	}
+
+	log.Printf("Writing the slowest requests of %d endpoint hours", len(closed))
+	if err := t.write(closed); err != nil {
+		log.Printf("Error writing slowest requests: %v", err)
+		t.mu.Lock()
+		for key, r := range closed {
+			if existing, ok := t.requests[key]; !ok || existing.Duration < r.Duration {
+				t.requests[key] = r
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// write upserts the requests in a single transaction, keeping the stored row when it is slower
+func (t *SlowestTracker) write(requests map[slowestKey]*slowestRequest) error {
+	// duration_ms 最后更新，前面的列仍与旧值比较
+	query := `
+		INSERT INTO oula_logs_slowest_hourly (hour, env, server, program, api_path, logged_at, ip, method, status_code, line, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			logged_at = IF(VALUES(duration_ms) > duration_ms, VALUES(logged_at), logged_at),
+			ip = IF(VALUES(duration_ms) > duration_ms, VALUES(ip), ip),
+			method = IF(VALUES(duration_ms) > duration_ms, VALUES(method), method),
+			status_code = IF(VALUES(duration_ms) > duration_ms, VALUES(status_code), status_code),
+			line = IF(VALUES(duration_ms) > duration_ms, VALUES(line), line),
+			duration_ms = GREATEST(duration_ms, VALUES(duration_ms))
+	`
+	tx, err := t.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for key, r := range requests {
+		line := sql.NullString{String: r.Line, Valid: r.Line != ""}
+		_, err := tx.Exec(query, key.Hour.Format("2006-01-02 15:04:05"), key.Env, t.Server, key.Program, key.APIPath,
+			r.LoggedAt.Format("2006-01-02 15:04:05"), r.IP, r.Method, statusCode(r.StatusCode), line,
+			float64(r.Duration)/float64(time.Millisecond))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Prune deletes rows older than the retention before now
+func (t *SlowestTracker) Prune(now time.Time) error {
+	cutoff := now.Add(-t.Retention).Format("2006-01-02 15:04:05")
+	_, err := t.DB.Exec(`DELETE FROM oula_logs_slowest_hourly WHERE hour < ?`, cutoff)
+	return err
+}
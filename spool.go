@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Gauges of the agent's spool, for alerting on a growing backlog
+var (
+	spoolBatches = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "logmonitor_spool_batches",
+		Help: "Batches waiting in the spool for the collector.",
+	})
+	spoolBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "logmonitor_spool_bytes",
+		Help: "Size on disk of the spool segments.",
+	})
+	spoolOldestAge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "logmonitor_spool_oldest_age_seconds",
+		Help: "Age of the oldest batch waiting in the spool, 0 when it is empty.",
+	})
+	spoolEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "logmonitor_spool_evicted_batches_total",
+		Help: "Batches deleted from the spool unsent to stay within -spool-max-bytes.",
+	})
+	spoolQuarantined = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "logmonitor_spool_quarantined_segments_total",
+		Help: "Spool segments set aside as .corrupt because a checksum did not match.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(spoolBatches, spoolBytes, spoolOldestAge, spoolEvicted, spoolQuarantined)
+}
+
+// newBatchID returns a random (version 4) UUID for a forwarded batch
+func newBatchID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Spool segment format. A segment starts with spoolMagic and holds frames of an 8-byte header, the
+// big-endian length and CRC-32C of the body, and a body of the big-endian spool time in nanoseconds
+// followed by the gzipped JSON of a batch.
+const (
+	spoolMagic        = "LMSPOOL1"
+	spoolFrameHeader  = 8
+	spoolMaxFrameSize = 256 << 20
+)
+
+// spoolCRC is the CRC-32C table of the frame checksums
+var spoolCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornFrame is returned for a frame cut short, by a crash while it was written
+var errTornFrame = errors.New("frame is incomplete")
+
+// spoolFrame locates a batch in a segment
+type spoolFrame struct {
+	Offset    int64
+	SpooledAt time.Time
+}
+
+// spoolSegment is a segment file of the spool and its frames, of which the first Acked were sent
+type spoolSegment struct {
+	Path   string
+	Size   int64
+	Frames []spoolFrame
+	Acked  int
+}
+
+// Spool keeps the batches an agent could not deliver in <dir>/<sequence>.seg segments and sends them in
+// order once the collector is reachable again. Batches are appended gzipped to the newest segment, which
+// is synced and closed once it reaches SegmentBytes. A segment is deleted when all its batches were sent,
+// or, oldest first, when the segments exceed MaxBytes. Batches keep their ID, so the collector ignores a
+// batch it already stored, e.g. the sent batches of a segment resent after a restart.
+type Spool struct {
+	Dir          string
+	MaxBytes     int64
+	SegmentBytes int64
+
+	mu       sync.Mutex
+	segments []*spoolSegment
+	active   *os.File
+	bytes    int64
+	next     int64
+}
+
+// OpenSpool opens the spool in dir, creating it if needed, with the segments left by a previous run.
+// Segments that fail their checksums are renamed to .corrupt with a warning, a frame cut short by a crash
+// is truncated.
+func OpenSpool(dir string, maxBytes, segmentBytes int64) (*Spool, error) {
+	if segmentBytes <= 0 || maxBytes > 0 && segmentBytes > maxBytes {
+		return nil, fmt.Errorf("segment size %d must be positive and at most the spool size %d", segmentBytes, maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	// 文件名是递增的序号，按名称排序即按写入顺序
+	sort.Strings(paths)
+	s := &Spool{Dir: dir, MaxBytes: maxBytes, SegmentBytes: segmentBytes}
+	batches := 0
+	for _, path := range paths {
+		if seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), ".seg"), 10, 64); err == nil && seq >= s.next {
+			s.next = seq + 1
+		}
+		seg, err := scanSegment(path)
+		if err != nil {
+			log.Printf("Warning: quarantining spool segment %s, its batches are not sent: %v", path, err)
+			spoolQuarantined.Inc()
+			if err := os.Rename(path, path+".corrupt"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(seg.Frames) == 0 {
+			os.Remove(path)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		s.bytes += seg.Size
+		batches += len(seg.Frames)
+	}
+	if batches > 0 {
+		log.Printf("Spool %s holds %d batches in %d segments from a previous run", dir, batches, len(s.segments))
+	}
+	if err := s.importJSON(); err != nil {
+		return nil, err
+	}
+	s.updateMetrics(time.Now())
+	return s, nil
+}
+
+// scanSegment reads the frames of a segment, verifying their checksums. A torn last frame is truncated.
+func scanSegment(path string) (*spoolSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(spoolMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != spoolMagic {
+		return nil, errors.New("not a spool segment")
+	}
+	seg := &spoolSegment{Path: path, Size: int64(len(spoolMagic))}
+	for {
+		spooledAt, _, n, err := readFrame(f, seg.Size)
+		if err == io.EOF {
+			return seg, nil
+		}
+		if errors.Is(err, errTornFrame) {
+			log.Printf("Warning: truncating the incomplete last batch of spool segment %s at offset %d", path, seg.Size)
+			if err := os.Truncate(path, seg.Size); err != nil {
+				return nil, err
+			}
+			return seg, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: %w", seg.Size, err)
+		}
+		seg.Frames = append(seg.Frames, spoolFrame{Offset: seg.Size, SpooledAt: spooledAt})
+		seg.Size += n
+	}
+}
+
+// readFrame reads the frame at offset of a segment and returns its spool time, its gzipped batch and its
+// length. It returns io.EOF at the end of the segment.
+func readFrame(r io.ReaderAt, offset int64) (time.Time, []byte, int64, error) {
+	var header [spoolFrameHeader]byte
+	n, err := r.ReadAt(header[:], offset)
+	if n == 0 && err == io.EOF {
+		return time.Time{}, nil, 0, io.EOF
+	}
+	if n < len(header) {
+		if err == io.EOF {
+			return time.Time{}, nil, 0, errTornFrame
+		}
+		return time.Time{}, nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 8 || length > spoolMaxFrameSize {
+		return time.Time{}, nil, 0, fmt.Errorf("invalid frame length %d", length)
+	}
+	body := make([]byte, length)
+	if n, err := r.ReadAt(body, offset+spoolFrameHeader); n < len(body) {
+		if err == io.EOF {
+			return time.Time{}, nil, 0, errTornFrame
+		}
+		return time.Time{}, nil, 0, err
+	}
+	if crc32.Checksum(body, spoolCRC) != binary.BigEndian.Uint32(header[4:8]) {
+		return time.Time{}, nil, 0, errors.New("checksum mismatch")
+	}
+	spooledAt := time.Unix(0, int64(binary.BigEndian.Uint64(body[:8])))
+	return spooledAt, body[8:], spoolFrameHeader + int64(length), nil
+}
+
+// encodeFrame returns the frame of a batch spooled at now
+func encodeFrame(batch *forwardedBatch, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, spoolFrameHeader+8))
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(batch); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	frame := buf.Bytes()
+	body := frame[spoolFrameHeader:]
+	binary.BigEndian.PutUint64(body[:8], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(body, spoolCRC))
+	return frame, nil
+}
+
+// importJSON moves the <epoch_ns>-<id>.json batches of the previous spool format into segments
+func (s *Spool) importJSON() error {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*-*.json"))
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		var batch forwardedBatch
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &batch)
+		}
+		if err != nil {
+			log.Printf("Warning: deleting unreadable spooled batch %s: %v", path, err)
+		} else if err := s.Push(&batch); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	log.Printf("Moved %d spooled batches of the previous format into segments", len(paths))
+	return s.rotate()
+}
+
+// Len returns the number of spooled batches, a nil spool holds none
+func (s *Spool) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending()
+}
+
+// pending returns the number of unsent batches, s.mu must be held
+func (s *Spool) pending() int {
+	n := 0
+	for _, seg := range s.segments {
+		n += len(seg.Frames) - seg.Acked
+	}
+	return n
+}
+
+// Push appends a batch to the newest segment, rotating it when it is full, and deletes the oldest
+// segments if the spool exceeds MaxBytes
+func (s *Spool) Push(batch *forwardedBatch) error {
+	now := time.Now()
+	frame, err := encodeFrame(batch, now)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != nil && s.segments[len(s.segments)-1].Size >= s.SegmentBytes {
+		if err := s.closeActive(); err != nil {
+			return err
+		}
+	}
+	if s.active == nil {
+		if err := s.createSegment(); err != nil {
+			return err
+		}
+	}
+	seg := s.segments[len(s.segments)-1]
+	if _, err := s.active.Write(frame); err != nil {
+		// 写入一半的帧在重启时截断
+		return err
+	}
+	seg.Frames = append(seg.Frames, spoolFrame{Offset: seg.Size, SpooledAt: now})
+	seg.Size += int64(len(frame))
+	s.bytes += int64(len(frame))
+	for s.MaxBytes > 0 && s.bytes > s.MaxBytes && len(s.segments) > 1 {
+		oldest := s.segments[0]
+		log.Printf("Warning: spool exceeds %d bytes, deleting its oldest segment %s with %d unsent batches", s.MaxBytes, oldest.Path, len(oldest.Frames)-oldest.Acked)
+		spoolEvicted.Add(float64(len(oldest.Frames) - oldest.Acked))
+		s.removeOldest()
+	}
+	s.updateMetrics(now)
+	return nil
+}
+
+// rotate syncs and closes the newest segment so the next batch starts a new one
+func (s *Spool) rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeActive()
+}
+
+// createSegment starts a new segment, s.mu must be held
+func (s *Spool) createSegment() error {
+	path := filepath.Join(s.Dir, fmt.Sprintf("%020d.seg", s.next))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(spoolMagic); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	s.next++
+	s.active = f
+	s.segments = append(s.segments, &spoolSegment{Path: path, Size: int64(len(spoolMagic))})
+	s.bytes += int64(len(spoolMagic))
+	return nil
+}
+
+// closeActive syncs and closes the segment being written, if any, s.mu must be held
+func (s *Spool) closeActive() error {
+	if s.active == nil {
+		return nil
+	}
+	f := s.active
+	s.active = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing spool segment %s: %w", f.Name(), err)
+	}
+	return f.Close()
+}
+
+// removeOldest deletes the oldest segment, closing it first if it is being written, s.mu must be held
+func (s *Spool) removeOldest() {
+	seg := s.segments[0]
+	if len(s.segments) == 1 && s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+	if err := os.Remove(seg.Path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing spool segment %s: %v", seg.Path, err)
+	}
+	s.segments = s.segments[1:]
+	s.bytes -= seg.Size
+}
+
+// oldest returns the oldest unsent batch and its segment, deleting the segments whose batches were all sent
+func (s *Spool) oldest() (*spoolSegment, spoolFrame, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if seg.Acked < len(seg.Frames) {
+			return seg, seg.Frames[seg.Acked], true
+		}
+		s.removeOldest()
+	}
+	return nil, spoolFrame{}, false
+}
+
+// ack records that the oldest unsent batch of seg was sent or dropped
+func (s *Spool) ack(seg *spoolSegment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 发送期间段可能因超出容量被删除
+	if len(s.segments) > 0 && s.segments[0] == seg {
+		seg.Acked++
+		if seg.Acked == len(seg.Frames) {
+			s.removeOldest()
+		}
+	}
+	s.updateMetrics(time.Now())
+}
+
+// readBatch reads a spooled batch
+func readBatch(seg *spoolSegment, frame spoolFrame) (*forwardedBatch, error) {
+	f, err := os.Open(seg.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, gzipped, _, err := readFrame(f, frame.Offset)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(gzipped))
+	if err != nil {
+		return nil, err
+	}
+	var batch forwardedBatch
+	if err := json.NewDecoder(zr).Decode(&batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// Drain sends the spooled batches oldest first until the spool is empty or send fails. A segment is
+// deleted once all its batches are sent. Batches the collector rejects as invalid, and unreadable ones,
+// are dropped with a warning as they would never be accepted.
+func (s *Spool) Drain(send func(*forwardedBatch) error) error {
+	sent := 0
+	defer func() {
+		if sent > 0 {
+			log.Printf("Sent %d spooled batches, %d left", sent, s.Len())
+		}
+	}()
+	for {
+		seg, frame, ok := s.oldest()
+		if !ok {
+			return nil
+		}
+		batch, err := readBatch(seg, frame)
+		if err != nil {
+			log.Printf("Warning: dropping unreadable spooled batch at offset %d of %s: %v", frame.Offset, seg.Path, err)
+		} else if err := send(batch); err != nil {
+			var rejected *rejectedBatchError
+			if !errors.As(err, &rejected) || !rejected.Permanent() {
+				return err
+			}
+			log.Printf("Warning: dropping spooled batch %s rejected by the collector: %v", batch.ID, err)
+		} else {
+			sent++
+		}
+		s.ack(seg)
+	}
+}
+
+// Run drains the spool every interval until ctx is done, then syncs and closes the segment being written
+func (s *Spool) Run(ctx context.Context, interval time.Duration, send func(*forwardedBatch) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.rotate(); err != nil {
+				log.Printf("Error closing spool segment: %v", err)
+			}
+			return
+		case now := <-ticker.C:
+			if s.Len() > 0 {
+				if err := s.Drain(send); err != nil {
+					log.Printf("Collector still unreachable, %d batches spooled: %v", s.Len(), err)
+				}
+			}
+			s.mu.Lock()
+			s.updateMetrics(now)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// updateMetrics sets the spool gauges, s.mu must be held
+func (s *Spool) updateMetrics(now time.Time) {
+	spoolBatches.Set(float64(s.pending()))
+	spoolBytes.Set(float64(s.bytes))
+	age := 0.0
+	for _, seg := range s.segments {
+		if seg.Acked < len(seg.Frames) {
+			age = now.Sub(seg.Frames[seg.Acked].SpooledAt).Seconds()
+			break
+		}
+	}
+	spoolOldestAge.Set(age)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// sqlEscaper escapes a string literal the way mysql_real_escape_string does
+var sqlEscaper = strings.NewReplacer(
+	"\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`, `\`, `\\`, `'`, `\'`, `"`, `\"`,
+)
+
+// sqlLiteral formats an argument of InsertLogEntry as a MySQL literal
+func sqlLiteral(arg interface{}) (string, error) {
+	if valuer, ok := arg.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return "", err
+		}
+		arg = v
+	}
+	switch v := arg.(type) {
+	case nil:
+		return "NULL", nil
+	case string:
+		return "'" + sqlEscaper.Replace(v) + "'", nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	}
+	return "", fmt.Errorf("unsupported SQL argument %T", arg)
+}
+
+// InterpolateSQL substitutes the ? placeholders of query with the escaped literals of args, so the
+// statement can be pasted into the mysql client. The query must not contain ? elsewhere.
+func InterpolateSQL(query string, args []interface{}) (string, error) {
+	if n := strings.Count(query, "?"); n != len(args) {
+		return "", fmt.Errorf("query has %d placeholders for %d arguments", n, len(args))
+	}
+	var b strings.Builder
+	for _, arg := range args {
+		i := strings.IndexByte(query, '?')
+		literal, err := sqlLiteral(arg)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(query[:i])
+		b.WriteString(literal)
+		query = query[i+1:]
+	}
+	b.WriteString(query)
+	return b.String(), nil
+}
+
+// recentLines returns the recent output of a program, as kept by supervisord
+func recentLines(program string) ([]string, error) {
+	out, err := exec.Command("supervisorctl", "tail", "-65536", program).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running supervisorctl tail: %w", err)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// GenerateSQL writes the statement of insertType of one entry per monitor, with its values substituted, for
+// debugging SQL issues without touching the database. The entry comes from sampleLine if it is set, or
+// else from the first line of the program's recent output that matches the API list. The lines go
+// through the same parsing, scrubbing, anonymization and matching as when monitoring, but are not
+// sampled nor counted in metrics and aggregations.
+func GenerateSQL(w io.Writer, monitors []*Monitor, sampleLine, insertType string) error {
+	for _, m := range monitors {
+		// 只保留解析和匹配所需的设置
+		probe := &Monitor{
+			Program: m.Program, Server: m.Server, APIList: m.APIList,
+			IgnoreIPs: m.IgnoreIPs, Scrubber: m.Scrubber, Anonymizer: m.Anonymizer, Bots: m.Bots, BotPolicy: m.BotPolicy,
+			QueryParams: m.QueryParams, GeoIP: m.GeoIP, GINMode: m.GINMode, FieldSep: m.FieldSep, TimestampFormat: m.TimestampFormat, Version: m.Version, SlowThreshold: m.SlowThreshold,
+		}
+		probe.refreshAppVersion()
+		lines := []string{sampleLine}
+		if sampleLine == "" {
+			var err error
+			if lines, err = recentLines(m.Program); err != nil {
+				return fmt.Errorf("%s: %w", m.Program, err)
+			}
+		}
+		var entry *LogEntry
+		for _, line := range lines {
+			if entry = probe.handleLine(line); entry != nil {
+				break
+			}
+		}
+		if entry == nil {
+			fmt.Fprintf(w, "-- %s: no line matched the API list\n", m.Program)
+			continue
+		}
+		m.Redactor.Apply(entry)
+		query, args, err := BuildInsertSQL("oula_logs_record", []*LogEntry{entry}, insertType)
+		releaseLogEntry(entry)
+		if err != nil {
+			return err
+		}
+		statement, err := InterpolateSQL(query, args)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "-- %s\n%s;\n", m.Program, statement)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// EndpointStats holds the totals of one endpoint over a time range
+type EndpointStats struct {
+	Program     string
+	APIPath     string
+	Count       int64
+	ErrorCount  int64
+	SumDuration float64
+	MaxDuration float64
+	Latency     LatencySketch
+}
+
+// ErrorRate returns the ratio of 5xx responses
+func (s *EndpointStats) ErrorRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.ErrorCount) / float64(s.Count)
+}
+
+// LoadStatsFromMinutes sums the minute rollups of env in [from, to) per endpoint, an empty env sums all environments
+func LoadStatsFromMinutes(ctx context.Context, db *sql.DB, env string, from, to time.Time) (map[endpointKey]*EndpointStats, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT program, api_path, count, error_count, sum_duration_ms, max_duration_ms, sketch
+		FROM oula_logs_minute
+		WHERE minute >= ? AND minute < ? AND (? = '' OR env = ?)
+	`, from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"), env, env)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make(map[endpointKey]*EndpointStats)
+	for rows.Next() {
+		var program, apiPath string
+		var count, errorCount int64
+		var sumMs, maxMs float64
+		var sketch []byte
+		if err := rows.Scan(&program, &apiPath, &count, &errorCount, &sumMs, &maxMs, &sketch); err != nil {
+			return nil, err
+		}
+		s := endpointStats(stats, program, apiPath)
+		s.Count += count
+		s.ErrorCount += errorCount
+		s.SumDuration += sumMs
+		if maxMs > s.MaxDuration {
+			s.MaxDuration = maxMs
+		}
+		var latency LatencySketch
+		if len(sketch) > 0 && latency.UnmarshalBinary(sketch) == nil {
+			s.Latency.Merge(&latency)
+		}
+	}
+	return stats, rows.Err()
+}
+
+// LoadStatsFromRaw folds the raw rows of env in [from, to) per endpoint, an empty env folds all environments
+func LoadStatsFromRaw(ctx context.Context, db *sql.DB, env string, from, to time.Time) (map[endpointKey]*EndpointStats, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT program, api_path, status_code, duration
+		FROM oula_logs_record
+		WHERE date >= ? AND date <= ? AND TIMESTAMP(date, time) >= ? AND TIMESTAMP(date, time) < ? AND (? = '' OR env = ?)
+	`, from.Format("2006-01-02"), to.Format("2006-01-02"), from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"), env, env)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make(map[endpointKey]*EndpointStats)
+	for rows.Next() {
+		var program, apiPath, statusCode, duration string
+		if err := rows.Scan(&program, &apiPath, &statusCode, &duration); err != nil {
+			return nil, err
+		}
+		s := endpointStats(stats, program, apiPath)
+		s.Count++
+		if code, _ := strconv.Atoi(statusCode); code >= 500 {
+			s.ErrorCount++
+		}
+		if d, err := parseStoredDuration(duration); err == nil {
+			ms := float64(d) / float64(time.Millisecond)
+			s.SumDuration += ms
+			if ms > s.MaxDuration {
+				s.MaxDuration = ms
+			}
+			s.Latency.Add(ms)
+		}
+	}
+	return stats, rows.Err()
+}
+
+// LoadStats sums the stats of env in [from, to) per endpoint from the minute rollups, or from the raw rows
+// when there are none, e.g. because -aggregate is disabled
+func LoadStats(ctx context.Context, db *sql.DB, env string, from, to time.Time) (map[endpointKey]*EndpointStats, error) {
+	stats, err := LoadStatsFromMinutes(ctx, db, env, from, to)
+	if err != nil || len(stats) > 0 {
+		return stats, err
+	}
+	return LoadStatsFromRaw(ctx, db, env, from, to)
+}
+
+// protocolKey identifies the requests of a program over one HTTP protocol and TLS version, empty when
+// they were not logged
+type protocolKey struct {
+	Program    string
+	Protocol   string
+	TLSVersion string
+}
+
+// LoadProtocolStats sums the stats of env in [from, to) per program, protocol and TLS version from the
+// minute rollups, or from the raw rows when there are none, an empty env sums all environments
+func LoadProtocolStats(ctx context.Context, db *sql.DB, env string, from, to time.Time) (map[protocolKey]*EndpointStats, error) {
+	stats := make(map[protocolKey]*EndpointStats)
+	rows, err := db.QueryContext(ctx, `
+		SELECT program, protocol, tls_version, count, error_count, sum_duration_ms, max_duration_ms, sketch
+		FROM oula_logs_minute
+		WHERE minute >= ? AND minute < ? AND (? = '' OR env = ?)
+	`, from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"), env, env)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key protocolKey
+		var count, errorCount int64
+		var sumMs, maxMs float64
+		var sketch []byte
+		if err := rows.Scan(&key.Program, &key.Protocol, &key.TLSVersion, &count, &errorCount, &sumMs, &maxMs, &sketch); err != nil {
+			return nil, err
+		}
+		s := protocolStats(stats, key)
+		s.Count += count
+		s.ErrorCount += errorCount
+		s.SumDuration += sumMs
+		if maxMs > s.MaxDuration {
+			s.MaxDuration = maxMs
+		}
+		var latency LatencySketch
+		if len(sketch) > 0 && latency.UnmarshalBinary(sketch) == nil {
+			s.Latency.Merge(&latency)
+		}
+	}
+	if err := rows.Err(); err != nil || len(stats) > 0 {
+		return stats, err
+	}
+
+	raw, err := db.QueryContext(ctx, `
+		SELECT program, COALESCE(protocol, ''), COALESCE(tls_version, ''), status_code, duration
+		FROM oula_logs_record
+		WHERE date >= ? AND date <= ? AND TIMESTAMP(date, time) >= ? AND TIMESTAMP(date, time) < ? AND (? = '' OR env = ?)
+	`, from.Format("2006-01-02"), to.Format("2006-01-02"), from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"), env, env)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+	for raw.Next() {
+		var key protocolKey
+		var statusCode, duration string
+		if err := raw.Scan(&key.Program, &key.Protocol, &key.TLSVersion, &statusCode, &duration); err != nil {
+			return nil, err
+		}
+		s := protocolStats(stats, key)
+		s.Count++
+		if code, _ := strconv.Atoi(statusCode); code >= 500 {
+			s.ErrorCount++
+		}
+		if d, err := parseStoredDuration(duration); err == nil {
+			ms := float64(d) / float64(time.Millisecond)
+			s.SumDuration += ms
+			if ms > s.MaxDuration {
+				s.MaxDuration = ms
+			}
+			s.Latency.Add(ms)
+		}
+	}
+	return stats, raw.Err()
+}
+
+// protocolStats returns the stats for a protocol, creating them if needed
+func protocolStats(stats map[protocolKey]*EndpointStats, key protocolKey) *EndpointStats {
+	s, ok := stats[key]
+	if !ok {
+		s = &EndpointStats{Program: key.Program}
+		stats[key] = s
+	}
+	return s
+}
+
+// endpointStats returns the stats for an endpoint, creating them if needed
+func endpointStats(stats map[endpointKey]*EndpointStats, program, apiPath string) *EndpointStats {
+	key := endpointKey{Program: program, APIPath: apiPath}
+	s, ok := stats[key]
+	if !ok {
+		s = &EndpointStats{Program: program, APIPath: apiPath}
+		stats[key] = s
+	}
+	return s
+}
+
+// parseStoredDuration parses the duration column of oula_logs_record, which holds whole milliseconds,
+// or the GIN latency string for rows written by older versions
+func parseStoredDuration(s string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return ParseGINDuration(s)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// StatusServer serves the internal HTTP endpoints
+type StatusServer struct {
+	Server   string
+	Programs []string
+	DB       *sql.DB
+	Backends map[string]Backend
+	Daily    *DailyRollup
+	Statuses *StatusTable
+	Activity *ActivityTracker
+	TopIPs   *TopIPTracker
+	// ProgramMetrics holds the state of each program shown by /-/status
+	ProgramMetrics *PerProgramMetrics
+	// Labels are added to every metric of /metrics and shown by /-/status
+	Labels map[string]string
+	// Leases holds the writer lease of each program shown by /-/status and /debug/state, nil if -writer-lease-ttl is 0
+	Leases *WriterLeases
+	// TLS serves HTTPS instead of HTTP when set
+	TLS *tls.Config
+	// RequireClientCert only serves the endpoints other than /-/health and the handlers registered with
+	// Handle to requests with a client certificate verified by TLS, or with the bearer Token when set
+	RequireClientCert bool
+	Token             string
+
+	StartedAt time.Time
+	mux       *http.ServeMux
+}
+
+// NewStatusServer creates the status server and registers its handlers
+func NewStatusServer(server string, programs []string, db *sql.DB, backends map[string]Backend) *StatusServer {
+	s := &StatusServer{
+		Server:    server,
+		Programs:  programs,
+		DB:        db,
+		Backends:  backends,
+		StartedAt: time.Now(),
+		mux:       http.NewServeMux(),
+	}
+	s.mux.Handle("/-/status", s.protect(http.HandlerFunc(s.handleStatus)))
+	s.mux.HandleFunc("/-/health", s.handleHealth)
+	s.mux.Handle("/api/error-rates", s.protect(http.HandlerFunc(s.handleErrorRates)))
+	s.mux.Handle("/debug/top-ips", s.protect(http.HandlerFunc(s.handleTopIPs)))
+	s.mux.Handle("/debug/state", s.protect(http.HandlerFunc(s.handleState)))
+	s.mux.Handle("/metrics", s.protect(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.GathererFunc(s.gather), promhttp.HandlerOpts{}))))
+	return s
+}
+
+// protect serves handler only to the requests allowed by RequireClientCert, answering the others with 401
+func (s *StatusServer) protect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.RequireClientCert && !s.authorized(r) {
+			log.Printf("Rejected %s %s from %s without a client certificate or token", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "client certificate or token required", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether r presented a client certificate, which TLS only accepts once verified
+// against the CA bundle, or the bearer token
+func (s *StatusServer) authorized(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return true
+	}
+	return s.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.Token)) == 1
+}
+
+// Handle registers an additional handler, it can be called while the server is running
+func (s *StatusServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// gather returns the metrics with the static labels added
+func (s *StatusServer) gather() ([]*dto.MetricFamily, error) {
+	return (&LabeledGatherer{Gatherer: prometheus.DefaultGatherer, Labels: s.Labels}).Gather()
+}
+
+// ListenAndServe serves on addr until ctx is done
+func (s *StatusServer) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s.mux, TLSConfig: s.TLS}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	var err error
+	if s.TLS != nil {
+		log.Printf("Status server listening on %s with TLS", addr)
+		// 证书由 TLSConfig.GetCertificate 提供
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Status server listening on %s", addr)
+		err = srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// statusResponse is the body of GET /-/status
+type statusResponse struct {
+	Server        string               `json:"server"`
+	Programs      []string             `json:"programs"`
+	StartedAt     time.Time            `json:"started_at"`
+	SchemaVersion int                  `json:"schema_version"`
+	SchemaLatest  int                  `json:"schema_latest"`
+	SchemaError   string               `json:"schema_error,omitempty"`
+	DailyRollup   *DailyRollupStatus   `json:"daily_rollup,omitempty"`
+	LastActivity  map[string]time.Time `json:"last_activity,omitempty"`
+	ProgramStatus []ProgramStatus      `json:"program_status,omitempty"`
+	Labels        map[string]string    `json:"labels,omitempty"`
+	WriterLeases  []LeaseStatus        `json:"writer_leases,omitempty"`
+}
+
+func (s *StatusServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	resp := statusResponse{
+		Server:       s.Server,
+		Programs:     s.Programs,
+		StartedAt:    s.StartedAt,
+		SchemaLatest: LatestSchemaVersion(),
+		Labels:       s.Labels,
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	version, err := GetSchemaVersion(ctx, s.DB)
+	if err != nil {
+		resp.SchemaError = err.Error()
+	}
+	resp.SchemaVersion = version
+
+	if s.Daily != nil {
+		daily := s.Daily.Status()
+		resp.DailyRollup = &daily
+	}
+	if s.Activity != nil {
+		resp.LastActivity = s.Activity.LastActivity()
+	}
+	if s.ProgramMetrics != nil {
+		resp.ProgramStatus = s.ProgramMetrics.Statuses()
+	}
+	resp.WriterLeases = s.Leases.Statuses()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// stateResponse is the body of GET /debug/state
+type stateResponse struct {
+	Server string `json:"server"`
+	// Labels are the effective static labels, stored with every row and added to every metric
+	Labels map[string]string `json:"labels"`
+	// WriterLeases is the lease of each program, omitted if -writer-lease-ttl is 0
+	WriterLeases []LeaseStatus `json:"writer_leases,omitempty"`
+	// WriterConflicts lists the programs another live instance holds the lease of
+	WriterConflicts []string `json:"writer_conflicts,omitempty"`
+}
+
+// handleState returns the effective runtime state of the instance
+func (s *StatusServer) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := stateResponse{Server: s.Server, Labels: s.Labels, WriterLeases: s.Leases.Statuses()}
+	if resp.Labels == nil {
+		resp.Labels = map[string]string{}
+	}
+	for _, lease := range resp.WriterLeases {
+		if lease.Holder != "" {
+			resp.WriterConflicts = append(resp.WriterConflicts, lease.Program)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleErrorRates returns the 5xx rate of each API path in the current window, highest first
+func (s *StatusServer) handleErrorRates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rates := []PathErrorRate{}
+	if s.Statuses != nil {
+		rates = s.Statuses.ErrorRates()
+	}
+	writeJSON(w, http.StatusOK, rates)
+}
+
+// handleTopIPs returns the top IPs of each program over the rolling window, or of the program given
+// by the program query parameter
+func (s *StatusServer) handleTopIPs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.TopIPs == nil {
+		http.Error(w, "top IPs are disabled, see -top-ips", http.StatusNotFound)
+		return
+	}
+	programs := s.TopIPs.Programs()
+	if program := r.URL.Query().Get("program"); program != "" {
+		programs = []string{program}
+	}
+	resp := make(map[string][]TopIP, len(programs))
+	for _, program := range programs {
+		top := s.TopIPs.Top(program)
+		if top == nil {
+			top = []TopIP{}
+		}
+		resp[program] = top
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// backendHealth is the health of one backend in GET /-/health
+type backendHealth struct {
+	Healthy   bool  `json:"healthy"`
+	LatencyMS int64 `json:"latency_ms"`
+}
+
+// handleHealth checks every backend concurrently and returns 503 if any is unhealthy
+func (s *StatusServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	resp := make(map[string]backendHealth)
+	for name, backend := range s.Backends {
+		wg.Add(1)
+		go func(name string, backend Backend) {
+			defer wg.Done()
+			start := time.Now()
+			healthy := backend.IsHealthy(ctx)
+			mu.Lock()
+			resp[name] = backendHealth{Healthy: healthy, LatencyMS: time.Since(start).Milliseconds()}
+			mu.Unlock()
+		}(name, backend)
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	for _, h := range resp {
+		if !h.Healthy {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, resp)
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing JSON response: %v", err)
+	}
+}
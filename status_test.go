@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// getState returns the body of GET /debug/state of s
+func getState(t *testing.T, s *StatusServer) map[string]any {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /debug/state = %d: %s", rec.Code, rec.Body)
+	}
+	var state map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestStatusServerState(t *testing.T) {
+	s := NewStatusServer("web-01", []string{"api"}, nil, nil)
+	if got := getState(t, s)["labels"]; !reflect.DeepEqual(got, map[string]any{}) {
+		t.Errorf("labels without static labels = %v, want {}", got)
+	}
+
+	s.Labels = map[string]string{"env": "prod", "region": "ap-east-1"}
+	state := getState(t, s)
+	if want := map[string]any{"env": "prod", "region": "ap-east-1"}; !reflect.DeepEqual(state["labels"], want) {
+		t.Errorf("labels = %v, want %v", state["labels"], want)
+	}
+	if state["server"] != "web-01" {
+		t.Errorf("server = %v, want web-01", state["server"])
+	}
+}
+
+func TestStatusServerClientAuth(t *testing.T) {
+	// 数据库不可达，/-/status 返回 schema_error
+	db, err := sql.Open("mysql", "user:secret@tcp(127.0.0.1:1)/logmonitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := NewStatusServer("web-01", []string{"api"}, db, nil)
+	s.ServeProfiles()
+	s.Token = "secret"
+	protected := []string{"/metrics", "/-/status", "/api/error-rates", "/debug/top-ips", "/debug/state",
+		"/debug/pprof/programs/api/goroutine"}
+
+	get := func(path string, cert bool, token string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if cert {
+			// TLS 握手只接受校验通过的客户端证书
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	s.RequireClientCert = true
+	for _, path := range protected {
+		if code := get(path, false, ""); code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a certificate = %d, want 401", path, code)
+		}
+		if code := get(path, false, "wrong"); code != http.StatusUnauthorized {
+			t.Errorf("GET %s with a wrong token = %d, want 401", path, code)
+		}
+		if code := get(path, true, ""); code == http.StatusUnauthorized {
+			t.Errorf("GET %s with a client certificate = 401", path)
+		}
+		if code := get(path, false, "secret"); code == http.StatusUnauthorized {
+			t.Errorf("GET %s with the token = 401", path)
+		}
+	}
+	if code := get("/-/health", false, ""); code != http.StatusOK {
+		t.Errorf("GET /-/health without a certificate = %d, want 200", code)
+	}
+
+	// 没有 -ingest-token 时只接受证书
+	s.Token = ""
+	if code := get("/metrics", false, "secret"); code != http.StatusUnauthorized {
+		t.Errorf("GET /metrics with a token but no -ingest-token = %d, want 401", code)
+	}
+
+	// -tls-public-status
+	s.RequireClientCert = false
+	for _, path := range protected {
+		if code := get(path, false, ""); code == http.StatusUnauthorized {
+			t.Errorf("GET %s with -tls-public-status = 401", path)
+		}
+	}
+}
+
+func TestStatusServerStateWriterConflict(t *testing.T) {
+	s := NewStatusServer("web-01", []string{"api", "worker"}, nil, nil)
+	if state := getState(t, s); state["writer_leases"] != nil || state["writer_conflicts"] != nil {
+		t.Errorf("state without writer leases = %v", state)
+	}
+
+	s.Leases = &WriterLeases{Server: "web-01", InstanceID: "web-01-b", Policy: "refuse"}
+	s.Leases.state("api").status = LeaseStatus{Program: "api", Holder: "web-01-a", HolderHost: "host-a", HolderHeartbeatAge: "2s"}
+	s.Leases.state("worker").status = LeaseStatus{Program: "worker", Held: true}
+	state := getState(t, s)
+	if got := state["writer_conflicts"]; !reflect.DeepEqual(got, []any{"api"}) {
+		t.Errorf("writer_conflicts = %v, want [api]", got)
+	}
+	leases, _ := state["writer_leases"].([]any)
+	if len(leases) != 2 {
+		t.Fatalf("writer_leases = %v, want the leases of api and worker", state["writer_leases"])
+	}
+	if api, _ := leases[0].(map[string]any); api["holder"] != "web-01-a" || api["holder_host"] != "host-a" || api["held"] != false {
+		t.Errorf("lease of api = %v, want held by web-01-a on host-a", api)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// StatusCodeKey identifies a per-minute count of one exact status code. Only codes that were observed
+// get a key, so the table stays as small as the set of codes a program actually returns.
+type StatusCodeKey struct {
+	Minute  time.Time
+	Env     string
+	Server  string
+	Program string
+	// StatusCode is 0 for a status that is not a valid HTTP code
+	StatusCode int
+}
+
+// EnsureStatusMinuteTable creates the oula_logs_status_minute table if it does not exist
+func EnsureStatusMinuteTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS oula_logs_status_minute (
+			minute DATETIME NOT NULL,
+			server VARCHAR(64) NOT NULL,
+			program VARCHAR(128) NOT NULL,
+			status_code SMALLINT UNSIGNED NOT NULL,
+			count BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (minute, server, program, status_code)
+		)
+	`)
+	return err
+}
+
+// statusCode returns the status of an entry as a number, 0 if it is not a valid HTTP code
+func statusCode(status string) int {
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 100 || code > 599 {
+		return 0
+	}
+	return code
+}
+
+// writeStatusCodes adds the counts to oula_logs_status_minute within tx
+func writeStatusCodes(tx *sql.Tx, counts map[StatusCodeKey]int64) error {
+	query := `
+		INSERT INTO oula_logs_status_minute (minute, env, server, program, status_code, count)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE count = count + VALUES(count)
+	`
+	for key, n := range counts {
+		_, err := tx.Exec(query, key.Minute.Format("2006-01-02 15:04:05"), key.Env, key.Server, key.Program, key.StatusCode, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneStatusMinutes deletes status code counts older than retention before now. It is independent of
+// the retention of raw rows, so the distribution can be kept much longer than the entries themselves.
+func PruneStatusMinutes(ctx context.Context, db *sql.DB, now time.Time, retention time.Duration) error {
+	cutoff := now.Add(-retention).Format("2006-01-02 15:04:05")
+	_, err := db.ExecContext(ctx, `DELETE FROM oula_logs_status_minute WHERE minute < ?`, cutoff)
+	return err
+}
+
+// StatusMatrixRow is the count of each status code of a program over one step of a status report
+type StatusMatrixRow struct {
+	Start   time.Time
+	Program string
+	Counts  map[int]int64
+}
+
+// LoadStatusMatrix sums the status code counts in [from, to) per program and step, a step of 0 covers
+// the whole range. An empty program or env sums all programs or environments. Rows are sorted by start,
+// then program.
+func LoadStatusMatrix(ctx context.Context, db *sql.DB, from, to time.Time, step time.Duration, program, env string) ([]*StatusMatrixRow, error) {
+	query := `
+		SELECT DATE_FORMAT(minute, '%Y-%m-%d %H:%i:%s'), program, status_code, SUM(count)
+		FROM oula_logs_status_minute
+		WHERE minute >= ? AND minute < ? AND (? = '' OR program = ?) AND (? = '' OR env = ?)
+		GROUP BY minute, program, status_code
+	`
+	rows, err := db.QueryContext(ctx, query, from.Format("2006-01-02 15:04:05"), to.Format("2006-01-02 15:04:05"), program, program, env, env)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type rowKey struct {
+		start   time.Time
+		program string
+	}
+	byKey := make(map[rowKey]*StatusMatrixRow)
+	for rows.Next() {
+		var minuteStr, prog string
+		var code int
+		var n int64
+		if err := rows.Scan(&minuteStr, &prog, &code, &n); err != nil {
+			return nil, err
+		}
+		minute, err := time.ParseInLocation("2006-01-02 15:04:05", minuteStr, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		start := from
+		if step > 0 {
+			start = from.Add(minute.Sub(from) / step * step)
+		}
+		key := rowKey{start, prog}
+		row, ok := byKey[key]
+		if !ok {
+			row = &StatusMatrixRow{Start: start, Program: prog, Counts: make(map[int]int64)}
+			byKey[key] = row
+		}
+		row.Counts[code] += n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	matrix := make([]*StatusMatrixRow, 0, len(byKey))
+	for _, row := range byKey {
+		matrix = append(matrix, row)
+	}
+	sort.Slice(matrix, func(i, j int) bool {
+		if !matrix[i].Start.Equal(matrix[j].Start) {
+			return matrix[i].Start.Before(matrix[j].Start)
+		}
+		return matrix[i].Program < matrix[j].Program
+	})
+	return matrix, nil
+}
+
+// writeStatusMatrix prints one row per step and program and one column per status code observed in
+// the range, with a TIME column only when the range is split into steps
+func writeStatusMatrix(out io.Writer, matrix []*StatusMatrixRow, step time.Duration) error {
+	seen := make(map[int]bool)
+	for _, row := range matrix {
+		for code := range row.Counts {
+			seen[code] = true
+		}
+	}
+	codes := make([]int, 0, len(seen))
+	for code := range seen {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	if step > 0 {
+		fmt.Fprint(w, "TIME\t")
+	}
+	fmt.Fprint(w, "PROGRAM\t")
+	for _, code := range codes {
+		if code == 0 {
+			fmt.Fprint(w, "OTHER\t")
+		} else {
+			fmt.Fprintf(w, "%d\t", code)
+		}
+	}
+	fmt.Fprintln(w, "TOTAL\t")
+	for _, row := range matrix {
+		if step > 0 {
+			fmt.Fprintf(w, "%s\t", row.Start.Format("2006-01-02 15:04"))
+		}
+		fmt.Fprintf(w, "%s\t", row.Program)
+		var total int64
+		for _, code := range codes {
+			n := row.Counts[code]
+			total += n
+			if n == 0 {
+				fmt.Fprint(w, "-\t")
+			} else {
+				fmt.Fprintf(w, "%d\t", n)
+			}
+		}
+		fmt.Fprintf(w, "%d\t\n", total)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PathErrorRate is an entry of GET /api/error-rates
+type PathErrorRate struct {
+	APIPath   string           `json:"api_path"`
+	Total     int64            `json:"total"`
+	Errors    int64            `json:"errors"`
+	ErrorRate float64          `json:"error_rate"`
+	Classes   map[string]int64 `json:"status_classes"`
+}
+
+// StatusTable counts matched entries per API path and status class in the current window,
+// from which the 5xx rate of each path is computed. Counts are reset at the end of every window.
+type StatusTable struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int64
+}
+
+// NewStatusTable creates an empty table
+func NewStatusTable() *StatusTable {
+	return &StatusTable{counts: make(map[string]map[string]int64)}
+}
+
+// Add counts an entry, a nil table is a no-op
+func (t *StatusTable) Add(entry *LogEntry) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	classes, ok := t.counts[entry.APIPath]
+	if !ok {
+		classes = make(map[string]int64)
+		t.counts[entry.APIPath] = classes
+	}
+	classes[StatusClass(entry.StatusCode)]++
+}
+
+// Run resets the counts every window until ctx is done
+func (t *StatusTable) Run(ctx context.Context, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.mu.Lock()
+			t.counts = make(map[string]map[string]int64)
+			t.mu.Unlock()
+		}
+	}
+}
+
+// ErrorRates returns the paths of the current window sorted by error rate descending, then by path
+func (t *StatusTable) ErrorRates() []PathErrorRate {
+	t.mu.Lock()
+	rates := make([]PathErrorRate, 0, len(t.counts))
+	for apiPath, classes := range t.counts {
+		rate := PathErrorRate{APIPath: apiPath, Classes: make(map[string]int64, len(classes))}
+		for class, n := range classes {
+			rate.Classes[class] = n
+			rate.Total += n
+		}
+		rate.Errors = classes["5xx"]
+		if rate.Total > 0 {
+			rate.ErrorRate = float64(rate.Errors) / float64(rate.Total)
+		}
+		rates = append(rates, rate)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].ErrorRate != rates[j].ErrorRate {
+			return rates[i].ErrorRate > rates[j].ErrorRate
+		}
+		return rates[i].APIPath < rates[j].APIPath
+	})
+	return rates
+}
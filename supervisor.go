@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// SupervisorStatus runs supervisorctl status and returns the state of each program, keyed by the name
+// supervisorctl tail accepts ("group:name" for programs in a group)
+func SupervisorStatus() (map[string]string, error) {
+	out, err := supervisorctlStatus()
+	if err != nil {
+		return nil, err
+	}
+	return parseSupervisorStatus(out), nil
+}
+
+// supervisorctlStatus returns the output of supervisorctl status
+func supervisorctlStatus() ([]byte, error) {
+	out, err := exec.Command("supervisorctl", "status").Output()
+	// supervisorctl status exits non-zero when a program is not running, the output is still complete
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && len(out) > 0) {
+		return nil, fmt.Errorf("running supervisorctl status: %w", err)
+	}
+	return out, nil
+}
+
+// parseSupervisorStatus parses lines such as "web:api   RUNNING   pid 123, uptime 1:02:03"
+func parseSupervisorStatus(out []byte) map[string]string {
+	states := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		states[fields[0]] = fields[1]
+	}
+	return states
+}
+
+// ListMatchedPrograms prints which programs are RUNNING, in another state or unknown to supervisord,
+// and reports whether all of them are RUNNING
+func ListMatchedPrograms(out io.Writer, programs []string, states map[string]string) bool {
+	var running, other, missing []string
+	for _, program := range programs {
+		state, ok := states[program]
+		switch {
+		case !ok:
+			missing = append(missing, program)
+		case state == "RUNNING":
+			running = append(running, program)
+		default:
+			other = append(other, program+" ("+state+")")
+		}
+	}
+	for _, group := range []struct {
+		title    string
+		programs []string
+	}{{"RUNNING", running}, {"Not running", other}, {"Not found", missing}} {
+		sort.Strings(group.programs)
+		fmt.Fprintf(out, "%s: %d\n", group.title, len(group.programs))
+		for _, program := range group.programs {
+			fmt.Fprintf(out, "  %s\n", program)
+		}
+	}
+	return len(other) == 0 && len(missing) == 0
+}
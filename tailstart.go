@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// supervisorHistory returns the last maxBytes of a program's buffered output, without the partial
+// first line when the output was cut
+func supervisorHistory(ctx context.Context, program string, maxBytes int) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, "supervisorctl", "tail", "-"+strconv.Itoa(maxBytes), program).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running supervisorctl tail: %w", err)
+	}
+	if len(out) >= maxBytes {
+		if i := bytes.IndexByte(out, '\n'); i >= 0 {
+			out = out[i+1:]
+		}
+	}
+	return out, nil
+}
+
+// tailBoundary finds where the live output of supervisorctl tail -f starts repeating the buffered
+// output processed before it: tail -f first prints the end of the buffer, and there is no marker
+// between the two. Live lines stamped before the last buffered GIN line are skipped, as are the lines
+// stamped at the same second that were already buffered. Skipping stops at the first new line.
+type tailBoundary struct {
+	m    *Monitor
+	last string
+	seen map[string]int
+	done bool
+}
+
+// newTailBoundary records the timestamp of the last GIN line of history and the lines sharing it
+func newTailBoundary(m *Monitor, history []byte) *tailBoundary {
+	b := &tailBoundary{m: m, seen: make(map[string]int)}
+	scanner := bufio.NewScanner(bytes.NewReader(history))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		stamp, ok := b.stamp(line)
+		if !ok {
+			continue
+		}
+		if stamp != b.last {
+			b.last = stamp
+			clear(b.seen)
+		}
+		b.seen[line]++
+	}
+	b.done = b.last == ""
+	return b
+}
+
+// stamp returns the normalized date and time of a GIN line, which sort as strings
+func (b *tailBoundary) stamp(line string) (string, bool) {
+	if !strings.Contains(line, "GIN") {
+		return "", false
+	}
+	entry, err := ParseLogLine(StripANSI(line), "", "", b.m.fieldMap(), b.m.fieldSep(), b.m.TimestampFormat)
+	if err != nil {
+		return "", false
+	}
+	stamp := entry.Date + " " + entry.Time
+	releaseLogEntry(entry)
+	return stamp, true
+}
+
+// skip reports whether a live line repeats the history
+func (b *tailBoundary) skip(line string) bool {
+	if b.done {
+		return false
+	}
+	line = strings.TrimRight(line, "\r\n")
+	stamp, ok := b.stamp(line)
+	switch {
+	case !ok:
+		// 非 GIN 行不影响边界判断
+		return false
+	case stamp < b.last:
+		return true
+	case stamp == b.last && b.seen[line] > 0:
+		b.seen[line]--
+		return true
+	}
+	b.done = true
+	return false
+}
+
+// historyAfter drops the lines of history up to the first GIN line stamped after after, the lines
+// processed before a restarted tail or written by the previous process of the program
+func historyAfter(m *Monitor, history []byte, after string) []byte {
+	b := &tailBoundary{m: m}
+	for rest := history; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i]
+		}
+		if stamp, ok := b.stamp(string(line)); ok && stamp > after {
+			return rest
+		}
+		rest = rest[len(line):]
+		if len(rest) > 0 {
+			rest = rest[1:]
+		}
+	}
+	return nil
+}
+
+// withHistory returns a reader of the program's buffered output followed by the live output of r,
+// without the live lines that repeat the buffered ones. With after, only the buffered output from the
+// first GIN line stamped after it is read.
+func withHistory(ctx context.Context, m *Monitor, r io.Reader, maxBytes int, after string) (io.Reader, error) {
+	history, err := supervisorHistory(ctx, m.Program, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	boundary := newTailBoundary(m, history)
+	if after != "" {
+		history = historyAfter(m, history, after)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		reader := bufio.NewReader(r)
+		skipped := 0
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				if boundary.skip(line) {
+					skipped++
+				} else {
+					if skipped > 0 {
+						log.Printf("Skipped %d live lines already in the buffered output of %s", skipped, m.Program)
+						skipped = 0
+					}
+					if _, err := pw.Write([]byte(line)); err != nil {
+						return
+					}
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return io.MultiReader(bytes.NewReader(history), pr), nil
+}
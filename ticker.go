@@ -0,0 +1,82 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// jitterRand is seeded from crypto/rand at startup so instances started together do not share a sequence
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(cryptoSeed()))
+)
+
+// cryptoSeed returns a random seed, falling back to the clock if crypto/rand fails
+func cryptoSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// randDuration returns a random duration in [0, n)
+func randDuration(n time.Duration) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(n)))
+}
+
+// flushTicker fires every interval. With jitter, the first tick comes after an extra random delay
+// in [0, jitter) and every later tick is moved by a random delta in [-jitter/2, +jitter/2].
+// A zero interval never fires.
+type flushTicker struct {
+	interval time.Duration
+	jitter   time.Duration
+	timer    *time.Timer
+}
+
+// newFlushTicker starts a flush ticker
+func newFlushTicker(interval, jitter time.Duration) *flushTicker {
+	t := &flushTicker{interval: interval, jitter: jitter}
+	if interval > 0 {
+		t.timer = time.NewTimer(interval + randDuration(jitter))
+	}
+	return t
+}
+
+// C returns the channel the ticks are delivered on
+func (t *flushTicker) C() <-chan time.Time {
+	if t.timer == nil {
+		return nil
+	}
+	return t.timer.C
+}
+
+// Next schedules the next tick, it must be called after each receive from C
+func (t *flushTicker) Next() {
+	if t.timer == nil {
+		return
+	}
+	d := t.interval
+	if t.jitter > 0 {
+		d += randDuration(t.jitter+1) - t.jitter/2
+	}
+	if d <= 0 {
+		d = time.Millisecond
+	}
+	t.timer.Reset(d)
+}
+
+// Stop stops the ticker
+func (t *flushTicker) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CertFiles holds a certificate and key pair and a CA bundle, reloaded from their files when they
+// change so certificates can be rotated without a restart. Either part may be unset.
+type CertFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	cert atomic.Pointer[tls.Certificate]
+	pool atomic.Pointer[x509.CertPool]
+}
+
+// NewCertFiles loads the files, failing with a message naming the file that cannot be used
+func NewCertFiles(certFile, keyFile, caFile string) (*CertFiles, error) {
+	f := &CertFiles{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("a certificate needs both a certificate file and a key file")
+	}
+	if certFile != "" {
+		if err := f.loadCert(); err != nil {
+			return nil, err
+		}
+	}
+	if caFile != "" {
+		if err := f.loadCA(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// loadCert reads the certificate and key pair, rejecting a certificate that has expired
+func (f *CertFiles) loadCert() error {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate %s with key %s: %w", f.CertFile, f.KeyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing certificate %s: %w", f.CertFile, err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("certificate %s (%s) expired on %s", f.CertFile, leaf.Subject, leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+	f.cert.Store(&cert)
+	return nil
+}
+
+// loadCA reads the PEM bundle of CA certificates
+func (f *CertFiles) loadCA() error {
+	data, err := os.ReadFile(f.CAFile)
+	if err != nil {
+		return fmt.Errorf("reading CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("CA bundle %s contains no PEM certificate", f.CAFile)
+	}
+	f.pool.Store(pool)
+	return nil
+}
+
+// Watch reloads the files when they change until ctx is done. Files that fail to load keep the previous
+// certificate or CAs, e.g. while a new certificate is written but not its key yet.
+func (f *CertFiles) Watch(ctx context.Context, interval time.Duration) {
+	if f.CertFile != "" {
+		go watchFile(ctx, "certificate", f.CertFile, interval, f.reloadCert)
+		go watchFile(ctx, "certificate key", f.KeyFile, interval, f.reloadCert)
+	}
+	if f.CAFile != "" {
+		go watchFile(ctx, "CA bundle", f.CAFile, interval, f.reloadCA)
+	}
+}
+
+// Reload reads the files again, keeping the previous certificate or CAs if they fail to load
+func (f *CertFiles) Reload() {
+	if f.CertFile != "" {
+		f.reloadCert()
+	}
+	if f.CAFile != "" {
+		f.reloadCA()
+	}
+}
+
+// reloadCert reads the certificate and key pair again, keeping the previous one on error
+func (f *CertFiles) reloadCert() {
+	if err := f.loadCert(); err != nil {
+		log.Printf("Error reloading certificate, keeping the previous one: %v", err)
+		return
+	}
+	log.Printf("Reloaded certificate %s, valid until %s", f.CertFile, f.cert.Load().Leaf.NotAfter.Format(time.RFC3339))
+}
+
+// reloadCA reads the CA bundle again, keeping the previous one on error
+func (f *CertFiles) reloadCA() {
+	if err := f.loadCA(); err != nil {
+		log.Printf("Error reloading CA bundle %s, keeping the previous one: %v", f.CAFile, err)
+		return
+	}
+	log.Printf("Reloaded CA bundle %s", f.CAFile)
+}
+
+// verify checks a peer's certificate chain against the CA bundle, returning an error that says what is
+// wrong with the certificate. host is checked against the certificate's names unless empty.
+func (f *CertFiles) verify(certs []*x509.Certificate, usage x509.ExtKeyUsage, peer, host string) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("%s presented no certificate", peer)
+	}
+	leaf := certs[0]
+	opts := x509.VerifyOptions{
+		Roots:         f.pool.Load(),
+		Intermediates: x509.NewCertPool(),
+		DNSName:       host,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return describeCertError(err, peer, leaf, f.CAFile)
+	}
+	return nil
+}
+
+// describeCertError names the problem of a certificate that failed verification
+func describeCertError(err error, peer string, cert *x509.Certificate, caFile string) error {
+	var unknown x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	switch {
+	case errors.As(err, &unknown):
+		return fmt.Errorf("%s certificate %s is not signed by a CA of %s (issuer %s): %w", peer, cert.Subject, caFile, cert.Issuer, err)
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return fmt.Errorf("%s certificate %s is outside its validity period %s to %s: %w", peer, cert.Subject,
+			cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339), err)
+	case errors.As(err, &invalid) && invalid.Reason == x509.IncompatibleUsage:
+		return fmt.Errorf("%s certificate %s does not allow this use (extended key usage): %w", peer, cert.Subject, err)
+	case errors.As(err, &hostname):
+		return fmt.Errorf("%s certificate %s is not valid for %s (names %s): %w", peer, cert.Subject, hostname.Host,
+			strings.Join(cert.DNSNames, ", "), err)
+	}
+	return fmt.Errorf("%s certificate %s is invalid: %w", peer, cert.Subject, err)
+}
+
+// NewServerTLSConfig returns the TLS configuration of the status server. With a CA bundle, clients are
+// asked for a certificate, which must be signed by one of its CAs when presented; endpoints that need a
+// client certificate check that one was verified.
+func NewServerTLSConfig(files *CertFiles) *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return files.cert.Load(), nil
+		},
+	}
+	if files.CAFile != "" {
+		// 证书由 VerifyConnection 按当前 CA 校验，CA 可以热更新
+		config.ClientAuth = tls.RequestClientCert
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return nil
+			}
+			return files.verify(cs.PeerCertificates, x509.ExtKeyUsageClientAuth, "client", "")
+		}
+	}
+	return config
+}
+
+// NewClientTLSConfig returns the TLS configuration of an agent connecting to host. With a CA bundle, the
+// collector's certificate is verified against it instead of the system roots. With a certificate, it is
+// presented to the collector.
+func NewClientTLSConfig(files *CertFiles, host string) *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if files.CAFile != "" {
+		// 按当前 CA 校验服务端证书，CA 可以热更新
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return files.verify(cs.PeerCertificates, x509.ExtKeyUsageServerAuth, "collector", host)
+		}
+	}
+	if files.CertFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return files.cert.Load(), nil
+		}
+	}
+	return config
+}
+
+// describeTLSAlert names the problem when the collector rejected the agent's certificate during the
+// handshake, err is returned unchanged otherwise
+func describeTLSAlert(err error) error {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" {
+		return err
+	}
+	// crypto/tls 不导出 TCP 连接收到的告警类型，只能按告警描述区分
+	switch opErr.Err.Error() {
+	case "tls: bad certificate", "tls: unsupported certificate":
+		return fmt.Errorf("collector rejected the client certificate of -collector-cert, see the collector's log for the reason: %w", err)
+	case "tls: revoked certificate":
+		return fmt.Errorf("collector reports the client certificate of -collector-cert as revoked: %w", err)
+	case "tls: expired certificate":
+		return fmt.Errorf("collector reports the client certificate of -collector-cert as expired: %w", err)
+	case "tls: unknown certificate authority":
+		return fmt.Errorf("collector does not trust the CA of the client certificate of -collector-cert: %w", err)
+	case "tls: certificate required":
+		return fmt.Errorf("collector requires a client certificate, set -collector-cert and -collector-key: %w", err)
+	}
+	return err
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// topIPEndpoints is the number of endpoints tracked per IP counter
+const topIPEndpoints = 5
+
+// topIPSlots is the number of slots the rolling window is divided into
+const topIPSlots = 6
+
+// ssCounter is a monitored key of a space-saving summary. Count overestimates the true count by at most Error.
+type ssCounter struct {
+	Key       string
+	Count     int64
+	Error     int64
+	Endpoints map[string]int64
+}
+
+// SpaceSaving is the space-saving heavy hitters summary: it monitors at most K keys, and a new key
+// replaces the one with the lowest count, inheriting that count as its error bound. Every key occurring
+// more than total/K times is guaranteed to be monitored. Each counter also keeps its top endpoints
+// with the same algorithm, so memory is bounded by K regardless of traffic.
+type SpaceSaving struct {
+	K        int
+	counters map[string]*ssCounter
+}
+
+// NewSpaceSaving creates a summary monitoring at most k keys
+func NewSpaceSaving(k int) *SpaceSaving {
+	return &SpaceSaving{K: k, counters: make(map[string]*ssCounter, k)}
+}
+
+// Add counts one occurrence of key on endpoint
+func (s *SpaceSaving) Add(key, endpoint string) {
+	c, ok := s.counters[key]
+	if !ok {
+		if len(s.counters) < s.K {
+			c = &ssCounter{Endpoints: make(map[string]int64, topIPEndpoints)}
+		} else {
+			c = s.evictMin()
+			c.Error = c.Count
+			c.Endpoints = make(map[string]int64, topIPEndpoints)
+		}
+		// 条目会被放回对象池，键需要复制
+		c.Key = strings.Clone(key)
+		s.counters[c.Key] = c
+	}
+	c.Count++
+
+	if _, ok := c.Endpoints[endpoint]; !ok {
+		var inherited int64
+		if len(c.Endpoints) >= topIPEndpoints {
+			// 接口计数同样按 space-saving 替换最小项
+			minEndpoint, minCount := "", int64(-1)
+			for e, n := range c.Endpoints {
+				if minCount < 0 || n < minCount {
+					minEndpoint, minCount = e, n
+				}
+			}
+			delete(c.Endpoints, minEndpoint)
+			inherited = minCount
+		}
+		endpoint = strings.Clone(endpoint)
+		c.Endpoints[endpoint] = inherited
+	}
+	c.Endpoints[endpoint]++
+}
+
+// evictMin removes and returns the counter with the lowest count
+func (s *SpaceSaving) evictMin() *ssCounter {
+	var min *ssCounter
+	for _, c := range s.counters {
+		if min == nil || c.Count < min.Count {
+			min = c
+		}
+	}
+	delete(s.counters, min.Key)
+	return min
+}
+
+// TopIP is an entry of the top IP list
+type TopIP struct {
+	IP    string `json:"ip"`
+	Count int64  `json:"count"`
+	// Error is the maximum overestimation of Count
+	Error     int64            `json:"error"`
+	Endpoints map[string]int64 `json:"endpoints"`
+}
+
+// programTopIPs holds the slots of the rolling window of a program, the current slot is Slots[Current]
+type programTopIPs struct {
+	Slots   []*SpaceSaving
+	Current int
+	Firing  map[string]bool
+}
+
+// TopIPTracker keeps the IPs with the most requests of each program over a rolling window, for scraping
+// incidents. The window is divided into slots of space-saving summaries that are merged when read, so
+// memory is bounded by K counters per slot and program. The IP is the client IP GIN logged, which is taken
+// from X-Forwarded-For when the service trusts its proxies, after anonymization if it is enabled. With an alert threshold, an alert is sent when an IP makes more
+// requests than that over the window.
+type TopIPTracker struct {
+	K      int
+	Window time.Duration
+	// AlertAbove is the number of requests per window above which an IP is alerted on, 0 disables alerts
+	AlertAbove int64
+	Server     string
+	Alerter    *Dispatcher
+
+	mu       sync.Mutex
+	programs map[string]*programTopIPs
+}
+
+// NewTopIPTracker creates a tracker keeping k IPs per program
+func NewTopIPTracker(k int, window time.Duration, alertAbove int64, server string, alerter *Dispatcher) *TopIPTracker {
+	return &TopIPTracker{
+		K:          k,
+		Window:     window,
+		AlertAbove: alertAbove,
+		Server:     server,
+		Alerter:    alerter,
+		programs:   make(map[string]*programTopIPs),
+	}
+}
+
+// Add counts the request of an entry, a nil tracker is a no-op
+func (t *TopIPTracker) Add(entry *LogEntry) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.programs[entry.Program]
+	if !ok {
+		p = &programTopIPs{Slots: make([]*SpaceSaving, topIPSlots), Firing: make(map[string]bool)}
+		for i := range p.Slots {
+			p.Slots[i] = NewSpaceSaving(t.K)
+		}
+		t.programs[entry.Program] = p
+	}
+	p.Slots[p.Current].Add(entry.IP, entry.APIPath)
+}
+
+// Top returns the top IPs of program over the window, most requests first, at most K of them
+func (t *TopIPTracker) Top(program string) []TopIP {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.programs[program]
+	if !ok {
+		return nil
+	}
+	return t.top(p)
+}
+
+// Programs returns the programs that have traffic in the window
+func (t *TopIPTracker) Programs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	programs := make([]string, 0, len(t.programs))
+	for program := range t.programs {
+		programs = append(programs, program)
+	}
+	sort.Strings(programs)
+	return programs
+}
+
+// top merges the slots of p, the caller must hold t.mu
+func (t *TopIPTracker) top(p *programTopIPs) []TopIP {
+	merged := make(map[string]*TopIP)
+	for _, slot := range p.Slots {
+		for ip, c := range slot.counters {
+			m, ok := merged[ip]
+			if !ok {
+				m = &TopIP{IP: ip, Endpoints: make(map[string]int64)}
+				merged[ip] = m
+			}
+			m.Count += c.Count
+			m.Error += c.Error
+			for endpoint, n := range c.Endpoints {
+				m.Endpoints[endpoint] += n
+			}
+		}
+	}
+	top := make([]TopIP, 0, len(merged))
+	for _, m := range merged {
+		top = append(top, *m)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].IP < top[j].IP
+	})
+	if len(top) > t.K {
+		top = top[:t.K]
+	}
+	return top
+}
+
+// Run starts a new slot every Window/topIPSlots until ctx is done, checking the alert threshold first
+func (t *TopIPTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.Window / topIPSlots)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, alert := range t.rotate(now) {
+				t.Alerter.Notify(alert)
+			}
+		}
+	}
+}
+
+// rotate returns the alerts for the window ending now and clears the oldest slot
+func (t *TopIPTracker) rotate(now time.Time) []*Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var alerts []*Alert
+	for program, p := range t.programs {
+		if t.AlertAbove > 0 {
+			above := make(map[string]bool)
+			for _, ip := range t.top(p) {
+				if ip.Count-ip.Error <= t.AlertAbove {
+					continue
+				}
+				above[ip.IP] = true
+				if p.Firing[ip.IP] {
+					continue
+				}
+				p.Firing[ip.IP] = true
+				alerts = append(alerts, &Alert{
+					Type:      "ip_rate_high",
+					Server:    t.Server,
+					Program:   program,
+					Value:     float64(ip.Count),
+					Threshold: float64(t.AlertAbove),
+					Window:    t.Window.String(),
+					Message:   fmt.Sprintf("%s made at least %d requests to %s over %s, top endpoints %v", ip.IP, ip.Count-ip.Error, program, t.Window, ip.Endpoints),
+					Time:      now,
+				})
+			}
+			for ip := range p.Firing {
+				if above[ip] {
+					continue
+				}
+				delete(p.Firing, ip)
+				alerts = append(alerts, &Alert{
+					Type:      "ip_rate_recovered",
+					Server:    t.Server,
+					Program:   program,
+					Threshold: float64(t.AlertAbove),
+					Window:    t.Window.String(),
+					Message:   fmt.Sprintf("%s is back below %d requests to %s over %s", ip, t.AlertAbove, program, t.Window),
+					Time:      now,
+				})
+			}
+		}
+
+		p.Current = (p.Current + 1) % len(p.Slots)
+		p.Slots[p.Current] = NewSpaceSaving(t.K)
+	}
+	return alerts
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sort"
+	"time"
+)
+
+// EnsureTopHourlyTable creates the oula_logs_top_hourly table if it does not exist
+func EnsureTopHourlyTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS oula_logs_top_hourly (
+			hour DATETIME NOT NULL,
+			kind VARCHAR(16) NOT NULL,
+			rank_no INT NOT NULL,
+			program VARCHAR(128) NOT NULL,
+			api_path VARCHAR(255) NOT NULL,
+			count BIGINT NOT NULL,
+			error_count BIGINT NOT NULL,
+			error_rate DOUBLE NOT NULL,
+			avg_ms DOUBLE NOT NULL,
+			p95_ms DOUBLE NOT NULL,
+			max_ms DOUBLE NOT NULL,
+			PRIMARY KEY (hour, kind, rank_no)
+		)
+	`)
+	return err
+}
+
+// TopOffenders computes the slowest and most error-prone endpoints of each hour into oula_logs_top_hourly
+type TopOffenders struct {
+	DB          *sql.DB
+	N           int
+	MinRequests int64
+	Retention   time.Duration
+}
+
+// Run computes the previous hour shortly after each hour boundary until ctx is done
+func (t *TopOffenders) Run(ctx context.Context, delay time.Duration) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Hour).Add(delay)
+		if !next.After(now) {
+			next = next.Add(time.Hour)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		hour := next.Add(-delay).Add(-time.Hour)
+		if err := t.Compute(ctx, hour); err != nil {
+			log.Printf("Error computing top offenders for %s: %v", hour.Format("2006-01-02 15:04"), err)
+		}
+		if err := t.Prune(ctx); err != nil {
+			log.Printf("Error pruning top offenders: %v", err)
+		}
+	}
+}
+
+// Compute ranks the endpoints of each environment in the hour starting at hour and replaces its rows in
+// oula_logs_top_hourly
+func (t *TopOffenders) Compute(ctx context.Context, hour time.Time) error {
+	envs, err := LoadEnvs(ctx, t.DB, hour, hour.Add(time.Hour))
+	if err != nil {
+		return err
+	}
+	ranked := make(map[string]map[string][]*EndpointStats, len(envs))
+	for _, env := range envs {
+		stats, err := LoadStats(ctx, t.DB, env, hour, hour.Add(time.Hour))
+		if err != nil {
+			return err
+		}
+
+		var eligible []*EndpointStats
+		for _, s := range stats {
+			if s.Count >= t.MinRequests {
+				eligible = append(eligible, s)
+			}
+		}
+		slowest := rankTop(eligible, t.N, func(s *EndpointStats) float64 { return s.Latency.Quantile(0.95) })
+		var failing []*EndpointStats
+		for _, s := range eligible {
+			if s.ErrorCount > 0 {
+				failing = append(failing, s)
+			}
+		}
+		errorProne := rankTop(failing, t.N, (*EndpointStats).ErrorRate)
+		ranked[env] = map[string][]*EndpointStats{"slowest": slowest, "errors": errorProne}
+		log.Printf("Top offenders of %s for %s: %d slowest, %d error-prone", env, hour.Format("2006-01-02 15:04"), len(slowest), len(errorProne))
+	}
+
+	tx, err := t.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	hourStr := hour.Format("2006-01-02 15:04:05")
+	if _, err := tx.ExecContext(ctx, `DELETE FROM oula_logs_top_hourly WHERE hour = ?`, hourStr); err != nil {
+		tx.Rollback()
+		return err
+	}
+	query := `
+		INSERT INTO oula_logs_top_hourly (hour, env, kind, rank_no, program, api_path, count, error_count, error_rate, avg_ms, p95_ms, max_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	for env, kinds := range ranked {
+		for kind, top := range kinds {
+			for i, s := range top {
+				_, err := tx.ExecContext(ctx, query, hourStr, env, kind, i+1, s.Program, s.APIPath, s.Count, s.ErrorCount,
+					s.ErrorRate(), s.SumDuration/float64(s.Count), s.Latency.Quantile(0.95), s.MaxDuration)
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Prune deletes rows older than the retention
+func (t *TopOffenders) Prune(ctx context.Context) error {
+	cutoff := time.Now().Add(-t.Retention).Format("2006-01-02 15:04:05")
+	_, err := t.DB.ExecContext(ctx, `DELETE FROM oula_logs_top_hourly WHERE hour < ?`, cutoff)
+	return err
+}
+
+// rankTop returns up to n stats with the highest metric, in descending order.
+// Endpoints tied with the first one left out are dropped as well, so the cut never picks arbitrarily between equal values.
+func rankTop(stats []*EndpointStats, n int, metric func(*EndpointStats) float64) []*EndpointStats {
+	sorted := append([]*EndpointStats(nil), stats...)
+	sort.Slice(sorted, func(i, j int) bool {
+		mi, mj := metric(sorted[i]), metric(sorted[j])
+		if mi != mj {
+			return mi > mj
+		}
+		if sorted[i].Program != sorted[j].Program {
+			return sorted[i].Program < sorted[j].Program
+		}
+		return sorted[i].APIPath < sorted[j].APIPath
+	})
+	if len(sorted) <= n {
+		return sorted
+	}
+	cut := metric(sorted[n])
+	top := sorted[:n]
+	for len(top) > 0 && metric(top[len(top)-1]) == cut {
+		top = top[:len(top)-1]
+	}
+	return top
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// truncatedValues counts the values cut to the size of their oula_logs_record column
+var truncatedValues = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "logmonitor_truncated_values_total",
+	Help: "Values cut to the size of their oula_logs_record column before insert, by column.",
+}, []string{"column"})
+
+func init() {
+	prometheus.MustRegister(truncatedValues)
+}
+
+// truncatedMarker ends a truncated value, a single character so it fits any column size
+const truncatedMarker = "…"
+
+// ColumnLimits are the sizes in characters of the string columns of oula_logs_record by name
+type ColumnLimits map[string]int
+
+// defaultColumnLimits are the sizes the migrations give the columns, used when the schema cannot be read
+var defaultColumnLimits = ColumnLimits{
+	"env": 32, "server": 64, "program": 128, "ip": 64, "method": 16, "api_path": 255, "country": 2,
+	"query_params": 512, "app_version": 64, "protocol": 16, "tls_version": 16, "raw_path": 1024,
+}
+
+// LoadColumnLimits returns the sizes of the character columns InsertLogEntry writes as the schema
+// declares them, over defaultColumnLimits. It returns defaultColumnLimits with the error if the schema
+// cannot be read.
+func LoadColumnLimits(ctx context.Context, db *sql.DB) (ColumnLimits, error) {
+	columns, err := LoadColumns(ctx, db, "oula_logs_record")
+	if err != nil {
+		return defaultColumnLimits, err
+	}
+	limits := make(ColumnLimits, len(defaultColumnLimits))
+	for name, size := range defaultColumnLimits {
+		limits[name] = size
+	}
+	for _, column := range recordColumns {
+		if info, ok := columns[column.Name]; ok && info.MaxLength > 0 && (info.DataType == "varchar" || info.DataType == "char") {
+			limits[column.Name] = int(info.MaxLength)
+		}
+	}
+	return limits, nil
+}
+
+// TruncateRunes returns s cut to at most limit characters, ending with truncatedMarker, and whether it
+// was cut. It never splits a multi-byte character.
+func TruncateRunes(s string, limit int) (string, bool) {
+	if limit <= 0 || utf8.RuneCountInString(s) <= limit {
+		return s, false
+	}
+	// 按字符截断，保留一个字符给标记
+	end := 0
+	for i := 0; i < limit-1; i++ {
+		_, size := utf8.DecodeRuneInString(s[end:])
+		end += size
+	}
+	return s[:end] + truncatedMarker, true
+}
+
+// limitedFields are the string fields of an entry stored in the columns of ColumnLimits
+var limitedFields = []struct {
+	Column string
+	Field  func(*LogEntry) *string
+}{
+	{"env", func(e *LogEntry) *string { return &e.Env }},
+	{"server", func(e *LogEntry) *string { return &e.Server }},
+	{"program", func(e *LogEntry) *string { return &e.Program }},
+	{"ip", func(e *LogEntry) *string { return &e.IP }},
+	{"method", func(e *LogEntry) *string { return &e.Method }},
+	{"api_path", func(e *LogEntry) *string { return &e.APIPath }},
+	{"country", func(e *LogEntry) *string { return &e.Country }},
+	{"query_params", func(e *LogEntry) *string { return &e.QueryParams }},
+	{"app_version", func(e *LogEntry) *string { return &e.AppVersion }},
+	{"protocol", func(e *LogEntry) *string { return &e.Protocol }},
+	{"tls_version", func(e *LogEntry) *string { return &e.TLSVersion }},
+	{"raw_path", func(e *LogEntry) *string { return &e.RawPath }},
+}
+
+// Apply cuts the values of entry longer than their column, counting each per column, and reports
+// whether any was cut, so that a single over-long value does not fail the insert of its whole batch
+func (limits ColumnLimits) Apply(entry *LogEntry) bool {
+	truncated := false
+	for _, f := range limitedFields {
+		field := f.Field(entry)
+		value, cut := TruncateRunes(*field, limits[f.Column])
+		if !cut {
+			continue
+		}
+		truncatedValues.WithLabelValues(f.Column).Inc()
+		*field = value
+		truncated = true
+	}
+	return truncated
+}
+
+// TruncateEntries applies limits to entries and returns copies of the entries as they were before being
+// cut, for keeping the original values
+func TruncateEntries(entries []*LogEntry, limits ColumnLimits) []*LogEntry {
+	var originals []*LogEntry
+	for _, entry := range entries {
+		original := *entry
+		if limits.Apply(entry) {
+			originals = append(originals, &original)
+		}
+	}
+	return originals
+}
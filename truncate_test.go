@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		name, s string
+		limit   int
+		want    string
+		cut     bool
+	}{
+		{"ASCII at the limit", "/api/v1", 7, "/api/v1", false},
+		{"ASCII over the limit", "/api/v1/users", 8, "/api/v1…", true},
+		{"CJK at the limit", "/接口/用户", 6, "/接口/用户", false},
+		{"CJK one over the limit", "/接口/用户", 5, "/接口/…", true},
+		{"CJK cut after a 3-byte rune", "日本語のパス", 4, "日本語…", true},
+		{"emoji at the limit", "😀😃😄", 3, "😀😃😄", false},
+		{"emoji over the limit", "😀😃😄", 2, "😀…", true},
+		{"mixed widths", "a é 日 😀 b", 6, "a é 日…", true},
+		{"limit of the marker alone", "日本", 1, "…", true},
+		{"no limit", "日本語", 0, "日本語", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, cut := TruncateRunes(tt.s, tt.limit)
+			if got != tt.want || cut != tt.cut {
+				t.Errorf("TruncateRunes(%q, %d) = %q, %t, want %q, %t", tt.s, tt.limit, got, cut, tt.want, tt.cut)
+			}
+		})
+	}
+}
+
+// TestTruncateRunesNeverSplits cuts strings of 1 to 4 byte runes at every limit, checking that the result
+// is valid UTF-8, fits the limit exactly when cut, and keeps a prefix of whole runes of the value
+func TestTruncateRunesNeverSplits(t *testing.T) {
+	for _, s := range []string{"/api/v1/users", "/用户/订单/详情", "/😀/🎉/🚀", "/a/é/日/😀/ñ/語/🎉", "👨‍👩‍👧‍👦"} {
+		n := utf8.RuneCountInString(s)
+		for limit := 1; limit <= n+1; limit++ {
+			got, cut := TruncateRunes(s, limit)
+			if !utf8.ValidString(got) {
+				t.Fatalf("TruncateRunes(%q, %d) = %q is not valid UTF-8", s, limit, got)
+			}
+			if cut != (limit < n) {
+				t.Errorf("TruncateRunes(%q, %d) cut = %t, want %t", s, limit, cut, limit < n)
+			}
+			if !cut {
+				if got != s {
+					t.Errorf("TruncateRunes(%q, %d) = %q, want it unchanged", s, limit, got)
+				}
+				continue
+			}
+			kept, ok := strings.CutSuffix(got, truncatedMarker)
+			if !ok || !strings.HasPrefix(s, kept) || utf8.RuneCountInString(got) != limit {
+				t.Errorf("TruncateRunes(%q, %d) = %q, want %d runes of its prefix ending with %s", s, limit, got, limit, truncatedMarker)
+			}
+		}
+	}
+}
+
+func TestColumnLimitsApply(t *testing.T) {
+	path := "/" + strings.Repeat("接口", 200)
+	entry := &LogEntry{Server: "web-01", Method: "GET", APIPath: path, RawPath: path + "?q=😀", Country: "JPN"}
+	apiPathCut := testutil.ToFloat64(truncatedValues.WithLabelValues("api_path"))
+	originals := TruncateEntries([]*LogEntry{entry, {Server: "web-02", Method: "GET", APIPath: "/api"}}, defaultColumnLimits)
+
+	if n := utf8.RuneCountInString(entry.APIPath); n != defaultColumnLimits["api_path"] || !utf8.ValidString(entry.APIPath) {
+		t.Errorf("api_path cut to %d runes (valid UTF-8 %t), want %d", n, utf8.ValidString(entry.APIPath), defaultColumnLimits["api_path"])
+	}
+	if entry.RawPath != path+"?q=😀" {
+		t.Errorf("raw_path of %d runes was cut below its limit of %d", utf8.RuneCountInString(path)+4, defaultColumnLimits["raw_path"])
+	}
+	if entry.Country != "J…" || entry.Server != "web-01" {
+		t.Errorf("country and server = %q and %q, want J… and web-01", entry.Country, entry.Server)
+	}
+	if got := testutil.ToFloat64(truncatedValues.WithLabelValues("api_path")) - apiPathCut; got != 1 {
+		t.Errorf("counted %v api_path values cut, want 1", got)
+	}
+	if len(originals) != 1 || originals[0].APIPath != path || originals[0].Country != "JPN" {
+		t.Errorf("originals = %+v, want the entry before it was cut", originals)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// EnsureUniqueIPsTable creates the oula_logs_unique_ips table if it does not exist
+func EnsureUniqueIPsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS oula_logs_unique_ips (
+			day DATE NOT NULL,
+			server VARCHAR(64) NOT NULL,
+			program VARCHAR(128) NOT NULL,
+			api_path VARCHAR(255) NOT NULL,
+			estimate BIGINT NOT NULL,
+			sketch BLOB NOT NULL,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			PRIMARY KEY (day, server, program, api_path)
+		)
+	`)
+	return err
+}
+
+// uniqueIPKey identifies the sketch of an endpoint on a day
+type uniqueIPKey struct {
+	Day     string
+	Env     string
+	Program string
+	APIPath string
+}
+
+// UniqueIPCounter estimates the distinct client IPs of each matched endpoint per day with a HyperLogLog
+// sketch, and periodically merges the sketches into oula_logs_unique_ips. Sketches of finished days are
+// dropped from memory once written, so memory is bounded by the number of endpoints, not by traffic.
+type UniqueIPCounter struct {
+	DB     *sql.DB
+	Server string
+
+	mu       sync.Mutex
+	sketches map[uniqueIPKey]*HyperLogLog
+}
+
+// NewUniqueIPCounter creates a counter writing to db
+func NewUniqueIPCounter(db *sql.DB, server string) *UniqueIPCounter {
+	return &UniqueIPCounter{DB: db, Server: server, sketches: make(map[uniqueIPKey]*HyperLogLog)}
+}
+
+// Add records the client IP of an entry, a nil counter is a no-op
+func (c *UniqueIPCounter) Add(entry *LogEntry) {
+	if c == nil {
+		return
+	}
+	day, err := time.ParseInLocation("2006/01/02", entry.Date, time.Local)
+	if err != nil {
+		log.Printf("Error parsing entry date %s: %v", entry.Date, err)
+		return
+	}
+	key := uniqueIPKey{Day: day.Format("2006-01-02"), Env: entry.Env, Program: entry.Program, APIPath: entry.APIPath}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.sketches[key]
+	if !ok {
+		h = &HyperLogLog{}
+		c.sketches[key] = h
+	}
+	h.Add(entry.IP)
+}
+
+// Run writes the sketches every interval until ctx is done, then writes them one last time
+func (c *UniqueIPCounter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.Flush(time.Now())
+			return
+		case now := <-ticker.C:
+			c.Flush(now)
+		}
+	}
+}
+
+// Flush merges the sketches into their stored rows and drops the sketches of days before now.
+// Sketches that fail to be written are kept for the next flush.
+func (c *UniqueIPCounter) Flush(now time.Time) {
+	c.mu.Lock()
+	sketches := make(map[uniqueIPKey]HyperLogLog, len(c.sketches))
+	for key, h := range c.sketches {
+		sketches[key] = *h
+	}
+	c.mu.Unlock()
+	if len(sketches) == 0 {
+		return
+	}
+
+	if err := c.write(sketches); err != nil {
+		log.Printf("Error writing unique IP sketches: %v", err)
+		return
+	}
+
+	today := now.Format("2006-01-02")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range sketches {
+		if key.Day < today {
+			delete(c.sketches, key)
+		}
+	}
+}
+
+// write merges each sketch with its stored copy and upserts the result in a single transaction
+func (c *UniqueIPCounter) write(sketches map[uniqueIPKey]HyperLogLog) error {
+	selectQuery := `
+		SELECT sketch FROM oula_logs_unique_ips
+		WHERE day = ? AND env = ? AND server = ? AND program = ? AND api_path = ?
+		FOR UPDATE
+	`
+	query := `
+		INSERT INTO oula_logs_unique_ips (day, env, server, program, api_path, estimate, sketch)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE estimate = VALUES(estimate), sketch = VALUES(sketch)
+	`
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for key, h := range sketches {
+		var stored []byte
+		err := tx.QueryRow(selectQuery, key.Day, key.Env, c.Server, key.Program, key.APIPath).Scan(&stored)
+		if err != nil && err != sql.ErrNoRows {
+			tx.Rollback()
+			return err
+		}
+		if len(stored) > 0 {
+			var previous HyperLogLog
+			if err := previous.UnmarshalBinary(stored); err != nil {
+				log.Printf("Ignoring stored unique IP sketch for %s %s: %v", key.Day, key.APIPath, err)
+			} else {
+				h.Merge(&previous)
+			}
+		}
+		sketch, _ := h.MarshalBinary()
+		if _, err := tx.Exec(query, key.Day, key.Env, c.Server, key.Program, key.APIPath, h.Estimate(), sketch); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadUniqueIPs merges the stored sketches of all servers of env, all environments if it is empty, for the
+// days in [from, to] and returns the estimate per endpoint
+func LoadUniqueIPs(ctx context.Context, db *sql.DB, env string, from, to time.Time) (map[endpointKey]uint64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT program, api_path, sketch FROM oula_logs_unique_ips
+		WHERE day >= ? AND day <= ? AND (? = '' OR env = ?)
+	`, from.Format("2006-01-02"), to.Format("2006-01-02"), env, env)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sketches := make(map[endpointKey]*HyperLogLog)
+	for rows.Next() {
+		var program, apiPath string
+		var data []byte
+		if err := rows.Scan(&program, &apiPath, &data); err != nil {
+			return nil, err
+		}
+		var h HyperLogLog
+		if err := h.UnmarshalBinary(data); err != nil {
+			log.Printf("Ignoring stored unique IP sketch for %s: %v", apiPath, err)
+			continue
+		}
+		key := endpointKey{Program: program, APIPath: apiPath}
+		if merged, ok := sketches[key]; ok {
+			merged.Merge(&h)
+		} else {
+			sketches[key] = &h
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	estimates := make(map[endpointKey]uint64, len(sketches))
+	for key, h := range sketches {
+		estimates[key] = h.Estimate()
+	}
+	return estimates, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// ReportingView is a view summarizing the raw rows, so that consumers of the table query it instead of
+// each writing their own aggregation
+type ReportingView struct {
+	Name        string
+	Description string
+	Query       string
+}
+
+// DDL returns the statement creating or replacing the view
+func (v ReportingView) DDL() string {
+	return fmt.Sprintf("CREATE OR REPLACE VIEW `%s` AS\n%s", v.Name, v.Query)
+}
+
+// ReportingViews returns the reporting views of table, which has the columns of oula_logs_record,
+// written for the columns it has: the environment, sampling weight and slow flag are only used if
+// their column exists, and columns whose type is unknown or text are converted. Like the report
+// subcommand, errors are the 5xx responses and counts are weighted by sampled_weight. The views are
+// named after table:
+//
+//	<table>_endpoint_hourly  requests, errors and latency of each endpoint and hour
+//	<table>_daily_totals     requests, errors and latency of each program and day
+//	<table>_top_errors       4xx and 5xx responses of each endpoint and day by status code
+func ReportingViews(table string, columns map[string]ColumnInfo) []ReportingView {
+	has := func(name string) bool {
+		_, ok := columns[name]
+		return ok
+	}
+	integer := func(name string) bool {
+		return slices.Contains(integerTypes, columns[name].DataType)
+	}
+
+	status := "status_code"
+	if !integer("status_code") {
+		status = "CAST(status_code AS UNSIGNED)"
+	}
+	// 旧版本存储的 GIN 耗时字符串不参与统计
+	duration := "duration"
+	if !integer("duration") {
+		duration = "CASE WHEN duration REGEXP '^[0-9]+$' THEN CAST(duration AS UNSIGNED) END"
+	}
+	weight := "1"
+	if has("sampled_weight") {
+		weight = "sampled_weight"
+	}
+	var env string
+	if has("env") {
+		env = "env, "
+	}
+
+	measures := []string{
+		fmt.Sprintf("SUM(%s) AS requests", weight),
+		fmt.Sprintf("SUM(CASE WHEN %s >= 500 THEN %s ELSE 0 END) AS errors", status, weight),
+		fmt.Sprintf("SUM(CASE WHEN %s >= 400 AND %s < 500 THEN %s ELSE 0 END) AS client_errors", status, status, weight),
+	}
+	if has("is_slow") {
+		measures = append(measures, fmt.Sprintf("SUM(CASE WHEN is_slow THEN %s ELSE 0 END) AS slow", weight))
+	}
+	measures = append(measures,
+		fmt.Sprintf("AVG(%s) AS avg_duration_ms", duration),
+		fmt.Sprintf("MAX(%s) AS max_duration_ms", duration),
+	)
+	measureList := strings.Join(measures, ",\n\t")
+
+	return []ReportingView{
+		{
+			Name:        table + "_endpoint_hourly",
+			Description: "Requests, errors and latency of each endpoint and hour of " + table,
+			Query: fmt.Sprintf("SELECT TIMESTAMP(date, MAKETIME(HOUR(time), 0, 0)) AS hour, %sserver, program, api_path,\n\t%s\nFROM `%s`\nGROUP BY hour, %sserver, program, api_path",
+				env, measureList, table, env),
+		},
+		{
+			Name:        table + "_daily_totals",
+			Description: "Requests, errors and latency of each program and day of " + table,
+			Query: fmt.Sprintf("SELECT date AS day, %sprogram,\n\t%s,\n\tCOUNT(DISTINCT api_path) AS endpoints\nFROM `%s`\nGROUP BY day, %sprogram",
+				env, measureList, table, env),
+		},
+		{
+			Name:        table + "_top_errors",
+			Description: "4xx and 5xx responses of each endpoint and day by status code of " + table + ", ORDER BY requests DESC for the top errors",
+			Query: fmt.Sprintf("SELECT date AS day, %sprogram, api_path, %s AS status_code,\n\tSUM(%s) AS requests,\n\tMAX(TIMESTAMP(date, time)) AS last_seen\nFROM `%s`\nWHERE %s >= 400\nGROUP BY day, %sprogram, api_path, %s",
+				env, status, weight, table, status, env, status),
+		},
+	}
+}
+
+// LoadReportingViews returns the reporting views of table for the columns it has in the database
+func LoadReportingViews(ctx context.Context, db *sql.DB, table string) ([]ReportingView, error) {
+	columns, err := LoadColumns(ctx, db, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s does not exist", table)
+	}
+	return ReportingViews(table, columns), nil
+}
+
+// defaultReportingViews returns the reporting views of table for the columns of recordColumns, of
+// unknown types, when the schema cannot be read
+func defaultReportingViews(table string) []ReportingView {
+	columns := make(map[string]ColumnInfo, len(recordColumns))
+	for _, column := range recordColumns {
+		columns[column.Name] = ColumnInfo{}
+	}
+	return ReportingViews(table, columns)
+}
+
+// EnsureReportingViews creates or replaces the reporting views of table, for its current columns
+func EnsureReportingViews(ctx context.Context, db *sql.DB, table string) error {
+	views, err := LoadReportingViews(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	for _, view := range views {
+		if _, err := db.ExecContext(ctx, view.DDL()); err != nil {
+			return fmt.Errorf("creating view %s: %w", view.Name, err)
+		}
+		log.Printf("Created view %s", view.Name)
+	}
+	return nil
+}
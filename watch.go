@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchAPIList reloads the API list into apiList whenever the file changes.
+// A file that fails to load keeps the previous list.
+func WatchAPIList(ctx context.Context, filePath string, apiList *atomic.Pointer[map[string]APIEntry], interval time.Duration) {
+	watchFile(ctx, "API list", filePath, interval, func() {
+		reloadAPIList(filePath, apiList)
+	})
+}
+
+// watchFile calls reload whenever the file changes until ctx is done.
+// It watches the file's directory with inotify, so editors that replace the file are handled, and
+// falls back to polling the modification time every interval when inotify cannot be set up.
+func watchFile(ctx context.Context, name, filePath string, interval time.Duration, reload func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(filePath))
+		if err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Watching %s %s by polling every %s (inotify unavailable: %v)", name, filePath, interval, err)
+		pollFile(ctx, name, filePath, interval, reload)
+		return
+	}
+	defer watcher.Close()
+
+	log.Printf("Watching %s %s with inotify", name, filePath)
+	cleanPath := filepath.Clean(filePath)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != cleanPath || !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+				continue
+			}
+			reload()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching %s: %v", name, err)
+		}
+	}
+}
+
+// pollFile calls reload when the file's modification time changes
+func pollFile(ctx context.Context, name, filePath string, interval time.Duration, reload func()) {
+	var lastMod time.Time
+	if info, err := os.Stat(filePath); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(filePath)
+			if err != nil {
+				log.Printf("Error checking %s: %v", name, err)
+				continue
+			}
+			if info.ModTime().Equal(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			reload()
+		}
+	}
+}
+
+// reloadAPIList loads the file and swaps it in, keeping the current list on error
+func reloadAPIList(filePath string, apiList *atomic.Pointer[map[string]APIEntry]) {
+	list, err := LoadAPIList(filePath)
+	if err != nil {
+		log.Printf("Error reloading API list, keeping the previous one: %v", err)
+		return
+	}
+	previous := apiList.Swap(&list)
+	log.Printf("Reloaded API list: %d APIs", len(list))
+	if previous != nil {
+		logAPIListChanges(*previous, list)
+	}
+}
+
+// logAPIListChanges logs the APIs added, removed or with changed options in a reloaded API list
+func logAPIListChanges(previous, list map[string]APIEntry) {
+	var paths []string
+	for path := range list {
+		paths = append(paths, path)
+	}
+	for path := range previous {
+		if _, ok := list[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		before, had := previous[path]
+		after, has := list[path]
+		switch {
+		case !had:
+			log.Printf("API list: added %s %+v", path, after)
+		case !has:
+			log.Printf("API list: removed %s", path)
+		case !reflect.DeepEqual(before, after):
+			log.Printf("API list: changed %s from %+v to %+v", path, before, after)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writerLeaseHeld is 1 for the programs whose lease this instance holds
+var writerLeaseHeld = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "logmonitor_writer_lease_held",
+	Help: "1 if this instance holds the writer lease of the program for its server.",
+}, []string{"program"})
+
+// writerLeaseConflict is 1 for the programs whose lease another live instance holds
+var writerLeaseConflict = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "logmonitor_writer_lease_conflict",
+	Help: "1 while another live instance holds the writer lease of the program for the same server.",
+}, []string{"program"})
+
+func init() {
+	prometheus.MustRegister(writerLeaseHeld, writerLeaseConflict)
+}
+
+// EnsureWriterLeasesTable creates the oula_writer_leases table if it does not exist
+func EnsureWriterLeasesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS oula_writer_leases (
+			env VARCHAR(32) NOT NULL,
+			server VARCHAR(64) NOT NULL,
+			program VARCHAR(128) NOT NULL,
+			instance_id VARCHAR(128) NOT NULL,
+			hostname VARCHAR(255) NOT NULL,
+			ttl_ms BIGINT NOT NULL,
+			acquired_at DATETIME(6) NOT NULL,
+			heartbeat_at DATETIME(6) NOT NULL,
+			PRIMARY KEY (env, server, program)
+		)
+	`)
+	return err
+}
+
+// writerConflictLabel is the label added to the rows of an instance writing a program it has no lease of
+const writerConflictLabel = "writer_conflict"
+
+// LeaseStatus is the lease state of a program, shown by /-/status and /debug/state
+type LeaseStatus struct {
+	Program string `json:"program"`
+	Held    bool   `json:"held"`
+	// Holder, HolderHost and HolderHeartbeatAge describe the other live instance holding the lease
+	Holder             string     `json:"holder,omitempty"`
+	HolderHost         string     `json:"holder_host,omitempty"`
+	HolderHeartbeatAge string     `json:"holder_heartbeat_age,omitempty"`
+	ConflictSince      *time.Time `json:"conflict_since,omitempty"`
+	LastError          string     `json:"last_error,omitempty"`
+}
+
+// leaseState is the lease state of a program and the holder its rows are tagged with
+type leaseState struct {
+	status LeaseStatus
+	tag    atomic.Pointer[string]
+}
+
+// WriterLeases makes sure a single instance writes the rows of each server and program, so that two hosts
+// configured with the same -server do not store interleaved duplicates. Each instance registers in
+// oula_writer_leases with its instance ID and renews its lease every TTL/3. A lease expires when it has
+// not been renewed for the TTL its holder registered, measured with the database's clock only, so the
+// clocks of the instances may disagree and a crashed holder is replaced after one TTL.
+//
+// When another live instance holds the lease, the "refuse" policy stops ingesting the program until
+// the lease is free, and the "tag" policy keeps ingesting it with a writer_conflict label holding the
+// other instance's ID. Either way the conflict is logged, alerted, exported as
+// logmonitor_writer_lease_conflict and shown by /-/status and /debug/state. Database errors leave the
+// state as it was, an instance that cannot read the leases keeps ingesting.
+type WriterLeases struct {
+	DB         *sql.DB
+	Env        string
+	Server     string
+	InstanceID string
+	Hostname   string
+	TTL        time.Duration
+	// Policy is "refuse" or "tag"
+	Policy  string
+	Alerter *Dispatcher
+
+	mu       sync.Mutex
+	programs map[string]*leaseState
+}
+
+// ValidateLeasePolicy returns an error if policy is not a -writer-lease-conflict value
+func ValidateLeasePolicy(policy string) error {
+	switch policy {
+	case "refuse", "tag":
+		return nil
+	}
+	return fmt.Errorf("unknown writer lease conflict policy %q, expected refuse or tag", policy)
+}
+
+// state returns the state of program, creating it if needed
+func (l *WriterLeases) state(program string) *leaseState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.programs == nil {
+		l.programs = make(map[string]*leaseState)
+	}
+	s, ok := l.programs[program]
+	if !ok {
+		s = &leaseState{status: LeaseStatus{Program: program}}
+		l.programs[program] = s
+	}
+	return s
+}
+
+// leaseHolder is the instance holding a lease
+type leaseHolder struct {
+	InstanceID string
+	Hostname   string
+	Age        time.Duration
+}
+
+// acquire registers or renews the lease of program, taking it over if its holder let it expire, and
+// returns the other live holder if there is one
+func (l *WriterLeases) acquire(ctx context.Context, program string) (*leaseHolder, error) {
+	tx, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var holder leaseHolder
+	var ttlMS, ageMicros int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT instance_id, hostname, ttl_ms, TIMESTAMPDIFF(MICROSECOND, heartbeat_at, NOW(6))
+		FROM oula_writer_leases
+		WHERE env = ? AND server = ? AND program = ?
+		FOR UPDATE
+	`, l.Env, l.Server, program).Scan(&holder.InstanceID, &holder.Hostname, &ttlMS, &ageMicros)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO oula_writer_leases (env, server, program, instance_id, hostname, ttl_ms, acquired_at, heartbeat_at)
+			VALUES (?, ?, ?, ?, ?, ?, NOW(6), NOW(6))
+		`, l.Env, l.Server, program, l.InstanceID, l.Hostname, l.TTL.Milliseconds())
+	case err != nil:
+		return nil, err
+	case holder.InstanceID == l.InstanceID:
+		_, err = tx.ExecContext(ctx, `
+			UPDATE oula_writer_leases SET hostname = ?, ttl_ms = ?, heartbeat_at = NOW(6)
+			WHERE env = ? AND server = ? AND program = ?
+		`, l.Hostname, l.TTL.Milliseconds(), l.Env, l.Server, program)
+	default:
+		holder.Age = time.Duration(ageMicros) * time.Microsecond
+		if holder.Age <= time.Duration(ttlMS)*time.Millisecond {
+			return &holder, nil
+		}
+		// 持有者未续期，视为已退出
+		log.Printf("Taking over the expired writer lease of %s from %s on %s, last renewed %s ago",
+			program, holder.InstanceID, holder.Hostname, holder.Age.Round(time.Second))
+		_, err = tx.ExecContext(ctx, `
+			UPDATE oula_writer_leases SET instance_id = ?, hostname = ?, ttl_ms = ?, acquired_at = NOW(6), heartbeat_at = NOW(6)
+			WHERE env = ? AND server = ? AND program = ?
+		`, l.InstanceID, l.Hostname, l.TTL.Milliseconds(), l.Env, l.Server, program)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, tx.Commit()
+}
+
+// check renews the lease of program and updates its state, logging, alerting and exporting the start and
+// end of a conflict. It reports whether the program may be ingested: always with the tag policy, and
+// with the refuse policy unless another live instance holds the lease.
+func (l *WriterLeases) check(ctx context.Context, program string) bool {
+	holder, err := l.acquire(ctx, program)
+	s := l.state(program)
+
+	l.mu.Lock()
+	if err != nil {
+		log.Printf("Error renewing the writer lease of %s: %v", program, err)
+		s.status.LastError = err.Error()
+		ingest := l.Policy == "tag" || s.status.Holder == ""
+		l.mu.Unlock()
+		return ingest
+	}
+	s.status.LastError = ""
+	wasConflict := s.status.Holder != ""
+	var alert *Alert
+	if holder == nil {
+		s.status.Held = true
+		s.status.Holder, s.status.HolderHost, s.status.HolderHeartbeatAge = "", "", ""
+		s.status.ConflictSince = nil
+		s.tag.Store(nil)
+		if wasConflict {
+			log.Printf("Acquired the writer lease of %s, the conflict is resolved", program)
+			alert = &Alert{Type: "writer_conflict_recovered", Server: l.Server, Program: program,
+				Message: fmt.Sprintf("%s now holds the writer lease of %s on server %s", l.InstanceID, program, l.Server)}
+		}
+	} else {
+		s.status.Held = false
+		s.status.Holder, s.status.HolderHost = holder.InstanceID, holder.Hostname
+		s.status.HolderHeartbeatAge = holder.Age.Round(time.Millisecond).String()
+		if !wasConflict {
+			now := time.Now()
+			s.status.ConflictSince = &now
+			action := "refusing to ingest it until the lease expires"
+			if l.Policy == "tag" {
+				action = "ingesting it with the " + writerConflictLabel + " label"
+			}
+			log.Printf("WRITER CONFLICT: program %s of server %s is already written by instance %s on %s, %s; check that -server is unique",
+				program, l.Server, holder.InstanceID, holder.Hostname, action)
+			alert = &Alert{Type: "writer_conflict", Server: l.Server, Program: program,
+				Message: fmt.Sprintf("program %s of server %s is written by %s on %s and by %s on %s, %s",
+					program, l.Server, holder.InstanceID, holder.Hostname, l.InstanceID, l.Hostname, action)}
+		}
+		if l.Policy == "tag" {
+			id := holder.InstanceID
+			s.tag.Store(&id)
+		}
+	}
+	held, conflict := s.status.Held, s.status.Holder != ""
+	l.mu.Unlock()
+
+	writerLeaseHeld.WithLabelValues(program).Set(boolGauge(held))
+	writerLeaseConflict.WithLabelValues(program).Set(boolGauge(conflict))
+	if alert != nil {
+		l.Alerter.Notify(alert)
+	}
+	return l.Policy == "tag" || !conflict
+}
+
+// boolGauge returns 1 for true and 0 for false
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// release deletes the lease of program if this instance holds it
+func (l *WriterLeases) release(program string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := l.DB.ExecContext(ctx, `DELETE FROM oula_writer_leases WHERE env = ? AND server = ? AND program = ? AND instance_id = ?`,
+		l.Env, l.Server, program, l.InstanceID)
+	if err != nil {
+		log.Printf("Error releasing the writer lease of %s: %v", program, err)
+	}
+	writerLeaseHeld.WithLabelValues(program).Set(0)
+}
+
+// Hold runs fn for program while it may be ingested, renewing its lease every TTL/3 until fn returns or
+// ctx is done, then releases the lease. With the refuse policy, fn does not start while another live
+// instance holds the lease, and its context is canceled when one takes it, after which Hold waits for
+// the lease and runs fn again.
+func (l *WriterLeases) Hold(ctx context.Context, program string, fn func(ctx context.Context) error) error {
+	interval := l.TTL / 3
+	defer l.release(program)
+	for {
+		for !l.check(ctx, program) {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(interval):
+			}
+		}
+
+		runCtx, cancel := context.WithCancel(ctx)
+		lost := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if !l.check(ctx, program) {
+						log.Printf("Stopping %s while another instance holds its writer lease", program)
+						close(lost)
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+
+		err := fn(runCtx)
+		close(done)
+		cancel()
+		select {
+		case <-lost:
+			if ctx.Err() == nil {
+				continue
+			}
+		default:
+		}
+		return err
+	}
+}
+
+// Labels returns the labels of the rows of program: labels, with the writer_conflict label added while
+// the program is ingested under the tag policy without its lease. It is nil-receiver safe.
+func (l *WriterLeases) Labels(program, labels string) string {
+	if l == nil {
+		return labels
+	}
+	tag := l.state(program).tag.Load()
+	if tag == nil {
+		return labels
+	}
+	merged := make(map[string]string)
+	if labels != "" {
+		json.Unmarshal([]byte(labels), &merged)
+	}
+	merged[writerConflictLabel] = *tag
+	return EncodeLabels(merged)
+}
+
+// Statuses returns the lease state of each program, sorted by program. It is nil-receiver safe.
+func (l *WriterLeases) Statuses() []LeaseStatus {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	statuses := make([]LeaseStatus, 0, len(l.programs))
+	for _, s := range l.programs {
+		statuses = append(statuses, s.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Program < statuses[j].Program })
+	return statuses
+}